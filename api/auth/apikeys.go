@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"app/jobs"
+	"app/utils"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tokens starting with APIKeyPrefix are API keys, other bearer tokens are JWTs
+const APIKeyPrefix = "pak_"
+
+// Scopes of API keys. A key with ScopeExecute + processID can execute that process.
+const (
+	ScopeAdmin    = "admin"
+	ScopeReadJobs = "jobs:read"
+	ScopeExecute  = "execute:"
+)
+
+// Echo context key holding the id of the API key that authenticated the request.
+// Handlers read it from the context since headers can be set by callers.
+const APIKeyContextKey = "apiKeyID"
+
+// Last used time of a key is written at most this often
+const apiKeyTouchInterval = time.Minute
+
+// APIKeyStore stores API keys, implemented by jobs.Database
+type APIKeyStore interface {
+	GetAPIKey(hash string) (jobs.APIKey, bool, error)
+	TouchAPIKey(id string, t time.Time) error
+}
+
+// APIKeyAuthStrategy implements AuthStrategy for API keys stored in the database.
+// Bearer tokens that are not API keys are passed to the next strategy.
+type APIKeyAuthStrategy struct {
+	Store APIKeyStore
+	// Strategy for tokens that are not API keys, nil if only API keys are accepted
+	Next          AuthStrategy
+	AdminRoleName string
+}
+
+// NewAPIKeyAuthStrategy creates a strategy accepting API keys from store
+// in addition to the tokens accepted by next, which can be nil.
+func NewAPIKeyAuthStrategy(store APIKeyStore, next AuthStrategy) *APIKeyAuthStrategy {
+	return &APIKeyAuthStrategy{
+		Store:         store,
+		Next:          next,
+		AdminRoleName: os.Getenv("AUTH_ADMIN_ROLE"),
+	}
+}
+
+// Hash of a token as stored in the database
+func HashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Check that scopes are known and name a process to execute
+func ValidateScopes(scopes []string) error {
+	for _, s := range scopes {
+		switch {
+		case s == ScopeAdmin, s == ScopeReadJobs:
+		case strings.HasPrefix(s, ScopeExecute) && len(s) > len(ScopeExecute) && !strings.Contains(s, ","):
+		default:
+			return fmt.Errorf("invalid scope: %s", s)
+		}
+	}
+	return nil
+}
+
+// NewAPIKey creates a key for owner, returning the token and the key to store.
+// The token can not be recovered from the stored key.
+func NewAPIKey(owner, name string, scopes []string, expires *time.Time) (string, jobs.APIKey, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return "", jobs.APIKey{}, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", jobs.APIKey{}, err
+	}
+	token := APIKeyPrefix + hex.EncodeToString(secret)
+
+	k := jobs.APIKey{
+		ID:      uuid.New().String(),
+		Name:    name,
+		Owner:   owner,
+		Hash:    HashAPIKey(token),
+		Scopes:  scopes,
+		Created: time.Now(),
+		Expires: expires,
+	}
+	return token, k, nil
+}
+
+// Roles granted by scopes, admin scope grants the admin role and execute scopes grant the role of the process
+func (aks *APIKeyAuthStrategy) scopeRoles(scopes []string) []string {
+	roles := []string{}
+	for _, s := range scopes {
+		switch {
+		case s == ScopeAdmin:
+			roles = append(roles, aks.AdminRoleName)
+		case strings.HasPrefix(s, ScopeExecute):
+			roles = append(roles, strings.TrimPrefix(s, ScopeExecute))
+		}
+	}
+	return roles
+}
+
+func (aks *APIKeyAuthStrategy) ValidateToken(tokenString string) (*Claims, error) {
+	if !strings.HasPrefix(tokenString, APIKeyPrefix) {
+		if aks.Next == nil {
+			return nil, errors.New("invalid API key")
+		}
+		return aks.Next.ValidateToken(tokenString)
+	}
+
+	k, ok, err := aks.Store.GetAPIKey(HashAPIKey(tokenString))
+	if err != nil {
+		log.Errorf("could not read API key: %s", err.Error())
+		return nil, errors.New("could not validate API key")
+	}
+	if !ok {
+		return nil, errors.New("invalid API key")
+	}
+
+	now := time.Now()
+	if k.Revoked != nil {
+		return nil, errors.New("API key revoked")
+	}
+	if !k.Active(now) {
+		return nil, errors.New("API key expired")
+	}
+
+	if k.LastUsed == nil || now.Sub(*k.LastUsed) > apiKeyTouchInterval {
+		if err := aks.Store.TouchAPIKey(k.ID, now); err != nil {
+			log.Errorf("could not record use of API key %s: %s", k.ID, err.Error())
+		}
+	}
+
+	return &Claims{
+		UserName: k.Name,
+		Email:    k.Owner,
+		Roles:    aks.scopeRoles(k.Scopes),
+		APIKeyID: k.ID,
+		Scopes:   k.Scopes,
+	}, nil
+}
+
+// Validate X-ProcessAPI-User-Email header against the key owner and the request against the key scopes.
+// Keys without the admin scope can only read jobs with the jobs:read scope,
+// execute processes they are scoped to, and make other GET requests.
+func (aks *APIKeyAuthStrategy) ValidateUser(c echo.Context, claims *Claims) (err error) {
+	if claims.APIKeyID == "" {
+		return aks.Next.ValidateUser(c, claims)
+	}
+
+	email := c.Request().Header.Get("X-ProcessAPI-User-Email")
+	if email != "" && email != claims.Email {
+		return fmt.Errorf("invalid X-ProcessAPI-User-Email header")
+	}
+
+	if utils.StringInSlice(ScopeAdmin, claims.Scopes) {
+		return nil
+	}
+
+	path := c.Path()
+	switch {
+	case path == "/processes/:processID/execution":
+		if !utils.StringInSlice(ScopeExecute+c.Param("processID"), claims.Scopes) {
+			return fmt.Errorf("API key is not scoped to execute process %s", c.Param("processID"))
+		}
+	case path == "/jobs" || strings.HasPrefix(path, "/jobs/"):
+		if c.Request().Method != http.MethodGet || !utils.StringInSlice(ScopeReadJobs, claims.Scopes) {
+			return fmt.Errorf("API key is not scoped to this jobs request")
+		}
+	case strings.HasPrefix(path, "/auth/keys"):
+		return fmt.Errorf("API keys can not manage API keys")
+	case c.Request().Method != http.MethodGet:
+		return fmt.Errorf("API key is not scoped to this request")
+	}
+	return nil
+}
+
+// Set user email and roles granted by the key scopes to API Headers
+func (aks *APIKeyAuthStrategy) SetUserRolesHeader(c echo.Context, claims *Claims) (err error) {
+	if claims.APIKeyID == "" {
+		return aks.Next.SetUserRolesHeader(c, claims)
+	}
+
+	c.Request().Header.Set("X-ProcessAPI-User-Email", claims.Email)
+	c.Request().Header.Set("X-ProcessAPI-User-Roles", strings.Join(claims.Roles, ","))
+	c.Set(APIKeyContextKey, claims.APIKeyID)
+	return nil
+}
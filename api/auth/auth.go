@@ -7,6 +7,7 @@ import (
 
 	"github.com/golang-jwt/jwt"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 )
 
 type AuthStrategy interface {
@@ -15,6 +16,12 @@ type AuthStrategy interface {
 	SetUserRolesHeader(c echo.Context, claims *Claims) error
 }
 
+// RequestAuthenticator is implemented by strategies that authenticate requests by other means than bearer tokens,
+// such as client certificates. ok is false if the request does not carry such credentials.
+type RequestAuthenticator interface {
+	AuthenticateRequest(c echo.Context) (claims *Claims, ok bool, err error)
+}
+
 type Audience []string
 
 // aud in token can be []string or string, therefore we need a custom unmarshaler.
@@ -42,6 +49,13 @@ type Claims struct {
 	Email       string              `json:"email"`
 	RealmAccess map[string][]string `json:"realm_access"`
 	Audience    Audience            `json:"aud,omitempty"`
+	// Roles resolved by strategies that read them from a configurable claim
+	Roles []string `json:"-"`
+	// Set when the request is authenticated with an API key
+	APIKeyID string   `json:"-"`
+	Scopes   []string `json:"-"`
+	// Subject of the client certificate when the request is authenticated with one
+	ClientCert string `json:"-"`
 	jwt.StandardClaims
 }
 
@@ -58,8 +72,37 @@ func overlap(s1 []string, s2 []string) bool {
 
 // Middleware
 func Authorize(strategy AuthStrategy) echo.MiddlewareFunc {
+	return AuthorizeWithSkipper(strategy, middleware.DefaultSkipper)
+}
+
+// Authorize requests except those for which skipper returns true, such as routes that authenticate their callers themselves
+func AuthorizeWithSkipper(strategy AuthStrategy, skipper middleware.Skipper) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			if skipper(c) {
+				return next(c)
+			}
+
+			authorized := func(claims *Claims) error {
+				if err := strategy.ValidateUser(c, claims); err != nil {
+					return c.JSON(http.StatusUnauthorized, err.Error())
+				}
+				if err := strategy.SetUserRolesHeader(c, claims); err != nil {
+					return c.JSON(http.StatusInternalServerError, err.Error())
+				}
+				return next(c)
+			}
+
+			if ra, ok := strategy.(RequestAuthenticator); ok {
+				claims, ok, err := ra.AuthenticateRequest(c)
+				if err != nil {
+					return c.JSON(http.StatusUnauthorized, err.Error())
+				}
+				if ok {
+					return authorized(claims)
+				}
+			}
+
 			authHead := c.Request().Header.Get("Authorization")
 			// Check if the Authorization header is missing or not in the expected format
 			if authHead == "" || !strings.HasPrefix(authHead, "Bearer ") {
@@ -76,17 +119,7 @@ func Authorize(strategy AuthStrategy) echo.MiddlewareFunc {
 				return c.JSON(http.StatusUnauthorized, err.Error())
 			}
 
-			err = strategy.ValidateUser(c, claims)
-			if err != nil {
-				return c.JSON(http.StatusUnauthorized, err.Error())
-			}
-
-			err = strategy.SetUserRolesHeader(c, claims)
-			if err != nil {
-				return c.JSON(http.StatusInternalServerError, err.Error())
-			}
-
-			return next(c)
+			return authorized(claims)
 		}
 	}
 }
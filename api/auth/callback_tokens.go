@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Audience of job callback tokens, so that they can not be used as other tokens signed with the secret
+const callbackAudience = "job-callback"
+
+// CallbackTokens issues and verifies job scoped tokens that containers use to post callbacks for their job.
+// Tokens are HS256 JWTs with the job id as subject. They expire after the maximum runtime of jobs,
+// callbacks of a job are also ignored once the job is finished.
+type CallbackTokens struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewCallbackTokens creates tokens signed with secret that expire ttl after they are issued.
+// If secret is empty a random secret is used, tokens are then only valid on this instance until it restarts.
+func NewCallbackTokens(secret string, ttl time.Duration) (*CallbackTokens, error) {
+	if ttl <= 0 {
+		return nil, errors.New("callback token lifetime must be positive")
+	}
+	if secret != "" {
+		return &CallbackTokens{secret: []byte(secret), ttl: ttl}, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("could not generate callback secret: %s", err.Error())
+	}
+	return &CallbackTokens{secret: b, ttl: ttl}, nil
+}
+
+// Issue a token for the job
+func (ct *CallbackTokens) Issue(jobID string) (string, error) {
+	now := time.Now()
+	claims := jwt.StandardClaims{
+		Subject:   jobID,
+		Audience:  callbackAudience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ct.ttl).Unix(),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ct.secret)
+}
+
+// Verify that the token was issued for the job, returns the subject of the token
+func (ct *CallbackTokens) Verify(tokenString, jobID string) (string, error) {
+	claims := jwt.StandardClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return ct.secret, nil
+	})
+	if err != nil {
+		return "", errors.New("invalid callback token")
+	}
+
+	// expired tokens are rejected by ParseWithClaims, tokens without expiry are not accepted
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", errors.New("invalid callback token")
+	}
+	if !claims.VerifyAudience(callbackAudience, true) || claims.Subject != jobID {
+		return "", errors.New("callback token was not issued for this job")
+	}
+	return claims.Subject, nil
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestCallbackTokens(t *testing.T) {
+	ct, err := NewCallbackTokens("secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ct.Issue("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sub, err := ct.Verify(token, "job-1"); err != nil || sub != "job-1" {
+		t.Errorf("Verify = %q, %v", sub, err)
+	}
+	if _, err := ct.Verify(token, "job-2"); err == nil {
+		t.Error("token accepted for another job")
+	}
+
+	other, _ := NewCallbackTokens("other", time.Hour)
+	if _, err := other.Verify(token, "job-1"); err == nil {
+		t.Error("token accepted with another secret")
+	}
+
+	sign := func(claims jwt.StandardClaims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	expired := sign(jwt.StandardClaims{Subject: "job-1", Audience: callbackAudience, ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	if _, err := ct.Verify(expired, "job-1"); err == nil {
+		t.Error("expired token accepted")
+	}
+	noExpiry := sign(jwt.StandardClaims{Subject: "job-1", Audience: callbackAudience})
+	if _, err := ct.Verify(noExpiry, "job-1"); err == nil {
+		t.Error("token without expiry accepted")
+	}
+	wrongAudience := sign(jwt.StandardClaims{Subject: "job-1", Audience: "api", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if _, err := ct.Verify(wrongAudience, "job-1"); err == nil {
+		t.Error("token of another audience accepted")
+	}
+
+	if _, err := NewCallbackTokens("secret", 0); err == nil {
+		t.Error("tokens created without lifetime")
+	}
+}
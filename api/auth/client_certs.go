@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// ClientCertUser is the user and roles of callers presenting a certificate with the subject.
+// Subject is the full distinguished name such as "CN=etl-runner,O=Example", CommonName only matches the CN.
+type ClientCertUser struct {
+	Subject    string   `yaml:"subject"`
+	CommonName string   `yaml:"commonName"`
+	Email      string   `yaml:"email"`
+	Roles      []string `yaml:"roles"`
+}
+
+// ClientCertAuthStrategy implements AuthStrategy for clients presenting a certificate verified against the client CAs.
+// Requests without a certificate that is mapped to a user are authenticated by the next strategy.
+type ClientCertAuthStrategy struct {
+	Users []ClientCertUser
+	// Strategy for bearer tokens, nil if only client certificates are accepted
+	Next AuthStrategy
+}
+
+// LoadClientCertAuthStrategy reads the users of certificate subjects from the yaml file at path,
+// tokens are authenticated by next, which can be nil.
+func LoadClientCertAuthStrategy(path string, next AuthStrategy) (*ClientCertAuthStrategy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client certificates file: %s", err.Error())
+	}
+
+	var f struct {
+		Clients []ClientCertUser `yaml:"clients"`
+	}
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("could not parse client certificates file: %s", err.Error())
+	}
+
+	for i, u := range f.Clients {
+		if (u.Subject == "") == (u.CommonName == "") {
+			return nil, fmt.Errorf("client %d must have either subject or commonName", i+1)
+		}
+		if u.Email == "" {
+			return nil, fmt.Errorf("client %d must have an email", i+1)
+		}
+		for _, r := range u.Roles {
+			if r == "" || strings.Contains(r, ",") {
+				return nil, fmt.Errorf("client %d has invalid role '%s'", i+1, r)
+			}
+		}
+	}
+
+	return &ClientCertAuthStrategy{Users: f.Clients, Next: next}, nil
+}
+
+// AuthenticateRequest maps the verified client certificate of the request to a user.
+// Returns false if the request has no verified certificate or its subject is not mapped.
+func (ccs *ClientCertAuthStrategy) AuthenticateRequest(c echo.Context) (*Claims, bool, error) {
+	state := c.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false, nil
+	}
+
+	subject := state.VerifiedChains[0][0].Subject
+	for _, u := range ccs.Users {
+		if (u.Subject != "" && u.Subject == subject.String()) || (u.CommonName != "" && u.CommonName == subject.CommonName) {
+			return &Claims{
+				UserName:   subject.CommonName,
+				Email:      u.Email,
+				Roles:      u.Roles,
+				ClientCert: subject.String(),
+			}, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (ccs *ClientCertAuthStrategy) ValidateToken(tokenString string) (*Claims, error) {
+	if ccs.Next == nil {
+		return nil, errors.New("client certificate required")
+	}
+	return ccs.Next.ValidateToken(tokenString)
+}
+
+// Validate X-ProcessAPI-User-Email header against the user of the certificate
+func (ccs *ClientCertAuthStrategy) ValidateUser(c echo.Context, claims *Claims) error {
+	if claims.ClientCert == "" {
+		return ccs.Next.ValidateUser(c, claims)
+	}
+
+	email := c.Request().Header.Get("X-ProcessAPI-User-Email")
+	if email != "" && email != claims.Email {
+		return fmt.Errorf("invalid X-ProcessAPI-User-Email header")
+	}
+	return nil
+}
+
+// Set user email and roles of the certificate to API Headers
+func (ccs *ClientCertAuthStrategy) SetUserRolesHeader(c echo.Context, claims *Claims) error {
+	if claims.ClientCert == "" {
+		return ccs.Next.SetUserRolesHeader(c, claims)
+	}
+
+	c.Request().Header.Set("X-ProcessAPI-User-Email", claims.Email)
+	c.Request().Header.Set("X-ProcessAPI-User-Roles", strings.Join(claims.Roles, ","))
+	return nil
+}
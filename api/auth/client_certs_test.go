@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLoadClientCertAuthStrategy(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "clients.yml")
+
+	valid := "clients:\n  - subject: CN=etl-runner,O=Example\n    email: etl@example.com\n    roles: [etl]\n  - commonName: backup\n    email: backup@example.com\n"
+	if err := os.WriteFile(file, []byte(valid), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ccs, err := LoadClientCertAuthStrategy(file, nil)
+	if err != nil || len(ccs.Users) != 2 || !reflect.DeepEqual(ccs.Users[0].Roles, []string{"etl"}) {
+		t.Errorf("LoadClientCertAuthStrategy = %+v, %v", ccs, err)
+	}
+
+	invalid := map[string]string{
+		"subject and commonName": "clients:\n  - subject: CN=a\n    commonName: a\n    email: a@example.com\n",
+		"no subject":             "clients:\n  - email: a@example.com\n",
+		"no email":               "clients:\n  - commonName: a\n",
+		"role with comma":        "clients:\n  - commonName: a\n    email: a@example.com\n    roles: [\"a,b\"]\n",
+		"invalid yaml":           "clients: [",
+	}
+	for name, content := range invalid {
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadClientCertAuthStrategy(file, nil); err == nil {
+			t.Errorf("clients with %s loaded", name)
+		}
+	}
+	if _, err := LoadClientCertAuthStrategy(filepath.Join(dir, "missing.yml"), nil); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestClientCertAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, pkix.Name{CommonName: "ca"}, nil)
+	server := newTestCert(t, dir, pkix.Name{CommonName: "server"}, ca)
+	etl := newTestCert(t, dir, pkix.Name{CommonName: "etl-runner", Organization: []string{"Example"}}, ca)
+	backup := newTestCert(t, dir, pkix.Name{CommonName: "backup", Organization: []string{"Other"}}, ca)
+	unknown := newTestCert(t, dir, pkix.Name{CommonName: "unknown"}, ca)
+	// mapped common name issued by another CA
+	otherDir := t.TempDir()
+	untrusted := newTestCert(t, otherDir, pkix.Name{CommonName: "backup"}, newTestCert(t, otherDir, pkix.Name{CommonName: "other-ca"}, nil))
+
+	r, err := NewCertReloader(server.certFile, server.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccs := &ClientCertAuthStrategy{Users: []ClientCertUser{
+		{Subject: "CN=etl-runner,O=Example", Email: "etl@example.com", Roles: []string{"etl", "pyecho"}},
+		{CommonName: "backup", Email: "backup@example.com"},
+	}}
+
+	e := echo.New()
+	e.GET("/", func(c echo.Context) error {
+		claims, ok, err := ccs.AuthenticateRequest(c)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		if err := ccs.SetUserRolesHeader(c, claims); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"user":  claims.UserName,
+			"email": c.Request().Header.Get("X-ProcessAPI-User-Email"),
+			"roles": c.Request().Header.Get("X-ProcessAPI-User-Roles"),
+		})
+	})
+	srv := httptest.NewUnstartedServer(e)
+	srv.TLS = r.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(client *testCert) (int, map[string]string, error) {
+		cfg := &tls.Config{RootCAs: roots}
+		if client != nil {
+			pair, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// sent even if it is not issued by the CAs the server asks for
+			cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &pair, nil }
+		}
+		resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}).Get(srv.URL)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer resp.Body.Close()
+		var body map[string]string
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body, nil
+	}
+
+	cases := []struct {
+		name   string
+		client *testCert
+		status int
+		body   map[string]string
+	}{
+		{"subject", etl, http.StatusOK, map[string]string{"user": "etl-runner", "email": "etl@example.com", "roles": "etl,pyecho"}},
+		{"common name", backup, http.StatusOK, map[string]string{"user": "backup", "email": "backup@example.com", "roles": ""}},
+		{"unmapped certificate", unknown, http.StatusUnauthorized, nil},
+		// clients without a certificate complete the handshake and are left to the other strategies
+		{"no certificate", nil, http.StatusUnauthorized, nil},
+	}
+	for _, c := range cases {
+		status, body, err := get(c.client)
+		if err != nil || status != c.status || !reflect.DeepEqual(body, c.body) {
+			t.Errorf("%s: %d %v, %v", c.name, status, body, err)
+		}
+	}
+
+	if _, _, err := get(untrusted); err == nil {
+		t.Error("certificate of another CA accepted")
+	}
+}
@@ -0,0 +1,379 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Keys are fetched again for an unknown kid at most this often, so that rotated keys are picked up
+// without letting tokens with random kids hammer the provider
+const oidcKeysMinRefresh = time.Minute
+
+// JSONWebKey is a public key of a JWKS, RSA keys use n and e, EC keys use crv, x and y, OKP keys use crv and x
+type JSONWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcKey struct {
+	alg string
+	key interface{}
+}
+
+// OIDCAuthStrategy implements AuthStrategy for any OpenID Connect provider such as Azure AD, Okta, Auth0 or Keycloak.
+// Signing keys are found through the provider's discovery document.
+type OIDCAuthStrategy struct {
+	Issuer   string
+	Audience string
+	// Path of the claim holding the roles, such as groups or resource_access.<client>.roles
+	RolesClaim      []string
+	EmailClaim      string
+	ServiceRoleName string
+
+	jwksURI    string
+	keys       map[string]oidcKey
+	lastLoaded time.Time
+	mutex      sync.RWMutex
+	client     *http.Client
+}
+
+// NewOIDCAuthStrategy creates a new instance of OIDCAuthStrategy from the provider's discovery document and
+// starts a background process to refresh the public keys periodically.
+func NewOIDCAuthStrategy() (*OIDCAuthStrategy, error) {
+	issuer, exist := os.LookupEnv("OIDC_ISSUER_URL")
+	if !exist || issuer == "" {
+		return nil, errors.New("env variable OIDC_ISSUER_URL not set")
+	}
+	audience, exist := os.LookupEnv("OIDC_AUDIENCE")
+	if !exist || audience == "" {
+		return nil, errors.New("env variable OIDC_AUDIENCE not set")
+	}
+
+	strategy := &OIDCAuthStrategy{
+		Issuer:          issuer,
+		Audience:        audience,
+		RolesClaim:      strings.Split(envOrDefault("OIDC_ROLES_CLAIM", "roles"), "."),
+		EmailClaim:      envOrDefault("OIDC_EMAIL_CLAIM", "email"),
+		ServiceRoleName: os.Getenv("AUTH_SERVICE_ROLE"),
+		keys:            make(map[string]oidcKey),
+		client:          &http.Client{Timeout: 10 * time.Second},
+	}
+
+	err := strategy.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	err = strategy.LoadPublicKeys()
+	if err != nil {
+		return nil, err
+	}
+	go strategy.refreshKeysPeriodically(24 * time.Hour)
+	return strategy, nil
+}
+
+func envOrDefault(key, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// Read the JWKS location from the discovery document, the issuer of the document must be the configured issuer
+func (oas *OIDCAuthStrategy) discover() error {
+	url := strings.TrimSuffix(oas.Issuer, "/") + "/.well-known/openid-configuration"
+	r, err := oas.client.Get(url)
+	if err != nil {
+		return fmt.Errorf("could not fetch OIDC discovery document: %s", err.Error())
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not fetch OIDC discovery document from %s: %s", url, r.Status)
+	}
+
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("could not parse OIDC discovery document: %s", err.Error())
+	}
+	if doc.Issuer != oas.Issuer {
+		return fmt.Errorf("OIDC discovery document is for issuer %s, expected %s", doc.Issuer, oas.Issuer)
+	}
+	if doc.JWKSURI == "" {
+		return errors.New("OIDC discovery document has no jwks_uri")
+	}
+	oas.jwksURI = doc.JWKSURI
+	return nil
+}
+
+// refreshKeysPeriodically runs in a goroutine and periodically refreshes
+// the public keys used for token validation.
+func (oas *OIDCAuthStrategy) refreshKeysPeriodically(duration time.Duration) {
+	for {
+		time.Sleep(duration)
+		err := oas.LoadPublicKeys()
+		if err != nil {
+			log.Errorf("Error refreshing public keys: %v\n", err)
+			duration = 10 * time.Minute // Retry after a delay in case of failure
+			continue
+		}
+		duration = 24 * time.Hour
+	}
+}
+
+// LoadPublicKeys fetches the signing keys of the provider.
+// Keys that can not be parsed or are not meant for signatures are skipped.
+func (oas *OIDCAuthStrategy) LoadPublicKeys() error {
+	r, err := oas.client.Get(oas.jwksURI)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not fetch keys from %s: %s", oas.jwksURI, r.Status)
+	}
+
+	var target struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&target); err != nil {
+		return err
+	}
+
+	newKeys := make(map[string]oidcKey)
+	for _, jwk := range target.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Warnf("Skipping key %s: %s", jwk.Kid, err.Error())
+			continue
+		}
+		newKeys[jwk.Kid] = oidcKey{alg: jwk.Alg, key: key}
+	}
+
+	oas.mutex.Lock()
+	defer oas.mutex.Unlock()
+	oas.keys = newKeys
+	oas.lastLoaded = time.Now()
+	return nil
+}
+
+// PublicKey decodes the key material of the JWK
+func (jwk JSONWebKey) PublicKey() (interface{}, error) {
+	decode := func(name, s string) ([]byte, error) {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid %s", name)
+		}
+		return b, nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode("n", jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid e")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decode("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decode("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid x")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// Get the key for a kid, keys are loaded again if the kid is unknown and were not loaded recently
+func (oas *OIDCAuthStrategy) getPublicKey(kid string) (oidcKey, bool) {
+	oas.mutex.RLock()
+	key, ok := oas.keys[kid]
+	stale := time.Since(oas.lastLoaded) > oidcKeysMinRefresh
+	oas.mutex.RUnlock()
+	if ok || !stale {
+		return key, ok
+	}
+
+	if err := oas.LoadPublicKeys(); err != nil {
+		log.Errorf("Error refreshing public keys: %v\n", err)
+		return oidcKey{}, false
+	}
+	oas.mutex.RLock()
+	defer oas.mutex.RUnlock()
+	key, ok = oas.keys[kid]
+	return key, ok
+}
+
+// Check that the signing method of the token matches the type of the key
+func signingMethodMatches(method jwt.SigningMethod, key interface{}) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return true
+		}
+	case *ecdsa.PublicKey:
+		_, ok := method.(*jwt.SigningMethodECDSA)
+		return ok
+	case ed25519.PublicKey:
+		_, ok := method.(*jwt.SigningMethodEd25519)
+		return ok
+	}
+	return false
+}
+
+func (oas *OIDCAuthStrategy) ValidateToken(tokenString string) (*Claims, error) {
+	mapClaims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, mapClaims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := oas.getPublicKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("public key not found")
+		}
+
+		if !signingMethodMatches(token.Method, key.key) || (key.alg != "" && key.alg != token.Method.Alg()) {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.key, nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWT: %v", err)
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid JWT")
+	}
+
+	if !mapClaims.VerifyIssuer(oas.Issuer, true) {
+		return nil, fmt.Errorf("invalid JWT issuer")
+	}
+	if !mapClaims.VerifyAudience(oas.Audience, true) {
+		return nil, fmt.Errorf("invalid JWT audience")
+	}
+
+	// claims are decoded again into the shared type, the roles claim is resolved separately since its path is configurable
+	var claims Claims
+	b, err := json.Marshal(mapClaims)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse JWT claims: %v", err)
+	}
+	claims.Email, _ = mapClaims[oas.EmailClaim].(string)
+	claims.Roles = claimStrings(mapClaims, oas.RolesClaim)
+
+	return &claims, nil
+}
+
+// Strings at a path of nested claims, a single string is returned as one value
+func claimStrings(claims map[string]interface{}, path []string) []string {
+	var v interface{} = claims
+	for _, p := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+
+	switch vs := v.(type) {
+	case string:
+		return []string{vs}
+	case []interface{}:
+		res := []string{}
+		for _, s := range vs {
+			if str, ok := s.(string); ok {
+				res = append(res, str)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// Validate X-ProcessAPI-User-Email header against user from claims
+func (oas *OIDCAuthStrategy) ValidateUser(c echo.Context, claims *Claims) (err error) {
+	if oas.ServiceRoleName != "" && overlap(claims.Roles, []string{oas.ServiceRoleName}) {
+		// assume provided header is correct
+	} else if claims.Email == "" || !(c.Request().Header.Get("X-ProcessAPI-User-Email") == claims.Email) {
+		return fmt.Errorf("invalid X-ProcessAPI-User-Email header")
+	}
+
+	return nil
+}
+
+// Set user roles to API Header, replacing roles sent by the client
+func (oas *OIDCAuthStrategy) SetUserRolesHeader(c echo.Context, claims *Claims) (err error) {
+	c.Request().Header.Set("X-ProcessAPI-User-Roles", strings.Join(claims.Roles, ","))
+	return nil
+}
@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Test provider serving a discovery document and a JWKS with a key of each type
+type testOIDCProvider struct {
+	srv    *httptest.Server
+	issuer string
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	ed     ed25519.PrivateKey
+	keys   []JSONWebKey
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	t.Helper()
+	p := &testOIDCProvider{}
+
+	var err error
+	if p.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if p.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	var edPub ed25519.PublicKey
+	if edPub, p.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	p.keys = []JSONWebKey{
+		{Kid: "rsa", Kty: "RSA", Alg: "RS256", Use: "sig", N: b64(p.rsa.N.Bytes()), E: b64(big.NewInt(int64(p.rsa.E)).Bytes())},
+		{Kid: "ec", Kty: "EC", Crv: "P-256", X: b64(p.ec.X.Bytes()), Y: b64(p.ec.Y.Bytes())},
+		{Kid: "ed", Kty: "OKP", Crv: "Ed25519", X: b64(edPub)},
+		// skipped, not a signing key or not valid
+		{Kid: "enc", Kty: "RSA", Use: "enc", N: b64(p.rsa.N.Bytes()), E: "AQAB"},
+		{Kid: "bad-curve", Kty: "EC", Crv: "P-256", X: b64([]byte{1}), Y: b64([]byte{2})},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": p.issuer, "jwks_uri": p.srv.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": p.keys})
+	})
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	p.issuer = p.srv.URL
+	return p
+}
+
+func (p *testOIDCProvider) sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func (p *testOIDCProvider) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":             p.issuer,
+		"aud":             "process-api",
+		"exp":             time.Now().Add(time.Hour).Unix(),
+		"email":           "user@example.com",
+		"resource_access": map[string]interface{}{"process-api": map[string]interface{}{"roles": []string{"admin", "pyecho"}}},
+	}
+}
+
+func newTestOIDCStrategy(t *testing.T, p *testOIDCProvider) *OIDCAuthStrategy {
+	t.Helper()
+	t.Setenv("OIDC_ISSUER_URL", p.issuer)
+	t.Setenv("OIDC_AUDIENCE", "process-api")
+	t.Setenv("OIDC_ROLES_CLAIM", "resource_access.process-api.roles")
+	oas, err := NewOIDCAuthStrategy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oas
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	oas := newTestOIDCStrategy(t, p)
+
+	if oas.jwksURI != p.srv.URL+"/keys" {
+		t.Errorf("jwks uri is %s", oas.jwksURI)
+	}
+	for _, kid := range []string{"rsa", "ec", "ed"} {
+		if _, ok := oas.keys[kid]; !ok {
+			t.Errorf("key %s was not loaded", kid)
+		}
+	}
+	for _, kid := range []string{"enc", "bad-curve"} {
+		if _, ok := oas.keys[kid]; ok {
+			t.Errorf("key %s was loaded", kid)
+		}
+	}
+
+	// the discovery document must be for the configured issuer
+	t.Setenv("OIDC_ISSUER_URL", p.issuer+"/realms/other")
+	if _, err := NewOIDCAuthStrategy(); err == nil {
+		t.Error("discovery document of another issuer was accepted")
+	}
+}
+
+func TestOIDCValidateToken(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	oas := newTestOIDCStrategy(t, p)
+
+	valid := map[string]string{
+		"RS256": p.sign(t, jwt.SigningMethodRS256, "rsa", p.rsa, p.claims()),
+		"ES256": p.sign(t, jwt.SigningMethodES256, "ec", p.ec, p.claims()),
+		"EdDSA": p.sign(t, jwt.SigningMethodEdDSA, "ed", p.ed, p.claims()),
+	}
+	for alg, token := range valid {
+		claims, err := oas.ValidateToken(token)
+		if err != nil {
+			t.Errorf("%s token rejected: %s", alg, err.Error())
+			continue
+		}
+		if claims.Email != "user@example.com" || !reflect.DeepEqual(claims.Roles, []string{"admin", "pyecho"}) {
+			t.Errorf("%s token claims are %+v", alg, claims)
+		}
+	}
+
+	otherIssuer := p.claims()
+	otherIssuer["iss"] = "https://attacker.example.com"
+	otherAudience := p.claims()
+	otherAudience["aud"] = "another-api"
+	expired := p.claims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+
+	rsaPub, err := x509.MarshalPKIXPublicKey(&p.rsa.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaPub})
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]string{
+		"issuer":      p.sign(t, jwt.SigningMethodRS256, "rsa", p.rsa, otherIssuer),
+		"audience":    p.sign(t, jwt.SigningMethodRS256, "rsa", p.rsa, otherAudience),
+		"expired":     p.sign(t, jwt.SigningMethodRS256, "rsa", p.rsa, expired),
+		"unknown kid": p.sign(t, jwt.SigningMethodRS256, "other", otherRSA, p.claims()),
+		"signature":   p.sign(t, jwt.SigningMethodRS256, "rsa", otherRSA, p.claims()),
+		// HMAC with the public key of the provider as secret
+		"HS256 with public key": p.sign(t, jwt.SigningMethodHS256, "rsa", rsaPubPEM, p.claims()),
+		"HS256 with key bytes":  p.sign(t, jwt.SigningMethodHS256, "ed", []byte(p.ed.Public().(ed25519.PublicKey)), p.claims()),
+		// alg of another key type than the key of the kid
+		"RS256 with EC kid":  p.sign(t, jwt.SigningMethodRS256, "ec", p.rsa, p.claims()),
+		"ES256 with OKP kid": p.sign(t, jwt.SigningMethodES256, "ed", p.ec, p.claims()),
+		"EdDSA with RSA kid": p.sign(t, jwt.SigningMethodEdDSA, "rsa", p.ed, p.claims()),
+		// alg of the right key type that is not the alg of the JWK
+		"PS256 with RS256 key": p.sign(t, jwt.SigningMethodPS256, "rsa", p.rsa, p.claims()),
+		"none":                 p.sign(t, jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType, p.claims()),
+	}
+	for name, token := range invalid {
+		if _, err := oas.ValidateToken(token); err == nil {
+			t.Errorf("token with invalid %s accepted", name)
+		}
+	}
+}
+
+func TestJSONWebKeyPublicKey(t *testing.T) {
+	invalid := []JSONWebKey{
+		{Kty: "RSA", N: "", E: "AQAB"},
+		{Kty: "RSA", N: "AQAB", E: b64(big.NewInt(1 << 40).Bytes())},
+		{Kty: "EC", Crv: "P-192", X: "AQAB", Y: "AQAB"},
+		{Kty: "EC", Crv: "P-256", X: "AQAB", Y: "AQAB"},
+		{Kty: "EC", Crv: "P-256", X: "not base64!", Y: "AQAB"},
+		{Kty: "OKP", Crv: "X25519", X: b64(make([]byte, 32))},
+		{Kty: "OKP", Crv: "Ed25519", X: b64(make([]byte, 16))},
+		{Kty: "oct"},
+	}
+	for _, jwk := range invalid {
+		if key, err := jwk.PublicKey(); err == nil {
+			t.Errorf("invalid key %+v parsed as %T", jwk, key)
+		}
+	}
+
+	ec, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := JSONWebKey{Kty: "EC", Crv: "P-384", X: b64(ec.X.Bytes()), Y: b64(ec.Y.Bytes())}.PublicKey()
+	if pub, ok := key.(*ecdsa.PublicKey); err != nil || !ok || !pub.Equal(&ec.PublicKey) {
+		t.Errorf("P-384 key parsed as %v, %v", key, err)
+	}
+	// padded base64 is accepted
+	key, err = JSONWebKey{Kty: "RSA", N: base64.URLEncoding.EncodeToString([]byte{0xc3, 0x01}), E: "AQAB"}.PublicKey()
+	if pub, ok := key.(*rsa.PublicKey); err != nil || !ok || pub.E != 65537 || pub.N.Int64() != 0xc301 {
+		t.Errorf("RSA key parsed as %v, %v", key, err)
+	}
+}
+
+func TestClaimStrings(t *testing.T) {
+	claims := map[string]interface{}{
+		"roles":  []interface{}{"a", 1, "b"},
+		"group":  "single",
+		"number": 5.0,
+		"realm":  map[string]interface{}{"client": map[string]interface{}{"roles": []interface{}{"c"}}},
+	}
+	cases := []struct {
+		path []string
+		want []string
+	}{
+		{[]string{"roles"}, []string{"a", "b"}},
+		{[]string{"group"}, []string{"single"}},
+		{[]string{"realm", "client", "roles"}, []string{"c"}},
+		{[]string{"number"}, nil},
+		{[]string{"missing"}, nil},
+		{[]string{"group", "roles"}, nil},
+		{[]string{"realm", "missing", "roles"}, nil},
+	}
+	for _, c := range cases {
+		if got := claimStrings(claims, c.path); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("claimStrings(%v) = %v, want %v", c.path, got, c.want)
+		}
+	}
+}
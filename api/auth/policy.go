@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"app/jobs"
+	"app/utils"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Actions granted by policy rules
+const (
+	ActionExecute         = "execute"
+	ActionDescribe        = "describe"
+	ActionListJobs        = "listJobs"
+	ActionReadLogs        = "readLogs"
+	ActionDismiss         = "dismiss"
+	ActionManageProcesses = "manageProcesses"
+	ActionReadStats       = "readStats"
+	ActionReadUsage       = "readUsage"
+	ActionManageAPIKeys   = "manageAPIKeys"
+	ActionAdmin           = "admin"
+)
+
+var policyActions = []string{ActionExecute, ActionDescribe, ActionListJobs, ActionReadLogs, ActionDismiss, ActionManageProcesses, ActionReadStats, ActionReadUsage, ActionManageAPIKeys, ActionAdmin}
+
+// Special values in rules. AnyRole matches every caller, ProcessRole matches the role named like the process.
+const (
+	AnyRole     = "*"
+	AnyAction   = "*"
+	ProcessRole = "$processID"
+)
+
+// PolicyRule grants actions on processes to callers with any of the roles.
+// Processes are process ids or glob patterns, all processes if empty.
+type PolicyRule struct {
+	Roles     []string `yaml:"roles" json:"roles"`
+	Actions   []string `yaml:"actions" json:"actions"`
+	Processes []string `yaml:"processes" json:"processes,omitempty"`
+}
+
+// Policy is read from the file at AUTH_POLICY_FILE. An action is allowed if any rule grants it.
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules" json:"rules"`
+}
+
+// Policy used when no policy file is set, it grants what handlers allowed before policy files:
+// admins can do everything, processes are executed by callers with the role named like the process,
+// and everyone can describe processes, read and dismiss jobs, read stats and usage and manage API keys,
+// subject to the ownership checks of the handlers.
+func DefaultPolicy(adminRole string) *Policy {
+	return &Policy{Rules: []PolicyRule{
+		{Roles: []string{adminRole}, Actions: []string{AnyAction}},
+		{Roles: []string{ProcessRole}, Actions: []string{ActionExecute}},
+		{Roles: []string{AnyRole}, Actions: []string{ActionDescribe, ActionListJobs, ActionReadLogs, ActionDismiss, ActionReadStats, ActionReadUsage, ActionManageAPIKeys}},
+	}}
+}
+
+// Load the policy from a yaml file, returns the default policy if path is empty
+func LoadPolicy(path, adminRole string) (*Policy, error) {
+	if path == "" {
+		return DefaultPolicy(adminRole), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read policy file: %s", err.Error())
+	}
+
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("could not parse policy file: %s", err.Error())
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	for i, r := range p.Rules {
+		if len(r.Roles) == 0 || len(r.Actions) == 0 {
+			return fmt.Errorf("rule %d of policy must have roles and actions", i+1)
+		}
+		for _, a := range r.Actions {
+			if a != AnyAction && !utils.StringInSlice(a, policyActions) {
+				return fmt.Errorf("rule %d of policy has unknown action %s, valid actions are: %s", i+1, a, strings.Join(policyActions, ", "))
+			}
+		}
+		for _, pattern := range r.Processes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d of policy has invalid process pattern %s", i+1, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Rule applies to a caller with the roles, for the process if processID is set
+func (r PolicyRule) matches(roles []string, processID string) bool {
+	roleMatch := false
+	for _, role := range r.Roles {
+		if role == AnyRole || (role == ProcessRole && processID != "" && utils.StringInSlice(processID, roles)) || (role != ProcessRole && utils.StringInSlice(role, roles)) {
+			roleMatch = true
+			break
+		}
+	}
+	if !roleMatch {
+		return false
+	}
+
+	if processID == "" || len(r.Processes) == 0 {
+		return true
+	}
+	for _, pattern := range r.Processes {
+		if ok, _ := path.Match(pattern, processID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports if a caller with the roles can take the action on the process.
+// If processID is empty the action is allowed if it is granted on any process.
+func (p *Policy) Allowed(roles []string, action, processID string) bool {
+	for _, r := range p.Rules {
+		if (utils.StringInSlice(AnyAction, r.Actions) || utils.StringInSlice(action, r.Actions)) && r.matches(roles, processID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions of a caller with the roles, the process patterns granted for each action.
+// A pattern of "*" means all processes. Roles are only taken as process ids if they are one of processIDs.
+func (p *Policy) Permissions(roles, processIDs []string) map[string][]string {
+	perms := map[string][]string{}
+	for _, r := range p.Rules {
+		processes := r.Processes
+		if len(processes) == 0 {
+			processes = []string{"*"}
+		}
+
+		for _, role := range r.Roles {
+			granted := processes
+			switch {
+			case role == AnyRole:
+			case role == ProcessRole:
+				// every role of the caller names a process it is granted
+				granted = []string{}
+				for _, pid := range roles {
+					if utils.StringInSlice(pid, processIDs) && r.matches(roles, pid) {
+						granted = append(granted, pid)
+					}
+				}
+			case !utils.StringInSlice(role, roles):
+				continue
+			}
+
+			for _, a := range r.Actions {
+				actions := []string{a}
+				if a == AnyAction {
+					actions = policyActions
+				}
+				for _, action := range actions {
+					for _, g := range granted {
+						if !utils.StringInSlice(g, perms[action]) {
+							perms[action] = append(perms[action], g)
+						}
+					}
+				}
+			}
+		}
+	}
+	for action, patterns := range perms {
+		if utils.StringInSlice("*", patterns) {
+			perms[action] = []string{"*"}
+			continue
+		}
+		sort.Strings(patterns)
+	}
+	return perms
+}
+
+// Actions of routes enforced by the policy, keyed by method and route path.
+// Requests to other routes are not restricted by the policy.
+var routeActions = map[string]string{
+	"POST /processes/:processID/execution":        ActionExecute,
+	"GET /processes":                              ActionDescribe,
+	"GET /processes/:processID":                   ActionDescribe,
+	"GET /processes/:processID/versions":          ActionDescribe,
+	"GET /processes/:processID/versions/:version": ActionDescribe,
+	"POST /processes/:processID":                  ActionManageProcesses,
+	"PUT /processes/:processID":                   ActionManageProcesses,
+	"DELETE /processes/:processID":                ActionManageProcesses,
+	"GET /jobs":                                   ActionListJobs,
+	"GET /jobs/:jobID":                            ActionListJobs,
+	"GET /jobs/:jobID/results":                    ActionListJobs,
+	"GET /jobs/:jobID/history":                    ActionListJobs,
+	"GET /jobs/:jobID/metadata":                   ActionListJobs,
+	"GET /jobs/:jobID/metadata/verify":            ActionListJobs,
+	"GET /jobs/:jobID/logs":                       ActionReadLogs,
+	"DELETE /jobs/:jobID":                         ActionDismiss,
+	"GET /stats":                                  ActionReadStats,
+	"GET /processes/:processID/stats":             ActionReadStats,
+	"GET /usage":                                  ActionReadUsage,
+	"POST /auth/keys":                             ActionManageAPIKeys,
+	"GET /auth/keys":                              ActionManageAPIKeys,
+	"DELETE /auth/keys/:keyID":                    ActionManageAPIKeys,
+	"GET /admin/jobs/export":                      ActionAdmin,
+	"POST /admin/jobs/import":                     ActionAdmin,
+	"GET /admin/audit":                            ActionAdmin,
+	"GET /admin/processes/errors":                 ActionAdmin,
+}
+
+// JobStore looks up the process of jobs, implemented by jobs.Database
+type JobStore interface {
+	GetJob(jid string) (jobs.JobRecord, bool, error)
+}
+
+// Enforce the policy on requests with the roles set by the Authorize middleware.
+// Actions on a job are checked against the process of the job.
+func Enforce(policy *Policy, store JobStore, skipper middleware.Skipper) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if skipper(c) {
+				return next(c)
+			}
+
+			action, ok := routeActions[c.Request().Method+" "+c.Path()]
+			if !ok {
+				return next(c)
+			}
+
+			processID := c.Param("processID")
+			if jid := c.Param("jobID"); jid != "" {
+				jr, ok, err := store.GetJob(jid)
+				if err != nil {
+					log.Errorf("could not read job %s to enforce policy: %s", jid, err.Error())
+					return c.JSON(http.StatusInternalServerError, "could not authorize request")
+				}
+				if !ok {
+					// handlers respond to jobs that do not exist
+					return next(c)
+				}
+				processID = jr.ProcessID
+			}
+
+			roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
+			if !policy.Allowed(roles, action, processID) {
+				return c.JSON(http.StatusForbidden, "Forbidden")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	p := &Policy{Rules: []PolicyRule{
+		{Roles: []string{"admin"}, Actions: []string{AnyAction}},
+		{Roles: []string{ProcessRole}, Actions: []string{ActionExecute}},
+		{Roles: []string{"analyst"}, Actions: []string{ActionExecute, ActionReadLogs}, Processes: []string{"ras-*", "hms"}},
+		{Roles: []string{AnyRole}, Actions: []string{ActionDescribe}},
+	}}
+
+	cases := []struct {
+		roles     []string
+		action    string
+		processID string
+		want      bool
+	}{
+		{[]string{"admin"}, ActionAdmin, "", true},
+		{[]string{"admin"}, ActionManageProcesses, "pyecho", true},
+		{[]string{"pyecho"}, ActionExecute, "pyecho", true},
+		{[]string{"pyecho"}, ActionExecute, "other", false},
+		{[]string{"pyecho"}, ActionReadLogs, "pyecho", false},
+		// the process role does not match roles named like a process when no process is given
+		{[]string{"pyecho"}, ActionExecute, "", false},
+		{[]string{"analyst"}, ActionExecute, "ras-unsteady", true},
+		{[]string{"analyst"}, ActionReadLogs, "hms", true},
+		{[]string{"analyst"}, ActionExecute, "hms-2", false},
+		// granted on some process
+		{[]string{"analyst"}, ActionReadLogs, "", true},
+		{[]string{"analyst"}, ActionAdmin, "", false},
+		{[]string{""}, ActionDescribe, "pyecho", true},
+		{nil, ActionDismiss, "pyecho", false},
+	}
+	for _, c := range cases {
+		if got := p.Allowed(c.roles, c.action, c.processID); got != c.want {
+			t.Errorf("Allowed(%v, %s, %q) = %v, want %v", c.roles, c.action, c.processID, got, c.want)
+		}
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	p := DefaultPolicy("admin")
+
+	for _, action := range policyActions {
+		if !p.Allowed([]string{"admin"}, action, "pyecho") {
+			t.Errorf("admin not allowed to %s", action)
+		}
+	}
+	for _, action := range []string{ActionManageProcesses, ActionAdmin} {
+		if p.Allowed([]string{"user", "pyecho"}, action, "pyecho") {
+			t.Errorf("user allowed to %s", action)
+		}
+	}
+	if !p.Allowed([]string{"user", "pyecho"}, ActionExecute, "pyecho") || p.Allowed([]string{"user"}, ActionExecute, "pyecho") {
+		t.Error("execute is not granted by the role named like the process")
+	}
+	if !p.Allowed([]string{"user"}, ActionDismiss, "pyecho") {
+		t.Error("user not allowed to dismiss")
+	}
+}
+
+func TestPolicyPermissions(t *testing.T) {
+	p := &Policy{Rules: []PolicyRule{
+		{Roles: []string{"ops"}, Actions: []string{AnyAction}, Processes: []string{"ras-*"}},
+		{Roles: []string{ProcessRole}, Actions: []string{ActionExecute}},
+		{Roles: []string{AnyRole}, Actions: []string{ActionDescribe}},
+		{Roles: []string{"reader"}, Actions: []string{ActionReadLogs}, Processes: []string{"hms", "ras-*"}},
+	}}
+	processIDs := []string{"pyecho", "hms", "ras-unsteady"}
+
+	got := p.Permissions([]string{"ops", "reader", "pyecho", "hms", "not-a-process"}, processIDs)
+	want := map[string][]string{
+		ActionExecute:         {"hms", "pyecho", "ras-*"},
+		ActionDescribe:        {"*"},
+		ActionListJobs:        {"ras-*"},
+		ActionReadLogs:        {"hms", "ras-*"},
+		ActionDismiss:         {"ras-*"},
+		ActionManageProcesses: {"ras-*"},
+		ActionReadStats:       {"ras-*"},
+		ActionReadUsage:       {"ras-*"},
+		ActionManageAPIKeys:   {"ras-*"},
+		ActionAdmin:           {"ras-*"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Permissions = %v, want %v", got, want)
+	}
+
+	got = p.Permissions(nil, processIDs)
+	if want := map[string][]string{ActionDescribe: {"*"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Permissions without roles = %v, want %v", got, want)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	p, err := LoadPolicy("", "admin")
+	if err != nil || !reflect.DeepEqual(p, DefaultPolicy("admin")) {
+		t.Errorf("LoadPolicy without file = %v, %v", p, err)
+	}
+
+	invalid := map[string]string{
+		"no roles":       "rules:\n  - actions: [execute]\n",
+		"unknown action": "rules:\n  - roles: [a]\n    actions: [launch]\n",
+		"bad pattern":    "rules:\n  - roles: [a]\n    actions: [execute]\n    processes: [\"[\"]\n",
+	}
+	dir := t.TempDir()
+	for name, content := range invalid {
+		file := filepath.Join(dir, "policy.yml")
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPolicy(file, "admin"); err == nil {
+			t.Errorf("policy with %s loaded", name)
+		}
+	}
+}
+
+func TestEnforceDescribe(t *testing.T) {
+	p := &Policy{Rules: []PolicyRule{{Roles: []string{AnyRole}, Actions: []string{ActionDescribe}, Processes: []string{"public-*"}}}}
+	e := echo.New()
+	e.Use(Enforce(p, nil, func(echo.Context) bool { return false }))
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.GET("/processes", ok)
+	e.GET("/processes/:processID", ok)
+	e.GET("/processes/:processID/versions/:version", ok)
+
+	cases := map[string]int{
+		"/processes":                          http.StatusOK,
+		"/processes/public-echo":              http.StatusOK,
+		"/processes/public-echo/versions/1.0": http.StatusOK,
+		"/processes/private":                  http.StatusForbidden,
+		"/processes/private/versions/1.0":     http.StatusForbidden,
+	}
+	for path, want := range cases {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-ProcessAPI-User-Roles", "user")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CertReloader serves the server certificate, and the CAs that client certificates are verified against,
+// from files that are reloaded when they change, so that certificates can be renewed without a restart.
+type CertReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// size and modification time of the files when they were last loaded
+	loaded map[string]string
+}
+
+// NewCertReloader loads the certificate and key, and the client CAs if clientCAFile is set.
+// Without client CAs clients are not asked for certificates.
+func NewCertReloader(certFile, keyFile, clientCAFile string) (*CertReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("certificate and key files are required for TLS")
+	}
+
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Size and modification time of the files, they change when a file is replaced or rewritten
+func (r *CertReloader) versions() (map[string]string, error) {
+	v := map[string]string{}
+	for _, f := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		v[f] = fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+	}
+	return v, nil
+}
+
+// Reload the files if any of them changed since they were loaded, returns true if they were reloaded.
+// If loading fails the previous certificate is kept.
+func (r *CertReloader) Reload() (bool, error) {
+	v, err := r.versions()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	changed := false
+	for f, version := range v {
+		if r.loaded[f] != version {
+			changed = true
+		}
+	}
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("could not load TLS certificate: %s", err.Error())
+	}
+
+	var pool *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return false, fmt.Errorf("could not read client CA file: %s", err.Error())
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, errors.New("client CA file does not contain PEM certificates")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.loaded = v
+	return true, nil
+}
+
+// Watch reloads the files every interval until stop is closed
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				log.Errorf("could not reload TLS certificates, serving the previous ones: %s", err.Error())
+				continue
+			}
+			if reloaded {
+				log.Info("reloaded TLS certificates")
+			}
+		}
+	}
+}
+
+// TLSConfig for the server. Each handshake uses the certificates loaded last.
+// Client certificates are verified if they are presented, requests without them are authenticated by other means.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				cfg.ClientCAs = r.clientCAs
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	certFile string
+	keyFile  string
+}
+
+var testSerial int64
+
+// Issue a certificate signed by parent, self-signed if parent is nil, and write it to dir
+func newTestCert(t *testing.T, dir string, subject pkix.Name, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	issuer, signer := tmpl, crypto.Signer(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, subject.CommonName+".crt"),
+		keyFile:  filepath.Join(dir, subject.CommonName+".key"),
+	}
+	writeTestFile(t, tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeTestFile(t, tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	return tc
+}
+
+// Write the file with a later modification time than the previous version,
+// so that rewrites within the timestamp resolution are seen as changes
+func writeTestFile(t *testing.T, file string, data []byte) {
+	t.Helper()
+	mtime := time.Now()
+	if info, err := os.Stat(file); err == nil && !info.ModTime().Before(mtime) {
+		mtime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Common name of the certificate served on the next handshake
+func servedCommonName(t *testing.T, r *CertReloader) string {
+	t.Helper()
+	cfg, err := r.TLSConfig().GetConfigForClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, dir, pkix.Name{CommonName: "first"}, nil)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	install := func(tc *testCert) {
+		writeTestFile(t, certFile, mustReadFile(t, tc.certFile))
+		writeTestFile(t, keyFile, mustReadFile(t, tc.keyFile))
+	}
+	install(first)
+
+	if _, err := NewCertReloader(certFile, "", ""); err == nil {
+		t.Error("reloader created without key")
+	}
+	if _, err := NewCertReloader(certFile, first.certFile, ""); err == nil {
+		t.Error("reloader created with a certificate as key")
+	}
+
+	r, err := NewCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := servedCommonName(t, r); cn != "first" {
+		t.Errorf("serving %s", cn)
+	}
+	if cfg, _ := r.TLSConfig().GetConfigForClient(nil); cfg.ClientCAs != nil || cfg.ClientAuth != 0 {
+		t.Error("client certificates requested without client CAs")
+	}
+	if reloaded, err := r.Reload(); reloaded || err != nil {
+		t.Errorf("unchanged files reloaded: %v", err)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		r.Watch(10*time.Millisecond, stop)
+		close(done)
+	}()
+
+	install(newTestCert(t, dir, pkix.Name{CommonName: "second"}, nil))
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCommonName(t, r) != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+
+	// a key that does not match the certificate keeps the previous pair
+	install(newTestCert(t, dir, pkix.Name{CommonName: "third"}, nil))
+	writeTestFile(t, keyFile, mustReadFile(t, first.keyFile))
+	if reloaded, err := r.Reload(); reloaded || err == nil {
+		t.Error("mismatched key pair loaded")
+	}
+	writeTestFile(t, keyFile, []byte("not a key"))
+	if reloaded, err := r.Reload(); reloaded || err == nil {
+		t.Error("invalid key loaded")
+	}
+	if cn := servedCommonName(t, r); cn != "second" {
+		t.Errorf("serving %s after invalid files", cn)
+	}
+}
+
+func mustReadFile(t *testing.T, file string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -266,12 +267,16 @@ func (c *AWSBatchController) GetJobTimes(batchID string) (cp time.Time, cr time.
 		job := describeJobsOutput.Jobs[0] // Assuming only one job is returned
 
 		// Extract createdAt, startedAt, and completedAt times
-		if job.CreatedAt != nil && job.StartedAt != nil && job.StoppedAt != nil {
-			cr = time.UnixMilli(*job.CreatedAt)
+		// startedAt and stoppedAt are left zero if the job never reached those stages, e.g. cancelled jobs
+		if job.CreatedAt == nil {
+			return time.Time{}, time.Time{}, time.Time{}, fmt.Errorf("job created time value is nil")
+		}
+		cr = time.UnixMilli(*job.CreatedAt)
+		if job.StartedAt != nil {
 			st = time.UnixMilli(*job.StartedAt)
+		}
+		if job.StoppedAt != nil {
 			cp = time.UnixMilli(*job.StoppedAt)
-		} else {
-			return time.Time{}, time.Time{}, time.Time{}, fmt.Errorf("one of the job time value is nil")
 		}
 	} else {
 		return time.Time{}, time.Time{}, time.Time{}, fmt.Errorf("no job information found")
@@ -279,3 +284,26 @@ func (c *AWSBatchController) GetJobTimes(batchID string) (cp time.Time, cr time.
 
 	return cr, st, cp, nil
 }
+
+// Get the status reason and container exit code of a job
+// Exit code is nil if the container never exited, e.g. cancelled jobs
+func (c *AWSBatchController) GetJobExitInfo(batchID string) (string, *int64, error) {
+	output, err := c.client.DescribeJobs(&batch.DescribeJobsInput{Jobs: aws.StringSlice([]string{batchID})})
+	if err != nil {
+		return "", nil, fmt.Errorf("error describing jobs: %s", err)
+	}
+	if len(output.Jobs) == 0 {
+		return "", nil, fmt.Errorf("no job information found")
+	}
+
+	job := output.Jobs[0]
+	reason := aws.StringValue(job.StatusReason)
+	var exitCode *int64
+	if job.Container != nil {
+		exitCode = job.Container.ExitCode
+		if cr := aws.StringValue(job.Container.Reason); cr != "" {
+			reason = strings.TrimSpace(reason + " " + cr)
+		}
+	}
+	return reason, exitCode, nil
+}
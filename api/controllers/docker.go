@@ -262,16 +262,22 @@ func (c *DockerController) RemoveVolume(name string) error {
 	return nil
 }
 
-// Get Image Digest from Image URI
-func (c *DockerController) GetImageDigest(imageURI string) (string, error) {
-	ctx := context.Background()
-	imageInspect, _, err := c.cli.ImageInspectWithRaw(ctx, imageURI)
+// Get the ID of the image a container was created from
+func (c *DockerController) GetContainerImageID(containerID string) (string, error) {
+	containerInfo, err := c.cli.ContainerInspect(context.Background(), containerID)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("error getting container details: %v", err)
 	}
-	// Get the digest from the image inspect response
-	imageDigest := imageInspect.ID
-	return imageDigest, nil
+	return containerInfo.Image, nil
+}
+
+// Get repo digests of a local image, these are the references of the manifests the image was pulled by
+func (c *DockerController) GetImageRepoDigests(image string) ([]string, error) {
+	imageInspect, _, err := c.cli.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		return nil, err
+	}
+	return imageInspect.RepoDigests, nil
 }
 
 // Get job execution times
@@ -303,3 +309,12 @@ func (c *DockerController) GetJobTimes(containerID string) (cp time.Time, cr tim
 
 	return
 }
+
+// Get the operating system, architecture and version of the docker daemon
+func (c *DockerController) ServerPlatform() (os string, arch string, version string, err error) {
+	v, err := c.cli.ServerVersion(context.Background())
+	if err != nil {
+		return "", "", "", fmt.Errorf("error getting docker server version: %v", err)
+	}
+	return v.Os, v.Arch, v.Version, nil
+}
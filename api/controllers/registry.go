@@ -0,0 +1,458 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Media types of manifests that can be resolved
+const (
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+const dockerHubRegistry = "registry-1.docker.io"
+
+// ImageReference is an image name split into the parts needed by the OCI Distribution API
+type ImageReference struct {
+	// Host of the registry API
+	Registry   string
+	Repository string
+	// Tag or digest
+	Reference string
+}
+
+// Parse an image name such as ubuntu:22.04, ghcr.io/org/img@sha256:..., or localhost:5000/img
+// Images without a registry are resolved against Docker Hub, images without a tag use latest.
+func ParseImageReference(image string) (ImageReference, error) {
+	var ir ImageReference
+	if image == "" {
+		return ir, fmt.Errorf("image name is empty")
+	}
+
+	name := image
+	if i := strings.Index(image, "@"); i != -1 {
+		name, ir.Reference = image[:i], image[i+1:]
+	} else if i := strings.LastIndex(image, ":"); i != -1 && !strings.Contains(image[i+1:], "/") {
+		name, ir.Reference = image[:i], image[i+1:]
+	} else {
+		ir.Reference = "latest"
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ir.Registry, ir.Repository = parts[0], parts[1]
+	} else {
+		ir.Registry, ir.Repository = "docker.io", name
+	}
+
+	if ir.Registry == "docker.io" || ir.Registry == "index.docker.io" {
+		ir.Registry = dockerHubRegistry
+		if !strings.Contains(ir.Repository, "/") {
+			ir.Repository = "library/" + ir.Repository
+		}
+	}
+
+	if ir.Repository == "" || ir.Reference == "" {
+		return ImageReference{}, fmt.Errorf("invalid image name: %s", image)
+	}
+	return ir, nil
+}
+
+type registryAuth struct {
+	Username string
+	Password string
+}
+
+// RegistryController is a minimal OCI Distribution API client used to resolve image digests.
+// It works with Docker Hub, GHCR, ECR, and self hosted registries such as registry:2.
+type RegistryController struct {
+	client *http.Client
+	// Credentials keyed by registry host
+	auths map[string]registryAuth
+	// Registries that are served over plain http
+	insecureHosts []string
+}
+
+// Create a registry controller.
+// Credentials are read from a docker config.json style file at REGISTRY_AUTH_FILE, defaulting to ~/.docker/config.json.
+// Registries listed in the comma separated REGISTRY_INSECURE_HOSTS, and localhost, are accessed over http.
+// ECR credentials are fetched using the AWS credentials of the server.
+func NewRegistryController() (*RegistryController, error) {
+	c := RegistryController{
+		client:        &http.Client{Timeout: 10 * time.Second},
+		auths:         make(map[string]registryAuth),
+		insecureHosts: []string{"localhost", "127.0.0.1"},
+	}
+
+	for _, h := range strings.Split(os.Getenv("REGISTRY_INSECURE_HOSTS"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			c.insecureHosts = append(c.insecureHosts, h)
+		}
+	}
+
+	authFile := os.Getenv("REGISTRY_AUTH_FILE")
+	if authFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &c, nil
+		}
+		authFile = filepath.Join(home, ".docker", "config.json")
+		if _, err := os.Stat(authFile); err != nil {
+			return &c, nil
+		}
+	}
+
+	err := c.loadAuthFile(authFile)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Load credentials from the auths section of a docker config.json style file
+func (c *RegistryController) loadAuthFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read registry auth file: %s", err.Error())
+	}
+
+	var cfg struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("could not parse registry auth file: %s", err.Error())
+	}
+
+	for host, a := range cfg.Auths {
+		ra := registryAuth{a.Username, a.Password}
+		if a.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return fmt.Errorf("invalid auth for registry %s", host)
+			}
+			user, pass, _ := strings.Cut(string(decoded), ":")
+			ra = registryAuth{user, pass}
+		}
+		c.auths[normalizeRegistryHost(host)] = ra
+	}
+	return nil
+}
+
+// Map the different spellings of a registry in config files to the host of its API
+func normalizeRegistryHost(host string) string {
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	switch host {
+	case "docker.io", "index.docker.io":
+		return dockerHubRegistry
+	}
+	return host
+}
+
+// Get credentials for a registry, ECR credentials are fetched on demand
+func (c *RegistryController) credentials(registry string) (registryAuth, bool, error) {
+	if a, ok := c.auths[registry]; ok {
+		return a, true, nil
+	}
+
+	// <account>.dkr.ecr.<region>.amazonaws.com
+	parts := strings.Split(registry, ".")
+	if len(parts) >= 6 && parts[1] == "dkr" && parts[2] == "ecr" && strings.HasSuffix(registry, ".amazonaws.com") {
+		a, err := ecrCredentials(parts[0], parts[3])
+		if err != nil {
+			return registryAuth{}, false, err
+		}
+		return a, true, nil
+	}
+
+	return registryAuth{}, false, nil
+}
+
+// Get registry credentials for ECR using the AWS credentials of the server
+func ecrCredentials(accountID, region string) (registryAuth, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), ""),
+		Region:      aws.String(region),
+	})
+	if err != nil {
+		return registryAuth{}, err
+	}
+
+	out, err := ecr.New(sess).GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{RegistryIds: []*string{aws.String(accountID)}})
+	if err != nil {
+		return registryAuth{}, fmt.Errorf("could not get ECR authorization token: %s", err.Error())
+	}
+	if len(out.AuthorizationData) == 0 {
+		return registryAuth{}, fmt.Errorf("no ECR authorization data returned")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(out.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return registryAuth{}, fmt.Errorf("invalid ECR authorization token")
+	}
+	user, pass, _ := strings.Cut(string(decoded), ":")
+	return registryAuth{user, pass}, nil
+}
+
+func (c *RegistryController) scheme(registry string) string {
+	host := registry
+	if h, _, found := strings.Cut(registry, ":"); found {
+		host = h
+	}
+	for _, ih := range c.insecureHosts {
+		if ih == registry || ih == host {
+			return "http"
+		}
+	}
+	return "https"
+}
+
+// Resolve a tag or digest to the digest of the manifest for the given platform, e.g. linux/amd64 or linux/arm64/v8.
+// If the reference points to an image index, the digest of the matching platform manifest is returned.
+// If it points to a single platform manifest, its own digest is returned.
+func (c *RegistryController) ResolveDigest(image, platform string) (string, error) {
+	ir, err := ParseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	body, mediaType, digest, err := c.getManifest(ir)
+	if err != nil {
+		return "", err
+	}
+
+	switch mediaType {
+	case mediaTypeOCIIndex, mediaTypeDockerManifestList:
+		return selectPlatformDigest(body, platform)
+	default:
+		return digest, nil
+	}
+}
+
+// Get the manifest for the reference.
+// Returns the manifest body, its media type, and its digest.
+func (c *RegistryController) getManifest(ir ImageReference) ([]byte, string, string, error) {
+	u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", c.scheme(ir.Registry), ir.Registry, ir.Repository, ir.Reference)
+
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join([]string{mediaTypeOCIIndex, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeDockerManifest}, ", "))
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	creds, haveCreds, err := c.credentials(ir.Registry)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error sending request: %s", err)
+	}
+
+	// Registries challenge anonymous requests, authenticate as instructed and retry once
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		req, err = newRequest()
+		if err != nil {
+			return nil, "", "", err
+		}
+
+		scheme, params := parseAuthChallenge(challenge)
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			token, err := c.fetchToken(params, ir.Repository, creds, haveCreds)
+			if err != nil {
+				return nil, "", "", err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		case "basic":
+			if !haveCreds {
+				return nil, "", "", fmt.Errorf("registry %s requires credentials", ir.Registry)
+			}
+			req.SetBasicAuth(creds.Username, creds.Password)
+		default:
+			return nil, "", "", fmt.Errorf("unsupported registry authentication scheme: %s", scheme)
+		}
+
+		resp, err = c.client.Do(req)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("error sending request: %s", err)
+		}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error reading response: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("registry responded with %s for %s/%s:%s", resp.Status, ir.Registry, ir.Repository, ir.Reference)
+	}
+
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if mediaType == "" || mediaType == "application/json" {
+		var m struct {
+			MediaType string `json:"mediaType"`
+		}
+		_ = json.Unmarshal(body, &m)
+		mediaType = m.MediaType
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		sum := sha256.Sum256(body)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	return body, mediaType, digest, nil
+}
+
+// Get a bearer token from the realm provided in the authentication challenge
+func (c *RegistryController) fetchToken(params map[string]string, repository string, creds registryAuth, haveCreds bool) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("authentication challenge missing realm")
+	}
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid authentication realm: %s", realm)
+	}
+	q := u.Query()
+	if s, ok := params["service"]; ok {
+		q.Set("service", s)
+	}
+	scope, ok := params["scope"]
+	if !ok {
+		scope = fmt.Sprintf("repository:%s:pull", repository)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if haveCreds {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting registry token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token request responded with %s", resp.Status)
+	}
+
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("error parsing registry token: %s", err)
+	}
+	if tr.Token != "" {
+		return tr.Token, nil
+	}
+	if tr.AccessToken != "" {
+		return tr.AccessToken, nil
+	}
+	return "", fmt.Errorf("registry token response did not include a token")
+}
+
+// Parse a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key = strings.TrimSpace(key); key != "" {
+			params[strings.ToLower(key)] = value
+		}
+	}
+	return scheme, params
+}
+
+// Select the digest of the manifest matching the platform from an image index
+func selectPlatformDigest(index []byte, platform string) (string, error) {
+	var idx struct {
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				Architecture string `json:"architecture"`
+				OS           string `json:"os"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(index, &idx); err != nil {
+		return "", fmt.Errorf("error parsing image index: %s", err)
+	}
+
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 {
+		return "", fmt.Errorf("invalid platform %s, expected os/arch[/variant]", platform)
+	}
+	wantOS, wantArch := parts[0], parts[1]
+	var variant string
+	if len(parts) > 2 {
+		variant = parts[2]
+	}
+
+	for _, m := range idx.Manifests {
+		if m.Platform.OS != wantOS || m.Platform.Architecture != wantArch {
+			continue
+		}
+		if variant != "" && m.Platform.Variant != "" && m.Platform.Variant != variant {
+			continue
+		}
+		return m.Digest, nil
+	}
+	return "", fmt.Errorf("no manifest found for platform %s", platform)
+}
@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	cases := map[string]ImageReference{
+		"ubuntu":                        {dockerHubRegistry, "library/ubuntu", "latest"},
+		"ubuntu:22.04":                  {dockerHubRegistry, "library/ubuntu", "22.04"},
+		"library/ubuntu:22.04":          {dockerHubRegistry, "library/ubuntu", "22.04"},
+		"docker.io/ubuntu":              {dockerHubRegistry, "library/ubuntu", "latest"},
+		"index.docker.io/org/img:1.0":   {dockerHubRegistry, "org/img", "1.0"},
+		"org/img":                       {dockerHubRegistry, "org/img", "latest"},
+		"ghcr.io/org/img:v1":            {"ghcr.io", "org/img", "v1"},
+		"localhost/img":                 {"localhost", "img", "latest"},
+		"localhost:5000/org/img":        {"localhost:5000", "org/img", "latest"},
+		"registry.local:5000/img:2.1":   {"registry.local:5000", "img", "2.1"},
+		"ghcr.io/org/img@sha256:abc123": {"ghcr.io", "org/img", "sha256:abc123"},
+		"ubuntu@sha256:abc123":          {dockerHubRegistry, "library/ubuntu", "sha256:abc123"},
+	}
+	for image, want := range cases {
+		got, err := ParseImageReference(image)
+		if err != nil || got != want {
+			t.Errorf("ParseImageReference(%s) = %+v, %v, want %+v", image, got, err, want)
+		}
+	}
+
+	for _, image := range []string{"", "ubuntu:", "ghcr.io/", "ubuntu@"} {
+		if ir, err := ParseImageReference(image); err == nil {
+			t.Errorf("ParseImageReference(%q) = %+v, want error", image, ir)
+		}
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull,push"`)
+	want := map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/ubuntu:pull,push"}
+	if scheme != "Bearer" || !reflect.DeepEqual(params, want) {
+		t.Errorf("bearer challenge parsed as %s %v", scheme, params)
+	}
+
+	scheme, params = parseAuthChallenge(`Basic Realm=registry, charset="UTF-8"`)
+	want = map[string]string{"realm": "registry", "charset": "UTF-8"}
+	if scheme != "Basic" || !reflect.DeepEqual(params, want) {
+		t.Errorf("basic challenge parsed as %s %v", scheme, params)
+	}
+}
+
+const testIndex = `{
+	"mediaType": "application/vnd.oci.image.index.v1+json",
+	"manifests": [
+		{"digest": "sha256:amd64", "platform": {"os": "linux", "architecture": "amd64"}},
+		{"digest": "sha256:armv6", "platform": {"os": "linux", "architecture": "arm", "variant": "v6"}},
+		{"digest": "sha256:armv7", "platform": {"os": "linux", "architecture": "arm", "variant": "v7"}},
+		{"digest": "sha256:arm64", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}}
+	]
+}`
+
+func TestSelectPlatformDigest(t *testing.T) {
+	cases := map[string]string{
+		"linux/amd64":    "sha256:amd64",
+		"linux/arm/v7":   "sha256:armv7",
+		"linux/arm/v6":   "sha256:armv6",
+		"linux/arm64/v8": "sha256:arm64",
+		// variants missing from the platform or the index match any variant
+		"linux/arm64":    "sha256:arm64",
+		"linux/amd64/v3": "sha256:amd64",
+	}
+	for platform, want := range cases {
+		if got, err := selectPlatformDigest([]byte(testIndex), platform); err != nil || got != want {
+			t.Errorf("selectPlatformDigest(%s) = %s, %v, want %s", platform, got, err, want)
+		}
+	}
+
+	for _, platform := range []string{"windows/amd64", "linux/arm/v5", "linux/386", "linux"} {
+		if got, err := selectPlatformDigest([]byte(testIndex), platform); err == nil {
+			t.Errorf("selectPlatformDigest(%s) = %s, want error", platform, got)
+		}
+	}
+	if _, err := selectPlatformDigest([]byte("not json"), "linux/amd64"); err == nil {
+		t.Error("invalid index parsed")
+	}
+}
+
+// Registry serving manifests with anonymous, bearer and basic access
+func newTestRegistry(t *testing.T) (*httptest.Server, *int) {
+	t.Helper()
+	tokenRequests := 0
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+
+	single := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	mux.HandleFunc("/v2/org/multi/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mediaTypeOCIIndex)
+		fmt.Fprint(w, testIndex)
+	})
+	mux.HandleFunc("/v2/org/single/manifests/1.0", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), mediaTypeOCIManifest) {
+			http.Error(w, "manifest type not accepted", http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		w.Header().Set("Docker-Content-Digest", "sha256:single")
+		fmt.Fprint(w, single)
+	})
+	// media type only in the body and no digest header
+	mux.HandleFunc("/v2/org/plain/manifests/1.0", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, single)
+	})
+	mux.HandleFunc("/v2/org/bearer/manifests/1.0", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer pull-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="repository:org/bearer:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", mediaTypeDockerManifestList)
+		fmt.Fprint(w, testIndex)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		user, pass, ok := r.BasicAuth()
+		q := r.URL.Query()
+		if !ok || user != "user" || pass != "secret" || q.Get("service") != "test-registry" || q.Get("scope") != "repository:org/bearer:pull" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "pull-token"})
+	})
+	mux.HandleFunc("/v2/org/basic/manifests/1.0", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", mediaTypeDockerManifest)
+		w.Header().Set("Docker-Content-Digest", "sha256:basic")
+		fmt.Fprint(w, single)
+	})
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &tokenRequests
+}
+
+func newTestRegistryController(t *testing.T, host, auth string) *RegistryController {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.json")
+	cfg := `{"auths": {}}`
+	if auth != "" {
+		cfg = fmt.Sprintf(`{"auths": {"http://%s": {"auth": "%s"}}}`, host, base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := os.WriteFile(file, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REGISTRY_AUTH_FILE", file)
+	c, err := NewRegistryController()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRegistryResolveDigest(t *testing.T) {
+	srv, tokenRequests := newTestRegistry(t)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	c := newTestRegistryController(t, host, "user:secret")
+
+	sum := sha256.Sum256([]byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`))
+	cases := []struct {
+		image, platform, want string
+	}{
+		{host + "/org/multi", "linux/arm/v7", "sha256:armv7"},
+		{host + "/org/single:1.0", "linux/arm64", "sha256:single"},
+		{host + "/org/plain:1.0", "linux/amd64", "sha256:" + hex.EncodeToString(sum[:])},
+		{host + "/org/bearer:1.0", "linux/amd64", "sha256:amd64"},
+		{host + "/org/basic:1.0", "linux/amd64", "sha256:basic"},
+	}
+	for _, tc := range cases {
+		got, err := c.ResolveDigest(tc.image, tc.platform)
+		if err != nil || got != tc.want {
+			t.Errorf("ResolveDigest(%s, %s) = %s, %v, want %s", tc.image, tc.platform, got, err, tc.want)
+		}
+	}
+	if *tokenRequests != 1 {
+		t.Errorf("%d token requests, want 1", *tokenRequests)
+	}
+
+	if _, err := c.ResolveDigest(host+"/org/multi", "windows/amd64"); err == nil {
+		t.Error("index without the platform resolved")
+	}
+	if _, err := c.ResolveDigest(host+"/org/missing:1.0", "linux/amd64"); err == nil {
+		t.Error("missing manifest resolved")
+	}
+
+	// without credentials the token is refused and basic auth is not attempted
+	anonymous := newTestRegistryController(t, host, "")
+	for _, image := range []string{host + "/org/bearer:1.0", host + "/org/basic:1.0"} {
+		if _, err := anonymous.ResolveDigest(image, "linux/amd64"); err == nil {
+			t.Errorf("%s resolved without credentials", image)
+		}
+	}
+	// wrong credentials
+	wrong := newTestRegistryController(t, host, "user:wrong")
+	if _, err := wrong.ResolveDigest(host+"/org/basic:1.0", "linux/amd64"); err == nil {
+		t.Error("basic auth accepted wrong credentials")
+	}
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"app/auth"
+	"app/jobs"
+	"app/utils"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// createAPIKeyRequest describes a key to create, Expires is optional.
+// Admins can create keys for another owner.
+type createAPIKeyRequest struct {
+	Name    string     `json:"name"`
+	Owner   string     `json:"owner"`
+	Scopes  []string   `json:"scopes"`
+	Expires *time.Time `json:"expires"`
+}
+
+// createAPIKeyResponse holds the token of a new key, it is not shown again
+type createAPIKeyResponse struct {
+	Token string      `json:"token"`
+	Key   jobs.APIKey `json:"key"`
+}
+
+// CreateAPIKeyHandler godoc
+// @Summary Create API Key
+// @Description Create a long lived token with scopes admin, jobs:read and execute:<processID>. Users can only grant scopes they hold themselves. The token is returned once and only its hash is stored.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Success 201 {object} createAPIKeyResponse
+// @Router /auth/keys [post]
+// Does not produce HTML
+func (rh *RESTHandler) CreateAPIKeyHandler(c echo.Context) error {
+	var req createAPIKeyRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{Message: "Invalid request body"})
+	}
+	if req.Name == "" {
+		return c.JSON(http.StatusBadRequest, errResponse{Message: "'name' is required"})
+	}
+	if err := auth.ValidateScopes(req.Scopes); err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{Message: err.Error()})
+	}
+	if req.Expires != nil && !req.Expires.After(time.Now()) {
+		return c.JSON(http.StatusBadRequest, errResponse{Message: "'expires' must be in the future"})
+	}
+	if req.Scopes == nil {
+		req.Scopes = []string{}
+	}
+
+	email := c.Request().Header.Get("X-ProcessAPI-User-Email")
+	owner := req.Owner
+	if owner == "" {
+		owner = email
+	}
+	if owner == "" {
+		return c.JSON(http.StatusBadRequest, errResponse{Message: "X-ProcessAPI-User-Email header or 'owner' is required"})
+	}
+
+	if rh.Config.AuthLevel > 0 {
+		roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
+
+		// non-admins can only create keys for themselves with scopes they hold
+		if !rh.isAdmin(c) {
+			if owner != email {
+				return c.JSON(http.StatusForbidden, errResponse{Message: "Forbidden"})
+			}
+			for _, s := range req.Scopes {
+				if s == auth.ScopeAdmin || (strings.HasPrefix(s, auth.ScopeExecute) && !utils.StringInSlice(strings.TrimPrefix(s, auth.ScopeExecute), roles)) {
+					return c.JSON(http.StatusForbidden, errResponse{Message: "Forbidden to grant scope " + s})
+				}
+			}
+		}
+	}
+
+	token, k, err := auth.NewAPIKey(owner, req.Name, req.Scopes, req.Expires)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
+	}
+	if err := rh.DB.AddAPIKey(k); err != nil {
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to store API key"})
+	}
+	rh.audit(c, jobs.AuditAPIKeyCreate, k.ID, fmt.Sprintf("key %s for %s with scopes %s", k.Name, k.Owner, strings.Join(k.Scopes, ",")), "", "")
+
+	return c.JSON(http.StatusCreated, createAPIKeyResponse{Token: token, Key: k})
+}
+
+// ListAPIKeysHandler godoc
+// @Summary List API Keys
+// @Description API keys including revoked and expired keys, ordered by creation time. Non admin users only see their own keys.
+// @Tags auth
+// @Param owner query string false "owner of the keys, admins only"
+// @Produce json
+// @Success 200 {array} jobs.APIKey
+// @Router /auth/keys [get]
+// Does not produce HTML
+func (rh *RESTHandler) ListAPIKeysHandler(c echo.Context) error {
+	owner := c.QueryParam("owner")
+
+	if rh.Config.AuthLevel > 0 {
+		// non admins can only see their own keys
+		if !rh.isAdmin(c) {
+			owner = c.Request().Header.Get("X-ProcessAPI-User-Email")
+		}
+	}
+
+	keys, err := rh.DB.GetAPIKeys(owner)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+// RevokeAPIKeyHandler godoc
+// @Summary Revoke API Key
+// @Description Revoke an API key, it can not authenticate requests afterwards. Non admin users can only revoke their own keys.
+// @Tags auth
+// @Param keyID path string true "API key id"
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Router /auth/keys/{keyID} [delete]
+// Does not produce HTML
+func (rh *RESTHandler) RevokeAPIKeyHandler(c echo.Context) error {
+	owner := ""
+
+	if rh.Config.AuthLevel > 0 {
+		// non admins can only revoke their own keys
+		if !rh.isAdmin(c) {
+			owner = c.Request().Header.Get("X-ProcessAPI-User-Email")
+		}
+	}
+
+	revoked, err := rh.DB.RevokeAPIKey(c.Param("keyID"), owner, time.Now())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to revoke API key"})
+	}
+	if !revoked {
+		return c.JSON(http.StatusNotFound, errResponse{Message: "API key does not exist or is already revoked"})
+	}
+	rh.audit(c, jobs.AuditAPIKeyRevoke, c.Param("keyID"), "", "", "")
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "API key revoked successfully"})
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"app/jobs"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// ExportJobsHandler godoc
+// @Summary Export Jobs
+// @Description Download an archive (tar.gz) of finished jobs with their history and usage, and optionally their logs, metadata and results. Admin only.
+// @Tags admin
+// @Param processID query string false "comma separated list of process ids"
+// @Param createdAfter query string false "RFC3339 time, inclusive"
+// @Param createdBefore query string false "RFC3339 time, exclusive"
+// @Param include query string false "comma separated list of logs, metadata, results"
+// @Produce application/gzip
+// @Success 200 {file} file
+// @Router /admin/jobs/export [get]
+// Does not produce HTML
+func (rh *RESTHandler) ExportJobsHandler(c echo.Context) error {
+	var opts jobs.ExportOptions
+	if p := c.QueryParam("processID"); p != "" {
+		opts.ProcessIDs = strings.Split(p, ",")
+	}
+
+	var err error
+	for _, f := range []struct {
+		param  string
+		target *time.Time
+	}{
+		{"createdAfter", &opts.CreatedAfter},
+		{"createdBefore", &opts.CreatedBefore},
+	} {
+		if v := c.QueryParam(f.param); v != "" {
+			*f.target, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, errResponse{Message: fmt.Sprintf("'%s' must be an RFC3339 time", f.param)})
+			}
+		}
+	}
+
+	if include := c.QueryParam("include"); include != "" {
+		for _, i := range strings.Split(include, ",") {
+			switch i {
+			case "logs":
+				opts.Logs = true
+			case "metadata":
+				opts.Metadata = true
+			case "results":
+				opts.Results = true
+			default:
+				return c.JSON(http.StatusBadRequest, errResponse{Message: fmt.Sprintf("'include' must be a list of logs, metadata or results, found '%s'", i)})
+			}
+		}
+	}
+
+	name := fmt.Sprintf("jobs-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	c.Response().Header().Set(echo.HeaderContentType, "application/gzip")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+
+	// nothing is written to the response until all job records are read
+	n, err := jobs.ExportJobs(rh.DB, rh.StorageSvc, c.Response(), opts)
+	if err != nil {
+		if !c.Response().Committed {
+			c.Response().Header().Del(echo.HeaderContentDisposition)
+			return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
+		}
+		log.Errorf("job export failed after the response started, archive is incomplete: %s", err.Error())
+		return nil
+	}
+	log.Infof("exported %d jobs", n)
+	return nil
+}
+
+// ImportJobsHandler godoc
+// @Summary Import Jobs
+// @Description Restore jobs and their logs and metadata from an archive created by /admin/jobs/export. Jobs that already exist are skipped with their logs and metadata. Admin only.
+// @Tags admin
+// @Accept application/gzip
+// @Produce json
+// @Success 200 {object} jobs.ImportResult
+// @Router /admin/jobs/import [post]
+// Does not produce HTML
+func (rh *RESTHandler) ImportJobsHandler(c echo.Context) error {
+	res, err := jobs.ImportJobs(rh.DB, rh.StorageSvc, c.Request().Body)
+	if err != nil {
+		// jobs imported before the error are kept, importing the archive again skips them and writes their storage objects
+		status := http.StatusInternalServerError
+		if errors.Is(err, jobs.ErrInvalidArchive) {
+			status = http.StatusBadRequest
+		}
+		return c.JSON(status, errResponse{Message: fmt.Sprintf("%s (imported %d jobs before the error)", err.Error(), res.Imported)})
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"app/jobs"
+	"app/processes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Auth failures of a client IP are recorded at most once per interval, so that a client retrying with
+// a bad token does not write an entry per request. The failures in between are counted in a later entry.
+const authFailureAuditInterval = time.Minute
+
+// Record an action of the caller in the audit log
+func (rh *RESTHandler) audit(c echo.Context, action, resource, message, before, after string) {
+	rh.Audit.Record(auditEntry(c, c.Request().Header.Get("X-ProcessAPI-User-Email"), action, resource, message, before, after))
+}
+
+// Audit entry of an action of the user in the request
+func auditEntry(c echo.Context, user, action, resource, message, before, after string) jobs.AuditEntry {
+	requestID := c.Response().Header().Get(echo.HeaderXRequestID)
+	if requestID == "" {
+		requestID = c.Request().Header.Get(echo.HeaderXRequestID)
+	}
+
+	return jobs.AuditEntry{
+		Time:      time.Now(),
+		Action:    action,
+		User:      user,
+		IP:        c.RealIP(),
+		RequestID: requestID,
+		Resource:  resource,
+		Message:   message,
+		Before:    before,
+		After:     after,
+	}
+}
+
+// Process definition as recorded in the audit log
+func processYAML(p processes.Process) string {
+	b, err := yaml.Marshal(p)
+	if err != nil {
+		log.Errorf("could not encode process %s for the audit log: %s", p.Info.ID, err.Error())
+		return ""
+	}
+	return string(b)
+}
+
+// AuditAuthFailures records requests that were rejected as unauthenticated or forbidden,
+// by the auth middleware or by handlers. The user is the one claimed by the request, it may not be verified.
+// Failures are sampled per client IP, see authFailureAuditInterval.
+func (rh *RESTHandler) AuditAuthFailures(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+
+		if status := c.Response().Status; status == http.StatusUnauthorized || status == http.StatusForbidden {
+			resource := c.Request().Method + " " + c.Request().URL.Path
+			e := auditEntry(c, c.Request().Header.Get("X-ProcessAPI-User-Email"), jobs.AuditAuthFailure, resource, fmt.Sprintf("%d %s", status, http.StatusText(status)), "", "")
+			rh.Audit.RecordSampled(c.RealIP(), e, authFailureAuditInterval)
+		}
+		return err
+	}
+}
+
+// AuditLogHandler godoc
+// @Summary Audit Log
+// @Description Administrative and security relevant actions, newest first: process changes with the process definitions before and after, job dismissals, status callbacks, API key changes and rejected requests.
+// @Tags admin
+// @Produce json
+// @Param action query string false "comma separated list of actions, such as process.update or auth.failure"
+// @Param user query string false "comma separated list of user emails"
+// @Param resource query string false "process id, job id or API key id"
+// @Param from query string false "RFC3339 time, inclusive"
+// @Param to query string false "RFC3339 time, exclusive"
+// @Param limit query int false "page size, max 100"
+// @Param before query int false "only entries older than this id, from the next link of the previous page"
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/audit [get]
+// Does not produce HTML
+func (rh *RESTHandler) AuditLogHandler(c echo.Context) error {
+	q := jobs.AuditQuery{Resource: c.QueryParam("resource")}
+
+	if v := c.QueryParam("action"); v != "" {
+		q.Actions = strings.Split(v, ",")
+	}
+	if v := c.QueryParam("user"); v != "" {
+		q.Users = strings.Split(v, ",")
+	}
+
+	for p, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		v := c.QueryParam(p)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, errResponse{Message: p + " must be a RFC3339 time"})
+		}
+		*t = parsed
+	}
+
+	if v := c.QueryParam("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before < 1 {
+			return c.JSON(http.StatusBadRequest, errResponse{Message: "before must be a positive entry id"})
+		}
+		q.BeforeID = before
+	}
+
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit > 100 || limit < 1 {
+		limit = 20
+	}
+	q.Limit = limit
+
+	entries, err := rh.DB.GetAuditEntries(q)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
+	}
+
+	links := make([]link, 0)
+	if len(entries) == limit {
+		// links repeat all filters of the request
+		params := url.Values{}
+		for _, p := range []string{"action", "user", "resource", "from", "to"} {
+			if v := c.QueryParam(p); v != "" {
+				params.Set(p, v)
+			}
+		}
+		params.Set("limit", strconv.Itoa(limit))
+		params.Set("before", strconv.FormatInt(entries[len(entries)-1].ID, 10))
+		links = append(links, link{Href: "/admin/audit?" + params.Encode(), Title: "next"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"links":   links,
+	})
+}
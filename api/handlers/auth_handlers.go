@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"app/auth"
+	"app/jobs"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// whoAmIResponse is the caller as seen by the server and what the policy allows it to do
+type whoAmIResponse struct {
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+	// Process ids or glob patterns each action is granted on, "*" is all processes
+	Permissions map[string][]string `json:"permissions"`
+}
+
+// WhoAmIHandler godoc
+// @Summary Effective Permissions
+// @Description Email and roles of the caller and the processes each action of the policy is granted on.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} whoAmIResponse
+// @Router /auth/whoami [get]
+// Does not produce HTML
+func (rh *RESTHandler) WhoAmIHandler(c echo.Context) error {
+	roles := []string{}
+	for _, r := range strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",") {
+		if r != "" {
+			roles = append(roles, r)
+		}
+	}
+
+	processIDs := []string{}
+	for _, info := range rh.ProcessList.Infos() {
+		processIDs = append(processIDs, info.ID)
+	}
+
+	return c.JSON(http.StatusOK, whoAmIResponse{
+		Email:       c.Request().Header.Get("X-ProcessAPI-User-Email"),
+		Roles:       roles,
+		Permissions: rh.Policy.Permissions(roles, processIDs),
+	})
+}
+
+// Viewer restricting the jobs the caller can read, nil if the caller can read all jobs
+// because auth is disabled or the caller is an admin.
+func (rh *RESTHandler) jobViewer(c echo.Context) *jobs.JobViewer {
+	if rh.Config.AuthLevel == 0 {
+		return nil
+	}
+
+	if rh.isAdmin(c) {
+		return nil
+	}
+	roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
+	return &jobs.JobViewer{Email: c.Request().Header.Get("X-ProcessAPI-User-Email"), Groups: roles}
+}
+
+// Check if the policy grants the admin action to the caller, admins can act on jobs and keys of other users
+func (rh *RESTHandler) isAdmin(c echo.Context) bool {
+	roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
+	return rh.Policy.Allowed(roles, auth.ActionAdmin, "")
+}
+
+// Check that the caller can read the job, submitters, members of the job group and admins can.
+// Jobs that do not exist are left to the handlers to report.
+func (rh *RESTHandler) checkJobAccess(c echo.Context, jobID string) *errResponse {
+	v := rh.jobViewer(c)
+	if v == nil {
+		return nil
+	}
+
+	jRcrd, ok, err := rh.DB.GetJob(jobID)
+	if err != nil {
+		return &errResponse{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
+	}
+	if ok && !v.CanRead(jRcrd) {
+		return &errResponse{HTTPStatus: http.StatusForbidden, Message: "Forbidden"}
+	}
+	return nil
+}
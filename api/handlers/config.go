@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"app/auth"
 	"app/jobs"
 	pr "app/processes"
 	"encoding/json"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -19,6 +21,9 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Longest time a job can run if JOB_MAX_RUNTIME is not set, its callback token expires afterwards
+const defaultJobMaxRuntime = 7 * 24 * time.Hour
+
 // Store for templates and a receiver function to render them
 type Template struct {
 	templates *template.Template
@@ -54,8 +59,22 @@ type RESTHandler struct {
 	DB           jobs.Database
 	MessageQueue *jobs.MessageQueue
 	ActiveJobs   *jobs.ActiveJobs
-	ProcessList  *pr.ProcessList
-	Config       *Config
+	Coordinator  *jobs.Coordinator
+	Quotas       *jobs.Quotas
+	// Execution requests of each caller, nil if not limited
+	RateLimits *jobs.RateLimits
+	// Actions granted to roles, enforced by the auth middleware
+	Policy *auth.Policy
+	// Tokens that containers use to post callbacks for their job
+	CallbackTokens *auth.CallbackTokens
+	// Administrative and security relevant actions
+	Audit *jobs.AuditLog
+	// Secrets referenced in the env vars of processes, nil if not configured
+	Secrets     jobs.SecretProvider
+	ProcessList *pr.ProcessList
+	// Imports process files of PLUGINS_DIR when they change
+	Plugins *pr.PluginsWatcher
+	Config  *Config
 }
 
 // Pretty print a JSON
@@ -111,6 +130,7 @@ func NewRESTHander() *RESTHandler {
 		"prettyPrint": prettyPrint, // to pretty print JSONs for results and metadata
 		"lower":       strings.ToLower,
 		"upper":       strings.ToUpper,
+		"percent":     func(v float64) float64 { return v * 100 },
 	}
 
 	config.T = Template{
@@ -148,17 +168,94 @@ func NewRESTHander() *RESTHandler {
 		JobDone:    make(chan jobs.Job, 1),
 	}
 
-	// Create local logs directory if not exist
+	// Share ownership of active jobs with other instances using the same database
+	config.Coordinator, err = jobs.NewCoordinator(db, &ac, config.MessageQueue, stSvc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("instance id: %s", config.Coordinator.InstanceID)
+
+	// Quotas are not enforced if QUOTAS_FILE is not set
+	config.Quotas, err = jobs.LoadQuotas(os.Getenv("QUOTAS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Execution requests are not rate limited if RATE_LIMITS_FILE is not set
+	config.RateLimits, err = jobs.LoadRateLimits(os.Getenv("RATE_LIMITS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Policy grants the same permissions as before policy files if AUTH_POLICY_FILE is not set
+	config.Policy, err = auth.LoadPolicy(os.Getenv("AUTH_POLICY_FILE"), config.Config.AdminRoleName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Callback tokens expire once the job can no longer be running
+	maxRuntime := defaultJobMaxRuntime
+	if v := os.Getenv("JOB_MAX_RUNTIME"); v != "" {
+		maxRuntime, err = time.ParseDuration(v)
+		if err != nil || maxRuntime <= 0 {
+			log.Fatalf("invalid JOB_MAX_RUNTIME %s, expected a positive duration such as 48h", v)
+		}
+	}
+
+	// Callback tokens are only verified when auth is enabled, AUTH_CALLBACK_SECRET is then required, see initAuth
+	config.CallbackTokens, err = auth.NewCallbackTokens(os.Getenv("AUTH_CALLBACK_SECRET"), maxRuntime)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Audit entries are only kept in the database if AUDIT_LOG_FILE is not set
+	config.Audit, err = jobs.NewAuditLog(db, os.Getenv("AUDIT_LOG_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Processes can only reference secrets if SECRETS_PROVIDER is set
+	config.Secrets, err = jobs.NewSecretProvider(os.Getenv("SECRETS_PROVIDER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Import process files into the database, processes are then served from the database
 	pluginsDir := os.Getenv("PLUGINS_DIR") // We already know this env variable exist because it is being checked in plguinsInit function
-	processList, err := pr.LoadProcesses(pluginsDir)
+	config.Plugins = pr.NewPluginsWatcher(db, pluginsDir, nil)
+	_, err = config.Plugins.Import()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config.ProcessList = &pr.ProcessList{}
+	err = config.ProcessList.Load(db)
 	if err != nil {
 		log.Fatal(err)
 	}
-	config.ProcessList = &processList
+	// Files changed later are imported by the watcher, see PluginsWatchRoutine
+	config.Plugins.OnImport = config.reloadProcesses
 
 	return &config
 }
 
+// This routine reloads processes whenever they are changed by this or any other instance.
+func (rh *RESTHandler) ProcessSyncRoutine() {
+	for range rh.DB.ProcessChanges() {
+		if err := rh.ProcessList.Load(rh.DB); err != nil {
+			log.Errorf("could not reload processes: %s", err.Error())
+		}
+	}
+}
+
+// This routine imports process files when they change until stop is closed.
+// Files are still imported at startup if the directory can not be watched.
+func (rh *RESTHandler) PluginsWatchRoutine(stop <-chan struct{}) {
+	if err := rh.Plugins.Watch(stop); err != nil {
+		log.Errorf("could not watch plugins directory, changes are only imported at startup: %s", err.Error())
+	}
+}
+
 // This routine sequentially updates status.
 // So that order of status updates received is preserved.
 func (rh *RESTHandler) StatusUpdateRoutine() {
@@ -172,6 +269,9 @@ func (rh *RESTHandler) JobCompletionRoutine() {
 	for {
 		j := <-rh.MessageQueue.JobDone
 		rh.ActiveJobs.Remove(&j)
+		if err := rh.Coordinator.Release(j); err != nil {
+			log.Errorf("could not release lease of job %s: %s", j.JobID(), err.Error())
+		}
 	}
 }
 
@@ -8,12 +8,18 @@ package handlers
 // These rules are in compliance with Specs
 
 import (
+	"app/auth"
 	"app/jobs"
+	"app/processes"
 	"app/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -96,8 +102,13 @@ func prepareResponse(c echo.Context, httpStatus int, renderName string, output i
 // runRequestBody provides the required inputs for containerized processes
 // specs: https://developer.ogc.org/api/processes/index.html#tag/Execute
 type runRequestBody struct {
-	Inputs  map[string]interface{} `json:"inputs"`
-	EnvVars map[string]string      `json:"environmentVariables"`
+	Inputs map[string]interface{} `json:"inputs"`
+	// Values of env vars listed in envOverrides of the process
+	EnvVars map[string]string `json:"environmentVariables"`
+	// Exact version or semantic version constraint of the process to execute, defaults to the current version
+	Version string `json:"version"`
+	// Role of the submitter to share the job with, members of the role can read the job
+	Group string `json:"group"`
 }
 
 // LandingPage godoc
@@ -148,8 +159,9 @@ func (rh *RESTHandler) Conformance(c echo.Context) error {
 // @Accept json
 // @Produce json
 // @Param processID path string true "pyecho"
-// @Param inputs body string true "example: {inputs: {text:Hello World!}} (add double quotes for all strings in the payload)"
+// @Param inputs body string true "example: {inputs: {text:Hello World!}, version: ^8.15, group: team-a} (add double quotes for all strings in the payload, version and group are optional)"
 // @Success 200 {object} jobResponse
+// @Failure 429 {object} errResponse "quota of the submitter or rate limit exceeded"
 // @Router /processes/{processID}/execution [post]
 // Does not produce HTML
 func (rh *RESTHandler) Execution(c echo.Context) error {
@@ -164,15 +176,6 @@ func (rh *RESTHandler) Execution(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, errResponse{Message: "'processID' incorrect"})
 	}
 
-	if rh.Config.AuthLevel > 0 {
-		roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
-
-		// admins are allowed to execute all processes, else you need to have a role with same name as processId
-		if !utils.StringInSlice(rh.Config.AdminRoleName, roles) && !utils.StringInSlice(processID, roles) {
-			return c.JSON(http.StatusForbidden, errResponse{Message: "Forbidden"})
-		}
-	}
-
 	var params runRequestBody
 	err = c.Bind(&params)
 	if err != nil {
@@ -183,11 +186,38 @@ func (rh *RESTHandler) Execution(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, errResponse{Message: "'inputs' is required in the body of the request"})
 	}
 
+	if params.Version != "" {
+		p, err = processes.ResolveVersion(rh.DB, processID, params.Version)
+		if err != nil {
+			if errors.Is(err, processes.ErrVersionNotFound) {
+				return c.JSON(http.StatusNotFound, errResponse{Message: fmt.Sprintf("no version of %s satisfies '%s'", processID, params.Version)})
+			}
+			return c.JSON(http.StatusBadRequest, errResponse{Message: err.Error()})
+		}
+	}
+
 	err = p.VerifyInputs(params.Inputs)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, errResponse{Message: err.Error()})
 	}
 
+	envOverrides, err := p.VerifyEnvOverrides(params.EnvVars)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{Message: err.Error()})
+	}
+
+	// Only valid requests take a token, so that mistakes of a caller do not lock it out.
+	// The user header is set by the client when auth is disabled, callers are then limited by IP.
+	user := ""
+	if rh.Config.AuthLevel > 0 {
+		user = c.Request().Header.Get("X-ProcessAPI-User-Email")
+	}
+	apiKeyID, _ := c.Get(auth.APIKeyContextKey).(string)
+	if ok, wait := rh.RateLimits.Allow(user, apiKeyID, c.RealIP(), processID, time.Now()); !ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return c.JSON(http.StatusTooManyRequests, errResponse{Message: fmt.Sprintf("rate limit exceeded, retry in %s", wait.Round(time.Second))})
+	}
+
 	jsonParams, err := json.Marshal(params.Inputs)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
@@ -203,6 +233,11 @@ func (rh *RESTHandler) Execution(c echo.Context) error {
 	mode := p.Info.JobControlOptions[0]
 	host := p.Host.Type
 
+	outputs := make([]jobs.OutputDef, len(p.Outputs))
+	for i, o := range p.Outputs {
+		outputs[i] = jobs.OutputDef{ID: o.ID, InputID: o.InputID}
+	}
+
 	// ----------- Process related setup is complete at this point ---------
 
 	jobID := uuid.New().String()
@@ -215,6 +250,31 @@ func (rh *RESTHandler) Execution(c echo.Context) error {
 	// }
 
 	submitter := c.Request().Header.Get("X-ProcessAPI-User-Email")
+
+	if params.Group != "" && rh.Config.AuthLevel > 0 {
+		roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
+
+		if !utils.StringInSlice(params.Group, roles) && !rh.isAdmin(c) {
+			return c.JSON(http.StatusForbidden, errResponse{Message: fmt.Sprintf("Forbidden to share job with group %s", params.Group)})
+		}
+	}
+
+	err = rh.Quotas.Check(rh.DB, submitter, time.Now())
+	if err != nil {
+		var qe *jobs.QuotaExceededError
+		if errors.As(err, &qe) {
+			retryAfter := int(math.Ceil(time.Until(qe.Resets).Seconds()))
+			c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			return c.JSON(http.StatusTooManyRequests, errResponse{Message: qe.Error()})
+		}
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
+	}
+
+	env, err := rh.callbackEnv(jobID, host)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
+	}
+
 	var j jobs.Job
 	switch host {
 	case "local":
@@ -224,9 +284,15 @@ func (rh *RESTHandler) Execution(c echo.Context) error {
 			ProcessVersion: p.Info.Version,
 			Image:          p.Container.Image,
 			Submitter:      submitter,
+			Group:          params.Group,
 			EnvVars:        p.Container.EnvVars,
+			Env:            env,
+			EnvOverrides:   envOverrides,
+			Secrets:        rh.Secrets,
 			Resources:      jobs.Resources(p.Container.Resources),
 			Cmd:            cmd,
+			Inputs:         params.Inputs,
+			Outputs:        outputs,
 			StorageSvc:     rh.StorageSvc,
 			DB:             rh.DB,
 			DoneChan:       rh.MessageQueue.JobDone,
@@ -238,10 +304,15 @@ func (rh *RESTHandler) Execution(c echo.Context) error {
 			ProcessName:    processID,
 			Image:          p.Container.Image,
 			Submitter:      submitter,
+			Group:          params.Group,
 			Cmd:            cmd,
+			Inputs:         params.Inputs,
+			Outputs:        outputs,
 			JobDef:         p.Host.JobDefinition,
 			JobQueue:       p.Host.JobQueue,
 			JobName:        fmt.Sprintf("%s_%s", rh.Name, jobID),
+			EnvVars:        env,
+			EnvOverrides:   envOverrides,
 			ProcessVersion: p.Info.Version,
 			StorageSvc:     rh.StorageSvc,
 			DB:             rh.DB,
@@ -257,6 +328,9 @@ func (rh *RESTHandler) Execution(c echo.Context) error {
 
 	// Add to active jobs
 	rh.ActiveJobs.Add(&j)
+	if err := rh.Coordinator.Acquire(j); err != nil {
+		log.Errorf("could not record ownership of job %s, it will not be taken over if this instance stops: %s", jobID, err.Error())
+	}
 
 	resp := jobResponse{ProcessID: j.ProcessID(), Type: "process", JobID: jobID, Status: j.CurrentStatus()}
 	switch mode {
@@ -295,6 +369,7 @@ func (rh *RESTHandler) Execution(c echo.Context) error {
 // @Accept */*
 // @Produce json
 // @Success 200 {object} jobResponse
+// @Success 202 {object} jobResponse "job is running on another instance, dismiss request sent to it"
 // @Router /jobs/{jobID} [delete]
 // Does not produce HTML
 func (rh *RESTHandler) JobDismissHandler(c echo.Context) error {
@@ -303,9 +378,7 @@ func (rh *RESTHandler) JobDismissHandler(c echo.Context) error {
 	if j, ok := rh.ActiveJobs.Jobs[jobID]; ok {
 
 		if rh.Config.AuthLevel > 0 {
-			roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
-
-			if (*j).SUBMITTER() != c.Request().Header.Get("X-ProcessAPI-User-Email") && !utils.StringInSlice(rh.Config.AdminRoleName, roles) {
+			if (*j).SUBMITTER() != c.Request().Header.Get("X-ProcessAPI-User-Email") && !rh.isAdmin(c) {
 				return c.JSON(http.StatusForbidden, errResponse{Message: "Forbidden"})
 			}
 		}
@@ -314,8 +387,31 @@ func (rh *RESTHandler) JobDismissHandler(c echo.Context) error {
 		if err != nil {
 			return c.JSON(http.StatusBadRequest, errResponse{Message: err.Error()})
 		}
+		rh.audit(c, jobs.AuditJobDismiss, jobID, "", "", "")
 		return c.JSON(http.StatusOK, jobResponse{ProcessID: (*j).ProcessID(), Type: "process", JobID: jobID, Status: (*j).CurrentStatus(), Message: fmt.Sprintf("job %s dismissed", jobID)})
 	}
+
+	// Job may be active on another instance
+	jRcrd, ok, err := rh.DB.GetJob(jobID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
+	}
+	if ok && (jRcrd.Status == jobs.ACCEPTED || jRcrd.Status == jobs.RUNNING) {
+		if rh.Config.AuthLevel > 0 {
+			if jRcrd.Submitter != c.Request().Header.Get("X-ProcessAPI-User-Email") && !rh.isAdmin(c) {
+				return c.JSON(http.StatusForbidden, errResponse{Message: "Forbidden"})
+			}
+		}
+
+		forwarded, err := rh.Coordinator.Forward(jobs.JobCommand{JobID: jobID, Action: jobs.JobCommandDismiss, Time: time.Now(), Source: jobs.EventSourceServer})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
+		}
+		if forwarded {
+			rh.audit(c, jobs.AuditJobDismiss, jobID, "dismiss request sent to the instance running the job", "", "")
+			return c.JSON(http.StatusAccepted, jobResponse{ProcessID: jRcrd.ProcessID, Type: "process", JobID: jobID, Status: jRcrd.Status, Message: fmt.Sprintf("dismiss request for job %s sent to the instance running it", jobID)})
+		}
+	}
 	return c.JSON(http.StatusNotFound, errResponse{Message: fmt.Sprintf("job %s not in the active jobs list", jobID)})
 }
 
@@ -336,6 +432,9 @@ func (rh *RESTHandler) JobStatusHandler(c echo.Context) (err error) {
 
 	var jRcrd jobs.JobRecord
 	jobID := c.Param("jobID")
+	if output := rh.checkJobAccess(c, jobID); output != nil {
+		return prepareResponse(c, output.HTTPStatus, "error", *output)
+	}
 	if job, ok := rh.ActiveJobs.Jobs[jobID]; ok {
 		resp := jobResponse{
 			ProcessID:  (*job).ProcessID(),
@@ -379,6 +478,9 @@ func (rh *RESTHandler) JobResultsHandler(c echo.Context) (err error) {
 
 	var jRcrd jobs.JobRecord
 	jobID := c.Param("jobID")
+	if output := rh.checkJobAccess(c, jobID); output != nil {
+		return prepareResponse(c, output.HTTPStatus, "error", *output)
+	}
 	if job, ok := rh.ActiveJobs.Jobs[jobID]; ok { // ActiveJobs hit
 		output := errResponse{HTTPStatus: http.StatusNotFound, Message: fmt.Sprintf("results not ready, job %s", (*job).CurrentStatus())}
 		return prepareResponse(c, http.StatusNotFound, "error", output)
@@ -403,6 +505,10 @@ func (rh *RESTHandler) JobResultsHandler(c echo.Context) (err error) {
 			output := errResponse{HTTPStatus: http.StatusNotFound, Message: "job Failed or Dismissed. Call logs route for details"}
 			return prepareResponse(c, http.StatusNotFound, "error", output)
 
+		case jobs.ACCEPTED, jobs.RUNNING: // active on another instance
+			output := errResponse{HTTPStatus: http.StatusNotFound, Message: fmt.Sprintf("results not ready, job %s", jRcrd.Status)}
+			return prepareResponse(c, http.StatusNotFound, "error", output)
+
 		default:
 			output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: "job status out of sync in database"}
 			return prepareResponse(c, http.StatusInternalServerError, "error", output)
@@ -421,13 +527,13 @@ func (rh *RESTHandler) JobResultsHandler(c echo.Context) (err error) {
 }
 
 // @Summary Job Metadata
-// @Description Provides metadata associated with a job
+// @Description Provides metadata associated with a job in any terminal status
 // @Tags jobs
 // @Accept */*
 // @Produce json
 // @Param jobID path string true "example: 44d9ca0e-2ca7-4013-907f-a8ccc60da3b4"
 // @Success 200 {object} map[string]interface{}
-// @Router /jobs/{jobID}/results [get]
+// @Router /jobs/{jobID}/metadata [get]
 // Does not produce HTML
 func (rh *RESTHandler) JobMetaDataHandler(c echo.Context) (err error) {
 	err = validateFormat(c)
@@ -438,26 +544,30 @@ func (rh *RESTHandler) JobMetaDataHandler(c echo.Context) (err error) {
 	var jRcrd jobs.JobRecord
 
 	jobID := c.Param("jobID")
+	if output := rh.checkJobAccess(c, jobID); output != nil {
+		return prepareResponse(c, output.HTTPStatus, "error", *output)
+	}
 	if job, ok := rh.ActiveJobs.Jobs[jobID]; ok { // ActiveJobs hit
 		output := errResponse{HTTPStatus: http.StatusNotFound, Message: fmt.Sprintf("metadata not ready, job %s", (*job).CurrentStatus())}
 		return prepareResponse(c, http.StatusNotFound, "error", output)
 
 	} else if jRcrd, ok, err = rh.DB.GetJob(jobID); ok { // db hit
 		switch jRcrd.Status {
-		case jobs.SUCCESSFUL:
+		case jobs.SUCCESSFUL, jobs.FAILED, jobs.DISMISSED:
 			md, err := jobs.FetchMeta(rh.StorageSvc, jobID)
 			if err != nil {
 				if err.Error() == "not found" {
-					output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: "metadata not found"}
-					return prepareResponse(c, http.StatusInternalServerError, "error", output)
+					// jobs that failed before metadata was written for all terminal statuses do not have metadata
+					output := errResponse{HTTPStatus: http.StatusNotFound, Message: "metadata not found"}
+					return prepareResponse(c, http.StatusNotFound, "error", output)
 				}
 				output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
 				return prepareResponse(c, http.StatusInternalServerError, "error", output)
 			}
 			return prepareResponse(c, http.StatusOK, "jobMetadata", md)
 
-		case jobs.FAILED, jobs.DISMISSED:
-			output := errResponse{HTTPStatus: http.StatusNotFound, Message: "job Failed or Dismissed. Metadata only available for successful jobs"}
+		case jobs.ACCEPTED, jobs.RUNNING: // active on another instance
+			output := errResponse{HTTPStatus: http.StatusNotFound, Message: fmt.Sprintf("metadata not ready, job %s", jRcrd.Status)}
 			return prepareResponse(c, http.StatusNotFound, "error", output)
 
 		default:
@@ -477,6 +587,105 @@ func (rh *RESTHandler) JobMetaDataHandler(c echo.Context) (err error) {
 	return prepareResponse(c, http.StatusNotFound, "error", output)
 }
 
+// @Summary Verify Job Metadata
+// @Description Verifies the stored metadata document of a job against its signature
+// @Tags jobs
+// @Accept */*
+// @Produce json
+// @Param jobID path string true "example: 44d9ca0e-2ca7-4013-907f-a8ccc60da3b4"
+// @Success 200 {object} jobs.MetaVerification
+// @Failure 501 {object} errResponse "metadata signing is not configured on the server"
+// @Router /jobs/{jobID}/metadata/verify [get]
+// Does not produce HTML
+func (rh *RESTHandler) JobMetaDataVerifyHandler(c echo.Context) error {
+	jobID := c.Param("jobID")
+	if output := rh.checkJobAccess(c, jobID); output != nil {
+		return prepareResponse(c, output.HTTPStatus, "error", *output)
+	}
+
+	if job, ok := rh.ActiveJobs.Jobs[jobID]; ok { // ActiveJobs hit
+		output := errResponse{HTTPStatus: http.StatusNotFound, Message: fmt.Sprintf("metadata not ready, job %s", (*job).CurrentStatus())}
+		return prepareResponse(c, http.StatusNotFound, "error", output)
+	}
+
+	ok, err := rh.DB.CheckJobExist(jobID)
+	if err != nil {
+		output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
+		return prepareResponse(c, http.StatusInternalServerError, "error", output)
+	}
+	if !ok {
+		output := errResponse{HTTPStatus: http.StatusNotFound, Message: fmt.Sprintf("%s job id not found", jobID)}
+		return prepareResponse(c, http.StatusNotFound, "error", output)
+	}
+
+	mv, err := jobs.VerifyMeta(rh.StorageSvc, jobID)
+	if err != nil {
+		var output errResponse
+		switch {
+		case err.Error() == "not found":
+			output = errResponse{HTTPStatus: http.StatusNotFound, Message: "metadata not found"}
+		case errors.Is(err, jobs.ErrSigningNotConfigured):
+			output = errResponse{HTTPStatus: http.StatusNotImplemented, Message: "metadata signing is not configured on this server, signatures can not be verified"}
+		default:
+			output = errResponse{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
+		}
+		return prepareResponse(c, output.HTTPStatus, "error", output)
+	}
+	return c.JSON(http.StatusOK, mv)
+}
+
+// @Summary Job Status History
+// @Description Status transitions of a job with the time and source of each transition
+// @Tags jobs
+// @Accept */*
+// @Produce json
+// @Param jobID path string true "example: 44d9ca0e-2ca7-4013-907f-a8ccc60da3b4"
+// @Success 200 {object} []jobs.JobEvent
+// @Router /jobs/{jobID}/history [get]
+func (rh *RESTHandler) JobHistoryHandler(c echo.Context) (err error) {
+	jobID := c.Param("jobID")
+
+	err = validateFormat(c)
+	if err != nil {
+		return err
+	}
+
+	if output := rh.checkJobAccess(c, jobID); output != nil {
+		return prepareResponse(c, output.HTTPStatus, "error", *output)
+	}
+
+	var pid, status string
+	var jRcrd jobs.JobRecord
+
+	if job, ok := rh.ActiveJobs.Jobs[jobID]; ok { // ActiveJobs hit
+		pid = (*job).ProcessID()
+		status = (*job).CurrentStatus()
+	} else if jRcrd, ok, err = rh.DB.GetJob(jobID); ok { // db hit
+		pid = jRcrd.ProcessID
+		status = jRcrd.Status
+	} else if err != nil {
+		output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
+		return prepareResponse(c, http.StatusInternalServerError, "error", output)
+	} else { // miss
+		output := errResponse{HTTPStatus: http.StatusNotFound, Message: "jobID not found"}
+		return prepareResponse(c, http.StatusNotFound, "error", output)
+	}
+
+	events, err := rh.DB.GetJobEvents(jobID)
+	if err != nil {
+		output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: "error while fetching history: " + err.Error()}
+		return prepareResponse(c, http.StatusInternalServerError, "error", output)
+	}
+
+	output := map[string]interface{}{
+		"jobID":     jobID,
+		"processID": pid,
+		"status":    status,
+		"events":    events,
+	}
+	return prepareResponse(c, http.StatusOK, "jobHistory", output)
+}
+
 // @Summary Job Logs
 // @Description
 // @Tags jobs
@@ -493,6 +702,10 @@ func (rh *RESTHandler) JobLogsHandler(c echo.Context) (err error) {
 		return err
 	}
 
+	if output := rh.checkJobAccess(c, jobID); output != nil {
+		return prepareResponse(c, output.HTTPStatus, "error", *output)
+	}
+
 	var pid, status string
 	var jRcrd jobs.JobRecord
 
@@ -531,10 +744,20 @@ func (rh *RESTHandler) JobLogsHandler(c echo.Context) (err error) {
 }
 
 // @Summary Summary of all (active) Jobs
-// @Description [Job List Specification](https://docs.ogc.org/is/18-062r2/18-062r2.html#sc_retrieve_job_results)
+// @Description [Job List Specification](https://docs.ogc.org/is/18-062r2/18-062r2.html#sc_retrieve_job_results). Non admin users only see jobs they submitted and jobs shared with one of their roles.
 // @Tags jobs
 // @Accept */*
 // @Produce json
+// @Param processID query string false "comma separated list of process ids"
+// @Param status query string false "comma separated list of statuses"
+// @Param submitter query string false "comma separated list of submitters"
+// @Param updatedAfter query string false "RFC3339 time, inclusive"
+// @Param updatedBefore query string false "RFC3339 time, exclusive"
+// @Param createdAfter query string false "RFC3339 time, inclusive"
+// @Param createdBefore query string false "RFC3339 time, exclusive"
+// @Param sort query string false "one of -updated (default), updated, -created, created"
+// @Param limit query int false "page size, max 100"
+// @Param cursor query string false "cursor from the next link of the previous page"
 // @Success 200 {object} []jobs.JobRecord
 // @Router /jobs [get]
 func (rh *RESTHandler) ListJobsHandler(c echo.Context) error {
@@ -548,6 +771,8 @@ func (rh *RESTHandler) ListJobsHandler(c echo.Context) error {
 	processIDs := c.QueryParam("processID") // assuming comma-separated list: "process1,process2"
 	statuses := c.QueryParam("status")
 	submitters := c.QueryParam("submitter")
+	sort := c.QueryParam("sort")
+	cursor := c.QueryParam("cursor")
 
 	var processIDList []string
 	if processIDs != "" {
@@ -568,12 +793,23 @@ func (rh *RESTHandler) ListJobsHandler(c echo.Context) error {
 		}
 	}
 
-	if rh.Config.AuthLevel > 1 { // changed for hotfix, should be > 0 when clients are updated
-		roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
+	if !jobs.ValidJobsSort(sort) {
+		output := errResponse{HTTPStatus: http.StatusBadRequest, Message: "sort must be one of " + strings.Join(jobs.JobsSortOrders, ", ")}
+		return prepareResponse(c, http.StatusBadRequest, "error", output)
+	}
 
-		if !utils.StringInSlice(rh.Config.AdminRoleName, roles) {
-			submitters = c.Request().Header.Get("X-ProcessAPI-User-Email")
+	timeFilters := map[string]time.Time{}
+	for _, p := range []string{"updatedAfter", "updatedBefore", "createdAfter", "createdBefore"} {
+		v := c.QueryParam(p)
+		if v == "" {
+			continue
 		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			output := errResponse{HTTPStatus: http.StatusBadRequest, Message: p + " must be a RFC3339 time"}
+			return prepareResponse(c, http.StatusBadRequest, "error", output)
+		}
+		timeFilters[p] = t
 	}
 
 	var submittersList []string
@@ -587,27 +823,62 @@ func (rh *RESTHandler) ListJobsHandler(c echo.Context) error {
 	}
 
 	offset, err := strconv.Atoi(offsetStr)
-	if err != nil || offset < 0 {
+	if err != nil || offset < 0 || cursor != "" {
 		offset = 0
 	}
 
-	result, err := rh.DB.GetJobs(limit, offset, processIDList, statusList, submittersList)
+	q := jobs.JobsQuery{
+		Limit:         limit,
+		Offset:        offset,
+		ProcessIDs:    processIDList,
+		Statuses:      statusList,
+		Submitters:    submittersList,
+		UpdatedAfter:  timeFilters["updatedAfter"],
+		UpdatedBefore: timeFilters["updatedBefore"],
+		CreatedAfter:  timeFilters["createdAfter"],
+		CreatedBefore: timeFilters["createdBefore"],
+		Sort:          sort,
+		Cursor:        cursor,
+		// non admins only see their own jobs and jobs shared with their groups
+		Viewer: rh.jobViewer(c),
+	}
+
+	result, next, err := rh.DB.GetJobs(q)
 	if err != nil {
+		if errors.Is(err, jobs.ErrInvalidCursor) {
+			output := errResponse{HTTPStatus: http.StatusBadRequest, Message: "cursor not valid for this query"}
+			return prepareResponse(c, http.StatusBadRequest, "error", output)
+		}
 		output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
-		return prepareResponse(c, http.StatusNotFound, "error", output)
+		return prepareResponse(c, http.StatusInternalServerError, "error", output)
 	}
 
+	// links repeat all filters of the request, cursor only encodes the position
+	params := url.Values{}
+	for _, p := range []string{"processID", "status", "submitter", "updatedAfter", "updatedBefore", "createdAfter", "createdBefore", "sort"} {
+		if v := c.QueryParam(p); v != "" {
+			params.Set(p, v)
+		}
+	}
+	params.Set("limit", strconv.Itoa(limit))
+
 	links := make([]link, 0)
-	if offset != 0 {
+	if offset != 0 { // offset paging is kept for older clients
+		prev := url.Values{}
+		for k, v := range params {
+			prev[k] = v
+		}
+		prev.Set("offset", strconv.Itoa(offset-limit))
 		lnk := link{
-			Href:  fmt.Sprintf("/jobs?offset=%v&limit=%v&processID=%v&status=%v&submitter=%v", offset-limit, limit, processIDs, statuses, submitters),
+			Href:  "/jobs?" + prev.Encode(),
 			Title: "prev",
 		}
 		links = append(links, lnk)
 	}
-	if limit == len(result) {
+	if next != "" {
+		params.Set("cursor", next)
 		lnk := link{
-			Href:  fmt.Sprintf("/jobs?offset=%v&limit=%v&processID=%v&status=%v&submitter=%v", offset+limit, limit, processIDs, statuses, submitters),
+			Href:  "/jobs?" + params.Encode(),
 			Title: "next",
 		}
 		links = append(links, lnk)
@@ -623,46 +894,58 @@ func (rh *RESTHandler) ListJobsHandler(c echo.Context) error {
 //
 //	{
 //		"status": "successful",
-//		"updated": "2023-08-28T18:25:44.731Z"
+//		"updated": "2023-08-28T18:25:44.731Z",
+//		"message": "optional message recorded in job history"
 //	}
 //
-// Time must be in RFC3339(ISO) format
+// Time must be in RFC3339(ISO) format.
+// Requests must be authorized with the callback token of the job as bearer token.
 func (rh *RESTHandler) JobStatusUpdateHandler(c echo.Context) error {
-	if rh.Config.AuthLevel > 0 {
-		roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
+	jobID := c.Param("jobID")
 
-		// only service accounts or admins can post status updates
-		if !utils.StringInSlice(rh.Config.ServiceRoleName, roles) && !utils.StringInSlice(rh.Config.AdminRoleName, roles) {
-			return c.JSON(http.StatusForbidden, errResponse{Message: "Forbidden"})
+	// callbacks are not authenticated with the user headers, they are recorded as the subject of the callback token
+	caller := ""
+	if rh.Config.AuthLevel > 0 {
+		// only the container of the job can post status updates for it
+		token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+		subject, err := rh.CallbackTokens.Verify(token, jobID)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, errResponse{Message: err.Error()})
 		}
+		caller = subject
 	}
 
-	jobID := c.Param("jobID")
-
 	if job, ok := rh.ActiveJobs.Jobs[jobID]; ok { // ActiveJobs hit
 		var sm jobs.StatusMessage
 		sm.Job = job
-		// setup some kind of token/auth to allow only the allowed agents to post to this route
-		defer c.Request().Body.Close()
-		dataBytes, err := io.ReadAll(c.Request().Body)
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, errResponse{http.StatusBadRequest, "could not read message body"})
-		}
-		if err = json.Unmarshal(dataBytes, &sm); err != nil {
-			return c.JSON(http.StatusBadRequest, errResponse{http.StatusBadRequest, "incorrect message body"})
-		}
-		// check status valid
-		switch sm.Status {
-		case jobs.ACCEPTED, jobs.RUNNING, jobs.DISMISSED, jobs.FAILED, jobs.SUCCESSFUL:
-			// do nothing
-		default:
-			return c.JSON(http.StatusBadRequest, fmt.Sprintf("status not valid, valid options are: %s, %s, %s, %s, %s", jobs.ACCEPTED, jobs.RUNNING, jobs.DISMISSED, jobs.FAILED, jobs.SUCCESSFUL))
+		sm.Source = jobs.EventSourceCallback
+		if errResp := readStatusMessage(c, &sm); errResp != nil {
+			return c.JSON(errResp.HTTPStatus, *errResp)
 		}
+		rh.Audit.Record(auditEntry(c, caller, jobs.AuditJobCallback, jobID, "status "+sm.Status, "", ""))
 		(*sm.Job).LogMessage(fmt.Sprintf("Status update received: %s.", sm.Status), logrus.InfoLevel)
 		rh.MessageQueue.StatusChan <- sm
 		return c.JSON(http.StatusAccepted, "status update received")
 	} else if ok, err := rh.DB.CheckJobExist(jobID); ok || err != nil { // db hit or error
 		if ok {
+			var sm jobs.StatusMessage
+			if errResp := readStatusMessage(c, &sm); errResp != nil {
+				return c.JSON(errResp.HTTPStatus, *errResp)
+			}
+			rh.Audit.Record(auditEntry(c, caller, jobs.AuditJobCallback, jobID, "status "+sm.Status, "", ""))
+
+			// Job may be active on another instance
+			cmd := jobs.JobCommand{JobID: jobID, Action: jobs.JobCommandStatus, Status: sm.Status, Time: sm.LastUpdate, Message: sm.Message, Source: jobs.EventSourceCallback}
+			forwarded, err := rh.Coordinator.Forward(cmd)
+			if err != nil {
+				output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
+				return prepareResponse(c, http.StatusInternalServerError, "error", output)
+			}
+			if forwarded {
+				log.Infof("Status update for job %s sent to the instance running it", jobID)
+				return c.JSON(http.StatusAccepted, "status update received")
+			}
+
 			log.Infof("Status update received for inactive job: %s", jobID)
 			// returning Accepted here so that callers do not retry
 			return c.JSON(http.StatusAccepted, "job not an active job")
@@ -676,9 +959,47 @@ func (rh *RESTHandler) JobStatusUpdateHandler(c echo.Context) error {
 	return c.JSON(http.StatusBadRequest, "job id not found")
 }
 
+// Env vars that let the container of a job post callbacks for it.
+// Local containers reach the server at API_URL_LOCAL, containers on other hosts at API_URL_PUBLIC.
+func (rh *RESTHandler) callbackEnv(jobID, host string) (map[string]string, error) {
+	token, err := rh.CallbackTokens.Issue(jobID)
+	if err != nil {
+		return nil, fmt.Errorf("could not issue callback token: %s", err.Error())
+	}
+	env := map[string]string{"PROCESSAPI_CALLBACK_TOKEN": token}
+
+	baseURL := os.Getenv("API_URL_PUBLIC")
+	if host == "local" {
+		baseURL = os.Getenv("API_URL_LOCAL")
+	}
+	if baseURL != "" {
+		env["PROCESSAPI_STATUS_CALLBACK_URL"] = fmt.Sprintf("%s/jobs/%s/status", strings.TrimSuffix(baseURL, "/"), jobID)
+	}
+	return env, nil
+}
+
+// Read a status update from the request body, returns the error response if body is not valid
+func readStatusMessage(c echo.Context, sm *jobs.StatusMessage) *errResponse {
+	defer c.Request().Body.Close()
+	dataBytes, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return &errResponse{http.StatusBadRequest, "could not read message body"}
+	}
+	if err = json.Unmarshal(dataBytes, sm); err != nil {
+		return &errResponse{http.StatusBadRequest, "incorrect message body"}
+	}
+	// check status valid
+	switch sm.Status {
+	case jobs.ACCEPTED, jobs.RUNNING, jobs.DISMISSED, jobs.FAILED, jobs.SUCCESSFUL:
+		return nil
+	default:
+		return &errResponse{http.StatusBadRequest, fmt.Sprintf("status not valid, valid options are: %s, %s, %s, %s, %s", jobs.ACCEPTED, jobs.RUNNING, jobs.DISMISSED, jobs.FAILED, jobs.SUCCESSFUL)}
+	}
+}
+
 // func (rh *RESTHandler) JobResultsUpdateHandler(c echo.Context) error {
 
-// 	// setup some kind of token/auth to allow only the container to post to this route
+// 	// require the callback token of the job like JobStatusUpdateHandler
 
 // 	defer c.Request().Body.Close()
 // 	dataBytes, err := io.ReadAll(c.Request().Body)
@@ -1,16 +1,17 @@
 package handlers
 
 import (
+	"app/auth"
+	"app/jobs"
 	"app/processes"
-	"app/utils"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 
 	"github.com/labstack/echo/v4"
-	"gopkg.in/yaml.v3"
+	log "github.com/sirupsen/logrus"
 )
 
 // ProcessListHandler godoc
@@ -41,15 +42,26 @@ func (rh *RESTHandler) ProcessListHandler(c echo.Context) error {
 		offset = 0
 	}
 
-	// instantiate result variable without importing processes pkg
-	result := rh.ProcessList.InfoList[0:0]
+	infos := rh.ProcessList.Infos()
+	// processes the caller can not describe are not listed
+	if rh.Config.AuthLevel > 0 {
+		roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
+		allowed := infos[:0]
+		for _, info := range infos {
+			if rh.Policy.Allowed(roles, auth.ActionDescribe, info.ID) {
+				allowed = append(allowed, info)
+			}
+		}
+		infos = allowed
+	}
+	result := infos[0:0]
 
-	if offset < len(rh.ProcessList.InfoList) {
+	if offset < len(infos) {
 		upperBound := offset + limit
-		if upperBound > len(rh.ProcessList.InfoList) {
-			upperBound = len(rh.ProcessList.InfoList)
+		if upperBound > len(infos) {
+			upperBound = len(infos)
 		}
-		result = rh.ProcessList.InfoList[offset:upperBound]
+		result = infos[offset:upperBound]
 	}
 
 	// required by /req/core/process-list-success
@@ -109,18 +121,74 @@ func (rh *RESTHandler) ProcessDescribeHandler(c echo.Context) error {
 	return prepareResponse(c, http.StatusOK, "process", description)
 }
 
-// AddProcessHandler adds a new process configuration
-func (rh *RESTHandler) AddProcessHandler(c echo.Context) error {
+// ProcessVersionsHandler godoc
+// @Summary List Process Versions
+// @Description All versions of a process that have been registered, old versions can still be described and executed
+// @Tags processes
+// @Param processID path string true "example: pyecho"
+// @Accept */*
+// @Produce json
+// @Success 200 {object} []processes.VersionInfo
+// @Router /processes/{processID}/versions [get]
+func (rh *RESTHandler) ProcessVersionsHandler(c echo.Context) error {
+	processID := c.Param("processID")
 
-	if rh.Config.AuthLevel > 0 {
-		roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
+	err := validateFormat(c)
+	if err != nil {
+		return err
+	}
+
+	versions, err := processes.Versions(rh.DB, processID)
+	if err != nil {
+		return prepareResponse(c, http.StatusInternalServerError, "error", errResponse{Message: err.Error(), HTTPStatus: http.StatusInternalServerError})
+	}
+	if len(versions) == 0 {
+		return prepareResponse(c, http.StatusNotFound, "error", errResponse{Message: "process not found", HTTPStatus: http.StatusNotFound})
+	}
+
+	output := map[string]interface{}{
+		"processID": processID,
+		"versions":  versions,
+	}
+	return prepareResponse(c, http.StatusOK, "processVersions", output)
+}
+
+// ProcessVersionDescribeHandler godoc
+// @Summary Describe Process Version
+// @Description Description of a registered version of a process
+// @Tags processes
+// @Param processID path string true "example: pyecho"
+// @Param version path string true "example: 8.15.2023"
+// @Accept */*
+// @Produce json
+// @Success 200 {object} processes.processDescription
+// @Router /processes/{processID}/versions/{version} [get]
+func (rh *RESTHandler) ProcessVersionDescribeHandler(c echo.Context) error {
+	processID := c.Param("processID")
+	version := c.Param("version")
 
-		// non-admins are not allowed
-		if !utils.StringInSlice(rh.Config.AdminRoleName, roles) {
-			return c.JSON(http.StatusForbidden, errResponse{Message: "Forbidden"})
+	err := validateFormat(c)
+	if err != nil {
+		return err
+	}
+
+	p, err := processes.GetVersion(rh.DB, processID, version)
+	if err != nil {
+		if errors.Is(err, processes.ErrVersionNotFound) {
+			return prepareResponse(c, http.StatusNotFound, "error", errResponse{Message: "process version not found", HTTPStatus: http.StatusNotFound})
 		}
+		return prepareResponse(c, http.StatusInternalServerError, "error", errResponse{Message: err.Error(), HTTPStatus: http.StatusInternalServerError})
 	}
 
+	description, err := p.Describe()
+	if err != nil {
+		return prepareResponse(c, http.StatusInternalServerError, "error", errResponse{Message: err.Error(), HTTPStatus: http.StatusInternalServerError})
+	}
+	return prepareResponse(c, http.StatusOK, "process", description)
+}
+
+// AddProcessHandler adds a new process configuration
+func (rh *RESTHandler) AddProcessHandler(c echo.Context) error {
 	processID := c.Param("processID")
 	_, _, err := rh.ProcessList.Get(processID)
 	if err == nil {
@@ -143,48 +211,33 @@ func (rh *RESTHandler) AddProcessHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, errResponse{Message: err.Error()})
 	}
 
-	pluginsDir := os.Getenv("PLUGINS_DIR") // We already know this env variable exist because it is being checked in plguinsInit function
-	filename := fmt.Sprintf("%s/%s/%s.yml", pluginsDir, processID, processID)
-
-	data, err := yaml.Marshal(newProcess)
+	pr, err := processes.NewProcessRecord(newProcess, jobs.ProcessSourceAPI)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to marshal process data"})
 	}
 
-	// Destination directory
-	destDir := fmt.Sprintf("%s/%s", pluginsDir, processID)
-
-	// Create the destination directory including all intermediate directories
-	err = os.MkdirAll(destDir, 0755)
+	err = rh.DB.AddProcess(pr)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to deprecate old process"})
-	}
-
-	if err := os.WriteFile(filename, data, 0644); err != nil {
-		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to write process file"})
+		if errors.Is(err, jobs.ErrProcessExists) {
+			return prepareResponse(c, http.StatusBadRequest, "error", errResponse{Message: "Process already exist. Use PUT method to update", HTTPStatus: http.StatusBadRequest})
+		}
+		if errors.Is(err, jobs.ErrProcessVersionExists) {
+			return c.JSON(http.StatusConflict, errResponse{Message: "Version already registered with a different definition, versions can not be changed"})
+		}
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to store process"})
 	}
 
-	rh.ProcessList.List = append(rh.ProcessList.List, newProcess)
-	rh.ProcessList.InfoList = append(rh.ProcessList.InfoList, newProcess.Info)
+	rh.reloadProcesses()
+	rh.audit(c, jobs.AuditProcessAdd, processID, "", "", processYAML(newProcess))
 
 	return c.JSON(http.StatusOK, map[string]string{"message": "Process added successfully"})
 }
 
 // UpdateProcessHandler updates an existing process configuration
 func (rh *RESTHandler) UpdateProcessHandler(c echo.Context) error {
-
-	if rh.Config.AuthLevel > 0 {
-		roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
-
-		// non-admins are not allowed
-		if !utils.StringInSlice(rh.Config.AdminRoleName, roles) {
-			return c.JSON(http.StatusForbidden, errResponse{Message: "Forbidden"})
-		}
-	}
-
 	processID := c.Param("processID")
 
-	oldProcess, i, err := rh.ProcessList.Get(processID)
+	current, _, err := rh.ProcessList.Get(processID)
 	if err != nil {
 		return prepareResponse(c, http.StatusBadRequest, "error", errResponse{Message: "Process does not exist", HTTPStatus: http.StatusBadRequest})
 	}
@@ -204,85 +257,63 @@ func (rh *RESTHandler) UpdateProcessHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, errResponse{Message: err.Error()})
 	}
 
-	pluginsDir := os.Getenv("PLUGINS_DIR") // We already know this env variable exist because it is being checked in plguinsInit function
-	filename := fmt.Sprintf("%s/%s/%s.yml", pluginsDir, processID, processID)
-
-	oldV := oldProcess.Info.Version
-
-	// to do: this should be atomic
-
-	// Destination directory
-	destDir := fmt.Sprintf("%s/deprecated/%s", pluginsDir, processID)
-
-	// Create the destination directory including all intermediate directories
-	err = os.MkdirAll(destDir, 0755)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to deprecate old process"})
-	}
-
-	// Move the file
-	err = os.Rename(filename, fmt.Sprintf("%s/%s_%s.yml", destDir, processID, oldV))
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to deprecate old process"})
-	}
-
-	data, err := yaml.Marshal(updatedProcess)
+	pr, err := processes.NewProcessRecord(updatedProcess, jobs.ProcessSourceAPI)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to marshal process data"})
 	}
 
-	if err := os.WriteFile(filename, data, 0644); err != nil {
-		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to write process file"})
+	if err := rh.DB.PutProcess(pr); err != nil {
+		if errors.Is(err, jobs.ErrProcessVersionExists) {
+			return c.JSON(http.StatusConflict, errResponse{Message: "Version already registered with a different definition, versions can not be changed"})
+		}
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to store process"})
 	}
 
-	rh.ProcessList.List[i] = updatedProcess
-	rh.ProcessList.InfoList[i] = updatedProcess.Info
+	rh.reloadProcesses()
+	rh.audit(c, jobs.AuditProcessUpdate, processID, "", processYAML(current), processYAML(updatedProcess))
 
 	return c.JSON(http.StatusOK, map[string]string{"message": "Process updated successfully"})
 }
 
 // DeleteProcessHandler deletes a process configuration
 func (rh *RESTHandler) DeleteProcessHandler(c echo.Context) error {
+	processID := c.Param("processID")
 
-	if rh.Config.AuthLevel > 0 {
-		roles := strings.Split(c.Request().Header.Get("X-ProcessAPI-User-Roles"), ",")
-
-		// non-admins are not allowed
-		if !utils.StringInSlice(rh.Config.AdminRoleName, roles) {
-			return c.JSON(http.StatusForbidden, errResponse{Message: "Forbidden"})
-		}
+	// definition as served before the delete, for the audit log
+	before := ""
+	if current, _, err := rh.ProcessList.Get(processID); err == nil {
+		before = processYAML(current)
 	}
 
-	processID := c.Param("processID")
-
-	oldProcess, i, err := rh.ProcessList.Get(processID)
+	deleted, err := rh.DB.DeleteProcess(processID, jobs.ProcessSourceAPI)
 	if err != nil {
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to delete process"})
+	}
+	if !deleted {
 		return prepareResponse(c, http.StatusBadRequest, "error", errResponse{Message: "Process does not exist", HTTPStatus: http.StatusBadRequest})
 	}
 
-	pluginsDir := os.Getenv("PLUGINS_DIR") // We already know this env variable exist because it is being checked in plguinsInit function
-	filename := fmt.Sprintf("%s/%s/%s.yml", pluginsDir, processID, processID)
-
-	oldV := oldProcess.Info.Version
+	rh.reloadProcesses()
+	rh.audit(c, jobs.AuditProcessDelete, processID, "", before, "")
 
-	// to do: this should be atomic
-
-	// Create the destination directory including all intermediate directories
-	destDir := fmt.Sprintf("%s/deprecated/%s", pluginsDir, processID)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Process deleted successfully"})
+}
 
-	err = os.MkdirAll(destDir, 0755)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to deprecate old process"})
-	}
+// PluginErrorsHandler godoc
+// @Summary Process File Errors
+// @Description Files in the plugins directory that were not imported by the last import, because they are not valid processes, define a process id already defined by another file, or change a registered version. Files are imported when they change.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} processes.PluginsStatus
+// @Router /admin/processes/errors [get]
+// Does not produce HTML
+func (rh *RESTHandler) PluginErrorsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, rh.Plugins.Status())
+}
 
-	// Move the file
-	err = os.Rename(filename, fmt.Sprintf("%s/%s_%s.yml", destDir, processID, oldV))
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, errResponse{Message: "Failed to deprecate old process"})
+// Reload processes right away so that this instance serves the change before the change notification arrives
+func (rh *RESTHandler) reloadProcesses() {
+	if err := rh.ProcessList.Load(rh.DB); err != nil {
+		log.Errorf("could not reload processes: %s", err.Error())
 	}
-
-	rh.ProcessList.List = append(rh.ProcessList.List[:i], rh.ProcessList.List[i+1:]...)
-	rh.ProcessList.InfoList = append(rh.ProcessList.InfoList[:i], rh.ProcessList.InfoList[i+1:]...)
-
-	return c.JSON(http.StatusOK, map[string]string{"message": "Process deleted successfully"})
 }
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"app/jobs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const defaultStatsWindow = "7d"
+
+// StatsHandler godoc
+// @Summary Job Statistics
+// @Description Run counts by status, success and failure rates, duration and queue wait percentiles, and top submitters of jobs created in the time window
+// @Tags jobs
+// @Param window query string false "time window ending now, such as 24h or 30d, at most 366d, default 7d"
+// @Param top query int false "number of top submitters, max 100, default 10"
+// @Accept */*
+// @Produce json
+// @Success 200 {object} jobs.JobStats
+// @Router /stats [get]
+func (rh *RESTHandler) StatsHandler(c echo.Context) error {
+	err := validateFormat(c)
+	if err != nil {
+		return err
+	}
+	return rh.jobStats(c, "")
+}
+
+// ProcessStatsHandler godoc
+// @Summary Process Statistics
+// @Description Job statistics of a process, see /stats
+// @Tags processes
+// @Param processID path string true "example: pyecho"
+// @Param window query string false "time window ending now, such as 24h or 30d, at most 366d, default 7d"
+// @Param top query int false "number of top submitters, max 100, default 10"
+// @Accept */*
+// @Produce json
+// @Success 200 {object} jobs.JobStats
+// @Router /processes/{processID}/stats [get]
+func (rh *RESTHandler) ProcessStatsHandler(c echo.Context) error {
+	processID := c.Param("processID")
+
+	err := validateFormat(c)
+	if err != nil {
+		return err
+	}
+
+	// deleted processes have stats too
+	_, ok, err := rh.DB.GetProcess(processID)
+	if err != nil {
+		output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
+		return prepareResponse(c, http.StatusInternalServerError, "error", output)
+	}
+	if !ok {
+		output := errResponse{HTTPStatus: http.StatusNotFound, Message: "processID incorrect or not available"}
+		return prepareResponse(c, http.StatusNotFound, "error", output)
+	}
+
+	return rh.jobStats(c, processID)
+}
+
+// Respond with statistics of jobs of the process, or of all jobs if processID is empty
+func (rh *RESTHandler) jobStats(c echo.Context, processID string) error {
+	window := c.QueryParam("window")
+	if window == "" {
+		window = defaultStatsWindow
+	}
+	d, err := jobs.ParseStatsWindow(window)
+	if err != nil {
+		output := errResponse{HTTPStatus: http.StatusBadRequest, Message: err.Error()}
+		return prepareResponse(c, http.StatusBadRequest, "error", output)
+	}
+
+	top, err := strconv.Atoi(c.QueryParam("top"))
+	if err != nil || top > 100 || top < 1 {
+		top = 10
+	}
+
+	to := time.Now()
+	from := to.Add(-d)
+
+	stats, err := rh.DB.GetJobStats(processID, from, to, top)
+	if err != nil {
+		output := errResponse{HTTPStatus: http.StatusInternalServerError, Message: err.Error()}
+		return prepareResponse(c, http.StatusInternalServerError, "error", output)
+	}
+
+	stats.ProcessID = processID
+	stats.Window = window
+	stats.From = from
+	stats.To = to
+
+	return prepareResponse(c, http.StatusOK, "stats", stats)
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"app/jobs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// usageResponse is the compute consumed by jobs that ended in [from, to)
+type usageResponse struct {
+	GroupBy string              `json:"groupBy"`
+	From    time.Time           `json:"from"`
+	To      time.Time           `json:"to"`
+	Usage   []jobs.UsageSummary `json:"usage"`
+}
+
+// UsageHandler godoc
+// @Summary Compute Usage
+// @Description Jobs, run time, vCPU-seconds and memory MiB-seconds of jobs that ended in the time range, grouped by submitter or process. Non admin users only see their own usage.
+// @Tags jobs
+// @Param groupBy query string false "submitter or process, default submitter"
+// @Param from query string false "RFC3339 time, default start of the current month (UTC)"
+// @Param to query string false "RFC3339 time, default now"
+// @Param submitter query string false "comma separated list of submitters"
+// @Param processID query string false "comma separated list of process ids"
+// @Accept */*
+// @Produce json
+// @Success 200 {object} usageResponse
+// @Router /usage [get]
+// Does not produce HTML
+func (rh *RESTHandler) UsageHandler(c echo.Context) error {
+	q := jobs.UsageQuery{GroupBy: c.QueryParam("groupBy")}
+	switch q.GroupBy {
+	case "":
+		q.GroupBy = jobs.UsageBySubmitter
+	case jobs.UsageBySubmitter, jobs.UsageByProcess:
+	default:
+		return c.JSON(http.StatusBadRequest, errResponse{Message: "'groupBy' must be 'submitter' or 'process'"})
+	}
+
+	now := time.Now().UTC()
+	q.From = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	q.To = now
+
+	var err error
+	if from := c.QueryParam("from"); from != "" {
+		q.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, errResponse{Message: "'from' must be an RFC3339 time"})
+		}
+	}
+	if to := c.QueryParam("to"); to != "" {
+		q.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, errResponse{Message: "'to' must be an RFC3339 time"})
+		}
+	}
+	if !q.From.Before(q.To) {
+		return c.JSON(http.StatusBadRequest, errResponse{Message: "'from' must be before 'to'"})
+	}
+
+	if s := c.QueryParam("submitter"); s != "" {
+		q.Submitters = strings.Split(s, ",")
+	}
+	if p := c.QueryParam("processID"); p != "" {
+		q.ProcessIDs = strings.Split(p, ",")
+	}
+
+	if rh.Config.AuthLevel > 0 {
+		// non admins can only see their own usage
+		if !rh.isAdmin(c) {
+			q.Submitters = []string{c.Request().Header.Get("X-ProcessAPI-User-Email")}
+		}
+	}
+
+	usage, err := rh.DB.GetUsage(q)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, errResponse{Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, usageResponse{GroupBy: q.GroupBy, From: q.From, To: q.To, Usage: usage})
+}
@@ -17,6 +17,14 @@ func (ac *ActiveJobs) Add(j *Job) {
 	ac.Jobs[(*j).JobID()] = j
 }
 
+func (ac *ActiveJobs) Get(jid string) (*Job, bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	j, ok := ac.Jobs[jid]
+	return j, ok
+}
+
 func (ac *ActiveJobs) Remove(j *Job) {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
@@ -0,0 +1,143 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// APIKey is a long lived token that authenticates its owner without an interactive login.
+// Only the hash of the token is stored, the token itself is shown once when the key is created.
+type APIKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Owner  string   `json:"owner"`
+	Hash   string   `json:"-"`
+	Scopes []string `json:"scopes"`
+	// Expires is nil if the key does not expire, Revoked is nil until the key is revoked
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+// Key can authenticate requests at the time
+func (k APIKey) Active(now time.Time) bool {
+	return k.Revoked == nil && (k.Expires == nil || now.Before(*k.Expires))
+}
+
+// Scopes are stored comma separated, they never contain commas since process ids are used as roles.
+
+// Times of a key are written with server local time
+func localTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Local()
+}
+
+func insertAPIKey(h *sql.DB, placeholder func(n int) string, k APIKey) error {
+	placeholders := make([]string, 7)
+	for i := range placeholders {
+		placeholders[i] = placeholder(i + 1)
+	}
+	query := fmt.Sprintf(`INSERT INTO api_keys (id, name, owner, hash, scopes, created, expires) VALUES (%s)`, strings.Join(placeholders, ", "))
+
+	_, err := h.Exec(query, k.ID, k.Name, k.Owner, k.Hash, strings.Join(k.Scopes, ","), k.Created.Local(), localTime(k.Expires))
+	return err
+}
+
+const apiKeyColumns = "id, name, owner, hash, scopes, created, expires, revoked, last_used"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var k APIKey
+	var scopes string
+	var expires, revoked, lastUsed sql.NullTime
+	if err := row.Scan(&k.ID, &k.Name, &k.Owner, &k.Hash, &scopes, &k.Created, &expires, &revoked, &lastUsed); err != nil {
+		return APIKey{}, err
+	}
+
+	k.Scopes = []string{}
+	if scopes != "" {
+		k.Scopes = strings.Split(scopes, ",")
+	}
+	nullable := func(t sql.NullTime) *time.Time {
+		if !t.Valid {
+			return nil
+		}
+		return &t.Time
+	}
+	k.Expires = nullable(expires)
+	k.Revoked = nullable(revoked)
+	k.LastUsed = nullable(lastUsed)
+	return k, nil
+}
+
+func selectAPIKey(h *sql.DB, placeholder func(n int) string, hash string) (APIKey, bool, error) {
+	query := fmt.Sprintf(`SELECT %s FROM api_keys WHERE hash = %s`, apiKeyColumns, placeholder(1))
+
+	k, err := scanAPIKey(h.QueryRow(query, hash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return APIKey{}, false, nil
+		}
+		return APIKey{}, false, err
+	}
+	return k, true, nil
+}
+
+func selectAPIKeys(h *sql.DB, placeholder func(n int) string, owner string) ([]APIKey, error) {
+	query := fmt.Sprintf(`SELECT %s FROM api_keys`, apiKeyColumns)
+	args := []interface{}{}
+	if owner != "" {
+		query += " WHERE owner = " + placeholder(1)
+		args = append(args, owner)
+	}
+	query += " ORDER BY created, id"
+
+	rows, err := h.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, k)
+	}
+	return res, rows.Err()
+}
+
+func updateAPIKeyRevoked(h *sql.DB, placeholder func(n int) string, id, owner string, t time.Time) (bool, error) {
+	query := fmt.Sprintf(`UPDATE api_keys SET revoked = %s WHERE id = %s AND revoked IS NULL`, placeholder(1), placeholder(2))
+	args := []interface{}{t.Local(), id}
+	if owner != "" {
+		query += " AND owner = " + placeholder(3)
+		args = append(args, owner)
+	}
+
+	res, err := h.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func updateAPIKeyLastUsed(h *sql.DB, placeholder func(n int) string, id string, t time.Time) error {
+	query := fmt.Sprintf(`UPDATE api_keys SET last_used = %s WHERE id = %s`, placeholder(1), placeholder(2))
+	_, err := h.Exec(query, t.Local(), id)
+	return err
+}
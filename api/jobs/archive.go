@@ -0,0 +1,403 @@
+package jobs
+
+import (
+	"app/utils"
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Job archives are gzipped tarballs with the entries
+//
+//	manifest.json                            format version and filters of the export
+//	jobs.jsonl                               one ArchivedJob per line
+//	logs/<jobID>.<container|server>.jsonl    optional
+//	metadata/<jobID>.json, <jobID>.jws       optional
+//	results/<jobID>.json                     optional, not imported since results are read from container logs
+//
+// manifest.json and jobs.jsonl always come first so that storage objects can be matched to imported jobs.
+const archiveVersion = 1
+
+// Number of jobs read from the database at once while exporting
+const archivePageSize = 500
+
+var archiveLogKinds = []string{"container", "server"}
+
+// ErrInvalidArchive is wrapped by import errors caused by the content of the archive
+var ErrInvalidArchive = errors.New("invalid archive")
+
+// ArchivedJob is a job record with its history and usage as written to job archives
+type ArchivedJob struct {
+	JobRecord
+	Events []JobEvent `json:"events"`
+	Usage  *JobUsage  `json:"usage,omitempty"`
+}
+
+// ExportOptions select the jobs of an archive and the storage objects included with them.
+// Only finished jobs are exported, active jobs are still writing their logs and metadata.
+type ExportOptions struct {
+	ProcessIDs []string
+	// Inclusive of CreatedAfter and exclusive of CreatedBefore, zero means no filter
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Logs          bool
+	Metadata      bool
+	Results       bool
+}
+
+type archiveManifest struct {
+	Version       int        `json:"version"`
+	Exported      time.Time  `json:"exported"`
+	Jobs          int        `json:"jobs"`
+	ProcessIDs    []string   `json:"processIDs,omitempty"`
+	CreatedAfter  *time.Time `json:"createdAfter,omitempty"`
+	CreatedBefore *time.Time `json:"createdBefore,omitempty"`
+	Logs          bool       `json:"logs"`
+	Metadata      bool       `json:"metadata"`
+	Results       bool       `json:"results"`
+}
+
+// ImportResult counts what was restored from an archive
+type ImportResult struct {
+	Imported int `json:"imported"`
+	// Jobs that already exist in the database are skipped with their storage objects
+	Skipped int `json:"skipped"`
+	Objects int `json:"objects"`
+}
+
+func logsKey(jid, kind string) string {
+	return fmt.Sprintf("%s/%s.%s.jsonl", os.Getenv("STORAGE_LOGS_PREFIX"), jid, kind)
+}
+
+// Write an archive of the finished jobs selected by opts to w, returns the number of jobs exported.
+// svc is only used if logs, metadata or results are included.
+func ExportJobs(db Database, svc *s3.S3, w io.Writer, opts ExportOptions) (int, error) {
+	if (opts.Logs || opts.Metadata || opts.Results) && svc == nil {
+		return 0, fmt.Errorf("storage service is required to export logs, metadata or results")
+	}
+
+	q := JobsQuery{
+		Limit:         archivePageSize,
+		ProcessIDs:    opts.ProcessIDs,
+		Statuses:      []string{SUCCESSFUL, FAILED, DISMISSED},
+		CreatedAfter:  opts.CreatedAfter,
+		CreatedBefore: opts.CreatedBefore,
+		Sort:          "created",
+	}
+
+	// Records are small enough to hold in memory, storage objects are streamed afterwards
+	var records bytes.Buffer
+	enc := json.NewEncoder(&records)
+	exported := []JobRecord{}
+	for {
+		page, next, err := db.GetJobs(q)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, r := range page {
+			// job lists do not include mode and host
+			jr, ok, err := db.GetJob(r.JobID)
+			if err != nil {
+				return 0, err
+			}
+			if !ok {
+				continue
+			}
+
+			a := ArchivedJob{JobRecord: jr}
+			a.Events, err = db.GetJobEvents(jr.JobID)
+			if err != nil {
+				return 0, err
+			}
+			u, ok, err := db.GetJobUsage(jr.JobID)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				a.Usage = &u
+			}
+
+			if err := enc.Encode(a); err != nil {
+				return 0, err
+			}
+			exported = append(exported, jr)
+		}
+
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+
+	m := archiveManifest{
+		Version:       archiveVersion,
+		Exported:      time.Now(),
+		Jobs:          len(exported),
+		ProcessIDs:    opts.ProcessIDs,
+		CreatedAfter:  timeRef(opts.CreatedAfter),
+		CreatedBefore: timeRef(opts.CreatedBefore),
+		Logs:          opts.Logs,
+		Metadata:      opts.Metadata,
+		Results:       opts.Results,
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := writeArchiveEntry(tw, "manifest.json", manifest); err != nil {
+		return 0, err
+	}
+	if err := writeArchiveEntry(tw, "jobs.jsonl", records.Bytes()); err != nil {
+		return 0, err
+	}
+
+	for _, jr := range exported {
+		if opts.Logs {
+			for _, k := range archiveLogKinds {
+				if err := archiveStorageObject(tw, svc, logsKey(jr.JobID, k), fmt.Sprintf("logs/%s.%s.jsonl", jr.JobID, k)); err != nil {
+					return 0, err
+				}
+			}
+		}
+
+		if opts.Metadata {
+			if err := archiveStorageObject(tw, svc, metaDataKey(jr.JobID), fmt.Sprintf("metadata/%s.json", jr.JobID)); err != nil {
+				return 0, err
+			}
+			if err := archiveStorageObject(tw, svc, metaSignatureKey(jr.JobID), fmt.Sprintf("metadata/%s.jws", jr.JobID)); err != nil {
+				return 0, err
+			}
+		}
+
+		// jobs without outputs or with unparsable results are left out
+		if opts.Results && jr.Status == SUCCESSFUL {
+			res, err := FetchResults(svc, jr.JobID)
+			if err == nil {
+				b, err := json.Marshal(res)
+				if err != nil {
+					return 0, err
+				}
+				if err := writeArchiveEntry(tw, fmt.Sprintf("results/%s.json", jr.JobID), b); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	return len(exported), nil
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Copy a storage object into the archive, missing objects are skipped since failed jobs may not have them
+func archiveStorageObject(tw *tar.Writer, svc *s3.S3, key, name string) error {
+	exist, err := utils.KeyExists(key, svc)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return nil
+	}
+
+	data, err := utils.GetS3Data(key, svc)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", key, err.Error())
+	}
+	return writeArchiveEntry(tw, name, data)
+}
+
+// Restore jobs and their storage objects from an archive written by ExportJobs.
+// Jobs that already exist are left unchanged with their storage objects. svc is only used if the archive has logs or metadata.
+// Errors caused by the content of the archive wrap ErrInvalidArchive, other errors are failures of the database or storage.
+func ImportJobs(db Database, svc *s3.S3, r io.Reader) (ImportResult, error) {
+	var res ImportResult
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return res, fmt.Errorf("%w: not gzip compressed: %s", ErrInvalidArchive, err.Error())
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "manifest.json" {
+		return res, fmt.Errorf("%w: does not start with manifest.json", ErrInvalidArchive)
+	}
+	var m archiveManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return res, fmt.Errorf("%w: could not parse manifest.json: %s", ErrInvalidArchive, err.Error())
+	}
+	if m.Version < 1 || m.Version > archiveVersion {
+		return res, fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, m.Version)
+	}
+
+	hdr, err = tr.Next()
+	if err != nil || hdr.Name != "jobs.jsonl" {
+		return res, fmt.Errorf("%w: missing jobs.jsonl after manifest.json", ErrInvalidArchive)
+	}
+
+	// Objects are only written for imported jobs, so that logs, metadata and signatures of existing jobs are kept
+	archived := map[string]bool{}
+	scanner := bufio.NewScanner(tr)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var a ArchivedJob
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			return res, fmt.Errorf("%w: jobs.jsonl line %d: %s", ErrInvalidArchive, line, err.Error())
+		}
+		if a.JobID == "" || strings.ContainsAny(a.JobID, "/.") {
+			return res, fmt.Errorf("%w: jobs.jsonl line %d: invalid job id '%s'", ErrInvalidArchive, line, a.JobID)
+		}
+
+		ok, err := db.restoreJob(a)
+		if err != nil {
+			return res, fmt.Errorf("could not import job %s: %s", a.JobID, err.Error())
+		}
+		if ok {
+			archived[a.JobID] = true
+			res.Imported++
+		} else {
+			res.Skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return res, fmt.Errorf("%w: could not read jobs.jsonl: %s", ErrInvalidArchive, err.Error())
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, fmt.Errorf("%w: %s", ErrInvalidArchive, err.Error())
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		key, contentType, jid := archivedObjectKey(hdr.Name)
+		if key == "" || !archived[jid] {
+			continue
+		}
+		if svc == nil {
+			return res, errors.New("storage service is required to import logs and metadata")
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return res, fmt.Errorf("%w: could not read %s: %s", ErrInvalidArchive, hdr.Name, err.Error())
+		}
+		if err := utils.WriteToS3(svc, data, key, contentType, 0); err != nil {
+			return res, fmt.Errorf("could not write %s: %s", key, err.Error())
+		}
+		res.Objects++
+	}
+
+	return res, nil
+}
+
+// Storage key and content type of an archive entry and the job it belongs to.
+// Key is empty for entries that are not imported.
+func archivedObjectKey(name string) (key, contentType, jid string) {
+	dir, base := path.Split(name)
+	parts := strings.SplitN(base, ".", 2)
+	if len(parts) != 2 {
+		return "", "", ""
+	}
+	jid = parts[0]
+
+	switch {
+	case dir == "logs/" && (parts[1] == "container.jsonl" || parts[1] == "server.jsonl"):
+		return logsKey(jid, strings.TrimSuffix(parts[1], ".jsonl")), "text/plain", jid
+	case dir == "metadata/" && parts[1] == "json":
+		return metaDataKey(jid), "application/json", jid
+	case dir == "metadata/" && parts[1] == "jws":
+		return metaSignatureKey(jid), "application/jose", jid
+	}
+	return "", "", ""
+}
+
+// Insert a job with its events and usage in one transaction, returns false if the job already exists.
+// Both databases share the statements, placeholder returns the bind parameter for the nth argument.
+func insertArchivedJob(h *sql.DB, placeholder func(n int) string, a ArchivedJob) (bool, error) {
+	placeholders := func(n int) string {
+		ps := make([]string, n)
+		for i := range ps {
+			ps[i] = placeholder(i + 1)
+		}
+		return strings.Join(ps, ", ")
+	}
+
+	tx, err := h.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// records are written with server local time
+	query := fmt.Sprintf(`INSERT INTO jobs (id, status, created, updated, mode, host, process_id, process_version, submitter, job_group)
+	VALUES (%s) ON CONFLICT (id) DO NOTHING`, placeholders(10))
+	r, err := tx.Exec(query, a.JobID, a.Status, a.Created.Local(), a.LastUpdate.Local(), a.Mode, a.Host, a.ProcessID, a.ProcessVersion, a.Submitter, a.Group)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	query = fmt.Sprintf(`INSERT INTO job_events (job_id, status, time, source, message) VALUES (%s)`, placeholders(5))
+	for _, e := range a.Events {
+		if _, err := tx.Exec(query, a.JobID, e.Status, e.Time.Local(), e.Source, e.Message); err != nil {
+			return false, err
+		}
+	}
+
+	if a.Usage != nil {
+		u := *a.Usage
+		u.JobID = a.JobID
+		if err := insertJobUsage(tx, placeholder, u); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
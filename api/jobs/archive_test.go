@@ -0,0 +1,151 @@
+package jobs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+func readArchive(t *testing.T, r io.Reader) []archiveEntry {
+	t.Helper()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	entries := []archiveEntry{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, archiveEntry{hdr.Name, data})
+	}
+}
+
+func writeArchive(t *testing.T, entries []archiveEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		if err := writeArchiveEntry(tw, e.name, e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := NewMemoryDB()
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, j := range []struct{ jid, status string }{{"job-1", SUCCESSFUL}, {"job-2", FAILED}, {"active", RUNNING}} {
+		if err := src.addJob(j.jid, ACCEPTED, "async-execute", "local", "pyecho", "1.0.0", "a@example.com", "", created); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.updateJobRecord(j.jid, j.status, EventSourceServer, "", created.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ended := created.Add(time.Minute)
+	if err := src.addJobUsage(newJobUsage("job-1", "pyecho", "a@example.com", "local", 2, 1024, &created, &ended)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := ExportJobs(src, nil, &buf, ExportOptions{})
+	if err != nil || n != 2 {
+		t.Fatalf("ExportJobs = %d, %v", n, err)
+	}
+	entries := readArchive(t, &buf)
+	if len(entries) != 2 || entries[0].name != "manifest.json" || entries[1].name != "jobs.jsonl" {
+		t.Fatalf("archive entries are %v", entries)
+	}
+
+	// job-2 exists in the target, its storage objects must not be written over the existing ones.
+	// Without storage service an object that is written fails the import.
+	dst := NewMemoryDB()
+	if err := dst.addJob("job-2", DISMISSED, "async-execute", "local", "pyecho", "1.0.0", "b@example.com", "", created); err != nil {
+		t.Fatal(err)
+	}
+	entries = append(entries,
+		archiveEntry{"logs/job-2.container.jsonl", []byte("{}")},
+		archiveEntry{"metadata/job-2.json", []byte("{}")},
+		archiveEntry{"metadata/job-2.jws", []byte("a..b")},
+		archiveEntry{"results/job-1.json", []byte("{}")},
+		archiveEntry{"notes.txt", []byte("unknown entries are ignored")},
+		archiveEntry{"metadata/job-1.txt", []byte("{}")},
+	)
+	res, err := ImportJobs(dst, nil, writeArchive(t, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (ImportResult{Imported: 1, Skipped: 1, Objects: 0}) {
+		t.Errorf("import result is %+v", res)
+	}
+
+	if jr, ok, _ := dst.GetJob("job-1"); !ok || jr.Status != SUCCESSFUL || !jr.Created.Equal(created) {
+		t.Errorf("imported job is %+v", jr)
+	}
+	want, _ := src.GetJobEvents("job-1")
+	if events, _ := dst.GetJobEvents("job-1"); len(events) == 0 || len(events) != len(want) || events[len(events)-1].Status != SUCCESSFUL {
+		t.Errorf("events of imported job are %+v, want %+v", events, want)
+	}
+	if u, ok, _ := dst.GetJobUsage("job-1"); !ok || u.CPUSeconds != 120 {
+		t.Errorf("usage of imported job is %+v", u)
+	}
+	if jr, _, _ := dst.GetJob("job-2"); jr.Status != DISMISSED || jr.Submitter != "b@example.com" {
+		t.Errorf("existing job changed to %+v", jr)
+	}
+	if _, ok, _ := dst.GetJob("active"); ok {
+		t.Error("active job exported")
+	}
+
+	// importing again skips all jobs
+	res, err = ImportJobs(dst, nil, writeArchive(t, entries))
+	if err != nil || res != (ImportResult{Skipped: 2}) {
+		t.Errorf("second import = %+v, %v", res, err)
+	}
+}
+
+func TestImportJobsInvalid(t *testing.T) {
+	manifest := archiveEntry{"manifest.json", []byte(`{"version": 1}`)}
+	invalid := map[string]io.Reader{
+		"not gzip":          bytes.NewBufferString("jobs"),
+		"no manifest":       writeArchive(t, []archiveEntry{{"jobs.jsonl", nil}}),
+		"unknown version":   writeArchive(t, []archiveEntry{{"manifest.json", []byte(`{"version": 2}`)}, {"jobs.jsonl", nil}}),
+		"no jobs":           writeArchive(t, []archiveEntry{manifest}),
+		"invalid record":    writeArchive(t, []archiveEntry{manifest, {"jobs.jsonl", []byte("{")}}),
+		"missing job id":    writeArchive(t, []archiveEntry{manifest, {"jobs.jsonl", []byte(`{"status": "successful"}`)}}),
+		"job id with path":  writeArchive(t, []archiveEntry{manifest, {"jobs.jsonl", []byte(`{"jobID": "../job-1"}`)}}),
+		"job id with a dot": writeArchive(t, []archiveEntry{manifest, {"jobs.jsonl", []byte(`{"jobID": "job.1"}`)}}),
+	}
+	for name, r := range invalid {
+		db := NewMemoryDB()
+		if _, err := ImportJobs(db, nil, r); !errors.Is(err, ErrInvalidArchive) {
+			t.Errorf("archive with %s: got %v", name, err)
+		}
+	}
+}
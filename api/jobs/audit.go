@@ -0,0 +1,240 @@
+package jobs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditProcessAdd    = "process.add"
+	AuditProcessUpdate = "process.update"
+	AuditProcessDelete = "process.delete"
+	AuditJobDismiss    = "job.dismiss"
+	AuditJobCallback   = "job.callback"
+	AuditAPIKeyCreate  = "apikey.create"
+	AuditAPIKeyRevoke  = "apikey.revoke"
+	AuditAuthFailure   = "auth.failure"
+)
+
+// AuditEntry records who did what. Entries are never updated or deleted.
+// ID is assigned by the database, it is not set in the stream.
+type AuditEntry struct {
+	ID        int64     `json:"id,omitempty"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	User      string    `json:"user"`
+	IP        string    `json:"ip"`
+	RequestID string    `json:"requestID"`
+	// Process id, job id or key id the action was taken on, the route for auth failures
+	Resource string `json:"resource"`
+	Message  string `json:"message,omitempty"`
+	// Process definitions as YAML before and after a change of the catalog
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// AuditQuery filters audit entries, zero values mean no filter.
+// Entries are returned newest first, BeforeID pages to entries older than a previous page.
+type AuditQuery struct {
+	Actions  []string
+	Users    []string
+	Resource string
+	// From is inclusive and To is exclusive
+	From     time.Time
+	To       time.Time
+	BeforeID int64
+	Limit    int
+}
+
+const auditColumns = "id, time, action, user_email, ip, request_id, resource, message, before_yaml, after_yaml"
+
+func insertAuditEntry(h *sql.DB, placeholder func(n int) string, e AuditEntry) error {
+	placeholders := make([]string, 9)
+	for i := range placeholders {
+		placeholders[i] = placeholder(i + 1)
+	}
+	query := fmt.Sprintf(`INSERT INTO audit_log (time, action, user_email, ip, request_id, resource, message, before_yaml, after_yaml) VALUES (%s)`, strings.Join(placeholders, ", "))
+
+	// records are written with server local time
+	_, err := h.Exec(query, e.Time.Local(), e.Action, e.User, e.IP, e.RequestID, e.Resource, e.Message, e.Before, e.After)
+	return err
+}
+
+func selectAuditEntries(h *sql.DB, placeholder func(n int) string, q AuditQuery) ([]AuditEntry, error) {
+	whereClauses := []string{}
+	args := []interface{}{}
+
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return placeholder(len(args))
+	}
+
+	in := func(column string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		placeholders := make([]string, len(values))
+		for i, v := range values {
+			placeholders[i] = arg(v)
+		}
+		whereClauses = append(whereClauses, fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", ")))
+	}
+
+	in("action", q.Actions)
+	in("user_email", q.Users)
+	if q.Resource != "" {
+		whereClauses = append(whereClauses, "resource = "+arg(q.Resource))
+	}
+	if !q.From.IsZero() {
+		whereClauses = append(whereClauses, "time >= "+arg(q.From.Local()))
+	}
+	if !q.To.IsZero() {
+		whereClauses = append(whereClauses, "time < "+arg(q.To.Local()))
+	}
+	if q.BeforeID > 0 {
+		whereClauses = append(whereClauses, "id < "+arg(q.BeforeID))
+	}
+
+	query := `SELECT ` + auditColumns + ` FROM audit_log`
+	if len(whereClauses) > 0 {
+		query += " WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT " + arg(q.Limit)
+
+	rows, err := h.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.Action, &e.User, &e.IP, &e.RequestID, &e.Resource, &e.Message, &e.Before, &e.After); err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+// AuditLog records entries in the database and writes them as JSON lines to a stream,
+// so that they can be shipped to a log collector outside of the reach of the API.
+type AuditLog struct {
+	DB Database
+
+	mu     sync.Mutex
+	stream io.Writer
+
+	sampleMu  sync.Mutex
+	samples   map[string]*auditSample
+	lastSweep time.Time
+}
+
+// Entries of a sample key not recorded since the last recorded one
+type auditSample struct {
+	recorded   time.Time
+	suppressed int
+	last       AuditEntry
+}
+
+// Entry recorded for the entries of a sample that were not recorded
+func (s *auditSample) summary() AuditEntry {
+	e := s.last
+	e.Message = fmt.Sprintf("%s (%d similar entries not recorded since %s)", e.Message, s.suppressed, s.recorded.Format(time.RFC3339))
+	return e
+}
+
+// NewAuditLog creates an audit log that appends to the file at path, no stream is written if path is empty.
+func NewAuditLog(db Database, path string) (*AuditLog, error) {
+	al := &AuditLog{DB: db}
+	if path == "" {
+		return al, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log file: %s", err.Error())
+	}
+	al.stream = f
+	return al, nil
+}
+
+// Record the entry. Failures are logged, they do not fail the action that is audited.
+func (al *AuditLog) Record(e AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if err := al.DB.AddAuditEntry(e); err != nil {
+		log.Errorf("could not record audit entry %s on %s by %s: %s", e.Action, e.Resource, e.User, err.Error())
+	}
+
+	if al.stream == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("could not encode audit entry: %s", err.Error())
+		return
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := al.stream.Write(append(b, '\n')); err != nil {
+		log.Errorf("could not write audit log stream: %s", err.Error())
+	}
+}
+
+// RecordSampled records the entry unless an entry with the same key was recorded less than interval ago,
+// so that repeated events such as auth failures of a client do not write an entry each.
+// Entries that are not recorded are counted, the last of them is recorded with the count once the interval is over.
+func (al *AuditLog) RecordSampled(key string, e AuditEntry, interval time.Duration) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	summaries := []AuditEntry{}
+	al.sampleMu.Lock()
+	if al.samples == nil {
+		al.samples = map[string]*auditSample{}
+	}
+	if e.Time.Sub(al.lastSweep) >= interval {
+		for k, s := range al.samples {
+			if e.Time.Sub(s.recorded) < interval {
+				continue
+			}
+			if s.suppressed > 0 {
+				summaries = append(summaries, s.summary())
+			}
+			delete(al.samples, k)
+		}
+		al.lastSweep = e.Time
+	}
+
+	record := false
+	if s, ok := al.samples[key]; ok && e.Time.Sub(s.recorded) < interval {
+		s.suppressed++
+		s.last = e
+	} else {
+		al.samples[key] = &auditSample{recorded: e.Time}
+		record = true
+	}
+	al.sampleMu.Unlock()
+
+	for _, s := range summaries {
+		al.Record(s)
+	}
+	if record {
+		al.Record(e)
+	}
+}
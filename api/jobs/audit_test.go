@@ -0,0 +1,46 @@
+package jobs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRecordSampled(t *testing.T) {
+	db := NewMemoryDB()
+	al, err := NewAuditLog(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	failure := func(ip string, after time.Duration) {
+		al.RecordSampled(ip, AuditEntry{Time: start.Add(after), Action: AuditAuthFailure, IP: ip, Message: "401 Unauthorized"}, time.Minute)
+	}
+	failure("10.0.0.1", 0)
+	failure("10.0.0.1", time.Second)
+	failure("10.0.0.1", 2*time.Second)
+	failure("10.0.0.2", 3*time.Second)
+
+	entries, err := db.GetAuditEntries(AuditQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries within the interval, want one per ip: %+v", len(entries), entries)
+	}
+
+	// the failures not recorded are summarized once the interval is over
+	failure("10.0.0.1", 2*time.Minute)
+	entries, err = db.GetAuditEntries(AuditQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries after the interval, want 4: %+v", len(entries), entries)
+	}
+	summary := entries[1]
+	if summary.IP != "10.0.0.1" || !summary.Time.Equal(start.Add(2*time.Second)) || !strings.Contains(summary.Message, "2 similar entries not recorded") {
+		t.Errorf("unexpected summary entry %+v", summary)
+	}
+}
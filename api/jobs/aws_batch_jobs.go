@@ -2,10 +2,8 @@ package jobs
 
 import (
 	"app/controllers"
-	"app/utils"
 	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -34,11 +32,24 @@ type AWSBatchJob struct {
 	ProcessName    string `json:"processID"`
 	ProcessVersion string
 	Submitter      string
-	Cmd            []string `json:"commandOverride"`
-	UpdateTime     time.Time
-	Status         string `json:"status"`
+	// Role the job is shared with, empty if only the submitter and admins can read it
+	Group      string
+	Cmd        []string `json:"commandOverride"`
+	Inputs     map[string]interface{}
+	Outputs    []OutputDef
+	UpdateTime time.Time
+	Status     string `json:"status"`
 	// results       interface{}
 
+	// Status changes recorded in metadata
+	statusHistory []statusTransition
+	// Guards statusHistory, which is appended by status updates while metadata is written
+	historyMu sync.Mutex
+	// Digest of the image manifest resolved at submission
+	imageDigest string
+	// Resources of the job definition, read when the job is submitted or resumed
+	resources Resources
+
 	logger  *log.Logger
 	logFile *os.File
 
@@ -46,8 +57,11 @@ type AWSBatchJob struct {
 	JobQueue string `json:"jobQueue"`
 
 	// Job Name in Batch for this job
-	JobName                string `json:"jobName"`
-	EnvVars                map[string]string
+	JobName string `json:"jobName"`
+	// Set in the container overrides of the job, such as the job callback token
+	EnvVars map[string]string
+	// Env vars set by the caller of the execution, added to the overrides and recorded in metadata
+	EnvOverrides           map[string]string
 	batchContext           *controllers.AWSBatchController
 	logStreamName          string
 	cloudWatchForwardToken string
@@ -150,7 +164,7 @@ func (j *AWSBatchJob) LastUpdate() time.Time {
 	return j.UpdateTime
 }
 
-func (j *AWSBatchJob) NewStatusUpdate(status string, updateTime time.Time) {
+func (j *AWSBatchJob) NewStatusUpdate(status string, updateTime time.Time, source string, message string) {
 
 	// If old status is one of the terminated status, it should not update status.
 	switch j.Status {
@@ -164,8 +178,42 @@ func (j *AWSBatchJob) NewStatusUpdate(status string, updateTime time.Time) {
 	} else {
 		j.UpdateTime = updateTime
 	}
-	j.DB.updateJobRecord(j.UUID, status, j.UpdateTime)
+	j.historyMu.Lock()
+	j.statusHistory = append(j.statusHistory, statusTransition{status, j.UpdateTime})
+	j.historyMu.Unlock()
+	j.DB.updateJobRecord(j.UUID, status, source, message, j.UpdateTime)
 	j.logger.Infof("Status changed to %s.", status)
+
+	switch status {
+	case SUCCESSFUL, DISMISSED, FAILED:
+		j.recordUsage()
+	}
+}
+
+// Copy of the status transitions of the job
+func (j *AWSBatchJob) history() []statusTransition {
+	j.historyMu.Lock()
+	defer j.historyMu.Unlock()
+	return append([]statusTransition(nil), j.statusHistory...)
+}
+
+// Record the compute consumed by the job, once it reached a terminal status.
+// Usage is recorded for every finished job, also if its metadata can not be written.
+func (j *AWSBatchJob) recordUsage() {
+	u := usageFromHistory(j.UUID, j.ProcessID(), j.Submitter, "aws-batch", j.resources.CPUs, j.resources.Memory, j.history())
+	if err := j.DB.addJobUsage(u); err != nil {
+		j.logger.Errorf("Error recording job usage: %s", err.Error())
+	}
+}
+
+// Read the resources of the job from its job definition, they are recorded in usage and metadata
+func (j *AWSBatchJob) resolveResources(c *controllers.AWSBatchController) {
+	jdi, err := c.GetJobDefInfo(j.JobDef)
+	if err != nil {
+		j.logger.Warnf("Could not get job definition resources: %s", err.Error())
+		return
+	}
+	j.resources = Resources{CPUs: jdi.VCPUs, Memory: jdi.Memory}
 }
 
 func (j *AWSBatchJob) CurrentStatus() string {
@@ -196,7 +244,8 @@ func (j *AWSBatchJob) initLogger() error {
 	// Create logger for server logs
 	j.logger = log.New()
 
-	file, err = os.Create(fmt.Sprintf("%s/%s.server.jsonl", os.Getenv("TMP_JOB_LOGS_DIR"), j.UUID))
+	// Appending so that server logs are kept when a job is resumed on the same host
+	file, err = os.OpenFile(fmt.Sprintf("%s/%s.server.jsonl", os.Getenv("TMP_JOB_LOGS_DIR"), j.UUID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		return fmt.Errorf("failed to open log file: %s", err.Error())
 	}
@@ -231,7 +280,16 @@ func (j *AWSBatchJob) Create() error {
 		return err
 	}
 
-	aWSBatchID, err := batchContext.JobCreate(j.ctx, j.JobDef, j.JobName, j.JobQueue, j.Cmd, j.EnvVars)
+	// Env vars of the process are set by the job definition, secrets through the secrets of the job definition
+	env := map[string]string{}
+	for k, v := range j.EnvOverrides {
+		env[k] = v
+	}
+	for k, v := range j.EnvVars {
+		env[k] = v
+	}
+
+	aWSBatchID, err := batchContext.JobCreate(j.ctx, j.JobDef, j.JobName, j.JobQueue, j.Cmd, env)
 	if err != nil {
 		j.ctxCancel()
 		return err
@@ -241,21 +299,73 @@ func (j *AWSBatchJob) Create() error {
 
 	j.AWSBatchID = aWSBatchID
 	j.batchContext = batchContext
+	j.resolveResources(batchContext)
+
+	// Pin the digest the tag points to at submission so that metadata records the image that ran
+	j.imageDigest, err = getRegistryImageDigest(j.Image, batchImagePlatform())
+	if err != nil {
+		j.logger.Warnf("Could not resolve image digest at submission: %s", err.Error())
+	}
 
 	// At this point job is ready to be added to database
-	err = j.DB.addJob(j.UUID, "accepted", "", "aws-batch", j.ProcessName, j.Submitter, time.Now())
+	err = j.DB.addJob(j.UUID, "accepted", "", "aws-batch", j.ProcessName, j.ProcessVersion, j.Submitter, j.Group, time.Now())
 	if err != nil {
 		j.ctxCancel()
 		return err
 	}
 
-	j.NewStatusUpdate(ACCEPTED, time.Time{})
+	j.NewStatusUpdate(ACCEPTED, time.Time{}, EventSourceServer, "")
 
 	// to do defer get log stream name
 
 	return nil
 }
 
+// Resume a job that was started by another instance.
+// Status, update time and history of the job must be set from the job record.
+// Returns the current status of the job in AWS Batch, since status updates may have been missed while the job had no owner.
+func (j *AWSBatchJob) Resume() (string, error) {
+	err := j.initLogger()
+	if err != nil {
+		return "", err
+	}
+	j.logger.Info("Resuming job started by another instance.")
+
+	ctx, cancelFunc := context.WithCancel(context.TODO())
+	j.ctx = ctx
+	j.ctxCancel = cancelFunc
+
+	batchContext, err := controllers.NewAWSBatchController(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_REGION"))
+	if err != nil {
+		j.ctxCancel()
+		return "", err
+	}
+	j.batchContext = batchContext
+	j.resolveResources(batchContext)
+
+	batchStatus, logStreamName, err := batchContext.JobMonitor(j.AWSBatchID)
+	if err != nil {
+		j.ctxCancel()
+		return "", err
+	}
+	j.logStreamName = logStreamName
+
+	j.wgRun.Add(1)
+
+	switch batchStatus {
+	case "ACCCEPTED":
+		return ACCEPTED, nil
+	case "RUNNING":
+		return RUNNING, nil
+	case "SUCCEEDED":
+		return SUCCESSFUL, nil
+	case "DISMISSED":
+		return DISMISSED, nil
+	default:
+		return FAILED, nil
+	}
+}
+
 func (j *AWSBatchJob) Kill() error {
 	j.logger.Info("Received dismiss signal.")
 
@@ -277,7 +387,7 @@ func (j *AWSBatchJob) Kill() error {
 		return err
 	}
 
-	j.NewStatusUpdate(DISMISSED, time.Time{})
+	j.NewStatusUpdate(DISMISSED, time.Time{}, EventSourceServer, "dismissed")
 	// If a dismiss status is updated the job is considered dismissed at this point
 	// Close being graceful or not does not matter.
 
@@ -378,10 +488,11 @@ func (j *AWSBatchJob) fetchCloudWatchLogs() ([]string, error) {
 }
 
 // Write metadata at the job's metadata location
+// Expects container logs to be written to disk.
+// Errors are logged and partial metadata is written, since metadata of failed jobs is
+// expected to have missing pieces.
 func (j *AWSBatchJob) WriteMetaData() {
 	j.logger.Info("Starting metadata writing routine.")
-	j.wg.Add(1)
-	defer j.wg.Done()
 	defer j.logger.Info("Finished metadata writing routine.")
 
 	c, err := controllers.NewAWSBatchController(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_REGION"))
@@ -392,57 +503,65 @@ func (j *AWSBatchJob) WriteMetaData() {
 
 	imgURI, err := c.GetImageURI(j.JobDef)
 	if err != nil {
-		j.logger.Errorf("Error writing metadata: %s", err.Error())
-		return
+		j.logger.Errorf("Error getting image URI: %s", err.Error())
+		imgURI = j.Image
 	}
 
-	// imgDgst would be incorrect if tag has been updated in between
-	// if there are multiple architecture available for same image tag
-	var imgDgst string
-	if strings.Contains(imgURI, "amazonaws.com/") {
-		imgDgst, err = getECRImageDigest(imgURI)
+	// Digest is resolved at submission, tag could have been updated before that if it is resolved here
+	i := image{ImageURI: imgURI, ImageDigest: j.imageDigest, Platform: batchImagePlatform()}
+	if i.ImageDigest == "" || imgURI != j.Image {
+		i.ImageDigest, err = getRegistryImageDigest(imgURI, i.Platform)
 		if err != nil {
-			j.logger.Errorf("Error writing metadata: %s", err.Error())
-			return
-		}
-	} else {
-		imgDgst, err = getDkrHubImageDigest(imgURI, "dummy")
-		if err != nil {
-			j.logger.Errorf("Error writing metadata: %s", err.Error())
-			return
+			j.logger.Errorf("Error getting image digest: %s", err.Error())
 		}
 	}
 
 	p := process{j.ProcessID(), j.ProcessVersion}
-	i := image{imgURI, imgDgst}
+
+	md := newMetaData(j.UUID, j.Submitter, j.Status, j.history(), p, i, j.Cmd)
+	md.EnvironmentVariables = j.EnvOverrides
 
 	g, s, e, err := c.GetJobTimes(j.AWSBatchID)
 	if err != nil {
-		j.logger.Errorf("Error writing metadata: %s", err.Error())
-		return
+		j.logger.Errorf("Error getting job times: %s", err.Error())
+	} else {
+		md.setTimes(g, s, e)
+	}
+
+	if j.Status != SUCCESSFUL {
+		md.FailureReason, md.ExitCode, err = c.GetJobExitInfo(j.AWSBatchID)
+		if err != nil {
+			j.logger.Errorf("Error getting job exit information: %s", err.Error())
+		}
 	}
 
-	md := metaData{
-		Context:         "https://github.com/Dewberry/process-api/blob/main/context.jsonld",
-		JobID:           j.UUID,
-		Process:         p,
-		Image:           i,
-		Commands:        j.Cmd,
-		GeneratedAtTime: g,
-		StartedAtTime:   s,
-		EndedAtTime:     e,
+	md.AtLocation = computeEnvironment{
+		ID:     activityID(j.UUID) + "#environment",
+		Type:   "prov:Location",
+		Host:   "aws-batch",
+		CPUs:   j.resources.CPUs,
+		Memory: j.resources.Memory,
+		Details: map[string]string{
+			"region":        os.Getenv("AWS_REGION"),
+			"jobQueue":      j.JobQueue,
+			"jobDefinition": j.JobDef,
+			"batchJobId":    j.AWSBatchID,
+		},
 	}
 
-	jsonBytes, err := json.Marshal(md)
-	if err != nil {
-		j.logger.Errorf("Error writing metadata: %s", err.Error())
-		return
+	md.Used = inputEntities(j.UUID, j.Inputs)
+	if j.Status == SUCCESSFUL {
+		md.Generated, err = outputEntities(j.StorageSvc, j.UUID, j.Outputs, j.Inputs)
+		if err != nil {
+			j.logger.Warnf("Output entities incomplete: %s", err.Error())
+		}
 	}
 
-	metadataDir := os.Getenv("STORAGE_METADATA_PREFIX")
-	mdLocation := fmt.Sprintf("%s/%s.json", metadataDir, j.UUID)
 	// TODO: Determine if batch metadata should be put on aws...currently this is the case
-	utils.WriteToS3(j.StorageSvc, jsonBytes, mdLocation, "application/json", 0)
+	err = writeMetaData(j.StorageSvc, j.UUID, md, nil)
+	if err != nil {
+		j.logger.Errorf("Error writing metadata: %s", err.Error())
+	}
 }
 
 // func (j *AWSBatchJob) WriteResults(data []byte) (err error) {
@@ -482,6 +601,14 @@ func (j *AWSBatchJob) Close() {
 		}
 	}
 
+	// Metadata is written for every terminal status
+	// after container logs are on disk since outputs are parsed from logs
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		j.WriteMetaData()
+	}()
+
 	j.DoneChan <- j // At this point job can be safely removed from active jobs
 
 	go func() {
@@ -495,3 +622,11 @@ func (j *AWSBatchJob) Close() {
 		DeleteLocalLogs(j.StorageSvc, j.UUID, j.ProcessName)
 	}()
 }
+
+// Platform of the compute environments used by batch jobs, used to select the image manifest
+func batchImagePlatform() string {
+	if p := os.Getenv("BATCH_IMAGE_PLATFORM"); p != "" {
+		return p
+	}
+	return "linux/amd64"
+}
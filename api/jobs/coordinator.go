@@ -0,0 +1,438 @@
+package jobs
+
+// Active jobs are owned by the instance that started them. Ownership is recorded as a lease in the database
+// which the owner renews while it is alive, so that multiple instances can share a database.
+// Requests for a job that reach another instance are sent to the owner as commands through the database,
+// and jobs whose lease expired are taken over by one of the remaining instances.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions of job commands
+const (
+	JobCommandStatus  = "status"
+	JobCommandDismiss = "dismiss"
+)
+
+const defaultJobLeaseTTL = 30 * time.Second
+
+// JobCommand is a request for a job received by an instance that does not own the job
+type JobCommand struct {
+	id     int64
+	JobID  string
+	Action string
+	// Status update details, used by status commands
+	Status  string
+	Time    time.Time
+	Message string
+	Source  string
+}
+
+func sortJobCommands(cmds []JobCommand) {
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].id < cmds[j].id })
+}
+
+// State of a job stored with its lease, so that another instance can take it over
+type jobSpec struct {
+	Host           string                 `json:"host"`
+	ProcessID      string                 `json:"processID"`
+	ProcessVersion string                 `json:"processVersion"`
+	Submitter      string                 `json:"submitter"`
+	Group          string                 `json:"group,omitempty"`
+	Image          string                 `json:"image"`
+	ImageDigest    string                 `json:"imageDigest,omitempty"`
+	Cmd            []string               `json:"commandOverride"`
+	Inputs         map[string]interface{} `json:"inputs"`
+	Outputs        []OutputDef            `json:"outputs"`
+	// Env vars set by the caller of the execution, recorded in metadata
+	EnvOverrides map[string]string `json:"envOverrides,omitempty"`
+	// AWS Batch details
+	AWSBatchID string `json:"awsBatchID,omitempty"`
+	JobDef     string `json:"jobDefinition,omitempty"`
+	JobQueue   string `json:"jobQueue,omitempty"`
+	JobName    string `json:"jobName,omitempty"`
+}
+
+// Coordinator shares ownership of active jobs with other instances using the same database
+type Coordinator struct {
+	InstanceID   string
+	DB           Database
+	ActiveJobs   *ActiveJobs
+	MessageQueue *MessageQueue
+	StorageSvc   *s3.S3
+
+	leaseTTL time.Duration
+	// resumes aws-batch jobs taken over from another instance, replaced in tests
+	resume func(*AWSBatchJob) (string, error)
+
+	mu sync.Mutex
+	// leases held by this instance
+	owned  map[string]bool
+	closed bool
+}
+
+// Create a coordinator for this instance.
+// Instance id is read from INSTANCE_ID and must be unique among instances, by default a random suffix is added to the host name.
+// Lease duration is read from JOB_LEASE_TTL.
+func NewCoordinator(db Database, ac *ActiveJobs, mq *MessageQueue, svc *s3.S3) (*Coordinator, error) {
+	id := os.Getenv("INSTANCE_ID")
+	if id == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "process-api"
+		}
+		id = fmt.Sprintf("%s-%s", host, uuid.New().String()[:8])
+	}
+
+	ttl := defaultJobLeaseTTL
+	if v := os.Getenv("JOB_LEASE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 3*time.Second {
+			return nil, fmt.Errorf("invalid JOB_LEASE_TTL %s, expected a duration of at least 3s", v)
+		}
+		ttl = d
+	}
+
+	return &Coordinator{
+		InstanceID:   id,
+		DB:           db,
+		ActiveJobs:   ac,
+		MessageQueue: mq,
+		StorageSvc:   svc,
+		leaseTTL:     ttl,
+		resume:       (*AWSBatchJob).Resume,
+		owned:        map[string]bool{},
+	}, nil
+}
+
+func (c *Coordinator) leaseExpiry() time.Time {
+	return time.Now().UTC().Add(c.leaseTTL)
+}
+
+// Record this instance as the owner of a job it started.
+// Jobs that already finished are skipped, their lease would have been released before it was added.
+func (c *Coordinator) Acquire(j Job) error {
+	var s jobSpec
+	switch jj := j.(type) {
+	case *AWSBatchJob:
+		s = jobSpec{
+			Host:           "aws-batch",
+			ProcessID:      jj.ProcessName,
+			ProcessVersion: jj.ProcessVersion,
+			Submitter:      jj.Submitter,
+			Group:          jj.Group,
+			Image:          jj.Image,
+			ImageDigest:    jj.imageDigest,
+			Cmd:            jj.Cmd,
+			Inputs:         jj.Inputs,
+			Outputs:        jj.Outputs,
+			EnvOverrides:   jj.EnvOverrides,
+			AWSBatchID:     jj.AWSBatchID,
+			JobDef:         jj.JobDef,
+			JobQueue:       jj.JobQueue,
+			JobName:        jj.JobName,
+		}
+	default:
+		// containers run on the docker daemon of this instance, other instances can not take them over
+		s = jobSpec{Host: "local", ProcessID: j.ProcessID(), ProcessVersion: j.ProcessVersionID(), Submitter: j.SUBMITTER(), Image: j.IMAGE()}
+	}
+
+	spec, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// jobs that fail at once can be released before they are acquired, status is terminal before the release
+	switch j.CurrentStatus() {
+	case SUCCESSFUL, FAILED, DISMISSED:
+		return nil
+	}
+
+	err = c.DB.AddJobLease(JobLease{JobID: j.JobID(), Owner: c.InstanceID, Expires: c.leaseExpiry(), Spec: spec})
+	if err != nil {
+		return err
+	}
+	c.owned[j.JobID()] = true
+	return nil
+}
+
+// Release the lease of a job that is no longer active
+func (c *Coordinator) Release(j Job) error {
+	return c.release(j.JobID())
+}
+
+func (c *Coordinator) release(jid string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.owned, jid)
+	return c.DB.RemoveJobLease(jid, c.InstanceID)
+}
+
+// Send a command to the instance owning the job.
+// Returns false if the job is not owned by any instance.
+func (c *Coordinator) Forward(cmd JobCommand) (bool, error) {
+	return c.DB.SendJobCommand(cmd)
+}
+
+// Run renews leases of this instance, takes over jobs with expired leases and executes commands sent to this instance.
+// Returns after HandOver.
+func (c *Coordinator) Run() {
+	commands := c.DB.JobCommands()
+	ticker := time.NewTicker(c.leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-commands:
+		case <-ticker.C:
+			if !c.renew() {
+				return
+			}
+			c.claim()
+		}
+		// also run on ticks in case a notification was missed
+		c.executeCommands()
+	}
+}
+
+// Renew leases of this instance, returns false once the instance has handed over its jobs
+func (c *Coordinator) renew() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	renewed, err := c.DB.RenewJobLeases(c.InstanceID, c.leaseExpiry())
+	if err != nil {
+		log.Errorf("could not renew job leases: %s", err.Error())
+		return true
+	}
+
+	held := make(map[string]bool, len(renewed))
+	for _, jid := range renewed {
+		held[jid] = true
+	}
+
+	// Leases are lost if they could not be renewed in time and another instance took the jobs over
+	for jid := range c.owned {
+		if held[jid] {
+			continue
+		}
+		log.Errorf("lease of job %s was lost to another instance", jid)
+		delete(c.owned, jid)
+		if j, ok := c.ActiveJobs.Get(jid); ok {
+			(*j).LogMessage("Lease lost, job is no longer managed by this instance.", log.ErrorLevel)
+			c.ActiveJobs.Remove(j)
+		}
+	}
+	return true
+}
+
+func (c *Coordinator) claim() {
+	leases, err := c.DB.ClaimExpiredJobLeases(c.InstanceID, time.Now().UTC(), c.leaseExpiry())
+	if err != nil {
+		log.Errorf("could not claim expired job leases: %s", err.Error())
+		return
+	}
+
+	for _, l := range leases {
+		log.Infof("taking over job %s from instance %s", l.JobID, l.Owner)
+		c.takeOver(l)
+	}
+}
+
+// Take over a job from an instance that stopped renewing its lease
+func (c *Coordinator) takeOver(l JobLease) {
+	c.mu.Lock()
+	c.owned[l.JobID] = true
+	c.mu.Unlock()
+
+	// lease of this instance expired while the database was unreachable, the job is still managed here
+	if _, ok := c.ActiveJobs.Get(l.JobID); ok && l.Owner == c.InstanceID {
+		return
+	}
+
+	release := func() {
+		if err := c.release(l.JobID); err != nil {
+			log.Errorf("could not release lease of job %s: %s", l.JobID, err.Error())
+		}
+	}
+
+	jr, ok, err := c.DB.GetJob(l.JobID)
+	if err != nil {
+		log.Errorf("could not take over job %s: %s", l.JobID, err.Error())
+		c.retry(l.JobID)
+		return
+	}
+	if !ok {
+		release()
+		return
+	}
+
+	switch jr.Status {
+	case SUCCESSFUL, FAILED, DISMISSED:
+		// job finished before its lease was released
+		release()
+		return
+	}
+
+	var s jobSpec
+	if err := json.Unmarshal(l.Spec, &s); err != nil {
+		log.Errorf("could not take over job %s, invalid job spec: %s", l.JobID, err.Error())
+		s.Host = ""
+	}
+
+	switch s.Host {
+	case "aws-batch":
+		history, err := c.DB.GetJobEvents(l.JobID)
+		if err != nil {
+			log.Errorf("could not take over job %s: %s", l.JobID, err.Error())
+			c.retry(l.JobID)
+			return
+		}
+
+		aj := &AWSBatchJob{
+			UUID:           l.JobID,
+			AWSBatchID:     s.AWSBatchID,
+			Image:          s.Image,
+			imageDigest:    s.ImageDigest,
+			ProcessName:    s.ProcessID,
+			ProcessVersion: s.ProcessVersion,
+			Submitter:      s.Submitter,
+			Group:          s.Group,
+			Cmd:            s.Cmd,
+			Inputs:         s.Inputs,
+			Outputs:        s.Outputs,
+			EnvOverrides:   s.EnvOverrides,
+			JobDef:         s.JobDef,
+			JobQueue:       s.JobQueue,
+			JobName:        s.JobName,
+			Status:         jr.Status,
+			UpdateTime:     jr.LastUpdate,
+			DB:             c.DB,
+			StorageSvc:     c.StorageSvc,
+			DoneChan:       c.MessageQueue.JobDone,
+		}
+		for _, e := range history {
+			aj.statusHistory = append(aj.statusHistory, statusTransition{e.Status, e.Time})
+		}
+
+		status, err := c.resume(aj)
+		if err != nil {
+			log.Errorf("could not take over job %s: %s", l.JobID, err.Error())
+			c.retry(l.JobID)
+			return
+		}
+
+		var j Job = aj
+		c.ActiveJobs.Add(&j)
+
+		// status can not go back to accepted once the job is running
+		if status != jr.Status && status != ACCEPTED {
+			c.MessageQueue.StatusChan <- StatusMessage{
+				Job:        &j,
+				Status:     status,
+				LastUpdate: time.Now(),
+				Source:     EventSourceReconciler,
+				Message:    fmt.Sprintf("status reconciled with AWS Batch after instance %s stopped", l.Owner),
+			}
+		}
+
+	default:
+		// Containers of local jobs ran on the host of the instance that stopped
+		msg := fmt.Sprintf("instance %s running the job stopped", l.Owner)
+		if err := c.DB.updateJobRecord(l.JobID, FAILED, EventSourceReconciler, msg, time.Now()); err != nil {
+			log.Errorf("could not update status of job %s: %s", l.JobID, err.Error())
+			c.retry(l.JobID)
+			return
+		}
+		release()
+	}
+}
+
+// Expire the lease of a job that could not be taken over, so that it is tried again
+func (c *Coordinator) retry(jid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.owned, jid)
+	if err := c.DB.ExpireJobLease(jid, c.InstanceID); err != nil {
+		log.Errorf("could not expire lease of job %s: %s", jid, err.Error())
+	}
+}
+
+// Execute commands sent by other instances for jobs of this instance
+func (c *Coordinator) executeCommands() {
+	cmds, err := c.DB.TakeJobCommands(c.InstanceID)
+	if err != nil {
+		log.Errorf("could not read job commands: %s", err.Error())
+		return
+	}
+
+	for _, cmd := range cmds {
+		j, ok := c.ActiveJobs.Get(cmd.JobID)
+		if !ok {
+			log.Infof("%s command received for inactive job: %s", cmd.Action, cmd.JobID)
+			continue
+		}
+
+		switch cmd.Action {
+		case JobCommandStatus:
+			(*j).LogMessage(fmt.Sprintf("Status update received from another instance: %s.", cmd.Status), log.InfoLevel)
+			c.MessageQueue.StatusChan <- StatusMessage{Job: j, Status: cmd.Status, LastUpdate: cmd.Time, Message: cmd.Message, Source: cmd.Source}
+		case JobCommandDismiss:
+			jid := cmd.JobID
+			go func() {
+				if err := (*j).Kill(); err != nil {
+					log.Errorf("could not dismiss job %s: %s", jid, err.Error())
+				}
+			}()
+		default:
+			log.Warnf("unknown command %s for job %s", cmd.Action, cmd.JobID)
+		}
+	}
+}
+
+// Prepare for shutdown. Local jobs are killed since their containers stop with this instance,
+// leases of other jobs are expired so that another instance takes them over without waiting.
+func (c *Coordinator) HandOver() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+
+	c.ActiveJobs.mu.Lock()
+	defer c.ActiveJobs.mu.Unlock()
+
+	for _, j := range c.ActiveJobs.Jobs {
+		switch (*j).CurrentStatus() {
+		case ACCEPTED, RUNNING:
+		default:
+			continue
+		}
+
+		if _, ok := (*j).(*AWSBatchJob); ok && c.owned[(*j).JobID()] {
+			if err := c.DB.ExpireJobLease((*j).JobID(), c.InstanceID); err != nil {
+				log.Errorf("could not hand over job %s: %s", (*j).JobID(), err.Error())
+			}
+			continue
+		}
+		// we can't wait for each Kill operation to complete since limited time is available to gracefully shutdown
+		go (*j).Kill()
+	}
+}
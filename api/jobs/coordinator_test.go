@@ -0,0 +1,247 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Job managed by a coordinator in tests, methods the coordinator does not call are not implemented
+type testJob struct {
+	Job
+	id     string
+	status string
+	killed chan struct{}
+}
+
+func newTestJob(id, status string) *testJob {
+	return &testJob{id: id, status: status, killed: make(chan struct{})}
+}
+
+func (j *testJob) JobID() string                                     { return j.id }
+func (j *testJob) CurrentStatus() string                             { return j.status }
+func (j *testJob) ProcessID() string                                 { return "pyecho" }
+func (j *testJob) ProcessVersionID() string                          { return "1.0.0" }
+func (j *testJob) SUBMITTER() string                                 { return "a@example.com" }
+func (j *testJob) IMAGE() string                                     { return "pyecho:1.0.0" }
+func (j *testJob) LogMessage(string, log.Level)                      {}
+func (j *testJob) Kill() error                                       { close(j.killed); return nil }
+func (j *testJob) Equals(other Job) bool                             { return other.JobID() == j.id }
+func (j *testJob) LastUpdate() time.Time                             { return time.Time{} }
+func (j *testJob) NewStatusUpdate(string, time.Time, string, string) {}
+
+func newTestCoordinator(t *testing.T, db Database, id string) *Coordinator {
+	t.Helper()
+	t.Setenv("INSTANCE_ID", id)
+	ac := &ActiveJobs{Jobs: map[string]*Job{}}
+	mq := &MessageQueue{StatusChan: make(chan StatusMessage, 10), JobDone: make(chan Job, 10)}
+	c, err := NewCoordinator(db, ac, mq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *Coordinator) isOwned(jid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.owned[jid]
+}
+
+func addActive(c *Coordinator, j Job) {
+	c.ActiveJobs.Add(&j)
+}
+
+func TestCoordinatorAcquireRelease(t *testing.T) {
+	db := NewMemoryDB()
+	c := newTestCoordinator(t, db, "a")
+
+	j := newTestJob("job-1", RUNNING)
+	if err := c.Acquire(j); err != nil {
+		t.Fatal(err)
+	}
+	if l, ok, _ := db.GetJobLease("job-1"); !ok || l.Owner != "a" || !c.isOwned("job-1") {
+		t.Fatalf("lease after Acquire is %+v, %v", l, ok)
+	}
+	if err := c.Release(j); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := db.GetJobLease("job-1"); ok || c.isOwned("job-1") {
+		t.Error("lease kept after Release")
+	}
+
+	// a job that failed at once is released before it is acquired
+	failed := newTestJob("job-2", FAILED)
+	if err := c.Release(failed); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Acquire(failed); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := db.GetJobLease("job-2"); ok || c.isOwned("job-2") {
+		t.Error("lease added for a finished job")
+	}
+}
+
+func TestCoordinatorRenew(t *testing.T) {
+	db := NewMemoryDB()
+	c := newTestCoordinator(t, db, "a")
+
+	kept, lost := newTestJob("kept", RUNNING), newTestJob("lost", RUNNING)
+	for _, j := range []*testJob{kept, lost} {
+		addActive(c, j)
+		if err := c.Acquire(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another instance took the job over while this instance could not renew
+	if err := db.ExpireJobLease("lost", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ClaimExpiredJobLeases("b", time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	if !c.renew() {
+		t.Fatal("renew stopped before hand over")
+	}
+	if l, _, _ := db.GetJobLease("kept"); l.Owner != "a" || !l.Expires.After(before) {
+		t.Errorf("lease of kept job is %+v", l)
+	}
+	if _, ok := c.ActiveJobs.Get("lost"); ok || c.isOwned("lost") {
+		t.Error("job with a lost lease is still managed")
+	}
+	if _, ok := c.ActiveJobs.Get("kept"); !ok || !c.isOwned("kept") {
+		t.Error("job with a renewed lease is no longer managed")
+	}
+
+	c.HandOver()
+	select {
+	case <-kept.killed:
+	case <-time.After(time.Second):
+		t.Error("local job not killed on hand over")
+	}
+	if c.renew() {
+		t.Error("renew continued after hand over")
+	}
+}
+
+func TestCoordinatorTakeOver(t *testing.T) {
+	db := NewMemoryDB()
+	now := time.Now()
+
+	addLease := func(jid, status string, s jobSpec) {
+		t.Helper()
+		if err := db.addJob(jid, status, "async-execute", s.Host, "pyecho", "1.0.0", "a@example.com", "", now.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		spec, _ := json.Marshal(s)
+		if err := db.AddJobLease(JobLease{JobID: jid, Owner: "a", Expires: now.Add(-time.Minute), Spec: spec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addLease("batch", RUNNING, jobSpec{Host: "aws-batch", ProcessID: "pyecho", AWSBatchID: "batch-123", JobQueue: "queue"})
+	addLease("local", RUNNING, jobSpec{Host: "local", ProcessID: "pyecho"})
+	addLease("finished", SUCCESSFUL, jobSpec{Host: "local", ProcessID: "pyecho"})
+	addLease("unavailable", RUNNING, jobSpec{Host: "aws-batch", ProcessID: "pyecho", AWSBatchID: "batch-456"})
+
+	c := newTestCoordinator(t, db, "b")
+	c.resume = func(aj *AWSBatchJob) (string, error) {
+		if aj.AWSBatchID == "batch-456" {
+			return "", errors.New("aws batch unavailable")
+		}
+		aj.logger = log.New()
+		return SUCCESSFUL, nil
+	}
+	c.claim()
+
+	// aws-batch jobs are resumed and their status reconciled
+	j, ok := c.ActiveJobs.Get("batch")
+	if !ok || !c.isOwned("batch") {
+		t.Fatal("aws-batch job not taken over")
+	}
+	if aj := (*j).(*AWSBatchJob); aj.AWSBatchID != "batch-123" || aj.JobQueue != "queue" || aj.Status != RUNNING {
+		t.Errorf("aws-batch job resumed as %+v", aj)
+	}
+	select {
+	case sm := <-c.MessageQueue.StatusChan:
+		if sm.Status != SUCCESSFUL || sm.Source != EventSourceReconciler || (*sm.Job).JobID() != "batch" {
+			t.Errorf("reconciled status is %+v", sm)
+		}
+	default:
+		t.Error("status of the aws-batch job not reconciled")
+	}
+
+	// aws-batch jobs that can not be resumed are tried again
+	if l, _, _ := db.GetJobLease("unavailable"); !l.Expires.IsZero() || c.isOwned("unavailable") {
+		t.Errorf("lease of a job that could not be resumed is %+v", l)
+	}
+
+	// local jobs ran on the instance that stopped
+	if jr, _, _ := db.GetJob("local"); jr.Status != FAILED {
+		t.Errorf("local job taken over has status %s", jr.Status)
+	}
+	for _, jid := range []string{"local", "finished"} {
+		if _, ok, _ := db.GetJobLease(jid); ok || c.isOwned(jid) {
+			t.Errorf("lease of %s job not released", jid)
+		}
+	}
+	if jr, _, _ := db.GetJob("finished"); jr.Status != SUCCESSFUL {
+		t.Errorf("finished job taken over has status %s", jr.Status)
+	}
+}
+
+func TestCoordinatorExecuteCommands(t *testing.T) {
+	db := NewMemoryDB()
+	owner := newTestCoordinator(t, db, "a")
+	other := newTestCoordinator(t, db, "b")
+
+	updated, dismissed := newTestJob("updated", RUNNING), newTestJob("dismissed", RUNNING)
+	for _, j := range []*testJob{updated, dismissed} {
+		addActive(owner, j)
+		if err := owner.Acquire(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent := time.Now()
+	for _, cmd := range []JobCommand{
+		{JobID: "updated", Action: JobCommandStatus, Status: SUCCESSFUL, Time: sent, Message: "done", Source: EventSourceCallback},
+		{JobID: "dismissed", Action: JobCommandDismiss},
+	} {
+		if ok, err := other.Forward(cmd); err != nil || !ok {
+			t.Fatalf("Forward(%+v) = %v, %v", cmd, ok, err)
+		}
+	}
+	if ok, _ := other.Forward(JobCommand{JobID: "unknown", Action: JobCommandDismiss}); ok {
+		t.Error("command forwarded for a job without lease")
+	}
+
+	// commands are only taken by the owner
+	other.executeCommands()
+	select {
+	case sm := <-other.MessageQueue.StatusChan:
+		t.Errorf("command executed by another instance: %+v", sm)
+	default:
+	}
+
+	owner.executeCommands()
+	select {
+	case sm := <-owner.MessageQueue.StatusChan:
+		if (*sm.Job).JobID() != "updated" || sm.Status != SUCCESSFUL || sm.Source != EventSourceCallback || sm.Message != "done" || !sm.LastUpdate.Equal(sent.Round(0)) {
+			t.Errorf("forwarded status is %+v", sm)
+		}
+	default:
+		t.Error("forwarded status not sent to the status routine")
+	}
+	select {
+	case <-dismissed.killed:
+	case <-time.After(time.Second):
+		t.Error("forwarded dismiss did not kill the job")
+	}
+}
@@ -1,6 +1,8 @@
 package jobs
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -8,14 +10,124 @@ import (
 
 // Database interface abstracts database operations
 type Database interface {
-	addJob(jid, status, mode, host, processID, submitter string, updated time.Time) error
-	updateJobRecord(jid, status string, now time.Time) error
+	addJob(jid, status, mode, host, processID, processVersion, submitter, group string, updated time.Time) error
+	// Update status and time of the job and record the transition as a job event
+	updateJobRecord(jid, status, source, message string, now time.Time) error
 	GetJob(jid string) (JobRecord, bool, error)
 	CheckJobExist(jid string) (bool, error)
-	GetJobs(limit, offset int, processIDs, statuses, submitters []string) ([]JobRecord, error)
+	// Status transitions of a job ordered by time
+	GetJobEvents(jid string) ([]JobEvent, error)
+	// Returns a page of jobs and the cursor for the next page, empty if there are no more jobs
+	GetJobs(q JobsQuery) ([]JobRecord, string, error)
+	// Statistics of jobs created in [from, to) with the top submitters, processID is optional
+	GetJobStats(processID string, from, to time.Time, top int) (JobStats, error)
+	// Record the compute consumed by a finished job, recording a job twice keeps the first record
+	addJobUsage(u JobUsage) error
+	GetJobUsage(jid string) (JobUsage, bool, error)
+	// Compute consumed by jobs that ended in the query range, ordered by cpu seconds descending
+	GetUsage(q UsageQuery) ([]UsageSummary, error)
+	// Number of jobs of the submitter created since the time
+	CountJobs(submitter string, since time.Time) (int, error)
+	// Insert a job from an archive with its events and usage, returns false if the job already exists
+	restoreJob(a ArchivedJob) (bool, error)
+
+	// Process definitions that are not deleted, ordered by id
+	GetProcesses() ([]ProcessRecord, error)
+	// Process definition including tombstone of deleted processes
+	GetProcess(pid string) (ProcessRecord, bool, error)
+	// Add a new process, returns ErrProcessExists if a process with the same id exists and is not deleted.
+	// Versions are immutable, AddProcess and PutProcess return ErrProcessVersionExists
+	// if the version is already registered with a different definition.
+	AddProcess(pr ProcessRecord) error
+	// Add or replace a process
+	PutProcess(pr ProcessRecord) error
+	// Mark a process deleted, returns false if process does not exist
+	DeleteProcess(pid, source string) (bool, error)
+	// All versions of a process ordered by registration time, including versions of deleted processes
+	GetProcessVersions(pid string) ([]ProcessRecord, error)
+	GetProcessVersion(pid, version string) (ProcessRecord, bool, error)
+	// Channel that receives a value when process definitions are changed by any instance.
+	// Multiple changes may be coalesced in one value.
+	ProcessChanges() <-chan struct{}
+
+	// Record the instance owning an active job
+	AddJobLease(l JobLease) error
+	GetJobLease(jid string) (JobLease, bool, error)
+	// Extend all leases of the owner, returns ids of the jobs whose lease was extended
+	RenewJobLeases(owner string, expires time.Time) ([]string, error)
+	// Expire the lease so that another instance takes the job over without waiting
+	ExpireJobLease(jid, owner string) error
+	// Remove the lease and pending commands of a job that is no longer active
+	RemoveJobLease(jid, owner string) error
+	// Transfer leases that expired before now to owner.
+	// Returns the leases taken over with the previous owner.
+	ClaimExpiredJobLeases(owner string, now, expires time.Time) ([]JobLease, error)
+	// Queue a command for the owner of the job, returns false if the job has no lease
+	SendJobCommand(cmd JobCommand) (bool, error)
+	// Remove and return the pending commands for jobs of the owner, in the order they were sent
+	TakeJobCommands(owner string) ([]JobCommand, error)
+	// Channel that receives a value when commands are sent by any instance.
+	// Multiple commands may be coalesced in one value.
+	JobCommands() <-chan struct{}
+
+	AddAPIKey(k APIKey) error
+	// Key with the token hash, including revoked and expired keys
+	GetAPIKey(hash string) (APIKey, bool, error)
+	// Keys of the owner ordered by creation time, keys of all owners if owner is empty
+	GetAPIKeys(owner string) ([]APIKey, error)
+	// Revoke a key of the owner, or of any owner if owner is empty.
+	// Returns false if there is no such key or it is already revoked.
+	RevokeAPIKey(id, owner string, t time.Time) (bool, error)
+	// Record when a key last authenticated a request
+	TouchAPIKey(id string, t time.Time) error
+
+	// Append an entry to the audit log, the id is assigned by the database
+	AddAuditEntry(e AuditEntry) error
+	// Entries matching the query, newest first
+	GetAuditEntries(q AuditQuery) ([]AuditEntry, error)
+
 	Close() error
 }
 
+// Sources of process definitions
+const (
+	ProcessSourceAPI  = "api"
+	ProcessSourceYAML = "yaml"
+)
+
+// How often instances check for process changes and job commands when the database can not notify them
+const (
+	processPollInterval    = 5 * time.Second
+	jobCommandPollInterval = time.Second
+)
+
+// ErrProcessExists is returned when adding a process that already exists
+var ErrProcessExists = errors.New("process already exists")
+
+// ErrProcessVersionExists is returned when registering an existing version with a different definition
+var ErrProcessVersionExists = errors.New("process version already exists with a different definition")
+
+// ProcessRecord is a process definition stored in the database
+type ProcessRecord struct {
+	ID      string
+	Version string
+	// JSON encoded process definition
+	Definition []byte
+	// Where the current definition came from, api or yaml
+	Source  string
+	Deleted bool
+	Updated time.Time
+}
+
+// JobLease records the instance owning an active job until the lease expires
+type JobLease struct {
+	JobID   string
+	Owner   string
+	Expires time.Time
+	// JSON encoded state needed by another instance to take over the job
+	Spec []byte
+}
+
 func NewDatabase(dbType string) (db Database, err error) {
 
 	switch dbType {
@@ -31,6 +143,8 @@ func NewDatabase(dbType string) (db Database, err error) {
 			return nil, fmt.Errorf("env variable POSTGRES_CONN_STRING not set")
 		}
 		db, err = NewPostgresDB(connString)
+	case "memory":
+		db = NewMemoryDB()
 	default:
 		return nil, fmt.Errorf("unsupported database type: %s", dbType)
 	}
@@ -41,3 +155,46 @@ func NewDatabase(dbType string) (db Database, err error) {
 
 	return db, nil
 }
+
+// Open a connection to the database set by dbType without applying migrations.
+func openDB(dbType string) (*sql.DB, error) {
+	switch dbType {
+	case "sqlite":
+		dbPath, exist := os.LookupEnv("SQLITE_DB_PATH")
+		if !exist {
+			return nil, fmt.Errorf("env variable SQLITE_DB_PATH not set")
+		}
+		return openSQLite(dbPath)
+	case "postgres":
+		connString, exist := os.LookupEnv("POSTGRES_CONN_STRING")
+		if !exist {
+			return nil, fmt.Errorf("env variable POSTGRES_CONN_STRING not set")
+		}
+		return openPostgres(connString)
+	case "memory":
+		return nil, fmt.Errorf("memory database has no schema to migrate")
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+}
+
+// Apply all pending migrations to the database.
+func migrateUp(h *sql.DB, dbType string) error {
+	m, err := newMigrator(h, dbType)
+	if err != nil {
+		return err
+	}
+	_, err = m.Up(0)
+	if err != nil {
+		return fmt.Errorf("error migrating database: %s", err.Error())
+	}
+	return nil
+}
+
+// Send a value on the channel without blocking, changes are coalesced if a value is pending
+func notifyChange(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,771 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// CheckDatabase runs the conformance checks every Database implementation must pass.
+// newDB must return an empty database, it is called for each check and the database is closed afterwards.
+// Returns an error listing all failed checks. Each implementation runs it from its own test, see database_memory_test.go.
+func CheckDatabase(newDB func() (Database, error)) error {
+	checks := []struct {
+		name  string
+		check func(db Database) error
+	}{
+		{"jobs", checkJobs},
+		{"job lists", checkJobLists},
+		{"job stats", checkJobStats},
+		{"usage", checkUsage},
+		{"restore", checkRestore},
+		{"processes", checkProcesses},
+		{"leases", checkLeases},
+		{"commands", checkCommands},
+		{"api keys", checkAPIKeys},
+		{"audit log", checkAuditLog},
+	}
+
+	failed := []string{}
+	for _, c := range checks {
+		db, err := newDB()
+		if err != nil {
+			return fmt.Errorf("could not create database: %s", err.Error())
+		}
+		err = c.check(db)
+		db.Close()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.name, err.Error()))
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// Databases store times with server local wall clock and at least microsecond precision,
+// some return the wall clock without the zone.
+func sameTime(got, want time.Time) bool {
+	const wall = "2006-01-02T15:04:05.000000"
+	return got.Equal(want) || got.Format(wall) == want.Local().Format(wall)
+}
+
+// Base time for records created by the checks, precise to the second so that all databases keep it
+func checkTime() time.Time {
+	return time.Now().Add(-time.Hour).Truncate(time.Second)
+}
+
+func checkJobs(db Database) error {
+	t := checkTime()
+
+	err := db.addJob("job-1", ACCEPTED, "async-execute", "local", "proc-a", "1.0.0", "a@example.com", "team-a", t)
+	if err != nil {
+		return err
+	}
+	if err := db.addJob("job-1", ACCEPTED, "async-execute", "local", "proc-a", "1.0.0", "a@example.com", "team-a", t); err == nil {
+		return fmt.Errorf("adding an existing job must fail")
+	}
+
+	ok, err := db.CheckJobExist("job-1")
+	if err != nil || !ok {
+		return fmt.Errorf("job-1 must exist, got %v, %v", ok, err)
+	}
+	ok, err = db.CheckJobExist("job-missing")
+	if err != nil || ok {
+		return fmt.Errorf("job-missing must not exist, got %v, %v", ok, err)
+	}
+
+	err = db.updateJobRecord("job-1", RUNNING, EventSourceServer, "", t.Add(time.Second))
+	if err != nil {
+		return err
+	}
+	err = db.updateJobRecord("job-1", SUCCESSFUL, EventSourceCallback, "done", t.Add(2*time.Second))
+	if err != nil {
+		return err
+	}
+
+	jr, ok, err := db.GetJob("job-1")
+	if err != nil || !ok {
+		return fmt.Errorf("job-1 not found: %v", err)
+	}
+	want := JobRecord{JobID: "job-1", Status: SUCCESSFUL, ProcessID: "proc-a", ProcessVersion: "1.0.0", Mode: "async-execute", Host: "local", Submitter: "a@example.com", Group: "team-a"}
+	got := jr
+	got.Created, got.LastUpdate = time.Time{}, time.Time{}
+	if got != want {
+		return fmt.Errorf("GetJob returned %+v, want %+v", got, want)
+	}
+	if !sameTime(jr.Created, t) || !sameTime(jr.LastUpdate, t.Add(2*time.Second)) {
+		return fmt.Errorf("GetJob returned created %s and updated %s, want %s and %s", jr.Created, jr.LastUpdate, t, t.Add(2*time.Second))
+	}
+
+	_, ok, err = db.GetJob("job-missing")
+	if err != nil || ok {
+		return fmt.Errorf("GetJob of a missing job must return false, got %v, %v", ok, err)
+	}
+
+	events, err := db.GetJobEvents("job-1")
+	if err != nil {
+		return err
+	}
+	if len(events) != 2 || events[0].Status != RUNNING || events[1].Status != SUCCESSFUL ||
+		events[1].Source != EventSourceCallback || events[1].Message != "done" || !sameTime(events[1].Time, t.Add(2*time.Second)) {
+		return fmt.Errorf("GetJobEvents returned %+v", events)
+	}
+
+	events, err = db.GetJobEvents("job-missing")
+	if err != nil || len(events) != 0 {
+		return fmt.Errorf("GetJobEvents of a missing job must be empty, got %+v, %v", events, err)
+	}
+	return nil
+}
+
+func checkJobLists(db Database) error {
+	t := checkTime()
+
+	// jobs are created a minute apart and updated in reverse order
+	n := 7
+	for i := 0; i < n; i++ {
+		jid := fmt.Sprintf("job-%d", i)
+		pid, submitter := "proc-a", "a@example.com"
+		if i%2 == 1 {
+			pid, submitter = "proc-b", "b@example.com"
+		}
+		// every third job is shared with a group
+		group := ""
+		if i%3 == 0 {
+			group = "team-x"
+		}
+		created := t.Add(time.Duration(i) * time.Minute)
+		if err := db.addJob(jid, ACCEPTED, "async-execute", "local", pid, "1.0.0", submitter, group, created); err != nil {
+			return err
+		}
+		if err := db.updateJobRecord(jid, RUNNING, EventSourceServer, "", t.Add(time.Hour-time.Duration(i)*time.Minute)); err != nil {
+			return err
+		}
+	}
+	if err := db.updateJobRecord("job-0", FAILED, EventSourceServer, "", t.Add(2*time.Hour)); err != nil {
+		return err
+	}
+
+	ids := func(q JobsQuery) ([]string, error) {
+		res := []string{}
+		for {
+			page, next, err := db.GetJobs(q)
+			if err != nil {
+				return nil, err
+			}
+			if len(page) > q.Limit {
+				return nil, fmt.Errorf("page of %d jobs exceeds limit %d", len(page), q.Limit)
+			}
+			for _, r := range page {
+				res = append(res, r.JobID)
+			}
+			if next == "" {
+				return res, nil
+			}
+			q.Cursor = next
+		}
+	}
+
+	cases := []struct {
+		q    JobsQuery
+		want []string
+	}{
+		{JobsQuery{Limit: 100}, []string{"job-0", "job-1", "job-2", "job-3", "job-4", "job-5", "job-6"}},
+		{JobsQuery{Limit: 2, Sort: "updated"}, []string{"job-6", "job-5", "job-4", "job-3", "job-2", "job-1", "job-0"}},
+		{JobsQuery{Limit: 3, Sort: "created"}, []string{"job-0", "job-1", "job-2", "job-3", "job-4", "job-5", "job-6"}},
+		{JobsQuery{Limit: 3, Sort: "-created"}, []string{"job-6", "job-5", "job-4", "job-3", "job-2", "job-1", "job-0"}},
+		{JobsQuery{Limit: 10, Sort: "created", ProcessIDs: []string{"proc-b"}}, []string{"job-1", "job-3", "job-5"}},
+		{JobsQuery{Limit: 10, Sort: "created", Submitters: []string{"a@example.com"}, Statuses: []string{RUNNING}}, []string{"job-2", "job-4", "job-6"}},
+		{JobsQuery{Limit: 10, Sort: "created", CreatedAfter: t.Add(2 * time.Minute), CreatedBefore: t.Add(5 * time.Minute)}, []string{"job-2", "job-3", "job-4"}},
+		{JobsQuery{Limit: 10, Sort: "created", UpdatedAfter: t.Add(time.Hour - 2*time.Minute), UpdatedBefore: t.Add(time.Hour)}, []string{"job-1", "job-2"}},
+		{JobsQuery{Limit: 2, Sort: "created", Offset: 5}, []string{"job-5", "job-6"}},
+		{JobsQuery{Limit: 2, Sort: "created", Viewer: &JobViewer{Email: "b@example.com", Groups: []string{"team-x", ""}}}, []string{"job-0", "job-1", "job-3", "job-5", "job-6"}},
+		{JobsQuery{Limit: 10, Sort: "created", Viewer: &JobViewer{Groups: []string{""}}}, []string{}},
+	}
+	for _, c := range cases {
+		got, err := ids(c.q)
+		if err != nil {
+			return fmt.Errorf("query %+v: %s", c.q, err.Error())
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			return fmt.Errorf("query %+v returned %v, want %v", c.q, got, c.want)
+		}
+	}
+
+	// records in lists have the same times as GetJob
+	page, _, err := db.GetJobs(JobsQuery{Limit: 1, Sort: "created"})
+	if err != nil {
+		return err
+	}
+	if len(page) != 1 || page[0].ProcessID != "proc-a" || page[0].Status != FAILED || !sameTime(page[0].Created, t) || !sameTime(page[0].LastUpdate, t.Add(2*time.Hour)) {
+		return fmt.Errorf("first job of the list is %+v", page)
+	}
+
+	_, next, err := db.GetJobs(JobsQuery{Limit: 1, Sort: "created"})
+	if err != nil {
+		return err
+	}
+	if _, _, err := db.GetJobs(JobsQuery{Limit: 1, Sort: "updated", Cursor: next}); !errors.Is(err, ErrInvalidCursor) {
+		return fmt.Errorf("cursor of another sort order must return ErrInvalidCursor, got %v", err)
+	}
+	if _, _, err := db.GetJobs(JobsQuery{Limit: 1, Cursor: "not a cursor"}); !errors.Is(err, ErrInvalidCursor) {
+		return fmt.Errorf("malformed cursor must return ErrInvalidCursor, got %v", err)
+	}
+
+	// jobs created at the same time are paged by id, jobs created before the cursor do not shift later pages
+	for _, jid := range []string{"tie-b", "tie-a", "tie-c"} {
+		if err := db.addJob(jid, ACCEPTED, "async-execute", "local", "proc-c", "1.0.0", "c@example.com", "", t.Add(time.Hour)); err != nil {
+			return err
+		}
+	}
+	q := JobsQuery{Limit: 2, Sort: "created", ProcessIDs: []string{"proc-c"}}
+	page, next, err = db.GetJobs(q)
+	if err != nil {
+		return err
+	}
+	if len(page) != 2 || page[0].JobID != "tie-a" || page[1].JobID != "tie-b" || next == "" {
+		return fmt.Errorf("first page of jobs created at the same time is %+v", page)
+	}
+	if err := db.addJob("tie-0", ACCEPTED, "async-execute", "local", "proc-c", "1.0.0", "c@example.com", "", t); err != nil {
+		return err
+	}
+	q.Cursor = next
+	page, next, err = db.GetJobs(q)
+	if err != nil {
+		return err
+	}
+	if len(page) != 1 || page[0].JobID != "tie-c" || next != "" {
+		return fmt.Errorf("page after the cursor is %+v, next %q", page, next)
+	}
+	return nil
+}
+
+func checkJobStats(db Database) error {
+	t := checkTime()
+
+	if err := db.addJob("job-1", ACCEPTED, "async-execute", "local", "proc-a", "1.0.0", "a@example.com", "", t); err != nil {
+		return err
+	}
+	if err := db.updateJobRecord("job-1", RUNNING, EventSourceServer, "", t.Add(10*time.Second)); err != nil {
+		return err
+	}
+	if err := db.updateJobRecord("job-1", SUCCESSFUL, EventSourceServer, "", t.Add(70*time.Second)); err != nil {
+		return err
+	}
+	if err := db.addJob("job-2", ACCEPTED, "async-execute", "local", "proc-b", "1.0.0", "b@example.com", "", t.Add(time.Minute)); err != nil {
+		return err
+	}
+	if err := db.addJob("job-3", ACCEPTED, "async-execute", "local", "proc-a", "1.0.0", "a@example.com", "", t.Add(2*time.Minute)); err != nil {
+		return err
+	}
+	if err := db.updateJobRecord("job-3", RUNNING, EventSourceServer, "", t.Add(3*time.Minute)); err != nil {
+		return err
+	}
+	if err := db.updateJobRecord("job-3", FAILED, EventSourceServer, "", t.Add(4*time.Minute)); err != nil {
+		return err
+	}
+	if err := db.addJob("job-4", ACCEPTED, "async-execute", "local", "proc-a", "1.0.0", "c@example.com", "", t.Add(-time.Hour)); err != nil {
+		return err
+	}
+
+	s, err := db.GetJobStats("", t, t.Add(time.Hour), 1)
+	if err != nil {
+		return err
+	}
+	if s.Total != 3 || s.Counts[SUCCESSFUL] != 1 || s.Counts[FAILED] != 1 || s.Counts[ACCEPTED] != 1 || s.Counts[RUNNING] != 0 {
+		return fmt.Errorf("GetJobStats counted %d jobs %v, want 3 created in the range", s.Total, s.Counts)
+	}
+	if s.SuccessRate != 0.5 || s.FailureRate != 0.5 {
+		return fmt.Errorf("GetJobStats rates are %v and %v, want 0.5", s.SuccessRate, s.FailureRate)
+	}
+	if s.Duration != (Percentiles{Count: 2, P50: 60, P95: 60}) || s.QueueWait != (Percentiles{Count: 2, P50: 10, P95: 60}) {
+		return fmt.Errorf("GetJobStats durations are %+v, queue waits %+v", s.Duration, s.QueueWait)
+	}
+	if len(s.TopSubmitters) != 1 || s.TopSubmitters[0] != (SubmitterCount{Submitter: "a@example.com", Jobs: 2}) {
+		return fmt.Errorf("GetJobStats top submitters are %+v", s.TopSubmitters)
+	}
+
+	s, err = db.GetJobStats("proc-b", t, t.Add(time.Hour), 10)
+	if err != nil {
+		return err
+	}
+	if s.Total != 1 || s.Counts[ACCEPTED] != 1 || s.Duration.Count != 0 || len(s.TopSubmitters) != 1 || s.TopSubmitters[0].Submitter != "b@example.com" {
+		return fmt.Errorf("GetJobStats of proc-b returned %+v", s)
+	}
+	return nil
+}
+
+func checkUsage(db Database) error {
+	t := checkTime()
+	started := t.Add(-time.Hour)
+
+	records := []JobUsage{
+		newJobUsage("job-1", "proc-a", "a@example.com", "local", 2, 1024, &started, &t),
+		newJobUsage("job-2", "proc-b", "a@example.com", "local", 1, 512, &started, &t),
+		newJobUsage("job-3", "proc-a", "b@example.com", "aws-batch", 4, 2048, &started, &t),
+		// ended before the queried range
+		newJobUsage("job-4", "proc-a", "b@example.com", "aws-batch", 4, 2048, nil, nil),
+	}
+	records[3].Ended = t.Add(-48 * time.Hour)
+	for _, u := range records {
+		if err := db.addJobUsage(u); err != nil {
+			return err
+		}
+	}
+
+	// the first record of a job is kept
+	again := newJobUsage("job-1", "proc-a", "a@example.com", "local", 64, 1024, &started, &t)
+	if err := db.addJobUsage(again); err != nil {
+		return err
+	}
+	u, ok, err := db.GetJobUsage("job-1")
+	if err != nil || !ok {
+		return fmt.Errorf("usage of job-1 not found: %v", err)
+	}
+	if u.CPUs != 2 || u.Memory != 1024 || u.CPUSeconds != 7200 || u.MemorySeconds != 1024*3600 || u.Host != "local" || !sameTime(u.Ended, t) {
+		return fmt.Errorf("GetJobUsage returned %+v", u)
+	}
+	if _, ok, err := db.GetJobUsage("job-missing"); err != nil || ok {
+		return fmt.Errorf("GetJobUsage of a missing job must return false, got %v, %v", ok, err)
+	}
+
+	from, to := t.Add(-24*time.Hour), t.Add(time.Minute)
+	got, err := db.GetUsage(UsageQuery{GroupBy: UsageBySubmitter, From: from, To: to})
+	if err != nil {
+		return err
+	}
+	want := []UsageSummary{
+		{Submitter: "b@example.com", Jobs: 1, Duration: 3600, CPUSeconds: 14400, CPUHours: 4, MemorySeconds: 2048 * 3600},
+		{Submitter: "a@example.com", Jobs: 2, Duration: 7200, CPUSeconds: 10800, CPUHours: 3, MemorySeconds: 1536 * 3600},
+	}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("usage by submitter is %+v, want %+v", got, want)
+	}
+
+	got, err = db.GetUsage(UsageQuery{GroupBy: UsageByProcess, From: from, To: to, Submitters: []string{"a@example.com"}, ProcessIDs: []string{"proc-a"}})
+	if err != nil {
+		return err
+	}
+	want = []UsageSummary{{ProcessID: "proc-a", Jobs: 1, Duration: 3600, CPUSeconds: 7200, CPUHours: 2, MemorySeconds: 1024 * 3600}}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("filtered usage by process is %+v, want %+v", got, want)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := db.addJob(fmt.Sprintf("job-%d", i), ACCEPTED, "async-execute", "local", "proc-a", "1.0.0", "a@example.com", "", t.Add(time.Duration(i)*time.Hour)); err != nil {
+			return err
+		}
+	}
+	n, err := db.CountJobs("a@example.com", t.Add(time.Hour))
+	if err != nil || n != 2 {
+		return fmt.Errorf("CountJobs returned %d, %v, want 2", n, err)
+	}
+	n, err = db.CountJobs("b@example.com", t)
+	if err != nil || n != 0 {
+		return fmt.Errorf("CountJobs of a submitter without jobs returned %d, %v", n, err)
+	}
+	return nil
+}
+
+func checkRestore(db Database) error {
+	t := checkTime()
+
+	a := ArchivedJob{
+		JobRecord: JobRecord{JobID: "job-1", Status: SUCCESSFUL, Created: t, LastUpdate: t.Add(time.Minute), ProcessID: "proc-a", ProcessVersion: "1.0.0", Mode: "async-execute", Host: "local", Submitter: "a@example.com", Group: "team-a"},
+		Events: []JobEvent{
+			{Status: RUNNING, Time: t.Add(time.Second), Source: EventSourceServer},
+			{Status: SUCCESSFUL, Time: t.Add(time.Minute), Source: EventSourceCallback, Message: "done"},
+		},
+		Usage: &JobUsage{ProcessID: "proc-a", Submitter: "a@example.com", Host: "local", CPUs: 1, Memory: 512, Duration: 59, CPUSeconds: 59, MemorySeconds: 512 * 59, Ended: t.Add(time.Minute)},
+	}
+
+	ok, err := db.restoreJob(a)
+	if err != nil || !ok {
+		return fmt.Errorf("restoreJob of a new job returned %v, %v", ok, err)
+	}
+	ok, err = db.restoreJob(a)
+	if err != nil || ok {
+		return fmt.Errorf("restoreJob of an existing job must return false, got %v, %v", ok, err)
+	}
+
+	jr, ok, err := db.GetJob("job-1")
+	if err != nil || !ok || jr.Status != SUCCESSFUL || jr.Host != "local" || !sameTime(jr.Created, t) || !sameTime(jr.LastUpdate, t.Add(time.Minute)) {
+		return fmt.Errorf("restored job is %+v, %v", jr, err)
+	}
+	events, err := db.GetJobEvents("job-1")
+	if err != nil || len(events) != 2 || events[1].Message != "done" {
+		return fmt.Errorf("restored events are %+v, %v", events, err)
+	}
+	u, ok, err := db.GetJobUsage("job-1")
+	if err != nil || !ok || u.JobID != "job-1" || u.CPUSeconds != 59 {
+		return fmt.Errorf("restored usage is %+v, %v", u, err)
+	}
+	return nil
+}
+
+func checkProcesses(db Database) error {
+	t := checkTime()
+	changes := db.ProcessChanges()
+
+	v1 := ProcessRecord{ID: "proc-a", Version: "1.0.0", Definition: []byte(`{"v":1}`), Source: ProcessSourceYAML, Updated: t}
+	if err := db.AddProcess(v1); err != nil {
+		return err
+	}
+	if err := db.AddProcess(v1); !errors.Is(err, ErrProcessExists) {
+		return fmt.Errorf("adding an existing process must return ErrProcessExists, got %v", err)
+	}
+
+	conflict := v1
+	conflict.Definition = []byte(`{"v":"changed"}`)
+	if err := db.PutProcess(conflict); !errors.Is(err, ErrProcessVersionExists) {
+		return fmt.Errorf("changing a registered version must return ErrProcessVersionExists, got %v", err)
+	}
+
+	v2 := ProcessRecord{ID: "proc-a", Version: "2.0.0", Definition: []byte(`{"v":2}`), Source: ProcessSourceAPI, Updated: t.Add(time.Second)}
+	if err := db.PutProcess(v2); err != nil {
+		return err
+	}
+	if err := db.AddProcess(ProcessRecord{ID: "proc-b", Version: "1.0.0", Definition: []byte(`{}`), Source: ProcessSourceAPI, Updated: t}); err != nil {
+		return err
+	}
+
+	pr, ok, err := db.GetProcess("proc-a")
+	if err != nil || !ok || pr.Version != "2.0.0" || string(pr.Definition) != `{"v":2}` || pr.Source != ProcessSourceAPI || pr.Deleted {
+		return fmt.Errorf("GetProcess returned %+v, %v, %v", pr, ok, err)
+	}
+
+	versions, err := db.GetProcessVersions("proc-a")
+	if err != nil || len(versions) != 2 || versions[0].Version != "1.0.0" || versions[1].Version != "2.0.0" {
+		return fmt.Errorf("GetProcessVersions returned %+v, %v", versions, err)
+	}
+	pv, ok, err := db.GetProcessVersion("proc-a", "1.0.0")
+	if err != nil || !ok || string(pv.Definition) != `{"v":1}` {
+		return fmt.Errorf("GetProcessVersion returned %+v, %v, %v", pv, ok, err)
+	}
+	if _, ok, err := db.GetProcessVersion("proc-a", "3.0.0"); err != nil || ok {
+		return fmt.Errorf("GetProcessVersion of a missing version must return false, got %v, %v", ok, err)
+	}
+
+	ok, err = db.DeleteProcess("proc-a", ProcessSourceAPI)
+	if err != nil || !ok {
+		return fmt.Errorf("DeleteProcess returned %v, %v", ok, err)
+	}
+	ok, err = db.DeleteProcess("proc-a", ProcessSourceAPI)
+	if err != nil || ok {
+		return fmt.Errorf("deleting a deleted process must return false, got %v, %v", ok, err)
+	}
+
+	prs, err := db.GetProcesses()
+	if err != nil || len(prs) != 1 || prs[0].ID != "proc-b" {
+		return fmt.Errorf("GetProcesses returned %+v, %v", prs, err)
+	}
+	pr, ok, err = db.GetProcess("proc-a")
+	if err != nil || !ok || !pr.Deleted {
+		return fmt.Errorf("deleted process must be returned with Deleted set, got %+v, %v, %v", pr, ok, err)
+	}
+	versions, err = db.GetProcessVersions("proc-a")
+	if err != nil || len(versions) != 2 {
+		return fmt.Errorf("versions of deleted processes must be kept, got %+v, %v", versions, err)
+	}
+
+	// a deleted process can be added again
+	if err := db.AddProcess(v1); err != nil {
+		return fmt.Errorf("adding a deleted process returned %v", err)
+	}
+
+	// changes made after subscribing are notified
+	select {
+	case <-changes:
+	case <-time.After(2 * processPollInterval):
+		return fmt.Errorf("no value received from ProcessChanges after changes")
+	}
+	return nil
+}
+
+func checkLeases(db Database) error {
+	now := time.Now().Truncate(time.Second)
+
+	l := JobLease{JobID: "job-1", Owner: "instance-a", Expires: now.Add(time.Minute), Spec: []byte(`{"host":"local"}`)}
+	if err := db.AddJobLease(l); err != nil {
+		return err
+	}
+	if err := db.AddJobLease(l); err == nil {
+		return fmt.Errorf("adding a lease for a leased job must fail")
+	}
+	if err := db.AddJobLease(JobLease{JobID: "job-2", Owner: "instance-a", Expires: now.Add(time.Minute), Spec: []byte(`{}`)}); err != nil {
+		return err
+	}
+
+	got, ok, err := db.GetJobLease("job-1")
+	if err != nil || !ok || got.Owner != "instance-a" || string(got.Spec) != string(l.Spec) || !sameTime(got.Expires, l.Expires) {
+		return fmt.Errorf("GetJobLease returned %+v, %v, %v", got, ok, err)
+	}
+	if _, ok, err := db.GetJobLease("job-missing"); err != nil || ok {
+		return fmt.Errorf("GetJobLease of a job without lease must return false, got %v, %v", ok, err)
+	}
+
+	renewed, err := db.RenewJobLeases("instance-a", now.Add(2*time.Minute))
+	if err != nil || len(renewed) != 2 {
+		return fmt.Errorf("RenewJobLeases returned %v, %v", renewed, err)
+	}
+
+	claimed, err := db.ClaimExpiredJobLeases("instance-b", now, now.Add(time.Minute))
+	if err != nil || len(claimed) != 0 {
+		return fmt.Errorf("leases that did not expire must not be claimed, got %+v, %v", claimed, err)
+	}
+
+	// only the owner can expire a lease
+	if err := db.ExpireJobLease("job-1", "instance-b"); err != nil {
+		return err
+	}
+	if err := db.ExpireJobLease("job-2", "instance-a"); err != nil {
+		return err
+	}
+	claimed, err = db.ClaimExpiredJobLeases("instance-b", now, now.Add(time.Minute))
+	if err != nil || len(claimed) != 1 || claimed[0].JobID != "job-2" || claimed[0].Owner != "instance-a" {
+		return fmt.Errorf("ClaimExpiredJobLeases must return job-2 with its previous owner, got %+v, %v", claimed, err)
+	}
+	got, _, err = db.GetJobLease("job-2")
+	if err != nil || got.Owner != "instance-b" {
+		return fmt.Errorf("claimed lease is %+v, %v", got, err)
+	}
+
+	// only the owner can remove a lease
+	if err := db.RemoveJobLease("job-2", "instance-a"); err != nil {
+		return err
+	}
+	if _, ok, _ := db.GetJobLease("job-2"); !ok {
+		return fmt.Errorf("lease removed by an instance that does not own it")
+	}
+	if err := db.RemoveJobLease("job-2", "instance-b"); err != nil {
+		return err
+	}
+	if _, ok, _ := db.GetJobLease("job-2"); ok {
+		return fmt.Errorf("lease not removed by its owner")
+	}
+	return nil
+}
+
+func checkCommands(db Database) error {
+	now := time.Now().Truncate(time.Second)
+	notified := db.JobCommands()
+
+	for _, jid := range []string{"job-1", "job-2"} {
+		if err := db.AddJobLease(JobLease{JobID: jid, Owner: "instance-a", Expires: now.Add(time.Minute), Spec: []byte(`{}`)}); err != nil {
+			return err
+		}
+	}
+
+	sent := []JobCommand{
+		{JobID: "job-2", Action: JobCommandDismiss, Time: now, Source: EventSourceServer},
+		{JobID: "job-1", Action: JobCommandStatus, Status: RUNNING, Time: now.Add(time.Second), Message: "started", Source: EventSourceCallback},
+		{JobID: "job-2", Action: JobCommandStatus, Status: FAILED, Time: now.Add(2 * time.Second), Source: EventSourceCallback},
+	}
+	for _, cmd := range sent {
+		ok, err := db.SendJobCommand(cmd)
+		if err != nil || !ok {
+			return fmt.Errorf("SendJobCommand to a leased job returned %v, %v", ok, err)
+		}
+	}
+	ok, err := db.SendJobCommand(JobCommand{JobID: "job-missing", Action: JobCommandDismiss, Time: now, Source: EventSourceServer})
+	if err != nil || ok {
+		return fmt.Errorf("SendJobCommand to a job without lease must return false, got %v, %v", ok, err)
+	}
+
+	select {
+	case <-notified:
+	case <-time.After(2 * jobCommandPollInterval):
+		return fmt.Errorf("no value received from JobCommands after commands were sent")
+	}
+
+	cmds, err := db.TakeJobCommands("instance-b")
+	if err != nil || len(cmds) != 0 {
+		return fmt.Errorf("commands of jobs leased by another instance must not be taken, got %+v, %v", cmds, err)
+	}
+
+	cmds, err = db.TakeJobCommands("instance-a")
+	if err != nil || len(cmds) != len(sent) {
+		return fmt.Errorf("TakeJobCommands returned %+v, %v", cmds, err)
+	}
+	for i, cmd := range cmds {
+		want := sent[i]
+		if cmd.JobID != want.JobID || cmd.Action != want.Action || cmd.Status != want.Status || cmd.Message != want.Message ||
+			cmd.Source != want.Source || !sameTime(cmd.Time, want.Time) {
+			return fmt.Errorf("command %d is %+v, want %+v", i, cmd, want)
+		}
+	}
+
+	cmds, err = db.TakeJobCommands("instance-a")
+	if err != nil || len(cmds) != 0 {
+		return fmt.Errorf("taken commands must be removed, got %+v, %v", cmds, err)
+	}
+
+	// pending commands are removed with the lease
+	if _, err := db.SendJobCommand(JobCommand{JobID: "job-1", Action: JobCommandDismiss, Time: now, Source: EventSourceServer}); err != nil {
+		return err
+	}
+	if err := db.RemoveJobLease("job-1", "instance-a"); err != nil {
+		return err
+	}
+	if err := db.AddJobLease(JobLease{JobID: "job-1", Owner: "instance-a", Expires: now.Add(time.Minute), Spec: []byte(`{}`)}); err != nil {
+		return err
+	}
+	cmds, err = db.TakeJobCommands("instance-a")
+	if err != nil || len(cmds) != 0 {
+		return fmt.Errorf("commands must be removed with the lease, got %+v, %v", cmds, err)
+	}
+	return nil
+}
+
+func checkAPIKeys(db Database) error {
+	t := checkTime()
+	expires := t.Add(24 * time.Hour)
+
+	keys := []APIKey{
+		{ID: "key-1", Name: "etl", Owner: "a@example.com", Hash: "hash-1", Scopes: []string{"jobs:read", "execute:proc-a"}, Created: t, Expires: &expires},
+		{ID: "key-2", Name: "admin", Owner: "b@example.com", Hash: "hash-2", Scopes: []string{"admin"}, Created: t.Add(time.Minute)},
+		{ID: "key-3", Name: "none", Owner: "a@example.com", Hash: "hash-3", Scopes: []string{}, Created: t.Add(2 * time.Minute)},
+	}
+	for _, k := range keys {
+		if err := db.AddAPIKey(k); err != nil {
+			return err
+		}
+	}
+	if err := db.AddAPIKey(APIKey{ID: "key-4", Name: "copy", Owner: "a@example.com", Hash: "hash-1", Scopes: []string{}, Created: t}); err == nil {
+		return fmt.Errorf("adding a key with an existing hash must fail")
+	}
+
+	k, ok, err := db.GetAPIKey("hash-1")
+	if err != nil || !ok {
+		return fmt.Errorf("key with hash-1 not found: %v", err)
+	}
+	if k.ID != "key-1" || k.Owner != "a@example.com" || !reflect.DeepEqual(k.Scopes, keys[0].Scopes) ||
+		!sameTime(k.Created, t) || k.Expires == nil || !sameTime(*k.Expires, expires) || k.Revoked != nil || k.LastUsed != nil {
+		return fmt.Errorf("GetAPIKey returned %+v", k)
+	}
+	if _, ok, err := db.GetAPIKey("hash-missing"); err != nil || ok {
+		return fmt.Errorf("GetAPIKey of a missing hash must return false, got %v, %v", ok, err)
+	}
+	k, _, err = db.GetAPIKey("hash-3")
+	if err != nil || len(k.Scopes) != 0 || k.Expires != nil {
+		return fmt.Errorf("key without scopes and expiry is %+v, %v", k, err)
+	}
+
+	ids := func(keys []APIKey) []string {
+		res := []string{}
+		for _, k := range keys {
+			res = append(res, k.ID)
+		}
+		return res
+	}
+	all, err := db.GetAPIKeys("")
+	if err != nil || !reflect.DeepEqual(ids(all), []string{"key-1", "key-2", "key-3"}) {
+		return fmt.Errorf("GetAPIKeys of all owners returned %v, %v", ids(all), err)
+	}
+	owned, err := db.GetAPIKeys("a@example.com")
+	if err != nil || !reflect.DeepEqual(ids(owned), []string{"key-1", "key-3"}) {
+		return fmt.Errorf("GetAPIKeys of a@example.com returned %v, %v", ids(owned), err)
+	}
+
+	if err := db.TouchAPIKey("key-1", t.Add(time.Hour)); err != nil {
+		return err
+	}
+	k, _, err = db.GetAPIKey("hash-1")
+	if err != nil || k.LastUsed == nil || !sameTime(*k.LastUsed, t.Add(time.Hour)) {
+		return fmt.Errorf("key last used is %v, %v", k.LastUsed, err)
+	}
+
+	ok, err = db.RevokeAPIKey("key-2", "a@example.com", t)
+	if err != nil || ok {
+		return fmt.Errorf("revoking a key of another owner must return false, got %v, %v", ok, err)
+	}
+	ok, err = db.RevokeAPIKey("key-1", "a@example.com", t.Add(2*time.Hour))
+	if err != nil || !ok {
+		return fmt.Errorf("revoking key-1 returned %v, %v", ok, err)
+	}
+	ok, err = db.RevokeAPIKey("key-1", "", t.Add(3*time.Hour))
+	if err != nil || ok {
+		return fmt.Errorf("revoking a revoked key must return false, got %v, %v", ok, err)
+	}
+	ok, err = db.RevokeAPIKey("key-2", "", t)
+	if err != nil || !ok {
+		return fmt.Errorf("revoking key-2 of any owner returned %v, %v", ok, err)
+	}
+	k, _, err = db.GetAPIKey("hash-1")
+	if err != nil || k.Revoked == nil || !sameTime(*k.Revoked, t.Add(2*time.Hour)) || k.Active(t) {
+		return fmt.Errorf("revoked key is %+v, %v", k, err)
+	}
+	return nil
+}
+
+func checkAuditLog(db Database) error {
+	t := checkTime()
+
+	entries := []AuditEntry{
+		{Time: t, Action: AuditProcessAdd, User: "a@example.com", IP: "10.0.0.1", RequestID: "req-1", Resource: "proc-a", After: "info:\n  id: proc-a\n"},
+		{Time: t.Add(time.Minute), Action: AuditJobDismiss, User: "b@example.com", IP: "10.0.0.2", RequestID: "req-2", Resource: "job-1"},
+		{Time: t.Add(2 * time.Minute), Action: AuditProcessDelete, User: "a@example.com", IP: "10.0.0.1", RequestID: "req-3", Resource: "proc-a", Before: "info:\n  id: proc-a\n"},
+		{Time: t.Add(3 * time.Minute), Action: AuditAuthFailure, IP: "10.0.0.3", RequestID: "req-4", Resource: "GET /jobs", Message: "401"},
+	}
+	for _, e := range entries {
+		if err := db.AddAuditEntry(e); err != nil {
+			return err
+		}
+	}
+
+	requests := func(q AuditQuery) ([]string, error) {
+		res := []string{}
+		page, err := db.GetAuditEntries(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			res = append(res, e.RequestID)
+		}
+		return res, nil
+	}
+
+	cases := []struct {
+		q    AuditQuery
+		want []string
+	}{
+		{AuditQuery{Limit: 10}, []string{"req-4", "req-3", "req-2", "req-1"}},
+		{AuditQuery{Limit: 2}, []string{"req-4", "req-3"}},
+		{AuditQuery{Limit: 10, Users: []string{"a@example.com"}}, []string{"req-3", "req-1"}},
+		{AuditQuery{Limit: 10, Actions: []string{AuditJobDismiss, AuditAuthFailure}}, []string{"req-4", "req-2"}},
+		{AuditQuery{Limit: 10, Resource: "proc-a", From: t.Add(time.Minute)}, []string{"req-3"}},
+		{AuditQuery{Limit: 10, From: t.Add(time.Minute), To: t.Add(3 * time.Minute)}, []string{"req-3", "req-2"}},
+	}
+	for _, c := range cases {
+		got, err := requests(c.q)
+		if err != nil {
+			return fmt.Errorf("query %+v: %s", c.q, err.Error())
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			return fmt.Errorf("query %+v returned %v, want %v", c.q, got, c.want)
+		}
+	}
+
+	// older entries are paged with the id of the last entry
+	page, err := db.GetAuditEntries(AuditQuery{Limit: 2})
+	if err != nil || len(page) != 2 {
+		return fmt.Errorf("first page is %+v, %v", page, err)
+	}
+	got, err := requests(AuditQuery{Limit: 10, BeforeID: page[1].ID})
+	if err != nil || !reflect.DeepEqual(got, []string{"req-2", "req-1"}) {
+		return fmt.Errorf("entries before id %d are %v, %v", page[1].ID, got, err)
+	}
+
+	last := page[1]
+	want := entries[2]
+	want.ID, want.Time = last.ID, last.Time
+	if last != want || !sameTime(last.Time, entries[2].Time) {
+		return fmt.Errorf("GetAuditEntries returned %+v, want %+v", last, entries[2])
+	}
+	return nil
+}
@@ -0,0 +1,744 @@
+package jobs
+
+import (
+	"app/utils"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDB keeps all records in memory, they are lost when the server stops.
+// Meant for throwaway deployments such as tests and demos, instances can not share it.
+type MemoryDB struct {
+	mu sync.RWMutex
+
+	jobs      map[string]JobRecord
+	events    map[string][]JobEvent
+	usage     map[string]JobUsage
+	processes map[string]ProcessRecord
+	// versions of each process in registration order
+	versions map[string][]ProcessRecord
+	leases   map[string]JobLease
+	// pending commands in the order they were sent
+	commands      []JobCommand
+	lastCommandID int64
+	// api keys by id
+	apiKeys map[string]APIKey
+	// audit entries in the order they were added
+	audit []AuditEntry
+
+	processChanges chan struct{}
+	jobCommands    chan struct{}
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		jobs:           map[string]JobRecord{},
+		events:         map[string][]JobEvent{},
+		usage:          map[string]JobUsage{},
+		processes:      map[string]ProcessRecord{},
+		versions:       map[string][]ProcessRecord{},
+		leases:         map[string]JobLease{},
+		apiKeys:        map[string]APIKey{},
+		processChanges: make(chan struct{}, 1),
+		jobCommands:    make(chan struct{}, 1),
+	}
+}
+
+// Records are stored without monotonic clock readings, like times read from the other databases
+func wallTime(t time.Time) time.Time {
+	return t.Round(0)
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func cloneProcess(pr ProcessRecord) ProcessRecord {
+	pr.Definition = cloneBytes(pr.Definition)
+	return pr
+}
+
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := wallTime(*t)
+	return &c
+}
+
+func cloneAPIKey(k APIKey) APIKey {
+	k.Scopes = append([]string{}, k.Scopes...)
+	k.Created = wallTime(k.Created)
+	k.Expires = cloneTime(k.Expires)
+	k.Revoked = cloneTime(k.Revoked)
+	k.LastUsed = cloneTime(k.LastUsed)
+	return k
+}
+
+func cloneLease(l JobLease) JobLease {
+	l.Spec = cloneBytes(l.Spec)
+	return l
+}
+
+// Add job to the database. Will return error if job exist.
+func (db *MemoryDB) addJob(jid, status, mode, host, processID, processVersion, submitter, group string, updated time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.jobs[jid]; ok {
+		return fmt.Errorf("job %s already exists", jid)
+	}
+	updated = wallTime(updated)
+	db.jobs[jid] = JobRecord{
+		JobID: jid, Status: status, Created: updated, LastUpdate: updated, Mode: mode, Host: host,
+		ProcessID: processID, ProcessVersion: processVersion, Submitter: submitter, Group: group,
+	}
+	return nil
+}
+
+// Update status and time of a job and add the transition to job events.
+func (db *MemoryDB) updateJobRecord(jid, status, source, message string, now time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now = wallTime(now)
+	if jr, ok := db.jobs[jid]; ok {
+		jr.Status = status
+		jr.LastUpdate = now
+		db.jobs[jid] = jr
+	}
+	db.events[jid] = append(db.events[jid], JobEvent{Status: status, Time: now, Source: source, Message: message})
+	return nil
+}
+
+// Get Job Record given a job id.
+func (db *MemoryDB) GetJob(jid string) (JobRecord, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	jr, ok := db.jobs[jid]
+	return jr, ok, nil
+}
+
+// Check if a job exists.
+func (db *MemoryDB) CheckJobExist(jid string) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, ok := db.jobs[jid]
+	return ok, nil
+}
+
+// Get status transitions of a job ordered by time.
+func (db *MemoryDB) GetJobEvents(jid string) ([]JobEvent, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	res := append([]JobEvent{}, db.events[jid]...)
+	// events are appended in id order, stable sort keeps it for equal times
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	return res, nil
+}
+
+// Filter, sort and page jobs the same way buildJobsQuery does.
+// Assumes query parameters are valid.
+func (db *MemoryDB) GetJobs(q JobsQuery) ([]JobRecord, string, error) {
+	order := q.Sort
+	if order == "" {
+		order = defaultJobsSort
+	}
+	column := sortColumn(order)
+	desc := strings.HasPrefix(order, "-")
+
+	key := func(r JobRecord) time.Time {
+		if column == "created" {
+			return r.Created
+		}
+		return r.LastUpdate
+	}
+	// reports if a comes before b in the sort order
+	before := func(at time.Time, aid string, bt time.Time, bid string) bool {
+		if !at.Equal(bt) {
+			return at.Before(bt) != desc
+		}
+		if aid == bid {
+			return false
+		}
+		return (aid < bid) != desc
+	}
+
+	var cursor *jobsCursor
+	if q.Cursor != "" {
+		c, err := decodeJobsCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if c.Sort != order {
+			return nil, "", ErrInvalidCursor
+		}
+		cursor = &c
+	}
+
+	inRange := func(t, after, before time.Time) bool {
+		return (after.IsZero() || !t.Before(after)) && (before.IsZero() || t.Before(before))
+	}
+
+	db.mu.RLock()
+	res := []JobRecord{}
+	for _, r := range db.jobs {
+		if !matches(r.ProcessID, q.ProcessIDs) || !matches(r.Status, q.Statuses) || !matches(r.Submitter, q.Submitters) {
+			continue
+		}
+		if q.Viewer != nil && !q.Viewer.CanRead(r) {
+			continue
+		}
+		if !inRange(r.LastUpdate, q.UpdatedAfter, q.UpdatedBefore) || !inRange(r.Created, q.CreatedAfter, q.CreatedBefore) {
+			continue
+		}
+		if cursor != nil && !before(cursor.Time, cursor.ID, key(r), r.JobID) {
+			continue
+		}
+
+		// job lists do not include mode and host
+		res = append(res, JobRecord{
+			JobID: r.JobID, Status: r.Status, Created: r.Created, LastUpdate: r.LastUpdate,
+			ProcessID: r.ProcessID, ProcessVersion: r.ProcessVersion, Submitter: r.Submitter, Group: r.Group,
+		})
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return before(key(res[i]), res[i].JobID, key(res[j]), res[j].JobID) })
+
+	if cursor == nil && q.Offset > 0 {
+		if q.Offset >= len(res) {
+			res = res[:0]
+		} else {
+			res = res[q.Offset:]
+		}
+	}
+	if len(res) > q.Limit+1 {
+		res = res[:q.Limit+1]
+	}
+
+	res, next := pageJobs(q, res)
+	return res, next, nil
+}
+
+// Empty filter values match everything
+func matches(v string, values []string) bool {
+	return len(values) == 0 || utils.StringInSlice(v, values)
+}
+
+// Compute statistics of jobs created in the time range.
+func (db *MemoryDB) GetJobStats(processID string, from, to time.Time, top int) (JobStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	b := newJobStatsBuilder()
+	submitters := map[string]int{}
+	for _, r := range db.jobs {
+		if r.Created.Before(from) || !r.Created.Before(to) || (processID != "" && r.ProcessID != processID) {
+			continue
+		}
+		b.stats.Counts[r.Status]++
+		submitters[r.Submitter]++
+
+		events := append([]JobEvent{}, db.events[r.JobID]...)
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+		var started, finished time.Time
+		for _, e := range events {
+			switch e.Status {
+			case RUNNING:
+				if started.IsZero() {
+					started = e.Time
+				}
+			case SUCCESSFUL, FAILED, DISMISSED:
+				finished = e.Time
+			}
+		}
+		b.addTimes(r.Created, started, finished)
+	}
+	b.setSubmitters(submitters, top)
+	return b.result(), nil
+}
+
+// Record the compute consumed by a job, the first record of a job is kept.
+func (db *MemoryDB) addJobUsage(u JobUsage) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.usage[u.JobID]; !ok {
+		u.Ended = wallTime(u.Ended)
+		db.usage[u.JobID] = u
+	}
+	return nil
+}
+
+// Get the compute consumed by a job.
+func (db *MemoryDB) GetJobUsage(jid string) (JobUsage, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	u, ok := db.usage[jid]
+	return u, ok, nil
+}
+
+// Get the compute consumed by jobs grouped by submitter or process, ordered by cpu seconds descending.
+func (db *MemoryDB) GetUsage(q UsageQuery) ([]UsageSummary, error) {
+	db.mu.RLock()
+	groups := map[string]*UsageSummary{}
+	for _, u := range db.usage {
+		if (!q.From.IsZero() && u.Ended.Before(q.From)) || (!q.To.IsZero() && !u.Ended.Before(q.To)) {
+			continue
+		}
+		if !matches(u.Submitter, q.Submitters) || !matches(u.ProcessID, q.ProcessIDs) {
+			continue
+		}
+
+		key := u.Submitter
+		if q.GroupBy == UsageByProcess {
+			key = u.ProcessID
+		}
+		s, ok := groups[key]
+		if !ok {
+			s = &UsageSummary{}
+			if q.GroupBy == UsageByProcess {
+				s.ProcessID = key
+			} else {
+				s.Submitter = key
+			}
+			groups[key] = s
+		}
+		s.Jobs++
+		s.Duration += u.Duration
+		s.CPUSeconds += u.CPUSeconds
+		s.MemorySeconds += u.MemorySeconds
+	}
+	db.mu.RUnlock()
+
+	res := []UsageSummary{}
+	for _, s := range groups {
+		s.CPUHours = roundTo(s.CPUSeconds/3600, 4)
+		res = append(res, *s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].CPUSeconds != res[j].CPUSeconds {
+			return res[i].CPUSeconds > res[j].CPUSeconds
+		}
+		return res[i].Submitter+res[i].ProcessID < res[j].Submitter+res[j].ProcessID
+	})
+	return res, nil
+}
+
+// Count the jobs of a submitter created since the time.
+func (db *MemoryDB) CountJobs(submitter string, since time.Time) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	n := 0
+	for _, r := range db.jobs {
+		if r.Submitter == submitter && !r.Created.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Insert a job from an archive with its events and usage, returns false if the job already exists.
+func (db *MemoryDB) restoreJob(a ArchivedJob) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.jobs[a.JobID]; ok {
+		return false, nil
+	}
+
+	jr := a.JobRecord
+	jr.Created = wallTime(jr.Created)
+	jr.LastUpdate = wallTime(jr.LastUpdate)
+	db.jobs[jr.JobID] = jr
+
+	for _, e := range a.Events {
+		e.Time = wallTime(e.Time)
+		db.events[jr.JobID] = append(db.events[jr.JobID], e)
+	}
+
+	if a.Usage != nil {
+		if _, ok := db.usage[jr.JobID]; !ok {
+			u := *a.Usage
+			u.JobID = jr.JobID
+			u.Ended = wallTime(u.Ended)
+			db.usage[jr.JobID] = u
+		}
+	}
+	return true, nil
+}
+
+// Get all process definitions that are not deleted, ordered by id.
+func (db *MemoryDB) GetProcesses() ([]ProcessRecord, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	res := []ProcessRecord{}
+	for _, pr := range db.processes {
+		if !pr.Deleted {
+			res = append(res, cloneProcess(pr))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+// Get process definition given a process id, including deleted processes.
+func (db *MemoryDB) GetProcess(pid string) (ProcessRecord, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	pr, ok := db.processes[pid]
+	return cloneProcess(pr), ok, nil
+}
+
+// Add a new process. A deleted process with the same id is replaced.
+func (db *MemoryDB) AddProcess(pr ProcessRecord) error {
+	return db.writeProcess(pr, "add")
+}
+
+// Add or replace a process.
+func (db *MemoryDB) PutProcess(pr ProcessRecord) error {
+	return db.writeProcess(pr, "put")
+}
+
+func (db *MemoryDB) writeProcess(pr ProcessRecord, action string) error {
+	if pr.Updated.IsZero() {
+		pr.Updated = time.Now()
+	}
+	pr = cloneProcess(pr)
+	pr.Updated = wallTime(pr.Updated)
+	pr.Deleted = false
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// versions are immutable
+	registered := false
+	for _, v := range db.versions[pr.ID] {
+		if v.Version == pr.Version {
+			if string(v.Definition) != string(pr.Definition) {
+				return ErrProcessVersionExists
+			}
+			registered = true
+		}
+	}
+
+	if current, ok := db.processes[pr.ID]; ok && action == "add" && !current.Deleted {
+		return ErrProcessExists
+	}
+
+	if !registered {
+		db.versions[pr.ID] = append(db.versions[pr.ID], pr)
+	}
+	db.processes[pr.ID] = pr
+
+	notifyChange(db.processChanges)
+	return nil
+}
+
+// Mark a process as deleted.
+func (db *MemoryDB) DeleteProcess(pid, source string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pr, ok := db.processes[pid]
+	if !ok || pr.Deleted {
+		return false, nil
+	}
+	pr.Deleted = true
+	pr.Source = source
+	pr.Updated = wallTime(time.Now())
+	db.processes[pid] = pr
+
+	notifyChange(db.processChanges)
+	return true, nil
+}
+
+// Get all registered versions of a process ordered by registration time.
+func (db *MemoryDB) GetProcessVersions(pid string) ([]ProcessRecord, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	res := []ProcessRecord{}
+	for _, v := range db.versions[pid] {
+		res = append(res, cloneProcess(v))
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if !res[i].Updated.Equal(res[j].Updated) {
+			return res[i].Updated.Before(res[j].Updated)
+		}
+		return res[i].Version < res[j].Version
+	})
+	return res, nil
+}
+
+// Get a registered version of a process.
+func (db *MemoryDB) GetProcessVersion(pid, version string) (ProcessRecord, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, v := range db.versions[pid] {
+		if v.Version == version {
+			return cloneProcess(v), true, nil
+		}
+	}
+	return ProcessRecord{}, false, nil
+}
+
+// All changes are made by this instance and are notified as they are made.
+func (db *MemoryDB) ProcessChanges() <-chan struct{} {
+	return db.processChanges
+}
+
+// Add the lease of a job. Will return error if the job has a lease.
+func (db *MemoryDB) AddJobLease(l JobLease) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.leases[l.JobID]; ok {
+		return fmt.Errorf("job %s already has a lease", l.JobID)
+	}
+	l = cloneLease(l)
+	l.Expires = wallTime(l.Expires)
+	db.leases[l.JobID] = l
+	return nil
+}
+
+// Get the lease of a job.
+func (db *MemoryDB) GetJobLease(jid string) (JobLease, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	l, ok := db.leases[jid]
+	return cloneLease(l), ok, nil
+}
+
+// Extend all leases of the owner.
+func (db *MemoryDB) RenewJobLeases(owner string, expires time.Time) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res := []string{}
+	for jid, l := range db.leases {
+		if l.Owner == owner {
+			l.Expires = wallTime(expires)
+			db.leases[jid] = l
+			res = append(res, jid)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Expire the lease of a job if it is held by owner.
+func (db *MemoryDB) ExpireJobLease(jid, owner string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if l, ok := db.leases[jid]; ok && l.Owner == owner {
+		l.Expires = time.Time{}
+		db.leases[jid] = l
+	}
+	return nil
+}
+
+// Remove the lease of a job if it is held by owner, and commands that were not taken.
+func (db *MemoryDB) RemoveJobLease(jid, owner string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l, ok := db.leases[jid]
+	if !ok || l.Owner != owner {
+		// job was taken over, commands belong to the new owner
+		return nil
+	}
+	delete(db.leases, jid)
+
+	pending := db.commands[:0]
+	for _, cmd := range db.commands {
+		if cmd.JobID != jid {
+			pending = append(pending, cmd)
+		}
+	}
+	db.commands = pending
+	return nil
+}
+
+// Transfer expired leases to owner.
+func (db *MemoryDB) ClaimExpiredJobLeases(owner string, now, expires time.Time) ([]JobLease, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res := []JobLease{}
+	for jid, l := range db.leases {
+		if !l.Expires.Before(now) {
+			continue
+		}
+		res = append(res, JobLease{JobID: jid, Owner: l.Owner, Expires: expires, Spec: cloneBytes(l.Spec)})
+		l.Owner = owner
+		l.Expires = wallTime(expires)
+		db.leases[jid] = l
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].JobID < res[j].JobID })
+	return res, nil
+}
+
+// Queue a command for the owner of the job.
+func (db *MemoryDB) SendJobCommand(cmd JobCommand) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.leases[cmd.JobID]; !ok {
+		return false, nil
+	}
+	db.lastCommandID++
+	cmd.id = db.lastCommandID
+	cmd.Time = wallTime(cmd.Time)
+	db.commands = append(db.commands, cmd)
+
+	notifyChange(db.jobCommands)
+	return true, nil
+}
+
+// Remove and return pending commands for jobs leased by owner.
+func (db *MemoryDB) TakeJobCommands(owner string) ([]JobCommand, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res := []JobCommand{}
+	pending := db.commands[:0]
+	for _, cmd := range db.commands {
+		if l, ok := db.leases[cmd.JobID]; ok && l.Owner == owner {
+			res = append(res, cmd)
+		} else {
+			pending = append(pending, cmd)
+		}
+	}
+	db.commands = pending
+	return res, nil
+}
+
+// All commands are sent by this instance and are notified as they are sent.
+func (db *MemoryDB) JobCommands() <-chan struct{} {
+	return db.jobCommands
+}
+
+// Store a new API key, ids and hashes are unique.
+func (db *MemoryDB) AddAPIKey(k APIKey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, e := range db.apiKeys {
+		if e.ID == k.ID || e.Hash == k.Hash {
+			return fmt.Errorf("api key already exists")
+		}
+	}
+	db.apiKeys[k.ID] = cloneAPIKey(k)
+	return nil
+}
+
+// Get the API key with the token hash.
+func (db *MemoryDB) GetAPIKey(hash string) (APIKey, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, k := range db.apiKeys {
+		if k.Hash == hash {
+			return cloneAPIKey(k), true, nil
+		}
+	}
+	return APIKey{}, false, nil
+}
+
+// Get the API keys of an owner, or of all owners if owner is empty, ordered by creation time.
+func (db *MemoryDB) GetAPIKeys(owner string) ([]APIKey, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	res := []APIKey{}
+	for _, k := range db.apiKeys {
+		if owner == "" || k.Owner == owner {
+			res = append(res, cloneAPIKey(k))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Created.Equal(res[j].Created) {
+			return res[i].Created.Before(res[j].Created)
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+// Revoke an API key that is not revoked yet.
+func (db *MemoryDB) RevokeAPIKey(id, owner string, t time.Time) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	k, ok := db.apiKeys[id]
+	if !ok || k.Revoked != nil || (owner != "" && k.Owner != owner) {
+		return false, nil
+	}
+	k.Revoked = cloneTime(&t)
+	db.apiKeys[id] = k
+	return true, nil
+}
+
+// Record when an API key was last used.
+func (db *MemoryDB) TouchAPIKey(id string, t time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if k, ok := db.apiKeys[id]; ok {
+		k.LastUsed = cloneTime(&t)
+		db.apiKeys[id] = k
+	}
+	return nil
+}
+
+// Append an entry to the audit log.
+func (db *MemoryDB) AddAuditEntry(e AuditEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e.ID = int64(len(db.audit) + 1)
+	e.Time = wallTime(e.Time)
+	db.audit = append(db.audit, e)
+	return nil
+}
+
+// Get audit entries matching the query, newest first.
+func (db *MemoryDB) GetAuditEntries(q AuditQuery) ([]AuditEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	res := []AuditEntry{}
+	for i := len(db.audit) - 1; i >= 0 && len(res) < q.Limit; i-- {
+		e := db.audit[i]
+		if !matches(e.Action, q.Actions) || !matches(e.User, q.Users) || (q.Resource != "" && e.Resource != q.Resource) {
+			continue
+		}
+		if (!q.From.IsZero() && e.Time.Before(q.From)) || (!q.To.IsZero() && !e.Time.Before(q.To)) || (q.BeforeID > 0 && e.ID >= q.BeforeID) {
+			continue
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+func (db *MemoryDB) Close() error {
+	return nil
+}
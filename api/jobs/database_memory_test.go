@@ -0,0 +1,10 @@
+package jobs
+
+import "testing"
+
+func TestMemoryDBConformance(t *testing.T) {
+	err := CheckDatabase(func() (Database, error) { return NewMemoryDB(), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,345 @@
+package jobs
+
+// Schema of the jobs database is evolved through versioned migrations.
+// Migrations are SQL files embedded in the binary, one directory per database type,
+// named <version>_<name>.up.sql and optionally <version>_<name>.down.sql.
+// Applied versions are recorded in the schema_migrations table.
+// Migrations are never edited once released, add a new version instead.
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+// Arbitrary key for postgres advisory lock, so that only one instance migrates at a time
+const migrationLockKey = 4825113
+
+type migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus describes a known migration and if it has been applied
+type MigrationStatus struct {
+	Version int        `json:"version"`
+	Name    string     `json:"name"`
+	Applied *time.Time `json:"applied,omitempty"`
+}
+
+// Migrator applies and rolls back schema migrations
+type Migrator struct {
+	handle     *sql.DB
+	dbType     string
+	migrations []migration
+}
+
+// Common methods of *sql.DB and *sql.Conn used by migrator
+type migrationConn interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Create a migrator for the database set by dbType, opening a new connection to it.
+// Used by the migrate command, server applies migrations through NewDatabase.
+func NewMigrator(dbType string) (*Migrator, error) {
+	h, err := openDB(dbType)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMigrator(h, dbType)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMigrator(h *sql.DB, dbType string) (*Migrator, error) {
+	ms, err := loadMigrations(dbType)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{handle: h, dbType: dbType, migrations: ms}, nil
+}
+
+// Read embedded migrations for the database type, sorted by version
+func loadMigrations(dbType string) ([]migration, error) {
+	dir := path.Join("migrations", dbType)
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for database type %s", dbType)
+	}
+
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		fn := e.Name()
+		if e.IsDir() || !strings.HasSuffix(fn, ".sql") {
+			continue
+		}
+
+		base := strings.TrimSuffix(fn, ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+		vs, name, found := strings.Cut(base, "_")
+		v, err := strconv.Atoi(vs)
+		if !found || err != nil || v <= 0 || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("invalid migration file name %s, expected <version>_<name>.(up|down).sql", fn)
+		}
+
+		data, err := fs.ReadFile(migrationsFS, path.Join(dir, fn))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[v]
+		if !ok {
+			m = &migration{Version: v, Name: name}
+			byVersion[v] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration version %d used by both %s and %s", v, m.Name, name)
+		}
+
+		if direction == ".up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	ms := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		ms = append(ms, *m)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+// Latest version known to this binary
+func (m *Migrator) LatestVersion() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) placeholder(i int) string {
+	if m.dbType == "postgres" {
+		return fmt.Sprintf("$%d", i)
+	}
+	return "?"
+}
+
+// Run fn while holding the migration lock.
+// Postgres uses a session level advisory lock so that multiple instances starting together do not race,
+// SQLite serializes writers on its own.
+func (m *Migrator) withLock(ctx context.Context, fn func(c migrationConn) error) error {
+	if m.dbType != "postgres" {
+		return fn(m.handle)
+	}
+
+	conn, err := m.handle.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("could not acquire migration lock: %s", err.Error())
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			log.Errorf("could not release migration lock: %s", err.Error())
+		}
+	}()
+
+	return fn(conn)
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, c migrationConn) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied TIMESTAMP NOT NULL
+	)`
+	if _, err := c.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %s", err.Error())
+	}
+	return nil
+}
+
+// Versions applied to the database and when
+func (m *Migrator) applied(ctx context.Context, c migrationConn) (map[int]time.Time, error) {
+	rows, err := c.QueryContext(ctx, `SELECT version, applied FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := map[int]time.Time{}
+	for rows.Next() {
+		var v int
+		var t time.Time
+		if err := rows.Scan(&v, &t); err != nil {
+			return nil, err
+		}
+		res[v] = t
+	}
+	return res, rows.Err()
+}
+
+// Execute migration SQL and record or remove its version in a single transaction
+func (m *Migrator) run(ctx context.Context, c migrationConn, mg migration, up bool) error {
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := mg.up
+	if !up {
+		stmt = mg.down
+	}
+	if _, err := tx.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("error running migration %d_%s: %s", mg.Version, mg.Name, err.Error())
+	}
+
+	if up {
+		query := fmt.Sprintf(`INSERT INTO schema_migrations (version, name, applied) VALUES (%s, %s, %s)`, m.placeholder(1), m.placeholder(2), m.placeholder(3))
+		_, err = tx.ExecContext(ctx, query, mg.Version, mg.Name, time.Now().UTC())
+	} else {
+		query := fmt.Sprintf(`DELETE FROM schema_migrations WHERE version = %s`, m.placeholder(1))
+		_, err = tx.ExecContext(ctx, query, mg.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("error recording migration %d_%s: %s", mg.Version, mg.Name, err.Error())
+	}
+
+	return tx.Commit()
+}
+
+// Apply all pending migrations up to and including target version.
+// Target 0 applies all migrations. Returns the versions applied.
+func (m *Migrator) Up(target int) ([]int, error) {
+	ctx := context.Background()
+	if target == 0 {
+		target = m.LatestVersion()
+	}
+
+	var done []int
+	err := m.withLock(ctx, func(c migrationConn) error {
+		if err := m.ensureTable(ctx, c); err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		for v := range applied {
+			if v > m.LatestVersion() {
+				log.Warnf("database schema version %d is newer than the latest known version %d", v, m.LatestVersion())
+				break
+			}
+		}
+
+		for _, mg := range m.migrations {
+			if mg.Version > target {
+				break
+			}
+			if _, ok := applied[mg.Version]; ok {
+				continue
+			}
+			if err := m.run(ctx, c, mg, true); err != nil {
+				return err
+			}
+			log.Infof("applied migration %d_%s", mg.Version, mg.Name)
+			done = append(done, mg.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Roll back applied migrations newer than target version, latest first.
+// Target 0 rolls back all migrations. Returns the versions rolled back.
+func (m *Migrator) Down(target int) ([]int, error) {
+	ctx := context.Background()
+
+	var done []int
+	err := m.withLock(ctx, func(c migrationConn) error {
+		if err := m.ensureTable(ctx, c); err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mg := m.migrations[i]
+			if mg.Version <= target {
+				break
+			}
+			if _, ok := applied[mg.Version]; !ok {
+				continue
+			}
+			if mg.down == "" {
+				return fmt.Errorf("migration %d_%s can not be rolled back, no down file", mg.Version, mg.Name)
+			}
+			if err := m.run(ctx, c, mg, false); err != nil {
+				return err
+			}
+			log.Infof("rolled back migration %d_%s", mg.Version, mg.Name)
+			done = append(done, mg.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status of all known migrations
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	ctx := context.Background()
+
+	if err := m.ensureTable(ctx, m.handle); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx, m.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]MigrationStatus, len(m.migrations))
+	for i, mg := range m.migrations {
+		res[i] = MigrationStatus{Version: mg.Version, Name: mg.Name}
+		if t, ok := applied[mg.Version]; ok {
+			t := t
+			res[i].Applied = &t
+		}
+	}
+	return res, nil
+}
+
+func (m *Migrator) Close() error {
+	return m.handle.Close()
+}
@@ -3,81 +3,92 @@ package jobs
 import (
 	"database/sql"
 	"fmt"
-	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Channels used to notify instances of process changes and job commands
+const (
+	processChangesChannel = "process_changes"
+	jobCommandsChannel    = "job_commands"
 )
 
 type PostgresDB struct {
 	Handle *sql.DB
+
+	connString     string
+	processChanges chan struct{}
+	jobCommands    chan struct{}
+	listenOnce     sync.Once
+	listener       *pq.Listener
 }
 
-// Initialize the database.
+// Initialize the database and apply pending migrations.
 func NewPostgresDB(dbConnString string) (*PostgresDB, error) {
-	h, err := sql.Open("postgres", dbConnString)
-
+	h, err := openPostgres(dbConnString)
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to database. Error: %s", err.Error())
-	}
-
-	if h == nil {
-		return nil, fmt.Errorf("db nil")
+		return nil, err
 	}
 
-	db := PostgresDB{Handle: h}
-	err = db.createTables()
+	db := PostgresDB{Handle: h, connString: dbConnString, processChanges: make(chan struct{}, 1), jobCommands: make(chan struct{}, 1)}
+	err = migrateUp(h, "postgres")
 	if err != nil {
+		h.Close()
 		return nil, err
 	}
 	return &db, nil
 }
 
-// createTables in the database if they do not exist already for PostgreSQL
-func (postgresDB *PostgresDB) createTables() error {
-
-	queryJobs := `
-    CREATE TABLE IF NOT EXISTS jobs (
-        id TEXT PRIMARY KEY,
-        status TEXT NOT NULL,
-        updated TIMESTAMP WITHOUT TIME ZONE NOT NULL,
-        mode TEXT NOT NULL,
-        host TEXT NOT NULL,
-        process_id TEXT NOT NULL,
-        submitter TEXT NOT NULL DEFAULT ''
-    );
-
-    CREATE INDEX IF NOT EXISTS idx_jobs_updated ON jobs(updated);
-    CREATE INDEX IF NOT EXISTS idx_jobs_process_id ON jobs(process_id);
-    CREATE INDEX IF NOT EXISTS idx_jobs_submitter ON jobs(submitter);
-    `
+func openPostgres(dbConnString string) (*sql.DB, error) {
+	h, err := sql.Open("postgres", dbConnString)
 
-	_, err := postgresDB.Handle.Exec(queryJobs)
 	if err != nil {
-		return fmt.Errorf("error creating tables: %s", err)
+		return nil, fmt.Errorf("could not connect to database. Error: %s", err.Error())
 	}
-	return nil
+
+	if h == nil {
+		return nil, fmt.Errorf("db nil")
+	}
+	return h, nil
 }
 
 // AddJob adds a new job to the database
-func (db *PostgresDB) addJob(jid, status, mode, host, processID, submitter string, updated time.Time) error {
-	query := `INSERT INTO jobs (id, status, updated, mode, host, process_id, submitter) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := db.Handle.Exec(query, jid, status, updated, mode, host, processID, submitter)
+func (db *PostgresDB) addJob(jid, status, mode, host, processID, processVersion, submitter, group string, updated time.Time) error {
+	query := `INSERT INTO jobs (id, status, created, updated, mode, host, process_id, process_version, submitter, job_group) VALUES ($1, $2, $3, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := db.Handle.Exec(query, jid, status, updated, mode, host, processID, processVersion, submitter, group)
 	return err
 }
 
-// UpdateJobRecord updates a job record
-func (db *PostgresDB) updateJobRecord(jid, status string, now time.Time) error {
+// UpdateJobRecord updates a job record and adds the transition to job events
+func (db *PostgresDB) updateJobRecord(jid, status, source, message string, now time.Time) error {
+	tx, err := db.Handle.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `UPDATE jobs SET status = $2, updated = $3 WHERE id = $1`
-	_, err := db.Handle.Exec(query, jid, status, now)
-	return err
+	_, err = tx.Exec(query, jid, status, now)
+	if err != nil {
+		return err
+	}
+
+	query = `INSERT INTO job_events (job_id, status, time, source, message) VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(query, jid, status, now, source, message)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // GetJob retrieves a job record by id
 func (db *PostgresDB) GetJob(jid string) (JobRecord, bool, error) {
-	query := `SELECT * FROM jobs WHERE id = $1`
+	query := `SELECT id, status, created, updated, mode, host, process_id, process_version, submitter, job_group FROM jobs WHERE id = $1`
 	var jr JobRecord
-	err := db.Handle.QueryRow(query, jid).Scan(&jr.JobID, &jr.Status, &jr.LastUpdate, &jr.Mode, &jr.Host, &jr.ProcessID, &jr.Submitter)
+	err := db.Handle.QueryRow(query, jid).Scan(&jr.JobID, &jr.Status, &jr.Created, &jr.LastUpdate, &jr.Mode, &jr.Host, &jr.ProcessID, &jr.ProcessVersion, &jr.Submitter, &jr.Group)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return JobRecord{}, false, nil
@@ -101,72 +112,320 @@ func (db *PostgresDB) CheckJobExist(jid string) (bool, error) {
 	return true, nil
 }
 
+// GetJobEvents retrieves status transitions of a job ordered by time
+func (db *PostgresDB) GetJobEvents(jid string) ([]JobEvent, error) {
+	query := `SELECT status, time, source, message FROM job_events WHERE job_id = $1 ORDER BY time, id`
+
+	rows, err := db.Handle.Query(query, jid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []JobEvent{}
+	for rows.Next() {
+		var e JobEvent
+		if err := rows.Scan(&e.Status, &e.Time, &e.Source, &e.Message); err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Assumes query parameters are valid
-func (pgDB *PostgresDB) GetJobs(limit, offset int, processIDs, statuses, submitters []string) ([]JobRecord, error) {
-	baseQuery := `SELECT id, status, updated, process_id, submitter FROM jobs`
-	whereClauses := []string{}
-	args := []interface{}{}
-
-	argIndex := 1 // Start from 1 for PostgreSQL placeholders
-
-	if len(processIDs) > 0 {
-		placeholders := make([]string, len(processIDs))
-		for i := range processIDs {
-			placeholders[i] = fmt.Sprintf("$%d", argIndex)
-			argIndex++
+func (pgDB *PostgresDB) GetJobs(q JobsQuery) ([]JobRecord, string, error) {
+	query, args, err := buildJobsQuery(q, func(n int) string { return fmt.Sprintf("$%d", n) })
+	if err != nil {
+		return nil, "", err
+	}
+
+	res := []JobRecord{}
+
+	rows, err := pgDB.Handle.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r JobRecord
+		if err := rows.Scan(&r.JobID, &r.Status, &r.Created, &r.LastUpdate, &r.ProcessID, &r.ProcessVersion, &r.Submitter, &r.Group); err != nil {
+			return nil, "", err
 		}
-		whereClauses = append(whereClauses, "process_id IN ("+strings.Join(placeholders, ", ")+")")
-		for _, pid := range processIDs {
-			args = append(args, pid)
+		res = append(res, r)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, next := pageJobs(q, res)
+	return res, next, nil
+}
+
+// GetJobStats computes statistics of jobs created in the time range
+func (db *PostgresDB) GetJobStats(processID string, from, to time.Time, top int) (JobStats, error) {
+	return queryJobStats(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, processID, from, to, top)
+}
+
+func (db *PostgresDB) addJobUsage(u JobUsage) error {
+	return insertJobUsage(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, u)
+}
+
+// GetJobUsage retrieves the compute consumed by a job
+func (db *PostgresDB) GetJobUsage(jid string) (JobUsage, bool, error) {
+	return selectJobUsage(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, jid)
+}
+
+// GetUsage retrieves the compute consumed by jobs grouped by submitter or process
+func (db *PostgresDB) GetUsage(q UsageQuery) ([]UsageSummary, error) {
+	return queryUsage(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, q)
+}
+
+// CountJobs counts the jobs of a submitter created since the time
+func (db *PostgresDB) CountJobs(submitter string, since time.Time) (int, error) {
+	return countJobs(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, submitter, since)
+}
+
+func (db *PostgresDB) restoreJob(a ArchivedJob) (bool, error) {
+	return insertArchivedJob(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, a)
+}
+
+// GetProcessVersions retrieves all registered versions of a process ordered by registration time
+func (db *PostgresDB) GetProcessVersions(pid string) ([]ProcessRecord, error) {
+	query := `SELECT process_id, version, definition, source, created FROM process_versions WHERE process_id = $1 ORDER BY created, version`
+
+	rows, err := db.Handle.Query(query, pid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []ProcessRecord{}
+	for rows.Next() {
+		var pr ProcessRecord
+		if err := rows.Scan(&pr.ID, &pr.Version, &pr.Definition, &pr.Source, &pr.Updated); err != nil {
+			return nil, err
 		}
+		res = append(res, pr)
 	}
 
-	if len(statuses) > 0 {
-		placeholders := make([]string, len(statuses))
-		for i := range statuses {
-			placeholders[i] = fmt.Sprintf("$%d", argIndex)
-			argIndex++
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetProcessVersion retrieves a registered version of a process
+func (db *PostgresDB) GetProcessVersion(pid, version string) (ProcessRecord, bool, error) {
+	query := `SELECT process_id, version, definition, source, created FROM process_versions WHERE process_id = $1 AND version = $2`
+
+	var pr ProcessRecord
+	err := db.Handle.QueryRow(query, pid, version).Scan(&pr.ID, &pr.Version, &pr.Definition, &pr.Source, &pr.Updated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ProcessRecord{}, false, nil
 		}
-		whereClauses = append(whereClauses, "status IN ("+strings.Join(placeholders, ", ")+")")
-		for _, st := range statuses {
-			args = append(args, st)
+		return ProcessRecord{}, false, err
+	}
+	return pr, true, nil
+}
+
+// GetProcesses retrieves all process definitions that are not deleted
+func (db *PostgresDB) GetProcesses() ([]ProcessRecord, error) {
+	query := `SELECT id, version, definition, source, deleted, updated FROM processes WHERE NOT deleted ORDER BY id`
+
+	rows, err := db.Handle.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []ProcessRecord{}
+	for rows.Next() {
+		var pr ProcessRecord
+		if err := rows.Scan(&pr.ID, &pr.Version, &pr.Definition, &pr.Source, &pr.Deleted, &pr.Updated); err != nil {
+			return nil, err
 		}
+		res = append(res, pr)
 	}
 
-	if len(submitters) > 0 {
-		placeholders := make([]string, len(submitters))
-		for i := range submitters {
-			placeholders[i] = fmt.Sprintf("$%d", argIndex)
-			argIndex++
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetProcess retrieves a process definition by id, including deleted processes
+func (db *PostgresDB) GetProcess(pid string) (ProcessRecord, bool, error) {
+	query := `SELECT id, version, definition, source, deleted, updated FROM processes WHERE id = $1`
+
+	var pr ProcessRecord
+	err := db.Handle.QueryRow(query, pid).Scan(&pr.ID, &pr.Version, &pr.Definition, &pr.Source, &pr.Deleted, &pr.Updated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ProcessRecord{}, false, nil
 		}
-		whereClauses = append(whereClauses, "submitter IN ("+strings.Join(placeholders, ", ")+")")
-		for _, sb := range submitters {
-			args = append(args, sb)
+		return ProcessRecord{}, false, err
+	}
+	return pr, true, nil
+}
+
+// AddProcess adds a new process, a deleted process with the same id is replaced
+func (db *PostgresDB) AddProcess(pr ProcessRecord) error {
+	return db.writeProcess(pr, "add")
+}
+
+// PutProcess adds or replaces a process
+func (db *PostgresDB) PutProcess(pr ProcessRecord) error {
+	return db.writeProcess(pr, "put")
+}
+
+func (db *PostgresDB) writeProcess(pr ProcessRecord, action string) error {
+	if pr.Updated.IsZero() {
+		pr.Updated = time.Now()
+	}
+
+	tx, err := db.Handle.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// versions are immutable
+	var def []byte
+	query := `SELECT definition FROM process_versions WHERE process_id = $1 AND version = $2`
+	err = tx.QueryRow(query, pr.ID, pr.Version).Scan(&def)
+	switch {
+	case err == sql.ErrNoRows:
+		query = `INSERT INTO process_versions (process_id, version, definition, source, created) VALUES ($1, $2, $3, $4, $5)`
+		_, err = tx.Exec(query, pr.ID, pr.Version, string(pr.Definition), pr.Source, pr.Updated)
+		if err != nil {
+			return err
 		}
+	case err != nil:
+		return err
+	case string(def) != string(pr.Definition):
+		return ErrProcessVersionExists
 	}
 
-	if len(whereClauses) > 0 {
-		baseQuery += " WHERE " + strings.Join(whereClauses, " AND ")
+	query = `
+    INSERT INTO processes (id, version, definition, source, deleted, updated) VALUES ($1, $2, $3, $4, FALSE, $5)
+    ON CONFLICT (id) DO UPDATE SET version = excluded.version, definition = excluded.definition,
+        source = excluded.source, deleted = FALSE, updated = excluded.updated`
+	if action == "add" {
+		query += ` WHERE processes.deleted`
 	}
 
-	// Add limit and offset to the query and args
-	query := baseQuery + fmt.Sprintf(" ORDER BY updated DESC LIMIT $%d OFFSET $%d", argIndex, argIndex+1)
-	args = append(args, limit, offset)
+	res, err := tx.Exec(query, pr.ID, pr.Version, string(pr.Definition), pr.Source, pr.Updated)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrProcessExists
+	}
 
-	res := []JobRecord{}
+	query = `INSERT INTO process_changes (process_id, version, action, source, definition, time) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = tx.Exec(query, pr.ID, pr.Version, action, pr.Source, string(pr.Definition), pr.Updated)
+	if err != nil {
+		return err
+	}
 
-	rows, err := pgDB.Handle.Query(query, args...)
+	// delivered to listeners when the transaction commits
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, processChangesChannel, pr.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteProcess marks a process as deleted
+func (db *PostgresDB) DeleteProcess(pid, source string) (bool, error) {
+	now := time.Now()
+
+	tx, err := db.Handle.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var version string
+	query := `UPDATE processes SET deleted = TRUE, source = $2, updated = $3 WHERE id = $1 AND NOT deleted RETURNING version`
+	err = tx.QueryRow(query, pid, source, now).Scan(&version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	query = `INSERT INTO process_changes (process_id, version, action, source, time) VALUES ($1, $2, 'delete', $3, $4)`
+	_, err = tx.Exec(query, pid, version, source, now)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, processChangesChannel, pid)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AddJobLease records the instance owning a job
+func (db *PostgresDB) AddJobLease(l JobLease) error {
+	query := `INSERT INTO job_leases (job_id, owner, expires, spec) VALUES ($1, $2, $3, $4)`
+	_, err := db.Handle.Exec(query, l.JobID, l.Owner, l.Expires, string(l.Spec))
+	return err
+}
+
+// GetJobLease retrieves the lease of a job
+func (db *PostgresDB) GetJobLease(jid string) (JobLease, bool, error) {
+	query := `SELECT job_id, owner, expires, spec FROM job_leases WHERE job_id = $1`
+
+	var l JobLease
+	err := db.Handle.QueryRow(query, jid).Scan(&l.JobID, &l.Owner, &l.Expires, &l.Spec)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return JobLease{}, false, nil
+		}
+		return JobLease{}, false, err
+	}
+	return l, true, nil
+}
+
+// RenewJobLeases extends all leases of the owner
+func (db *PostgresDB) RenewJobLeases(owner string, expires time.Time) ([]string, error) {
+	query := `UPDATE job_leases SET expires = $2 WHERE owner = $1 RETURNING job_id`
+
+	rows, err := db.Handle.Query(query, owner, expires)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	res := []string{}
 	for rows.Next() {
-		var r JobRecord
-		if err := rows.Scan(&r.JobID, &r.Status, &r.LastUpdate, &r.ProcessID, &r.Submitter); err != nil {
+		var jid string
+		if err := rows.Scan(&jid); err != nil {
 			return nil, err
 		}
-		res = append(res, r)
+		res = append(res, jid)
 	}
 
 	err = rows.Err()
@@ -176,6 +435,224 @@ func (pgDB *PostgresDB) GetJobs(limit, offset int, processIDs, statuses, submitt
 	return res, nil
 }
 
+// ExpireJobLease expires the lease of a job if it is held by owner
+func (db *PostgresDB) ExpireJobLease(jid, owner string) error {
+	query := `UPDATE job_leases SET expires = $3 WHERE job_id = $1 AND owner = $2`
+	_, err := db.Handle.Exec(query, jid, owner, time.Time{})
+	return err
+}
+
+// RemoveJobLease removes the lease of a job if it is held by owner, and commands that were not taken
+func (db *PostgresDB) RemoveJobLease(jid, owner string) error {
+	tx, err := db.Handle.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM job_leases WHERE job_id = $1 AND owner = $2`, jid, owner)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// job was taken over, commands belong to the new owner
+		return nil
+	}
+
+	_, err = tx.Exec(`DELETE FROM job_commands WHERE job_id = $1`, jid)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimExpiredJobLeases transfers expired leases to owner.
+// Rows locked by another instance claiming them at the same time are skipped.
+func (db *PostgresDB) ClaimExpiredJobLeases(owner string, now, expires time.Time) ([]JobLease, error) {
+	query := `
+    UPDATE job_leases l SET owner = $1, expires = $3
+    FROM (SELECT job_id, owner FROM job_leases WHERE expires < $2 FOR UPDATE SKIP LOCKED) prev
+    WHERE l.job_id = prev.job_id
+    RETURNING l.job_id, prev.owner, l.expires, l.spec`
+
+	rows, err := db.Handle.Query(query, owner, now, expires)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []JobLease{}
+	for rows.Next() {
+		var l JobLease
+		if err := rows.Scan(&l.JobID, &l.Owner, &l.Expires, &l.Spec); err != nil {
+			return nil, err
+		}
+		res = append(res, l)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SendJobCommand queues a command for the owner of the job and notifies instances
+func (db *PostgresDB) SendJobCommand(cmd JobCommand) (bool, error) {
+	tx, err := db.Handle.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// the command is only queued if the job has a lease
+	query := `
+    INSERT INTO job_commands (job_id, action, status, time, message, source)
+    SELECT job_id, $2, $3, $4, $5, $6 FROM job_leases WHERE job_id = $1`
+	res, err := tx.Exec(query, cmd.JobID, cmd.Action, cmd.Status, cmd.Time, cmd.Message, cmd.Source)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return false, nil
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, jobCommandsChannel, cmd.JobID)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// TakeJobCommands removes and returns pending commands for jobs leased by owner
+func (db *PostgresDB) TakeJobCommands(owner string) ([]JobCommand, error) {
+	query := `
+    DELETE FROM job_commands WHERE job_id IN (SELECT job_id FROM job_leases WHERE owner = $1)
+    RETURNING id, job_id, action, status, time, message, source`
+
+	rows, err := db.Handle.Query(query, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []JobCommand{}
+	for rows.Next() {
+		var cmd JobCommand
+		if err := rows.Scan(&cmd.id, &cmd.JobID, &cmd.Action, &cmd.Status, &cmd.Time, &cmd.Message, &cmd.Source); err != nil {
+			return nil, err
+		}
+		res = append(res, cmd)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// rows are not returned in any particular order
+	sortJobCommands(res)
+	return res, nil
+}
+
+// Listen for notifications on process_changes and job_commands channels.
+// Notifications may be missed while the listener is reconnecting, a change is signalled on both channels after reconnects.
+func (db *PostgresDB) listen() {
+	db.listenOnce.Do(func() {
+		db.listener = pq.NewListener(db.connString, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Errorf("database listener: %s", err.Error())
+			}
+			if ev == pq.ListenerEventReconnected {
+				notifyChange(db.processChanges)
+				notifyChange(db.jobCommands)
+			}
+		})
+
+		for _, ch := range []string{processChangesChannel, jobCommandsChannel} {
+			if err := db.listener.Listen(ch); err != nil {
+				log.Errorf("could not listen on channel %s: %s", ch, err.Error())
+			}
+		}
+
+		go func() {
+			for {
+				select {
+				case n, ok := <-db.listener.Notify:
+					if !ok {
+						return
+					}
+					// a nil notification is sent after the connection is re-established
+					if n == nil || n.Channel == processChangesChannel {
+						notifyChange(db.processChanges)
+					}
+					if n == nil || n.Channel == jobCommandsChannel {
+						notifyChange(db.jobCommands)
+					}
+				case <-time.After(90 * time.Second):
+					// check the connection is still alive
+					go db.listener.Ping()
+				}
+			}
+		}()
+	})
+}
+
+// ProcessChanges signals notifications on the process_changes channel
+func (db *PostgresDB) ProcessChanges() <-chan struct{} {
+	db.listen()
+	return db.processChanges
+}
+
+// JobCommands signals notifications on the job_commands channel
+func (db *PostgresDB) JobCommands() <-chan struct{} {
+	db.listen()
+	return db.jobCommands
+}
+
+// AddAPIKey stores a new API key
+func (db *PostgresDB) AddAPIKey(k APIKey) error {
+	return insertAPIKey(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, k)
+}
+
+// GetAPIKey retrieves the API key with the token hash
+func (db *PostgresDB) GetAPIKey(hash string) (APIKey, bool, error) {
+	return selectAPIKey(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, hash)
+}
+
+// GetAPIKeys retrieves the API keys of an owner, or of all owners if owner is empty
+func (db *PostgresDB) GetAPIKeys(owner string) ([]APIKey, error) {
+	return selectAPIKeys(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, owner)
+}
+
+// RevokeAPIKey revokes an API key that is not revoked yet
+func (db *PostgresDB) RevokeAPIKey(id, owner string, t time.Time) (bool, error) {
+	return updateAPIKeyRevoked(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, id, owner, t)
+}
+
+// TouchAPIKey records when an API key was last used
+func (db *PostgresDB) TouchAPIKey(id string, t time.Time) error {
+	return updateAPIKeyLastUsed(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, id, t)
+}
+
+// AddAuditEntry appends an entry to the audit log
+func (db *PostgresDB) AddAuditEntry(e AuditEntry) error {
+	return insertAuditEntry(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, e)
+}
+
+// GetAuditEntries retrieves audit entries matching the query, newest first
+func (db *PostgresDB) GetAuditEntries(q AuditQuery) ([]AuditEntry, error) {
+	return selectAuditEntries(db.Handle, func(n int) string { return fmt.Sprintf("$%d", n) }, q)
+}
+
 func (pgDB *PostgresDB) Close() error {
+	if pgDB.listener != nil {
+		pgDB.listener.Close()
+	}
 	return pgDB.Handle.Close()
 }
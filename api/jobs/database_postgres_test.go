@@ -0,0 +1,58 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs against the database at TEST_POSTGRES_CONN_STRING, skipped if it is not set.
+// Each check gets a new schema, which is dropped at the end of the test.
+func TestPostgresDBConformance(t *testing.T) {
+	connString := os.Getenv("TEST_POSTGRES_CONN_STRING")
+	if connString == "" {
+		t.Skip("TEST_POSTGRES_CONN_STRING not set")
+	}
+
+	admin, err := sql.Open("postgres", connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	prefix := fmt.Sprintf("conformance_%d", time.Now().UnixNano())
+	schemas := []string{}
+	t.Cleanup(func() {
+		for _, s := range schemas {
+			if _, err := admin.Exec(`DROP SCHEMA IF EXISTS ` + s + ` CASCADE`); err != nil {
+				t.Errorf("could not drop schema %s: %s", s, err.Error())
+			}
+		}
+	})
+
+	err = CheckDatabase(func() (Database, error) {
+		schema := fmt.Sprintf("%s_%d", prefix, len(schemas)+1)
+		if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+		return NewPostgresDB(withSearchPath(connString, schema))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Add the search_path run time parameter to a URL or key value connection string
+func withSearchPath(connString, schema string) string {
+	if !strings.Contains(connString, "://") {
+		return connString + " search_path=" + schema
+	}
+	if strings.Contains(connString, "?") {
+		return connString + "&search_path=" + schema
+	}
+	return connString + "?search_path=" + schema
+}
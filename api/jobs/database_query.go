@@ -0,0 +1,211 @@
+package jobs
+
+import (
+	"app/utils"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sort orders supported for job lists, "-" prefix for descending
+var JobsSortOrders = []string{"-updated", "updated", "-created", "created"}
+
+const defaultJobsSort = "-updated"
+
+// ErrInvalidCursor is returned when a cursor can not be decoded or does not match the query
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// JobsQuery describes the filters, sort order and page of a job list.
+// Zero values mean no filter.
+type JobsQuery struct {
+	Limit      int
+	Offset     int // ignored when Cursor is set
+	ProcessIDs []string
+	Statuses   []string
+	Submitters []string
+	// Time filters are inclusive of After and exclusive of Before
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          string // one of JobsSortOrders, defaults to -updated
+	Cursor        string // opaque cursor returned with the previous page
+	// Only jobs the viewer can read if set, nil for admins and when auth is disabled
+	Viewer *JobViewer
+}
+
+// JobViewer can read jobs it submitted and jobs shared with one of its groups
+type JobViewer struct {
+	Email  string
+	Groups []string
+}
+
+// CanRead reports if the viewer can read the job
+func (v JobViewer) CanRead(r JobRecord) bool {
+	if v.Email != "" && r.Submitter == v.Email {
+		return true
+	}
+	return r.Group != "" && utils.StringInSlice(r.Group, v.Groups)
+}
+
+// Position of the last record of a page, encoded in cursors.
+// Records are ordered by (time, id) so that the position is unique even when times are equal.
+type jobsCursor struct {
+	Sort string    `json:"s"`
+	Time time.Time `json:"t"`
+	ID   string    `json:"id"`
+}
+
+func encodeJobsCursor(sort string, r JobRecord) string {
+	c := jobsCursor{Sort: sort, Time: r.LastUpdate, ID: r.JobID}
+	if sortColumn(sort) == "created" {
+		c.Time = r.Created
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeJobsCursor(s string) (jobsCursor, error) {
+	var c jobsCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == "" {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Check if the sort order is supported, empty is valid and means default
+func ValidJobsSort(sort string) bool {
+	if sort == "" {
+		return true
+	}
+	for _, s := range JobsSortOrders {
+		if s == sort {
+			return true
+		}
+	}
+	return false
+}
+
+func sortColumn(sort string) string {
+	return strings.TrimPrefix(sort, "-")
+}
+
+// Build the select query for a job list.
+// placeholder returns the bind parameter for the nth argument, since it differs between databases.
+// One more record than the limit is requested to know if there is a next page.
+// Assumes query parameters are valid.
+func buildJobsQuery(q JobsQuery, placeholder func(n int) string) (string, []interface{}, error) {
+	whereClauses := []string{}
+	args := []interface{}{}
+
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return placeholder(len(args))
+	}
+
+	in := func(column string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		placeholders := make([]string, len(values))
+		for i, v := range values {
+			placeholders[i] = arg(v)
+		}
+		whereClauses = append(whereClauses, fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", ")))
+	}
+
+	in("process_id", q.ProcessIDs)
+	in("status", q.Statuses)
+	in("submitter", q.Submitters)
+
+	if q.Viewer != nil {
+		visible := []string{}
+		if q.Viewer.Email != "" {
+			visible = append(visible, "submitter = "+arg(q.Viewer.Email))
+		}
+		groups := []string{}
+		for _, g := range q.Viewer.Groups {
+			if g != "" {
+				groups = append(groups, arg(g))
+			}
+		}
+		if len(groups) > 0 {
+			visible = append(visible, fmt.Sprintf("job_group IN (%s)", strings.Join(groups, ", ")))
+		}
+		if len(visible) == 0 {
+			// the viewer can not read any job
+			visible = append(visible, "1 = 0")
+		}
+		whereClauses = append(whereClauses, "("+strings.Join(visible, " OR ")+")")
+	}
+
+	timeFilters := []struct {
+		column string
+		op     string
+		t      time.Time
+	}{
+		{"updated", ">=", q.UpdatedAfter},
+		{"updated", "<", q.UpdatedBefore},
+		{"created", ">=", q.CreatedAfter},
+		{"created", "<", q.CreatedBefore},
+	}
+	for _, f := range timeFilters {
+		if !f.t.IsZero() {
+			// records are written with server local time
+			whereClauses = append(whereClauses, fmt.Sprintf("%s %s %s", f.column, f.op, arg(f.t.Local())))
+		}
+	}
+
+	sort := q.Sort
+	if sort == "" {
+		sort = defaultJobsSort
+	}
+	column := sortColumn(sort)
+	direction, cmp := "ASC", ">"
+	if strings.HasPrefix(sort, "-") {
+		direction, cmp = "DESC", "<"
+	}
+
+	if q.Cursor != "" {
+		c, err := decodeJobsCursor(q.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		if c.Sort != sort {
+			return "", nil, ErrInvalidCursor
+		}
+		whereClauses = append(whereClauses, fmt.Sprintf("(%s, id) %s (%s, %s)", column, cmp, arg(c.Time), arg(c.ID)))
+	}
+
+	query := `SELECT id, status, created, updated, process_id, process_version, submitter, job_group FROM jobs`
+	if len(whereClauses) > 0 {
+		query += " WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %s", column, direction, direction, arg(q.Limit+1))
+	if q.Cursor == "" && q.Offset > 0 {
+		query += " OFFSET " + arg(q.Offset)
+	}
+
+	return query, args, nil
+}
+
+// Trim the extra record requested by buildJobsQuery and create cursor for the next page if there is one.
+func pageJobs(q JobsQuery, res []JobRecord) ([]JobRecord, string) {
+	if len(res) <= q.Limit {
+		return res, ""
+	}
+	res = res[:q.Limit]
+
+	sort := q.Sort
+	if sort == "" {
+		sort = defaultJobsSort
+	}
+	return res, encodeJobsCursor(sort, res[len(res)-1])
+}
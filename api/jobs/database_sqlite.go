@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -14,11 +14,33 @@ import (
 
 type SQLiteDB struct {
 	Handle *sql.DB
+
+	processChanges chan struct{}
+	watchOnce      sync.Once
+	jobCommands    chan struct{}
+	commandsOnce   sync.Once
+	stop           chan struct{}
 }
 
-// Initialize the database.
+// Initialize the database and apply pending migrations.
 // Creates intermediate directories if not exist.
 func NewSQLiteDB(dbPath string) (*SQLiteDB, error) {
+	h, err := openSQLite(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	db := SQLiteDB{Handle: h, processChanges: make(chan struct{}, 1), jobCommands: make(chan struct{}, 1), stop: make(chan struct{})}
+	err = migrateUp(h, "sqlite")
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return &db, nil
+}
+
+// Open the database file, creating it if not exist.
+func openSQLite(dbPath string) (*sql.DB, error) {
 
 	// Create directory structure if it doesn't exist
 	dir := filepath.Dir(dbPath)
@@ -38,81 +60,52 @@ func NewSQLiteDB(dbPath string) (*SQLiteDB, error) {
 	if h == nil {
 		return nil, fmt.Errorf("db nil")
 	}
-
-	db := SQLiteDB{Handle: h}
-	err = db.createTables()
-	if err != nil {
-		return nil, err
-	}
-	return &db, nil
+	return h, nil
 }
 
-// Create tables in the database if they do not exist already
-func (sqliteDB *SQLiteDB) createTables() error {
-
-	// SQLite does not have a built-in ENUM type or array type.
-	// SQLite doesn't enforce the length of the VARCHAR datatype, therefore not using something like VARCHAR(30).
-	// SQLite's concurrency control is based on transactions, not connections. A connection to a SQLite database does not inherently acquire a lock.
-	// Locks are acquired when a transaction is started and released when the transaction is committed or rolled back.
-
-	// indices needed to speedup
-	// fetching jobs for a particular process id
-	// providing job-lists ordered by time
-
-	queryJobs := `
-	CREATE TABLE IF NOT EXISTS jobs (
-		id TEXT PRIMARY KEY,
-		status TEXT NOT NULL,
-		updated TIMESTAMP NOT NULL,
-		mode TEXT NOT NULL,
-		host TEXT NOT NULL,
-		process_id TEXT NOT NULL,
-		submitter TEXT NOT NULL DEFAULT ''
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_jobs_updated ON jobs(updated);
-	CREATE INDEX IF NOT EXISTS idx_jobs_process_id ON jobs(process_id);
-	CREATE INDEX IF NOT EXISTS idx_jobs_submitter ON jobs(submitter);
-	`
+// Add job to the database. Will return error if job exist.
+func (sqliteDB *SQLiteDB) addJob(jid, status, mode, host, processID, processVersion, submitter, group string, updated time.Time) error {
+	query := `INSERT INTO jobs (id, status, created, updated, mode, host, process_id, process_version, submitter, job_group) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	_, err := sqliteDB.Handle.Exec(queryJobs)
+	_, err := sqliteDB.Handle.Exec(query, jid, status, updated, updated, mode, host, processID, processVersion, submitter, group)
 	if err != nil {
-		return fmt.Errorf("error creating tables: %s", err)
+		return err
 	}
 	return nil
 }
 
-// Add job to the database. Will return error if job exist.
-func (sqliteDB *SQLiteDB) addJob(jid, status, mode, host, processID, submitter string, updated time.Time) error {
-	query := `INSERT INTO jobs (id, status, updated, mode, host, process_id, submitter) VALUES (?, ?, ?, ?, ?, ?, ?)`
-
-	_, err := sqliteDB.Handle.Exec(query, jid, status, updated, mode, host, processID, submitter)
+// Update status and time of a job and add the transition to job events.
+func (sqliteDB *SQLiteDB) updateJobRecord(jid, status, source, message string, now time.Time) error {
+	tx, err := sqliteDB.Handle.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
-}
+	defer tx.Rollback()
 
-// Update status and time of a job.
-func (sqliteDB *SQLiteDB) updateJobRecord(jid, status string, now time.Time) error {
 	query := `UPDATE jobs SET status = ?, updated = ? WHERE id = ?`
-	_, err := sqliteDB.Handle.Exec(query, status, now, jid)
+	_, err = tx.Exec(query, status, now, jid)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	query = `INSERT INTO job_events (job_id, status, time, source, message) VALUES (?, ?, ?, ?, ?)`
+	_, err = tx.Exec(query, jid, status, now, source, message)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Get Job Record from database given a job id.
 // If job do not exists, or error encountered bool would be false.
 // Similar behavior as key exist in hashmap.
 func (sqliteDB *SQLiteDB) GetJob(jid string) (JobRecord, bool, error) {
-	query := `SELECT * FROM jobs WHERE id = ?`
+	query := `SELECT id, status, created, updated, mode, host, process_id, process_version, submitter, job_group FROM jobs WHERE id = ?`
 
 	jr := JobRecord{}
 
 	row := sqliteDB.Handle.QueryRow(query, jid)
-	err := row.Scan(&jr.JobID, &jr.Status, &jr.LastUpdate, &jr.Mode, &jr.Host, &jr.ProcessID, &jr.Submitter)
+	err := row.Scan(&jr.JobID, &jr.Status, &jr.Created, &jr.LastUpdate, &jr.Mode, &jr.Host, &jr.ProcessID, &jr.ProcessVersion, &jr.Submitter, &jr.Group)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return JobRecord{}, false, nil
@@ -142,57 +135,348 @@ func (sqliteDB *SQLiteDB) CheckJobExist(jid string) (bool, error) {
 	return true, nil
 }
 
+// Get status transitions of a job ordered by time.
+func (sqliteDB *SQLiteDB) GetJobEvents(jid string) ([]JobEvent, error) {
+	query := `SELECT status, time, source, message FROM job_events WHERE job_id = ? ORDER BY time, id`
+
+	rows, err := sqliteDB.Handle.Query(query, jid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []JobEvent{}
+	for rows.Next() {
+		var e JobEvent
+		if err := rows.Scan(&e.Status, &e.Time, &e.Source, &e.Message); err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Assumes query parameters are valid
-func (sqliteDB *SQLiteDB) GetJobs(limit, offset int, processIDs, statuses []string, submitters []string) ([]JobRecord, error) {
-	baseQuery := `SELECT id, status, updated, process_id, submitter FROM jobs`
-	whereClauses := []string{}
-	args := []interface{}{}
+func (sqliteDB *SQLiteDB) GetJobs(q JobsQuery) ([]JobRecord, string, error) {
+	query, args, err := buildJobsQuery(q, func(int) string { return "?" })
+	if err != nil {
+		return nil, "", err
+	}
 
-	if len(processIDs) > 0 {
-		placeholders := strings.Repeat("?,", len(processIDs)-1) + "?"
-		whereClauses = append(whereClauses, fmt.Sprintf("process_id IN (%s)", placeholders))
-		for _, pid := range processIDs {
-			args = append(args, pid)
+	res := []JobRecord{}
+
+	rows, err := sqliteDB.Handle.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r JobRecord
+		if err := rows.Scan(&r.JobID, &r.Status, &r.Created, &r.LastUpdate, &r.ProcessID, &r.ProcessVersion, &r.Submitter, &r.Group); err != nil {
+			return nil, "", err
 		}
+		res = append(res, r)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, "", err
 	}
 
-	if len(statuses) > 0 {
-		placeholders := strings.Repeat("?,", len(statuses)-1) + "?"
-		whereClauses = append(whereClauses, fmt.Sprintf("status IN (%s)", placeholders))
-		for _, st := range statuses {
-			args = append(args, st)
+	res, next := pageJobs(q, res)
+	return res, next, nil
+}
+
+// Compute statistics of jobs created in the time range.
+func (sqliteDB *SQLiteDB) GetJobStats(processID string, from, to time.Time, top int) (JobStats, error) {
+	return queryJobStats(sqliteDB.Handle, func(n int) string { return "?" }, processID, from, to, top)
+}
+
+func (sqliteDB *SQLiteDB) addJobUsage(u JobUsage) error {
+	return insertJobUsage(sqliteDB.Handle, func(n int) string { return "?" }, u)
+}
+
+// Get the compute consumed by a job.
+func (sqliteDB *SQLiteDB) GetJobUsage(jid string) (JobUsage, bool, error) {
+	return selectJobUsage(sqliteDB.Handle, func(n int) string { return "?" }, jid)
+}
+
+// Get the compute consumed by jobs grouped by submitter or process.
+func (sqliteDB *SQLiteDB) GetUsage(q UsageQuery) ([]UsageSummary, error) {
+	return queryUsage(sqliteDB.Handle, func(n int) string { return "?" }, q)
+}
+
+// Count the jobs of a submitter created since the time.
+func (sqliteDB *SQLiteDB) CountJobs(submitter string, since time.Time) (int, error) {
+	return countJobs(sqliteDB.Handle, func(n int) string { return "?" }, submitter, since)
+}
+
+func (sqliteDB *SQLiteDB) restoreJob(a ArchivedJob) (bool, error) {
+	return insertArchivedJob(sqliteDB.Handle, func(n int) string { return "?" }, a)
+}
+
+// Get all registered versions of a process ordered by registration time.
+func (sqliteDB *SQLiteDB) GetProcessVersions(pid string) ([]ProcessRecord, error) {
+	query := `SELECT process_id, version, definition, source, created FROM process_versions WHERE process_id = ? ORDER BY created, version`
+
+	rows, err := sqliteDB.Handle.Query(query, pid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []ProcessRecord{}
+	for rows.Next() {
+		var pr ProcessRecord
+		if err := rows.Scan(&pr.ID, &pr.Version, &pr.Definition, &pr.Source, &pr.Updated); err != nil {
+			return nil, err
 		}
+		res = append(res, pr)
 	}
 
-	if len(submitters) > 0 {
-		placeholders := strings.Repeat("?,", len(submitters)-1) + "?"
-		whereClauses = append(whereClauses, fmt.Sprintf("submitter IN (%s)", placeholders))
-		for _, sb := range submitters {
-			args = append(args, sb)
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Get a registered version of a process.
+func (sqliteDB *SQLiteDB) GetProcessVersion(pid, version string) (ProcessRecord, bool, error) {
+	query := `SELECT process_id, version, definition, source, created FROM process_versions WHERE process_id = ? AND version = ?`
+
+	var pr ProcessRecord
+	err := sqliteDB.Handle.QueryRow(query, pid, version).Scan(&pr.ID, &pr.Version, &pr.Definition, &pr.Source, &pr.Updated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ProcessRecord{}, false, nil
 		}
+		return ProcessRecord{}, false, err
 	}
+	return pr, true, nil
+}
 
-	if len(whereClauses) > 0 {
-		baseQuery += " WHERE " + strings.Join(whereClauses, " AND ")
+// Get all process definitions that are not deleted.
+func (sqliteDB *SQLiteDB) GetProcesses() ([]ProcessRecord, error) {
+	query := `SELECT id, version, definition, source, deleted, updated FROM processes WHERE NOT deleted ORDER BY id`
+
+	rows, err := sqliteDB.Handle.Query(query)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	query := baseQuery + ` ORDER BY updated DESC LIMIT ? OFFSET ?`
-	args = append(args, limit, offset)
+	res := []ProcessRecord{}
+	for rows.Next() {
+		var pr ProcessRecord
+		if err := rows.Scan(&pr.ID, &pr.Version, &pr.Definition, &pr.Source, &pr.Deleted, &pr.Updated); err != nil {
+			return nil, err
+		}
+		res = append(res, pr)
+	}
 
-	res := []JobRecord{}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
 
-	rows, err := sqliteDB.Handle.Query(query, args...)
+// Get process definition given a process id, including deleted processes.
+func (sqliteDB *SQLiteDB) GetProcess(pid string) (ProcessRecord, bool, error) {
+	query := `SELECT id, version, definition, source, deleted, updated FROM processes WHERE id = ?`
+
+	var pr ProcessRecord
+	err := sqliteDB.Handle.QueryRow(query, pid).Scan(&pr.ID, &pr.Version, &pr.Definition, &pr.Source, &pr.Deleted, &pr.Updated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ProcessRecord{}, false, nil
+		}
+		return ProcessRecord{}, false, err
+	}
+	return pr, true, nil
+}
+
+// Add a new process. A deleted process with the same id is replaced.
+func (sqliteDB *SQLiteDB) AddProcess(pr ProcessRecord) error {
+	return sqliteDB.writeProcess(pr, "add")
+}
+
+// Add or replace a process.
+func (sqliteDB *SQLiteDB) PutProcess(pr ProcessRecord) error {
+	return sqliteDB.writeProcess(pr, "put")
+}
+
+func (sqliteDB *SQLiteDB) writeProcess(pr ProcessRecord, action string) error {
+	if pr.Updated.IsZero() {
+		pr.Updated = time.Now()
+	}
+
+	tx, err := sqliteDB.Handle.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// versions are immutable
+	var def []byte
+	query := `SELECT definition FROM process_versions WHERE process_id = ? AND version = ?`
+	err = tx.QueryRow(query, pr.ID, pr.Version).Scan(&def)
+	switch {
+	case err == sql.ErrNoRows:
+		query = `INSERT INTO process_versions (process_id, version, definition, source, created) VALUES (?, ?, ?, ?, ?)`
+		_, err = tx.Exec(query, pr.ID, pr.Version, pr.Definition, pr.Source, pr.Updated)
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case string(def) != string(pr.Definition):
+		return ErrProcessVersionExists
+	}
+
+	query = `
+	INSERT INTO processes (id, version, definition, source, deleted, updated) VALUES (?, ?, ?, ?, FALSE, ?)
+	ON CONFLICT (id) DO UPDATE SET version = excluded.version, definition = excluded.definition,
+		source = excluded.source, deleted = FALSE, updated = excluded.updated`
+	if action == "add" {
+		query += ` WHERE processes.deleted`
+	}
+
+	res, err := tx.Exec(query, pr.ID, pr.Version, pr.Definition, pr.Source, pr.Updated)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrProcessExists
+	}
+
+	query = `INSERT INTO process_changes (process_id, version, action, source, definition, time) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(query, pr.ID, pr.Version, action, pr.Source, pr.Definition, pr.Updated)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	notifyChange(sqliteDB.processChanges)
+	return nil
+}
+
+// Mark a process as deleted.
+func (sqliteDB *SQLiteDB) DeleteProcess(pid, source string) (bool, error) {
+	now := time.Now()
+
+	tx, err := sqliteDB.Handle.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var version string
+	query := `UPDATE processes SET deleted = TRUE, source = ?, updated = ? WHERE id = ? AND NOT deleted RETURNING version`
+	err = tx.QueryRow(query, source, now, pid).Scan(&version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	query = `INSERT INTO process_changes (process_id, version, action, source, time) VALUES (?, ?, 'delete', ?, ?)`
+	_, err = tx.Exec(query, pid, version, source, now)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	notifyChange(sqliteDB.processChanges)
+	return true, nil
+}
+
+// SQLite can not notify other connections, changes made by other processes are detected by polling the change log.
+func (sqliteDB *SQLiteDB) ProcessChanges() <-chan struct{} {
+	sqliteDB.watchOnce.Do(func() {
+		var last int64
+		query := `SELECT COALESCE(MAX(id), 0) FROM process_changes`
+		if err := sqliteDB.Handle.QueryRow(query).Scan(&last); err != nil {
+			log.Errorf("could not read process changes: %s", err.Error())
+		}
+
+		go func() {
+			ticker := time.NewTicker(processPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-sqliteDB.stop:
+					return
+				case <-ticker.C:
+					var id int64
+					if err := sqliteDB.Handle.QueryRow(query).Scan(&id); err != nil {
+						log.Errorf("could not read process changes: %s", err.Error())
+						continue
+					}
+					if id != last {
+						last = id
+						notifyChange(sqliteDB.processChanges)
+					}
+				}
+			}
+		}()
+	})
+	return sqliteDB.processChanges
+}
+
+// Add the lease of a job. Will return error if the job has a lease.
+func (sqliteDB *SQLiteDB) AddJobLease(l JobLease) error {
+	query := `INSERT INTO job_leases (job_id, owner, expires, spec) VALUES (?, ?, ?, ?)`
+	_, err := sqliteDB.Handle.Exec(query, l.JobID, l.Owner, l.Expires, string(l.Spec))
+	return err
+}
+
+// Get the lease of a job.
+func (sqliteDB *SQLiteDB) GetJobLease(jid string) (JobLease, bool, error) {
+	query := `SELECT job_id, owner, expires, spec FROM job_leases WHERE job_id = ?`
+
+	var l JobLease
+	err := sqliteDB.Handle.QueryRow(query, jid).Scan(&l.JobID, &l.Owner, &l.Expires, &l.Spec)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return JobLease{}, false, nil
+		}
+		return JobLease{}, false, err
+	}
+	return l, true, nil
+}
+
+// Extend all leases of the owner.
+func (sqliteDB *SQLiteDB) RenewJobLeases(owner string, expires time.Time) ([]string, error) {
+	query := `UPDATE job_leases SET expires = ? WHERE owner = ? RETURNING job_id`
+
+	rows, err := sqliteDB.Handle.Query(query, expires, owner)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	res := []string{}
 	for rows.Next() {
-		var r JobRecord
-		if err := rows.Scan(&r.JobID, &r.Status, &r.LastUpdate, &r.ProcessID, &r.Submitter); err != nil {
+		var jid string
+		if err := rows.Scan(&jid); err != nil {
 			return nil, err
 		}
-		res = append(res, r)
+		res = append(res, jid)
 	}
 
 	err = rows.Err()
@@ -202,6 +486,197 @@ func (sqliteDB *SQLiteDB) GetJobs(limit, offset int, processIDs, statuses []stri
 	return res, nil
 }
 
+// Expire the lease of a job if it is held by owner.
+func (sqliteDB *SQLiteDB) ExpireJobLease(jid, owner string) error {
+	query := `UPDATE job_leases SET expires = ? WHERE job_id = ? AND owner = ?`
+	_, err := sqliteDB.Handle.Exec(query, time.Time{}, jid, owner)
+	return err
+}
+
+// Remove the lease of a job if it is held by owner, and commands that were not taken.
+func (sqliteDB *SQLiteDB) RemoveJobLease(jid, owner string) error {
+	tx, err := sqliteDB.Handle.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM job_leases WHERE job_id = ? AND owner = ?`, jid, owner)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// job was taken over, commands belong to the new owner
+		return nil
+	}
+
+	_, err = tx.Exec(`DELETE FROM job_commands WHERE job_id = ?`, jid)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Transfer expired leases to owner.
+// SQLite serializes writers so leases can not be claimed by two instances.
+func (sqliteDB *SQLiteDB) ClaimExpiredJobLeases(owner string, now, expires time.Time) ([]JobLease, error) {
+	tx, err := sqliteDB.Handle.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT job_id, owner, spec FROM job_leases WHERE expires < ?`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []JobLease{}
+	for rows.Next() {
+		l := JobLease{Expires: expires}
+		if err := rows.Scan(&l.JobID, &l.Owner, &l.Spec); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		res = append(res, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range res {
+		_, err := tx.Exec(`UPDATE job_leases SET owner = ?, expires = ? WHERE job_id = ?`, owner, expires, l.JobID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Queue a command for the owner of the job.
+func (sqliteDB *SQLiteDB) SendJobCommand(cmd JobCommand) (bool, error) {
+	// the command is only queued if the job has a lease
+	query := `
+	INSERT INTO job_commands (job_id, action, status, time, message, source)
+	SELECT job_id, ?, ?, ?, ?, ? FROM job_leases WHERE job_id = ?`
+
+	res, err := sqliteDB.Handle.Exec(query, cmd.Action, cmd.Status, cmd.Time, cmd.Message, cmd.Source, cmd.JobID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Remove and return pending commands for jobs leased by owner.
+func (sqliteDB *SQLiteDB) TakeJobCommands(owner string) ([]JobCommand, error) {
+	query := `
+	DELETE FROM job_commands WHERE job_id IN (SELECT job_id FROM job_leases WHERE owner = ?)
+	RETURNING id, job_id, action, status, time, message, source`
+
+	rows, err := sqliteDB.Handle.Query(query, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []JobCommand{}
+	for rows.Next() {
+		var cmd JobCommand
+		if err := rows.Scan(&cmd.id, &cmd.JobID, &cmd.Action, &cmd.Status, &cmd.Time, &cmd.Message, &cmd.Source); err != nil {
+			return nil, err
+		}
+		res = append(res, cmd)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// order of returned rows is not guaranteed
+	sortJobCommands(res)
+	return res, nil
+}
+
+// SQLite can not notify other connections, commands sent by other processes are detected by polling.
+func (sqliteDB *SQLiteDB) JobCommands() <-chan struct{} {
+	sqliteDB.commandsOnce.Do(func() {
+		var last int64
+		query := `SELECT COALESCE(MAX(id), 0) FROM job_commands`
+		if err := sqliteDB.Handle.QueryRow(query).Scan(&last); err != nil {
+			log.Errorf("could not read job commands: %s", err.Error())
+		}
+
+		go func() {
+			ticker := time.NewTicker(jobCommandPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-sqliteDB.stop:
+					return
+				case <-ticker.C:
+					var id int64
+					if err := sqliteDB.Handle.QueryRow(query).Scan(&id); err != nil {
+						log.Errorf("could not read job commands: %s", err.Error())
+						continue
+					}
+					if id != last {
+						last = id
+						notifyChange(sqliteDB.jobCommands)
+					}
+				}
+			}
+		}()
+	})
+	return sqliteDB.jobCommands
+}
+
+// Store a new API key.
+func (sqliteDB *SQLiteDB) AddAPIKey(k APIKey) error {
+	return insertAPIKey(sqliteDB.Handle, func(n int) string { return "?" }, k)
+}
+
+// Get the API key with the token hash.
+func (sqliteDB *SQLiteDB) GetAPIKey(hash string) (APIKey, bool, error) {
+	return selectAPIKey(sqliteDB.Handle, func(n int) string { return "?" }, hash)
+}
+
+// Get the API keys of an owner, or of all owners if owner is empty.
+func (sqliteDB *SQLiteDB) GetAPIKeys(owner string) ([]APIKey, error) {
+	return selectAPIKeys(sqliteDB.Handle, func(n int) string { return "?" }, owner)
+}
+
+// Revoke an API key that is not revoked yet.
+func (sqliteDB *SQLiteDB) RevokeAPIKey(id, owner string, t time.Time) (bool, error) {
+	return updateAPIKeyRevoked(sqliteDB.Handle, func(n int) string { return "?" }, id, owner, t)
+}
+
+// Record when an API key was last used.
+func (sqliteDB *SQLiteDB) TouchAPIKey(id string, t time.Time) error {
+	return updateAPIKeyLastUsed(sqliteDB.Handle, func(n int) string { return "?" }, id, t)
+}
+
+// Append an entry to the audit log.
+func (sqliteDB *SQLiteDB) AddAuditEntry(e AuditEntry) error {
+	return insertAuditEntry(sqliteDB.Handle, func(n int) string { return "?" }, e)
+}
+
+// Get audit entries matching the query, newest first.
+func (sqliteDB *SQLiteDB) GetAuditEntries(q AuditQuery) ([]AuditEntry, error) {
+	return selectAuditEntries(sqliteDB.Handle, func(n int) string { return "?" }, q)
+}
+
 func (sqliteDB *SQLiteDB) Close() error {
+	close(sqliteDB.stop)
 	return sqliteDB.Handle.Close()
 }
@@ -0,0 +1,19 @@
+package jobs
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteDBConformance(t *testing.T) {
+	dir := t.TempDir()
+	n := 0
+	err := CheckDatabase(func() (Database, error) {
+		n++
+		return NewSQLiteDB(filepath.Join(dir, fmt.Sprintf("check-%d.sqlite", n)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,10 +2,8 @@ package jobs
 
 import (
 	"app/controllers"
-	"app/utils"
 	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
@@ -29,16 +27,37 @@ type DockerJob struct {
 	ProcessName    string `json:"processID"`
 	ProcessVersion string `json:"processVersion"`
 	Submitter      string
-	EnvVars        []string
-	Cmd            []string `json:"commandOverride"`
-	UpdateTime     time.Time
-	Status         string `json:"status"`
+	// Role the job is shared with, empty if only the submitter and admins can read it
+	Group string
+	// Names of server env vars and secret references, see ParseEnvVar
+	EnvVars []string
+	// Env vars set by the caller of the execution, recorded in metadata
+	EnvOverrides map[string]string
+	// Values set in the container env in addition to EnvVars, such as the job callback token
+	Env        map[string]string
+	Cmd        []string `json:"commandOverride"`
+	Inputs     map[string]interface{}
+	Outputs    []OutputDef
+	UpdateTime time.Time
+	Status     string `json:"status"`
+
+	// Termination details recorded in metadata
+	statusHistory []statusTransition
+	// Guards Status, UpdateTime, statusHistory and the termination details, which are set by
+	// status updates of the run and dismiss routines while metadata is written
+	historyMu     sync.Mutex
+	failureReason string
+	exitCode      *int64
 
 	logger  *log.Logger
 	logFile *os.File
+	// Removes values of resolved secrets from server logs and metadata
+	redactor *secretRedactor
 
 	Resources
-	DB         Database
+	DB Database
+	// Provider of secrets referenced in EnvVars, nil if none is configured
+	Secrets    SecretProvider
 	StorageSvc *s3.S3
 	DoneChan   chan Job
 }
@@ -74,7 +93,7 @@ func (j *DockerJob) IMAGE() string {
 // Update container logs
 func (j *DockerJob) UpdateContainerLogs() (err error) {
 	// If old status is one of the terminated status, close has already been called and container logs fetched, container killed
-	switch j.Status {
+	switch j.CurrentStatus() {
 	case SUCCESSFUL, DISMISSED, FAILED:
 		return
 	}
@@ -133,14 +152,24 @@ func (j *DockerJob) LogMessage(m string, level log.Level) {
 }
 
 func (j *DockerJob) LastUpdate() time.Time {
+	j.historyMu.Lock()
+	defer j.historyMu.Unlock()
 	return j.UpdateTime
 }
 
-func (j *DockerJob) NewStatusUpdate(status string, updateTime time.Time) {
+func (j *DockerJob) NewStatusUpdate(status string, updateTime time.Time, source string, message string) {
+	j.updateStatus(status, updateTime, source, message, nil)
+}
+
+// Update the status of the job. The message of failed and dismissed statuses is recorded as failure reason
+// and the exit code of the container with the terminal status, so that only the first terminal status sets them.
+func (j *DockerJob) updateStatus(status string, updateTime time.Time, source, message string, exitCode *int64) {
+	j.historyMu.Lock()
 
 	// If old status is one of the terminated status, it should not update status.
 	switch j.Status {
 	case SUCCESSFUL, DISMISSED, FAILED:
+		j.historyMu.Unlock()
 		return
 	}
 
@@ -150,11 +179,45 @@ func (j *DockerJob) NewStatusUpdate(status string, updateTime time.Time) {
 	} else {
 		j.UpdateTime = updateTime
 	}
-	j.DB.updateJobRecord(j.UUID, status, j.UpdateTime)
+	updated := j.UpdateTime
+	j.statusHistory = append(j.statusHistory, statusTransition{status, updated})
+	switch status {
+	case FAILED, DISMISSED:
+		j.failureReason = message
+	}
+	if exitCode != nil {
+		j.exitCode = exitCode
+	}
+	j.historyMu.Unlock()
+
+	j.DB.updateJobRecord(j.UUID, status, source, message, updated)
 	j.logger.Infof("Status changed to %s.", status)
+
+	switch status {
+	case SUCCESSFUL, DISMISSED, FAILED:
+		j.recordUsage()
+	}
+}
+
+// Copy of the status transitions of the job
+func (j *DockerJob) history() []statusTransition {
+	j.historyMu.Lock()
+	defer j.historyMu.Unlock()
+	return append([]statusTransition(nil), j.statusHistory...)
+}
+
+// Record the compute consumed by the job, once it reached a terminal status.
+// Usage is recorded for every finished job, also if its metadata can not be written.
+func (j *DockerJob) recordUsage() {
+	u := usageFromHistory(j.UUID, j.ProcessID(), j.Submitter, "local", j.Resources.CPUs, j.Resources.Memory, j.history())
+	if err := j.DB.addJobUsage(u); err != nil {
+		j.logger.Errorf("Error recording job usage: %s", err.Error())
+	}
 }
 
 func (j *DockerJob) CurrentStatus() string {
+	j.historyMu.Lock()
+	defer j.historyMu.Unlock()
 	return j.Status
 }
 
@@ -212,13 +275,13 @@ func (j *DockerJob) Create() error {
 	j.ctxCancel = cancelFunc
 
 	// At this point job is ready to be added to database
-	err = j.DB.addJob(j.UUID, "accepted", "", "local", j.ProcessName, j.Submitter, time.Now())
+	err = j.DB.addJob(j.UUID, "accepted", "", "local", j.ProcessName, j.ProcessVersion, j.Submitter, j.Group, time.Now())
 	if err != nil {
 		j.ctxCancel()
 		return err
 	}
 
-	j.NewStatusUpdate(ACCEPTED, time.Time{})
+	j.NewStatusUpdate(ACCEPTED, time.Time{}, EventSourceServer, "")
 	j.wgRun.Add(1)
 	go j.Run()
 	return nil
@@ -249,14 +312,24 @@ func (j *DockerJob) Run() {
 	c, err := controllers.NewDockerController()
 	if err != nil {
 		j.logger.Errorf("Failed creating NewDockerController. Error: %s", err.Error())
-		j.NewStatusUpdate(FAILED, time.Time{})
+		j.NewStatusUpdate(FAILED, time.Time{}, EventSourceServer, fmt.Sprintf("could not create docker controller: %s", err.Error()))
 		return
 	}
 
-	// get environment variables
-	envVars := map[string]string{}
-	for _, eVar := range j.EnvVars {
-		envVars[eVar] = os.Getenv(eVar)
+	// get environment variables, secrets are resolved now so that changed secrets are used by new jobs
+	envVars, redactor, err := resolveEnv(j.Secrets, j.ProcessName, j.EnvVars, true)
+	if err != nil {
+		j.logger.Errorf("Failed resolving env vars. Error: %s", err.Error())
+		j.NewStatusUpdate(FAILED, time.Time{}, EventSourceServer, err.Error())
+		return
+	}
+	j.redactor = redactor
+	j.logger.AddHook(redactor)
+	for k, v := range j.EnvOverrides {
+		envVars[k] = v
+	}
+	for k, v := range j.Env {
+		envVars[k] = v
 	}
 
 	j.logger.Infof("Registered %v env vars", len(envVars))
@@ -267,7 +340,7 @@ func (j *DockerJob) Run() {
 	err = c.EnsureImage(j.ctx, j.Image, false)
 	if err != nil {
 		j.logger.Infof("Could not ensure image %s available", j.Image)
-		j.NewStatusUpdate(FAILED, time.Time{})
+		j.NewStatusUpdate(FAILED, time.Time{}, EventSourceServer, fmt.Sprintf("could not ensure image %s available: %s", j.Image, err.Error()))
 		return
 	}
 
@@ -275,10 +348,10 @@ func (j *DockerJob) Run() {
 	containerID, err := c.ContainerRun(j.ctx, j.Image, j.Cmd, []controllers.VolumeMount{}, envVars, resources)
 	if err != nil {
 		j.logger.Errorf("Failed to run container. Error: %s", err.Error())
-		j.NewStatusUpdate(FAILED, time.Time{})
+		j.NewStatusUpdate(FAILED, time.Time{}, EventSourceServer, fmt.Sprintf("failed to run container: %s", err.Error()))
 		return
 	}
-	j.NewStatusUpdate(RUNNING, time.Time{})
+	j.NewStatusUpdate(RUNNING, time.Time{}, EventSourceServer, "")
 
 	j.ContainerID = containerID
 
@@ -291,19 +364,18 @@ func (j *DockerJob) Run() {
 	if err != nil {
 
 		j.logger.Errorf("Failed waiting for container to finish. Error: %s", err.Error())
-		j.NewStatusUpdate(FAILED, time.Time{})
+		j.NewStatusUpdate(FAILED, time.Time{}, EventSourceServer, fmt.Sprintf("failed waiting for container to finish: %s", err.Error()))
 		return
 	}
 
 	if exitCode != 0 {
 		j.logger.Errorf("Container failure, exit code: %d", exitCode)
-		j.NewStatusUpdate(FAILED, time.Time{})
+		j.updateStatus(FAILED, time.Time{}, EventSourceServer, fmt.Sprintf("container exited with non-zero exit code: %d", exitCode), &exitCode)
 		return
 	}
 
 	j.logger.Info("Container process finished successfully.")
-	j.NewStatusUpdate(SUCCESSFUL, time.Time{})
-	go j.WriteMetaData()
+	j.updateStatus(SUCCESSFUL, time.Time{}, EventSourceServer, "", &exitCode)
 }
 
 // kill local container
@@ -315,7 +387,7 @@ func (j *DockerJob) Kill() error {
 		return fmt.Errorf("can't call delete on an already completed, failed, or dismissed job")
 	}
 
-	j.NewStatusUpdate(DISMISSED, time.Time{})
+	j.NewStatusUpdate(DISMISSED, time.Time{}, EventSourceServer, "dismissed")
 	// If a dismiss status is updated the job is considered dismissed at this point
 	// Close being graceful or not does not matter.
 
@@ -326,54 +398,84 @@ func (j *DockerJob) Kill() error {
 }
 
 // Write metadata at the job's metadata location
+// Expects container logs to be written to disk and container to not be removed yet.
+// Errors are logged and partial metadata is written, since metadata of failed jobs is
+// expected to have missing pieces.
 func (j *DockerJob) WriteMetaData() {
 	j.logger.Info("Starting metadata writing routine.")
-	j.wg.Add(1)
-	defer j.wg.Done()
 	defer j.logger.Info("Finished metadata writing routine.")
 
 	c, err := controllers.NewDockerController()
 	if err != nil {
 		j.logger.Errorf("Could not create controller. Error: %s", err.Error())
+		return
 	}
 
 	p := process{j.ProcessID(), j.ProcessVersionID()}
-	imageDigest, err := c.GetImageDigest(j.IMAGE())
+	i := image{ImageURI: j.IMAGE()}
+
+	dOS, dArch, dVersion, err := c.ServerPlatform()
 	if err != nil {
-		j.logger.Errorf("Error getting Image Digest: %s", err.Error())
-		return
+		j.logger.Warnf("Could not get docker platform: %s", err.Error())
+	} else {
+		i.Platform = dOS + "/" + dArch
 	}
 
-	i := image{j.IMAGE(), imageDigest}
+	// Record the image that actually ran, not the image the tag currently points to
+	if j.ContainerID != "" {
+		i.ImageID, err = c.GetContainerImageID(j.ContainerID)
+		if err != nil {
+			j.logger.Errorf("Error getting container image: %s", err.Error())
+		}
+	}
+	if i.ImageID != "" && i.Platform != "" {
+		i.ImageDigest, err = getLocalImageDigest(c, i.ImageID, j.IMAGE(), i.Platform)
+		if err != nil {
+			j.logger.Warnf("Could not resolve image manifest digest, using image ID: %s", err.Error())
+			i.ImageDigest = i.ImageID
+		}
+	}
 
-	g, s, e, err := c.GetJobTimes(j.ContainerID)
-	if err != nil {
-		j.logger.Errorf("Error getting job times: %s", err.Error())
-		return
+	j.historyMu.Lock()
+	md := newMetaData(j.UUID, j.Submitter, j.Status, append([]statusTransition(nil), j.statusHistory...), p, i, j.Cmd)
+	md.FailureReason = j.failureReason
+	md.ExitCode = j.exitCode
+	j.historyMu.Unlock()
+	md.EnvironmentVariables = j.EnvOverrides
+
+	if j.ContainerID != "" {
+		g, s, e, err := c.GetJobTimes(j.ContainerID)
+		if err != nil {
+			j.logger.Errorf("Error getting job times: %s", err.Error())
+		} else {
+			md.setTimes(g, s, e)
+		}
 	}
 
-	md := metaData{
-		Context:         "https://github.com/Dewberry/process-api/blob/main/context.jsonld",
-		JobID:           j.UUID,
-		Process:         p,
-		Image:           i,
-		Commands:        j.Cmd,
-		GeneratedAtTime: g,
-		StartedAtTime:   s,
-		EndedAtTime:     e,
+	md.AtLocation = computeEnvironment{
+		ID:     activityID(j.UUID) + "#environment",
+		Type:   "prov:Location",
+		Host:   "local",
+		CPUs:   j.Resources.CPUs,
+		Memory: j.Resources.Memory,
+	}
+	md.AtLocation.Hostname, _ = os.Hostname()
+	if i.Platform != "" {
+		md.AtLocation.Platform = i.Platform
+		md.AtLocation.Details = map[string]string{"dockerVersion": dVersion, "containerID": j.ContainerID}
 	}
 
-	jsonBytes, err := json.Marshal(md)
-	if err != nil {
-		j.logger.Errorf("Error marshalling metadata to JSON bytes: %s", err.Error())
-		return
+	md.Used = inputEntities(j.UUID, j.Inputs)
+	if j.CurrentStatus() == SUCCESSFUL {
+		md.Generated, err = outputEntities(j.StorageSvc, j.UUID, j.Outputs, j.Inputs)
+		if err != nil {
+			j.logger.Warnf("Output entities incomplete: %s", err.Error())
+		}
 	}
 
-	metadataDir := os.Getenv("STORAGE_METADATA_PREFIX")
-	mdLocation := fmt.Sprintf("%s/%s.json", metadataDir, j.UUID)
-	err = utils.WriteToS3(j.StorageSvc, jsonBytes, mdLocation, "application/json", 0)
+	err = writeMetaData(j.StorageSvc, j.UUID, md, j.redactor)
 	if err != nil {
-		return
+		j.logger.Errorf("Error writing metadata: %s", err.Error())
 	}
 }
 
@@ -415,8 +517,10 @@ func (j *DockerJob) Close() {
 	// to do: add panic recover to remove job from active jobs even if following panics
 	j.ctxCancel() // Signal Run function to terminate if running
 
+	var c *controllers.DockerController
 	if j.ContainerID != "" { // Container related cleanups if container exists
-		c, err := controllers.NewDockerController()
+		var err error
+		c, err = controllers.NewDockerController()
 		if err != nil {
 			j.logger.Errorf("Could not create controller. Error: %s", err.Error())
 		} else {
@@ -446,17 +550,30 @@ func (j *DockerJob) Close() {
 
 			writer.Flush()
 			file.Close()
-
-			err = c.ContainerRemove(context.TODO(), j.ContainerID)
-			if err != nil {
-				j.logger.Errorf("Could not remove container. Error: %s", err.Error())
-			}
 		}
 	}
+
+	// Metadata is written for every terminal status
+	// after container logs are on disk since outputs are parsed from logs
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		j.WriteMetaData()
+	}()
+
 	j.DoneChan <- j // At this point job can be safely removed from active jobs
 
 	go func() {
 		j.wg.Wait() // wait if other routines like metadata are running
+
+		// Container is removed after metadata routine since metadata needs to inspect the container
+		if c != nil {
+			err := c.ContainerRemove(context.TODO(), j.ContainerID)
+			if err != nil {
+				j.logger.Errorf("Could not remove container. Error: %s", err.Error())
+			}
+		}
+
 		j.logFile.Close()
 		UploadLogsToStorage(j.StorageSvc, j.UUID, j.ProcessName)
 		// It is expected that logs will be requested multiple times for a recently finished job
@@ -0,0 +1,48 @@
+package jobs
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestDockerJobTerminalStatus(t *testing.T) {
+	db := NewMemoryDB()
+	created := time.Now().Add(-time.Minute)
+	if err := db.addJob("job-1", RUNNING, "async-execute", "local", "pyecho", "1.0.0", "a@example.com", "", created); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	j := &DockerJob{UUID: "job-1", ProcessName: "pyecho", Status: RUNNING, UpdateTime: created, DB: db, logger: logger}
+
+	// a dismissed container makes the run routine fail waiting for it
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		j.NewStatusUpdate(DISMISSED, time.Time{}, EventSourceServer, "dismissed")
+	}()
+	go func() {
+		defer wg.Done()
+		j.CurrentStatus()
+		j.history()
+	}()
+	wg.Wait()
+
+	exitCode := int64(137)
+	j.updateStatus(FAILED, time.Time{}, EventSourceServer, "failed waiting for container to finish: context canceled", &exitCode)
+
+	if j.CurrentStatus() != DISMISSED || j.failureReason != "dismissed" || j.exitCode != nil {
+		t.Errorf("status %s, failure reason %q, exit code %v after dismiss", j.CurrentStatus(), j.failureReason, j.exitCode)
+	}
+	if h := j.history(); len(h) != 1 || h[0].Status != DISMISSED {
+		t.Errorf("history after dismiss is %+v", h)
+	}
+	if jr, _, _ := db.GetJob("job-1"); jr.Status != DISMISSED {
+		t.Errorf("job record has status %s", jr.Status)
+	}
+}
@@ -43,15 +43,19 @@ type Job interface {
 	// NewStatusUpdate must update the status of the job to the provided status string.
 	// If a zero-value time is provided as updateTime, the current time (time.Now()) should be set as the UpdateTime.
 	// Otherwise, the provided updateTime should be set as the UpdateTime.
-	// This function should also update the job record in the database with the new status and UpdateTime.
+	// This function should also update the job record in the database with the new status and UpdateTime,
+	// and record the transition as a job event with the source of the update and an optional message.
 	// If old status is one of the terminated status, it should not update status.
-	NewStatusUpdate(string, time.Time)
+	NewStatusUpdate(status string, updateTime time.Time, source string, message string)
 
 	// Create must change job status to accepted.
 	// Must create log files.
 	// At this point job should be ready to be processed and added to database
 	Create() error
 
+	// WriteMetaData must write a PROV-O metadata document for the job to storage.
+	// It is called by Close() once container logs are available, for every terminal status.
+	// Documents of failed and dismissed jobs must include the failure details that are available.
 	WriteMetaData()
 	// WriteResults([]byte) error
 
@@ -66,16 +70,39 @@ type Job interface {
 	Close()
 }
 
+// Sources of status updates recorded in job events
+const (
+	// status changed by the server, e.g. container started or exited
+	EventSourceServer = "server"
+	// status posted by the job through the status callback
+	EventSourceCallback = "callback"
+	// status recovered by the server from the execution platform
+	EventSourceReconciler = "reconciler"
+)
+
+// JobEvent is a status transition of a job
+type JobEvent struct {
+	Status  string    `json:"status"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Message string    `json:"message,omitempty"`
+}
+
 // JobRecord contains details about a job
 type JobRecord struct {
 	JobID      string    `json:"jobID"`
+	Created    time.Time `json:"created"`
 	LastUpdate time.Time `json:"updated"`
 	Status     string    `json:"status"`
 	ProcessID  string    `json:"processID"`
-	Type       string    `default:"process" json:"type"`
-	Host       string    `json:"host,omitempty"`
-	Mode       string    `json:"mode,omitempty"`
-	Submitter  string    `json:"submitter"`
+	// Version of the process the job was started with
+	ProcessVersion string `json:"processVersion,omitempty"`
+	Type           string `default:"process" json:"type"`
+	Host           string `json:"host,omitempty"`
+	Mode           string `json:"mode,omitempty"`
+	Submitter      string `json:"submitter"`
+	// Role the job is shared with, members of the role can read the job
+	Group string `json:"group,omitempty"`
 }
 
 type LogEntry struct {
@@ -189,7 +216,7 @@ func FetchResults(svc *s3.S3, jid string) (interface{}, error) {
 // If JobID exists but metadata file doesn't then it raises an error
 // Assumes jobID is valid
 func FetchMeta(svc *s3.S3, jid string) (interface{}, error) {
-	key := fmt.Sprintf("%s/%s.json", os.Getenv("STORAGE_METADATA_PREFIX"), jid)
+	key := metaDataKey(jid)
 
 	exist, err := utils.KeyExists(key, svc)
 	if err != nil {
@@ -8,6 +8,8 @@ type StatusMessage struct {
 	Job        *Job
 	Status     string    `json:"status"`
 	LastUpdate time.Time `json:"updated"`
+	Message    string    `json:"message,omitempty"`
+	Source     string    `json:"-"`
 }
 
 type ResultsMessage struct {
@@ -30,17 +32,15 @@ func ProcessStatusMessageUpdate(sm StatusMessage) {
 	case SUCCESSFUL, DISMISSED, FAILED:
 		return
 	}
-	(*sm.Job).NewStatusUpdate(sm.Status, sm.LastUpdate)
+	(*sm.Job).NewStatusUpdate(sm.Status, sm.LastUpdate, sm.Source, sm.Message)
 
 	switch sm.Status {
-	case SUCCESSFUL:
-		go (*sm.Job).WriteMetaData()
-		fallthrough
-	case DISMISSED, FAILED:
+	case SUCCESSFUL, DISMISSED, FAILED:
 		// swap the order of following if results are posted/written by the container
 		// also then no need to do all of this together in a separate routine
 		// we can do RunFinished in this routine but Close will still need to be run in a new routine
 		// so that the message queue is not hanged up
+		// Close also triggers writing metadata once the logs are available
 		go func() {
 			(*sm.Job).Close()
 			(*sm.Job).RunFinished()
@@ -1,148 +1,400 @@
 package jobs
 
 import (
+	"app/controllers"
+	"app/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+const metaDataContext = "https://github.com/Dewberry/process-api/blob/main/context.jsonld"
+
 type process struct {
 	ProcessID      string `json:"processId"`
 	ProcessVersion string `json:"processVersion"`
 }
 
 type image struct {
-	ImageURI    string `json:"imageURI"`
+	ImageURI string `json:"imageURI"`
+	// Digest of the platform specific manifest that ran
 	ImageDigest string `json:"imageDigest"`
+	// Local image ID (config digest), only available for local jobs
+	ImageID  string `json:"imageId,omitempty"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// OutputDef is the part of a process output definition needed to trace lineage of the output
+type OutputDef struct {
+	ID string
+	// Input this output is derived from, if empty output is considered derived from all inputs
+	InputID string
+}
+
+// reference to another node of the provenance graph
+type ref struct {
+	ID string `json:"@id"`
+}
+
+// prov:Agent, the user who submitted the job
+type agent struct {
+	ID    string `json:"@id"`
+	Type  string `json:"@type"`
+	Email string `json:"apiUser,omitempty"`
+}
+
+// prov:Plan, the process version that was executed
+type plan struct {
+	ID   string `json:"@id"`
+	Type string `json:"@type"`
+	process
+}
+
+type association struct {
+	Type    string `json:"@type"`
+	Agent   ref    `json:"agent"`
+	HadPlan plan   `json:"hadPlan"`
+}
+
+// prov:Entity, an input or output of the job
+type entity struct {
+	ID             string      `json:"@id"`
+	Type           string      `json:"@type"`
+	Identifier     string      `json:"identifier"`
+	Value          interface{} `json:"value,omitempty"`
+	StorageKey     string      `json:"storageKey,omitempty"`
+	Checksum       string      `json:"checksum,omitempty"`
+	WasDerivedFrom []ref       `json:"wasDerivedFrom,omitempty"`
+	WasGeneratedBy *ref        `json:"wasGeneratedBy,omitempty"`
+	// Members of a prov:Collection
+	HadMember []entity `json:"hadMember,omitempty"`
+}
+
+// prov:Location, the host and compute environment the job ran on
+type computeEnvironment struct {
+	ID       string            `json:"@id"`
+	Type     string            `json:"@type"`
+	Host     string            `json:"host"`
+	Hostname string            `json:"hostname,omitempty"`
+	Platform string            `json:"platform,omitempty"`
+	CPUs     float32           `json:"cpus,omitempty"`
+	Memory   int               `json:"memory,omitempty"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// A status change of the job as seen by the server
+type statusTransition struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
 }
 
 // Define a metaData object
+// The document is a PROV-O JSON-LD description of the job as a prov:Activity
 type metaData struct {
-	Context string `json:"@context"`
-	JobID   string `json:"apiJobId"`
-	// User    string  `json:"apiUser"`
+	Context string  `json:"@context"`
+	ID      string  `json:"@id"`
+	Type    string  `json:"@type"`
+	JobID   string  `json:"apiJobId"`
 	Process process `json:"process"`
 	Image   image   `json:"image"`
-	// ComputeEnvironmentURI    string    // ARN
 	// ComputeEnvironmentDigest string    // required for reproducibility, will need to be custom implemented
-	Commands        []string  `json:"containerCommands"`
-	GeneratedAtTime time.Time `json:"generatedAtTime"`
-	StartedAtTime   time.Time `json:"startedAtTime"`
-	EndedAtTime     time.Time `json:"endedAtTime"`
+	Commands []string `json:"containerCommands"`
+	// Env vars set by the caller of the execution
+	EnvironmentVariables map[string]string `json:"environmentVariables,omitempty"`
+	// Times are omitted if the job did not reach the corresponding stage
+	GeneratedAtTime      *time.Time         `json:"generatedAtTime,omitempty"`
+	StartedAtTime        *time.Time         `json:"startedAtTime,omitempty"`
+	EndedAtTime          *time.Time         `json:"endedAtTime,omitempty"`
+	Status               string             `json:"status"`
+	FailureReason        string             `json:"failureReason,omitempty"`
+	ExitCode             *int64             `json:"exitCode,omitempty"`
+	StatusHistory        []statusTransition `json:"statusHistory"`
+	WasAssociatedWith    agent              `json:"wasAssociatedWith"`
+	QualifiedAssociation association        `json:"qualifiedAssociation"`
+	AtLocation           computeEnvironment `json:"atLocation"`
+	Used                 []entity           `json:"used"`
+	Generated            []entity           `json:"generated"`
+}
+
+// Set the times of the activity, zero times are left out of the document
+func (md *metaData) setTimes(g, s, e time.Time) {
+	md.GeneratedAtTime = timeRef(g)
+	md.StartedAtTime = timeRef(s)
+	md.EndedAtTime = timeRef(e)
 }
 
-// Get image digest from ecr
-func getECRImageDigest(imgURI string) (string, error) {
-	var imgDgst string
+// Replace values of secrets in the strings of the document that come from the job, copies are modified
+// so that the job is not changed. Other fields are set by the server and can not hold secrets.
+func (md *metaData) redact(r *secretRedactor) {
+	if r == nil {
+		return
+	}
 
-	sess, err := session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	})
-	if err != nil {
-		return "", err
+	cmd := make([]string, len(md.Commands))
+	for i, c := range md.Commands {
+		cmd[i] = r.redact(c)
 	}
-	ecrClient := ecr.New(sess)
+	md.Commands = cmd
+	md.FailureReason = r.redact(md.FailureReason)
 
-	accountID, repositoryName, imgTag, err := parseECRImgURI(imgURI)
-	if err != nil {
-		return "", err
+	if md.EnvironmentVariables != nil {
+		env := make(map[string]string, len(md.EnvironmentVariables))
+		for k, v := range md.EnvironmentVariables {
+			env[k] = r.redact(v)
+		}
+		md.EnvironmentVariables = env
+	}
+
+	md.Used = redactEntities(r, md.Used)
+	md.Generated = redactEntities(r, md.Generated)
+}
+
+func redactEntities(r *secretRedactor, entities []entity) []entity {
+	if entities == nil {
+		return nil
+	}
+	res := make([]entity, len(entities))
+	for i, e := range entities {
+		e.Value = r.redactValue(e.Value)
+		e.HadMember = redactEntities(r, e.HadMember)
+		res[i] = e
+	}
+	return res
+}
+
+func timeRef(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func activityID(jid string) string {
+	return "urn:uuid:" + jid
+}
+
+func inputEntityID(jid, inputID string) string {
+	return fmt.Sprintf("urn:uuid:%s#input-%s", jid, inputID)
+}
+
+func outputEntityID(jid, outputID string) string {
+	return fmt.Sprintf("urn:uuid:%s#output-%s", jid, outputID)
+}
+
+// Create a metadata document with the activity, agent, plan and status nodes populated.
+// Callers are responsible for times, location, termination details, and input/output entities.
+func newMetaData(jid, submitter, status string, history []statusTransition, p process, i image, cmd []string) metaData {
+	a := agent{ID: "urn:process-api:agent:anonymous", Type: "prov:Agent"}
+	if submitter != "" {
+		a.ID = "mailto:" + submitter
+		a.Email = submitter
 	}
 
-	// Retrieve the image details from ECR
-	describeImagesInput := &ecr.DescribeImagesInput{
-		RegistryId:     aws.String(accountID),
-		RepositoryName: aws.String(repositoryName),
-		ImageIds: []*ecr.ImageIdentifier{
-			{
-				ImageTag: aws.String(imgTag),
-			},
+	return metaData{
+		Context:           metaDataContext,
+		ID:                activityID(jid),
+		Type:              "prov:Activity",
+		JobID:             jid,
+		Process:           p,
+		Image:             i,
+		Commands:          cmd,
+		WasAssociatedWith: a,
+		QualifiedAssociation: association{
+			Type:    "prov:Association",
+			Agent:   ref{a.ID},
+			HadPlan: plan{ID: fmt.Sprintf("urn:process-api:process:%s:%s", p.ProcessID, p.ProcessVersion), Type: "prov:Plan", process: p},
 		},
+		Status:        status,
+		StatusHistory: history,
+		Used:          []entity{},
+		Generated:     []entity{},
+	}
+}
+
+// Create input entities from the inputs submitted with the execution request
+func inputEntities(jid string, inputs map[string]interface{}) []entity {
+	ids := make([]string, 0, len(inputs))
+	for id := range inputs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids) // deterministic documents
+
+	entities := make([]entity, len(ids))
+	for i, id := range ids {
+		entities[i] = entity{ID: inputEntityID(jid, id), Type: "prov:Entity", Identifier: id, Value: inputs[id]}
 	}
+	return entities
+}
 
-	describeImagesOutput, err := ecrClient.DescribeImages(describeImagesInput)
+// Create output entities by matching declared outputs against the job results.
+// Outputs that reference an object in the storage bucket record its key and checksum.
+func outputEntities(svc *s3.S3, jid string, defs []OutputDef, inputs map[string]interface{}) ([]entity, error) {
+	entities := make([]entity, 0, len(defs))
+	if len(defs) == 0 {
+		return entities, nil
+	}
+
+	results, err := FetchResults(svc, jid)
 	if err != nil {
-		return "", err
+		return entities, err
 	}
+	resultsMap, _ := results.(map[string]interface{})
 
-	// Get the digest from the image details
-	if len(describeImagesOutput.ImageDetails) > 0 {
-		imgDgst = aws.StringValue(describeImagesOutput.ImageDetails[0].ImageDigest)
-	} else {
-		return "", fmt.Errorf("image not found in ECR")
+	allInputs := make([]ref, 0, len(inputs))
+	for _, e := range inputEntities(jid, inputs) {
+		allInputs = append(allInputs, ref{e.ID})
 	}
 
-	return imgDgst, nil
-}
+	var errs []string
+	for _, d := range defs {
+		e := entity{ID: outputEntityID(jid, d.ID), Type: "prov:Entity", Identifier: d.ID, WasGeneratedBy: &ref{activityID(jid)}}
+
+		if d.InputID != "" {
+			e.WasDerivedFrom = []ref{{inputEntityID(jid, d.InputID)}}
+		} else {
+			e.WasDerivedFrom = allInputs
+		}
+
+		v, ok := resultsMap[d.ID]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("output %s not found in results", d.ID))
+			entities = append(entities, e)
+			continue
+		}
+
+		// Outputs with multiple objects are described as a collection of entities, one per object
+		if items, ok := v.([]interface{}); ok && len(items) > 0 {
+			if uri, _, _ := storageKey(items[0]); uri != "" {
+				e.Type = "prov:Collection"
+				for k, item := range items {
+					m := entity{ID: fmt.Sprintf("%s-%d", e.ID, k), Type: "prov:Entity", Identifier: fmt.Sprintf("%s[%d]", d.ID, k)}
+					if err := describeOutput(svc, &m, item); err != nil {
+						errs = append(errs, fmt.Sprintf("output %s: %s", m.Identifier, err.Error()))
+					}
+					e.HadMember = append(e.HadMember, m)
+				}
+				entities = append(entities, e)
+				continue
+			}
+		}
 
-// Helper function to parse the ECR Image URI
-func parseECRImgURI(imgURI string) (string, string, string, error) {
-	// Split the repository URI into account ID, repository name, and image tag
-	parts := strings.Split(imgURI, "/")
-	if len(parts) != 2 {
-		return "", "", "", fmt.Errorf("invalid repository URI: %s", imgURI)
+		if err := describeOutput(svc, &e, v); err != nil {
+			errs = append(errs, fmt.Sprintf("output %s: %s", d.ID, err.Error()))
+		}
+		entities = append(entities, e)
 	}
 
-	accountID := strings.Split(parts[0], ".")[0]
-	imageWithTag := parts[1]
+	if len(errs) > 0 {
+		return entities, errors.New(strings.Join(errs, "; "))
+	}
+	return entities, nil
+}
 
-	imageParts := strings.SplitN(imageWithTag, ":", 2)
-	if len(imageParts) != 2 {
-		return "", "", "", fmt.Errorf("invalid image tag in repository URI: %s", imgURI)
+// Set the value of an output entity, or its storage key and the SHA-256 checksum
+// of the object if the value references an object in the storage bucket.
+func describeOutput(svc *s3.S3, e *entity, v interface{}) error {
+	uri, key, inBucket := storageKey(v)
+	if uri == "" {
+		e.Value = v
+		return nil
 	}
 
-	repositoryName := imageParts[0]
-	imageTag := imageParts[1]
+	e.StorageKey = uri
+	if !inBucket {
+		return nil
+	}
 
-	return accountID, repositoryName, imageTag, nil
+	checksum, err := utils.GetS3Checksum(key, svc)
+	if err != nil {
+		return fmt.Errorf("could not compute checksum: %s", err.Error())
+	}
+	e.Checksum = checksum
+	return nil
 }
 
-// Get Image Digest from Docker Hub
-// arch based digest not yet implemented, arch is not used
-func getDkrHubImageDigest(imgURI string, arch string) (string, error) {
-	parts := strings.Split(imgURI, ":")
-	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid image Name: %s", imgURI)
+// Get the storage location referenced by an output value.
+// Values can be an s3 uri string or an object with an s3 uri as href.
+// Returns the uri, the key, and if the key is in the configured storage bucket.
+func storageKey(v interface{}) (string, string, bool) {
+	var uri string
+	switch val := v.(type) {
+	case string:
+		uri = val
+	case map[string]interface{}:
+		uri, _ = val["href"].(string)
 	}
 
-	imageName := parts[0]
-	imageTag := parts[1]
+	if !strings.HasPrefix(uri, "s3://") {
+		return "", "", false
+	}
 
-	url := fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/tags/%s/images", imageName, imageTag)
+	parts := strings.SplitN(strings.TrimPrefix(uri, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", false
+	}
+	return uri, parts[1], parts[0] == os.Getenv("STORAGE_BUCKET")
+}
 
-	client := http.Client{
-		Timeout: 10 * time.Second, // Set a timeout for the request
+// Write metadata document at the job's metadata location and sign it if a signing key is configured
+// Values of secrets the job resolved are replaced by the redactor, which can be nil
+func writeMetaData(svc *s3.S3, jid string, md metaData, redactor *secretRedactor) error {
+	md.redact(redactor)
+	jsonBytes, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("error marshalling metadata to JSON bytes: %s", err.Error())
 	}
 
-	response, err := client.Get(url)
+	err = utils.WriteToS3(svc, jsonBytes, metaDataKey(jid), "application/json", 0)
 	if err != nil {
-		return "", fmt.Errorf("error sending request: %s", err)
+		return err
+	}
 
+	// Signature is over the exact bytes stored so that the document can be verified later
+	err = writeMetaSignature(svc, jid, jsonBytes)
+	if err != nil {
+		return fmt.Errorf("error writing metadata signature: %s", err.Error())
 	}
-	defer response.Body.Close()
+	return nil
+}
 
-	body, err := io.ReadAll(response.Body)
+// Get the digest of the manifest for the platform from the image registry
+func getRegistryImageDigest(imgURI, platform string) (string, error) {
+	rc, err := controllers.NewRegistryController()
 	if err != nil {
-		return "", fmt.Errorf("error reading response: %s", err)
+		return "", err
 	}
+	return rc.ResolveDigest(imgURI, platform)
+}
 
-	var result []interface{}
-	err = json.Unmarshal(body, &result)
+// Get the digest of the platform manifest of the local image a container ran.
+// The image is resolved through the repo digest it was pulled by, so the result does not change
+// if the tag has been moved in the registry since. Images never pulled from a registry have no
+// repo digest, an error is returned for them.
+func getLocalImageDigest(c *controllers.DockerController, imageID, imgURI, platform string) (string, error) {
+	repoDigests, err := c.GetImageRepoDigests(imageID)
 	if err != nil {
-		return "", fmt.Errorf("error parsing JSON: %s", err)
+		return "", err
 	}
 
-	// Currently it gets just the first image, while there can be more than 1. This is incorrect
-	digest, ok := result[0].(map[string]interface{})["digest"].(string)
-	if !ok {
-		return "", fmt.Errorf("error retrieving image digest")
+	want, err := controllers.ParseImageReference(imgURI)
+	if err != nil {
+		return "", err
 	}
 
-	return digest, nil
+	for _, rd := range repoDigests {
+		got, err := controllers.ParseImageReference(rd)
+		if err != nil {
+			continue
+		}
+		if got.Registry == want.Registry && got.Repository == want.Repository {
+			return getRegistryImageDigest(rd, platform)
+		}
+	}
+	return "", fmt.Errorf("image %s has no repo digest for %s", imageID, imgURI)
 }
@@ -0,0 +1,227 @@
+package jobs
+
+// Metadata documents are signed with an ed25519 key as a JWS with detached payload (RFC 7515 Appendix F).
+// The payload is the metadata document exactly as stored, so consumers can verify the stored bytes
+// using the public key without any canonicalization of the JSON.
+
+import (
+	"app/utils"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const metaSignatureAlg = "EdDSA"
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// MetaVerification describes the outcome of verifying the signature of a job's metadata
+type MetaVerification struct {
+	JobID    string `json:"jobID"`
+	Verified bool   `json:"verified"`
+	// Algorithm and key used to sign the document
+	Algorithm string `json:"algorithm,omitempty"`
+	KeyID     string `json:"keyID,omitempty"`
+	// Public key of the server as base64 so that consumers can verify the document themselves
+	PublicKey string `json:"publicKey,omitempty"`
+	// SHA-256 digest of the stored metadata document
+	Digest    string `json:"digest,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// ErrSigningNotConfigured is returned when no metadata signing key is set
+var ErrSigningNotConfigured = errors.New("metadata signing key not configured")
+
+func metaDataKey(jid string) string {
+	return fmt.Sprintf("%s/%s.json", os.Getenv("STORAGE_METADATA_PREFIX"), jid)
+}
+
+func metaSignatureKey(jid string) string {
+	return fmt.Sprintf("%s/%s.jws", os.Getenv("STORAGE_METADATA_PREFIX"), jid)
+}
+
+// Load the metadata signing key from the PEM encoded PKCS #8 file at METADATA_SIGNING_KEY_FILE.
+// Returns ErrSigningNotConfigured if the env variable is not set.
+func loadMetaSigningKey() (ed25519.PrivateKey, string, error) {
+	keyFile := os.Getenv("METADATA_SIGNING_KEY_FILE")
+	if keyFile == "" {
+		return nil, "", ErrSigningNotConfigured
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read metadata signing key: %s", err.Error())
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", fmt.Errorf("metadata signing key is not PEM encoded")
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not parse metadata signing key: %s", err.Error())
+	}
+
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, "", fmt.Errorf("metadata signing key must be an ed25519 key")
+	}
+
+	kid := os.Getenv("METADATA_SIGNING_KEY_ID")
+	if kid == "" {
+		kid = publicKeyThumbprint(key.Public().(ed25519.PublicKey))
+	}
+	return key, kid, nil
+}
+
+// Default key id, base64url encoded SHA-256 of the raw public key
+func publicKeyThumbprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Create a JWS with detached payload, in compact serialization header..signature
+func signMetaData(payload []byte, key ed25519.PrivateKey, kid string) (string, error) {
+	h, err := json.Marshal(jwsHeader{Alg: metaSignatureAlg, Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	encHeader := base64.RawURLEncoding.EncodeToString(h)
+	signingInput := encHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig := ed25519.Sign(key, []byte(signingInput))
+	return encHeader + ".." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify a JWS with detached payload against the payload
+func verifyMetaSignature(payload []byte, jws string, pub ed25519.PublicKey) (jwsHeader, error) {
+	var h jwsHeader
+
+	parts := strings.Split(strings.TrimSpace(jws), ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return h, fmt.Errorf("signature is not a JWS with detached payload")
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return h, fmt.Errorf("invalid signature header")
+	}
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return h, fmt.Errorf("invalid signature header")
+	}
+	if h.Alg != metaSignatureAlg {
+		return h, fmt.Errorf("unsupported signature algorithm: %s", h.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return h, fmt.Errorf("invalid signature encoding")
+	}
+
+	signingInput := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload)
+	if !ed25519.Verify(pub, []byte(signingInput), sig) {
+		return h, fmt.Errorf("signature does not match metadata document")
+	}
+	return h, nil
+}
+
+// Sign the metadata document and write the signature next to it.
+// Signing is skipped if no signing key is configured.
+func writeMetaSignature(svc *s3.S3, jid string, payload []byte) error {
+	key, kid, err := loadMetaSigningKey()
+	if err != nil {
+		if err == ErrSigningNotConfigured {
+			return nil
+		}
+		return err
+	}
+
+	jws, err := signMetaData(payload, key, kid)
+	if err != nil {
+		return fmt.Errorf("error signing metadata: %s", err.Error())
+	}
+
+	return utils.WriteToS3(svc, []byte(jws), metaSignatureKey(jid), "application/jose", 0)
+}
+
+// Verify the stored metadata document of a job against its stored signature.
+// Returns ErrSigningNotConfigured before reading storage if no signing key is set,
+// and an error with message "not found" if metadata does not exist.
+// A missing or invalid signature is not an error, it is reported in the verification.
+func VerifyMeta(svc *s3.S3, jid string) (MetaVerification, error) {
+	key, kid, err := loadMetaSigningKey()
+	if err != nil {
+		return MetaVerification{JobID: jid}, err
+	}
+
+	exist, err := utils.KeyExists(metaDataKey(jid), svc)
+	if err != nil {
+		return MetaVerification{JobID: jid}, err
+	}
+	if !exist {
+		return MetaVerification{JobID: jid}, fmt.Errorf("not found")
+	}
+
+	payload, err := utils.GetS3Data(metaDataKey(jid), svc)
+	if err != nil {
+		return MetaVerification{JobID: jid}, err
+	}
+
+	var jws []byte
+	exist, err = utils.KeyExists(metaSignatureKey(jid), svc)
+	if err != nil {
+		return MetaVerification{JobID: jid}, err
+	}
+	if exist {
+		jws, err = utils.GetS3Data(metaSignatureKey(jid), svc)
+		if err != nil {
+			return MetaVerification{JobID: jid}, err
+		}
+	}
+
+	return verifyMetaDocument(jid, payload, string(jws), key.Public().(ed25519.PublicKey), kid), nil
+}
+
+// Verify a metadata document against its signature with the server key, jws is empty if the document is not signed
+func verifyMetaDocument(jid string, payload []byte, jws string, pub ed25519.PublicKey, kid string) MetaVerification {
+	sum := sha256.Sum256(payload)
+	mv := MetaVerification{
+		JobID:     jid,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+	}
+
+	if jws == "" {
+		mv.Message = "metadata is not signed"
+		return mv
+	}
+	mv.Signature = jws
+
+	h, err := verifyMetaSignature(payload, jws, pub)
+	mv.Algorithm = h.Alg
+	mv.KeyID = h.Kid
+	if err != nil {
+		mv.Message = err.Error()
+		if h.Kid != "" && h.Kid != kid {
+			mv.Message = fmt.Sprintf("metadata was signed with key %s, server key is %s", h.Kid, kid)
+		}
+		return mv
+	}
+
+	mv.Verified = true
+	return mv
+}
@@ -0,0 +1,131 @@
+package jobs
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSigningKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Replace the header of a compact JWS keeping its signature
+func withJWSHeader(t *testing.T, jws string, h jwsHeader) string {
+	t.Helper()
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(jws, ".")
+	return base64.RawURLEncoding.EncodeToString(b) + "." + parts[1] + "." + parts[2]
+}
+
+func TestMetaSignature(t *testing.T) {
+	key := newTestSigningKey(t)
+	pub := key.Public().(ed25519.PublicKey)
+	payload := []byte(`{"jobID": "job-1", "status": "successful"}`)
+
+	jws, err := signMetaData(payload, key, "server-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts := strings.Split(jws, "."); len(parts) != 3 || parts[1] != "" {
+		t.Fatalf("signature %s does not have a detached payload", jws)
+	}
+	if h, err := verifyMetaSignature(payload, jws, pub); err != nil || h.Alg != "EdDSA" || h.Kid != "server-key" {
+		t.Errorf("verifyMetaSignature = %+v, %v", h, err)
+	}
+
+	parts := strings.Split(jws, ".")
+	invalid := map[string]struct {
+		payload []byte
+		jws     string
+	}{
+		"tampered payload": {[]byte(`{"jobID": "job-1", "status": "failed"}`), jws},
+		"tampered header":  {payload, withJWSHeader(t, jws, jwsHeader{Alg: "EdDSA", Kid: "other-key"})},
+		"wrong alg":        {payload, withJWSHeader(t, jws, jwsHeader{Alg: "HS256", Kid: "server-key"})},
+		"attached payload": {payload, parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]},
+		"other key":        {payload, func() string { s, _ := signMetaData(payload, newTestSigningKey(t), "server-key"); return s }()},
+		"not a JWS":        {payload, "signature"},
+	}
+	for name, c := range invalid {
+		if _, err := verifyMetaSignature(c.payload, c.jws, pub); err == nil {
+			t.Errorf("signature with %s verified", name)
+		}
+	}
+}
+
+func TestVerifyMetaDocument(t *testing.T) {
+	key := newTestSigningKey(t)
+	pub := key.Public().(ed25519.PublicKey)
+	payload := []byte(`{"jobID": "job-1"}`)
+	jws, _ := signMetaData(payload, key, "server-key")
+
+	mv := verifyMetaDocument("job-1", payload, jws, pub, "server-key")
+	if !mv.Verified || mv.KeyID != "server-key" || mv.Algorithm != "EdDSA" || mv.PublicKey != base64.StdEncoding.EncodeToString(pub) || !strings.HasPrefix(mv.Digest, "sha256:") {
+		t.Errorf("verification of a signed document is %+v", mv)
+	}
+
+	if mv := verifyMetaDocument("job-1", payload, "", pub, "server-key"); mv.Verified || mv.Message != "metadata is not signed" {
+		t.Errorf("verification of an unsigned document is %+v", mv)
+	}
+
+	// documents signed before the server key was rotated
+	old, _ := signMetaData(payload, newTestSigningKey(t), "old-key")
+	mv = verifyMetaDocument("job-1", payload, old, pub, "server-key")
+	if mv.Verified || mv.Message != "metadata was signed with key old-key, server key is server-key" {
+		t.Errorf("verification with another key is %+v", mv)
+	}
+}
+
+func TestLoadMetaSigningKey(t *testing.T) {
+	t.Setenv("METADATA_SIGNING_KEY_FILE", "")
+	if _, _, err := loadMetaSigningKey(); !errors.Is(err, ErrSigningNotConfigured) {
+		t.Errorf("key without file: %v", err)
+	}
+	// storage is not read when signing is not configured
+	if _, err := VerifyMeta(nil, "job-1"); !errors.Is(err, ErrSigningNotConfigured) {
+		t.Errorf("VerifyMeta without key: %v", err)
+	}
+
+	key := newTestSigningKey(t)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("METADATA_SIGNING_KEY_FILE", file)
+
+	loaded, kid, err := loadMetaSigningKey()
+	if err != nil || !loaded.Equal(key) || kid != publicKeyThumbprint(key.Public().(ed25519.PublicKey)) {
+		t.Errorf("loaded key %s, %v", kid, err)
+	}
+	t.Setenv("METADATA_SIGNING_KEY_ID", "server-key")
+	if _, kid, _ := loadMetaSigningKey(); kid != "server-key" {
+		t.Errorf("key id is %s", kid)
+	}
+
+	if err := os.WriteFile(file, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadMetaSigningKey(); err == nil || errors.Is(err, ErrSigningNotConfigured) {
+		t.Errorf("invalid key file: %v", err)
+	}
+}
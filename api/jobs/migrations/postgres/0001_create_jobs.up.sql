@@ -0,0 +1,18 @@
+-- IF NOT EXISTS so that databases created before migrations were introduced are adopted as is.
+
+CREATE TABLE IF NOT EXISTS jobs (
+    id TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    updated TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    mode TEXT NOT NULL,
+    host TEXT NOT NULL,
+    process_id TEXT NOT NULL,
+    submitter TEXT NOT NULL DEFAULT ''
+);
+
+-- Databases created before submitter was added
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS submitter TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_jobs_updated ON jobs(updated);
+CREATE INDEX IF NOT EXISTS idx_jobs_process_id ON jobs(process_id);
+CREATE INDEX IF NOT EXISTS idx_jobs_submitter ON jobs(submitter);
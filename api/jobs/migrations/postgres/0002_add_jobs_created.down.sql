@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_jobs_created_id;
+DROP INDEX IF EXISTS idx_jobs_updated_id;
+CREATE INDEX IF NOT EXISTS idx_jobs_updated ON jobs(updated);
+ALTER TABLE jobs DROP COLUMN IF EXISTS created;
@@ -0,0 +1,8 @@
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS created TIMESTAMP WITHOUT TIME ZONE;
+UPDATE jobs SET created = updated WHERE created IS NULL;
+ALTER TABLE jobs ALTER COLUMN created SET NOT NULL;
+
+-- (time, id) indices for keyset pagination of job lists
+DROP INDEX IF EXISTS idx_jobs_updated;
+CREATE INDEX IF NOT EXISTS idx_jobs_updated_id ON jobs(updated, id);
+CREATE INDEX IF NOT EXISTS idx_jobs_created_id ON jobs(created, id);
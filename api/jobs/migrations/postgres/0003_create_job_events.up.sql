@@ -0,0 +1,11 @@
+-- Every status transition of a job, jobs table only holds the latest status
+CREATE TABLE IF NOT EXISTS job_events (
+    id BIGSERIAL PRIMARY KEY,
+    job_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    time TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    source TEXT NOT NULL,
+    message TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_events_job_id ON job_events(job_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_process_changes_process_id;
+DROP TABLE IF EXISTS process_changes;
+DROP TABLE IF EXISTS processes;
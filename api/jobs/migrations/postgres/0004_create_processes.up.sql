@@ -0,0 +1,23 @@
+-- Process definitions shared by all API instances.
+-- Deleted processes are kept as tombstones so that imports from yaml files do not bring them back.
+CREATE TABLE IF NOT EXISTS processes (
+    id TEXT PRIMARY KEY,
+    version TEXT NOT NULL,
+    definition TEXT NOT NULL,
+    source TEXT NOT NULL,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    updated TIMESTAMP WITHOUT TIME ZONE NOT NULL
+);
+
+-- Every change to process definitions, instances are notified of changes on channel process_changes
+CREATE TABLE IF NOT EXISTS process_changes (
+    id BIGSERIAL PRIMARY KEY,
+    process_id TEXT NOT NULL,
+    version TEXT NOT NULL,
+    action TEXT NOT NULL,
+    source TEXT NOT NULL,
+    definition TEXT NOT NULL DEFAULT '',
+    time TIMESTAMP WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_process_changes_process_id ON process_changes(process_id);
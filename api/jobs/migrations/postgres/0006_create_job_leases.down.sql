@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_job_commands_job_id;
+DROP TABLE IF EXISTS job_commands;
+DROP INDEX IF EXISTS idx_job_leases_expires;
+DROP INDEX IF EXISTS idx_job_leases_owner;
+DROP TABLE IF EXISTS job_leases;
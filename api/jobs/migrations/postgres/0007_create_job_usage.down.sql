@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_jobs_submitter_created;
+DROP INDEX IF EXISTS idx_job_usage_process_id;
+DROP INDEX IF EXISTS idx_job_usage_submitter;
+DROP INDEX IF EXISTS idx_job_usage_ended;
+DROP TABLE IF EXISTS job_usage;
@@ -0,0 +1,15 @@
+-- Long lived tokens users authenticate with instead of an interactive login.
+-- Only the sha256 hash of a token is stored, scopes are comma separated.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    owner TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    scopes TEXT NOT NULL,
+    created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    expires TIMESTAMP WITHOUT TIME ZONE,
+    revoked TIMESTAMP WITHOUT TIME ZONE,
+    last_used TIMESTAMP WITHOUT TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_owner ON api_keys(owner);
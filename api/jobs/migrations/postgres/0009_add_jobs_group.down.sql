@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_jobs_job_group;
+ALTER TABLE jobs DROP COLUMN IF EXISTS job_group;
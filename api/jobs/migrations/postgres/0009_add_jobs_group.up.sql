@@ -0,0 +1,4 @@
+-- Role a job is shared with, members of the role can read the job in addition to its submitter
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS job_group TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_jobs_job_group ON jobs(job_group);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_jobs_submitter;
+DROP INDEX IF EXISTS idx_jobs_process_id;
+DROP INDEX IF EXISTS idx_jobs_updated;
+DROP TABLE IF EXISTS jobs;
@@ -0,0 +1,20 @@
+-- SQLite does not have a built-in ENUM type or array type.
+-- SQLite doesn't enforce the length of the VARCHAR datatype, therefore not using something like VARCHAR(30).
+-- IF NOT EXISTS so that databases created before migrations were introduced are adopted as is.
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	status TEXT NOT NULL,
+	updated TIMESTAMP NOT NULL,
+	mode TEXT NOT NULL,
+	host TEXT NOT NULL,
+	process_id TEXT NOT NULL,
+	submitter TEXT NOT NULL DEFAULT ''
+);
+
+-- indices needed to speedup
+-- fetching jobs for a particular process id
+-- providing job-lists ordered by time
+CREATE INDEX IF NOT EXISTS idx_jobs_updated ON jobs(updated);
+CREATE INDEX IF NOT EXISTS idx_jobs_process_id ON jobs(process_id);
+CREATE INDEX IF NOT EXISTS idx_jobs_submitter ON jobs(submitter);
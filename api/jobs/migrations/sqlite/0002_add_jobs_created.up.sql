@@ -0,0 +1,8 @@
+-- SQLite can not add a NOT NULL column without a constant default, existing records are backfilled instead.
+ALTER TABLE jobs ADD COLUMN created TIMESTAMP;
+UPDATE jobs SET created = updated WHERE created IS NULL;
+
+-- (time, id) indices for keyset pagination of job lists
+DROP INDEX IF EXISTS idx_jobs_updated;
+CREATE INDEX IF NOT EXISTS idx_jobs_updated_id ON jobs(updated, id);
+CREATE INDEX IF NOT EXISTS idx_jobs_created_id ON jobs(created, id);
@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN process_version;
+DROP TABLE IF EXISTS process_versions;
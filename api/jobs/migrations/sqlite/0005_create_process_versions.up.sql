@@ -0,0 +1,19 @@
+-- Every version of a process ever registered, versions are immutable so that jobs can be re-run exactly
+CREATE TABLE IF NOT EXISTS process_versions (
+	process_id TEXT NOT NULL,
+	version TEXT NOT NULL,
+	definition TEXT NOT NULL,
+	source TEXT NOT NULL,
+	created TIMESTAMP NOT NULL,
+	PRIMARY KEY (process_id, version)
+);
+
+-- Current definitions first, then the latest definition of each version in the change log
+INSERT OR IGNORE INTO process_versions (process_id, version, definition, source, created)
+	SELECT id, version, definition, source, updated FROM processes;
+INSERT OR IGNORE INTO process_versions (process_id, version, definition, source, created)
+	SELECT process_id, version, definition, source, time FROM process_changes
+	WHERE action != 'delete' ORDER BY id DESC;
+
+-- Version of the process a job was started with
+ALTER TABLE jobs ADD COLUMN process_version TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,26 @@
+-- Instance that owns each active job. Owners renew their leases while they are alive,
+-- jobs with an expired lease are taken over by another instance.
+-- spec holds the state another instance needs to take over the job.
+CREATE TABLE IF NOT EXISTS job_leases (
+	job_id TEXT PRIMARY KEY,
+	owner TEXT NOT NULL,
+	expires TIMESTAMP NOT NULL,
+	spec TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_leases_owner ON job_leases(owner);
+CREATE INDEX IF NOT EXISTS idx_job_leases_expires ON job_leases(expires);
+
+-- Requests received by an instance for jobs owned by another instance,
+-- the owner polls the latest id to detect new commands
+CREATE TABLE IF NOT EXISTS job_commands (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	job_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT '',
+	time TIMESTAMP NOT NULL,
+	message TEXT NOT NULL DEFAULT '',
+	source TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_commands_job_id ON job_commands(job_id);
@@ -0,0 +1,21 @@
+-- Compute consumed by each finished job, for accounting per submitter and per process.
+-- cpus and memory (MiB) are the resources the job ran with, seconds are derived from the run duration.
+CREATE TABLE IF NOT EXISTS job_usage (
+	job_id TEXT PRIMARY KEY,
+	process_id TEXT NOT NULL,
+	submitter TEXT NOT NULL,
+	host TEXT NOT NULL,
+	cpus REAL NOT NULL,
+	memory INTEGER NOT NULL,
+	duration REAL NOT NULL,
+	cpu_seconds REAL NOT NULL,
+	memory_seconds REAL NOT NULL,
+	ended TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_usage_ended ON job_usage(ended);
+CREATE INDEX IF NOT EXISTS idx_job_usage_submitter ON job_usage(submitter);
+CREATE INDEX IF NOT EXISTS idx_job_usage_process_id ON job_usage(process_id);
+
+-- quotas count jobs of a submitter created since a time
+CREATE INDEX IF NOT EXISTS idx_jobs_submitter_created ON jobs(submitter, created);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_api_keys_owner;
+DROP TABLE IF EXISTS api_keys;
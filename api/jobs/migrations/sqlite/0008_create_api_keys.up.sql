@@ -0,0 +1,15 @@
+-- Long lived tokens users authenticate with instead of an interactive login.
+-- Only the sha256 hash of a token is stored, scopes are comma separated.
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	hash TEXT NOT NULL UNIQUE,
+	scopes TEXT NOT NULL,
+	created TIMESTAMP NOT NULL,
+	expires TIMESTAMP,
+	revoked TIMESTAMP,
+	last_used TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_owner ON api_keys(owner);
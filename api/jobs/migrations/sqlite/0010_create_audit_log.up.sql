@@ -0,0 +1,28 @@
+-- Append-only record of administrative and security relevant actions.
+-- before_yaml and after_yaml hold process definitions for changes of the catalog.
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TIMESTAMP NOT NULL,
+	action TEXT NOT NULL,
+	user_email TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	request_id TEXT NOT NULL,
+	resource TEXT NOT NULL,
+	message TEXT NOT NULL,
+	before_yaml TEXT NOT NULL,
+	after_yaml TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log(time);
+CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log(action);
+CREATE INDEX IF NOT EXISTS idx_audit_log_user_email ON audit_log(user_email);
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
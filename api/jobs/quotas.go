@@ -0,0 +1,108 @@
+package jobs
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// QuotaLimits are the limits of a submitter, zero means unlimited
+type QuotaLimits struct {
+	// Jobs submitted per calendar day (UTC)
+	JobsPerDay int `yaml:"jobsPerDay" json:"jobsPerDay,omitempty"`
+	// vCPU-hours of finished jobs per calendar month (UTC)
+	CPUHoursPerMonth float64 `yaml:"cpuHoursPerMonth" json:"cpuHoursPerMonth,omitempty"`
+}
+
+// Quotas are read from the file at QUOTAS_FILE.
+// Limits of a submitter listed in the file replace the default limits.
+type Quotas struct {
+	Default    QuotaLimits            `yaml:"default"`
+	Submitters map[string]QuotaLimits `yaml:"submitters"`
+}
+
+// QuotaExceededError is returned when a submitter has used up a quota
+type QuotaExceededError struct {
+	Quota  string
+	Used   float64
+	Limit  float64
+	Resets time.Time
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %g of %g %s used, resets at %s", e.Used, e.Limit, e.Quota, e.Resets.Format(time.RFC3339))
+}
+
+// Load quota policies from a yaml file, returns nil if path is empty so that no quotas are enforced
+func LoadQuotas(path string) (*Quotas, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read quotas file: %s", err.Error())
+	}
+
+	var q Quotas
+	if err := yaml.Unmarshal(data, &q); err != nil {
+		return nil, fmt.Errorf("could not parse quotas file: %s", err.Error())
+	}
+
+	for s, l := range q.Submitters {
+		if l.JobsPerDay < 0 || l.CPUHoursPerMonth < 0 {
+			return nil, fmt.Errorf("quotas of %s must not be negative", s)
+		}
+	}
+	if q.Default.JobsPerDay < 0 || q.Default.CPUHoursPerMonth < 0 {
+		return nil, fmt.Errorf("default quotas must not be negative")
+	}
+	return &q, nil
+}
+
+// Limits that apply to a submitter
+func (q *Quotas) Limits(submitter string) QuotaLimits {
+	if l, ok := q.Submitters[submitter]; ok {
+		return l
+	}
+	return q.Default
+}
+
+// Check if the submitter can submit another job.
+// Returns a *QuotaExceededError if a quota is used up. Always nil when quotas are not configured.
+func (q *Quotas) Check(db Database, submitter string, now time.Time) error {
+	if q == nil {
+		return nil
+	}
+	l := q.Limits(submitter)
+	now = now.UTC()
+
+	if l.JobsPerDay > 0 {
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		n, err := db.CountJobs(submitter, day)
+		if err != nil {
+			return err
+		}
+		if n >= l.JobsPerDay {
+			return &QuotaExceededError{Quota: "jobs per day", Used: float64(n), Limit: float64(l.JobsPerDay), Resets: day.AddDate(0, 0, 1)}
+		}
+	}
+
+	if l.CPUHoursPerMonth > 0 {
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		usage, err := db.GetUsage(UsageQuery{GroupBy: UsageBySubmitter, From: month, Submitters: []string{submitter}})
+		if err != nil {
+			return err
+		}
+		var used float64
+		for _, u := range usage {
+			used += u.CPUHours
+		}
+		if used >= l.CPUHoursPerMonth {
+			return &QuotaExceededError{Quota: "cpu hours per month", Used: used, Limit: l.CPUHoursPerMonth, Resets: month.AddDate(0, 1, 0)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package jobs
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RateLimit is a token bucket: Burst executions can be submitted at once,
+// and the bucket refills at PerMinute executions per minute. PerMinute 0 is unlimited.
+type RateLimit struct {
+	PerMinute float64 `yaml:"perMinute"`
+	Burst     int     `yaml:"burst"`
+}
+
+// RateLimits of execution requests, read from the file at RATE_LIMITS_FILE.
+// Callers are identified by the API key of the request, else the authenticated submitter, else the client IP,
+// and the limit listed for the caller replaces the default. Executions of a process listed in Processes
+// are limited with the limit of the process instead, in a bucket of the caller for that process.
+// Buckets are kept in memory, each instance limits the requests it receives.
+type RateLimits struct {
+	Default   RateLimit            `yaml:"default"`
+	Users     map[string]RateLimit `yaml:"users"`
+	APIKeys   map[string]RateLimit `yaml:"apiKeys"`
+	IPs       map[string]RateLimit `yaml:"ips"`
+	Processes map[string]RateLimit `yaml:"processes"`
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+// Full buckets are removed this often so that callers that stopped do not use memory
+const rateBucketSweepInterval = 10 * time.Minute
+
+// Load rate limits from a yaml file, returns nil if path is empty so that no limits are enforced
+func LoadRateLimits(path string) (*RateLimits, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read rate limits file: %s", err.Error())
+	}
+
+	var rl RateLimits
+	if err := yaml.Unmarshal(data, &rl); err != nil {
+		return nil, fmt.Errorf("could not parse rate limits file: %s", err.Error())
+	}
+
+	check := func(name string, l RateLimit) error {
+		if l.PerMinute < 0 || l.Burst < 0 {
+			return fmt.Errorf("rate limit of %s must not be negative", name)
+		}
+		return nil
+	}
+	if err := check("default", rl.Default); err != nil {
+		return nil, err
+	}
+	for _, m := range []map[string]RateLimit{rl.Users, rl.APIKeys, rl.IPs, rl.Processes} {
+		for name, l := range m {
+			if err := check(name, l); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	rl.buckets = map[string]*rateBucket{}
+	return &rl, nil
+}
+
+// Bucket key and limit of a caller executing the process
+func (rl *RateLimits) limit(user, apiKeyID, ip, processID string) (string, RateLimit) {
+	var key string
+	var l RateLimit
+	var ok bool
+	switch {
+	case apiKeyID != "":
+		key = "apikey:" + apiKeyID
+		l, ok = rl.APIKeys[apiKeyID]
+	case user != "":
+		key = "user:" + user
+		l, ok = rl.Users[user]
+	default:
+		key = "ip:" + ip
+		l, ok = rl.IPs[ip]
+	}
+	if !ok {
+		l = rl.Default
+	}
+
+	if pl, ok := rl.Processes[processID]; ok {
+		return key + "|process:" + processID, pl
+	}
+	return key, l
+}
+
+// Refill the bucket up to now
+func (b *rateBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Minutes()*b.limit.PerMinute)
+	b.updated = now
+}
+
+// Allow reports if the caller can execute the process now and takes a token from its bucket.
+// If not, it returns how long until a token is available. Always true when rate limits are not configured.
+func (rl *RateLimits) Allow(user, apiKeyID, ip, processID string, now time.Time) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	key, l := rl.limit(user, apiKeyID, ip, processID)
+	if l.PerMinute == 0 {
+		return true, 0
+	}
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateBucketSweepInterval {
+		for k, b := range rl.buckets {
+			if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: float64(l.Burst), updated: now, limit: l}
+		rl.buckets[key] = b
+	}
+	b.refill(now)
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.PerMinute * float64(time.Minute))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
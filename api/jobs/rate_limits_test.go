@@ -0,0 +1,120 @@
+package jobs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func loadTestRateLimits(t *testing.T, content string) *RateLimits {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "rate_limits.yml")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rl, err := LoadRateLimits(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rl
+}
+
+func TestRateLimitsAllow(t *testing.T) {
+	rl := loadTestRateLimits(t, `
+default: {perMinute: 2, burst: 3}
+users:
+  vip@example.com: {perMinute: 0}
+apiKeys:
+  key1: {perMinute: 1, burst: 1}
+processes:
+  heavy: {perMinute: 0.5, burst: 1}
+`)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// the burst is available at once, then a token every 30 seconds
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("a@example.com", "", "10.0.0.1", "pyecho", now); !ok {
+			t.Fatalf("request %d of the burst denied", i+1)
+		}
+	}
+	if ok, wait := rl.Allow("a@example.com", "", "10.0.0.1", "pyecho", now); ok || wait != 30*time.Second {
+		t.Errorf("request over the burst: got %v, wait %s", ok, wait)
+	}
+	if ok, wait := rl.Allow("a@example.com", "", "10.0.0.1", "pyecho", now.Add(20*time.Second)); ok || wait != 10*time.Second {
+		t.Errorf("request before refill: got %v, wait %s", ok, wait)
+	}
+	if ok, _ := rl.Allow("a@example.com", "", "10.0.0.1", "pyecho", now.Add(30*time.Second)); !ok {
+		t.Error("request after refill denied")
+	}
+
+	// the bucket refills up to the burst only
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		rl.Allow("a@example.com", "", "10.0.0.1", "pyecho", later)
+	}
+	if ok, _ := rl.Allow("a@example.com", "", "10.0.0.1", "pyecho", later); ok {
+		t.Error("bucket refilled over the burst")
+	}
+
+	// processes with a limit use a bucket of their own
+	if ok, _ := rl.Allow("a@example.com", "", "10.0.0.1", "heavy", later); !ok {
+		t.Error("first request of a limited process denied")
+	}
+	if ok, wait := rl.Allow("a@example.com", "", "10.0.0.1", "heavy", later); ok || wait != 2*time.Minute {
+		t.Errorf("second request of a limited process: got %v, wait %s", ok, wait)
+	}
+
+	// other callers and unlimited callers are not affected
+	if ok, _ := rl.Allow("b@example.com", "", "10.0.0.1", "pyecho", later); !ok {
+		t.Error("request of another user denied")
+	}
+	for i := 0; i < 10; i++ {
+		if ok, _ := rl.Allow("vip@example.com", "", "10.0.0.1", "pyecho", later); !ok {
+			t.Fatal("request of an unlimited user denied")
+		}
+	}
+
+	// the API key identifies the caller before the user
+	if ok, _ := rl.Allow("a@example.com", "key1", "10.0.0.1", "pyecho", later); !ok {
+		t.Error("first request of the API key denied")
+	}
+	if ok, _ := rl.Allow("b@example.com", "key1", "10.0.0.2", "pyecho", later); ok {
+		t.Error("API key limit not shared by the users of the key")
+	}
+
+	// without a user or key the client IP identifies the caller
+	for i := 0; i < 3; i++ {
+		rl.Allow("", "", "10.0.0.3", "pyecho", later)
+	}
+	if ok, _ := rl.Allow("", "", "10.0.0.3", "pyecho", later); ok {
+		t.Error("IP over the burst allowed")
+	}
+	if ok, _ := rl.Allow("", "", "10.0.0.4", "pyecho", later); !ok {
+		t.Error("request of another IP denied")
+	}
+
+	// full buckets are swept
+	rl.Allow("", "", "10.0.0.4", "pyecho", later.Add(time.Hour))
+	rl.mu.Lock()
+	n := len(rl.buckets)
+	rl.mu.Unlock()
+	if n != 1 {
+		t.Errorf("%d buckets left after sweep, want 1", n)
+	}
+
+	var nilLimits *RateLimits
+	if ok, _ := nilLimits.Allow("", "", "10.0.0.1", "pyecho", now); !ok {
+		t.Error("request denied without rate limits")
+	}
+}
+
+func TestLoadRateLimitsNegative(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rate_limits.yml")
+	if err := os.WriteFile(file, []byte("users:\n  a@example.com: {perMinute: -1}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRateLimits(file); err == nil {
+		t.Error("negative rate limit loaded")
+	}
+}
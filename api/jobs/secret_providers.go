@@ -0,0 +1,303 @@
+package jobs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DirSecretProvider reads secrets from files at Dir/<scope>/<name>, such as mounted Docker or Kubernetes secrets.
+// Trailing newlines of the files are removed.
+type DirSecretProvider struct {
+	Dir string
+}
+
+func NewDirSecretProvider(dir string) (*DirSecretProvider, error) {
+	if dir == "" {
+		return nil, errors.New("env variable SECRETS_DIR is required for the dir secrets provider")
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open secrets directory: %s", err.Error())
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("secrets directory %s is not a directory", dir)
+	}
+	return &DirSecretProvider{Dir: dir}, nil
+}
+
+func (p *DirSecretProvider) GetSecret(scope, name string) (string, error) {
+	if !secretNamePattern.MatchString(scope) || !secretNamePattern.MatchString(name) {
+		return "", ErrSecretNotFound
+	}
+
+	data, err := os.ReadFile(filepath.Join(p.Dir, scope, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", ErrSecretNotFound
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// EncryptedSecretStore keeps secrets in a local file encrypted with AES-256-GCM.
+// The file is read on every lookup so that secrets changed with the secrets command are used by the next job.
+type EncryptedSecretStore struct {
+	Path string
+
+	mu   sync.Mutex
+	aead cipher.AEAD
+}
+
+// NewEncryptedSecretStore opens the store at path with the base64 encoded 32 byte key.
+// The file is created when the first secret is set.
+func NewEncryptedSecretStore(path, key string) (*EncryptedSecretStore, error) {
+	if path == "" || key == "" {
+		return nil, errors.New("env variables SECRETS_STORE_FILE and SECRETS_STORE_KEY are required for the encrypted secrets provider")
+	}
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(k) != 32 {
+		return nil, errors.New("secrets store key must be 32 bytes encoded with base64")
+	}
+
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &EncryptedSecretStore{Path: path, aead: aead}
+	// Fail at startup rather than at job start if the key does not decrypt the file
+	if _, err := s.read(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Secrets of the store by scope and name, empty if the file does not exist
+func (s *EncryptedSecretStore) read() (map[string]map[string]string, error) {
+	secrets := map[string]map[string]string{}
+
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return secrets, nil
+		}
+		return nil, fmt.Errorf("could not read secrets store: %s", err.Error())
+	}
+
+	n := s.aead.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("could not decrypt secrets store: file is too short")
+	}
+	plain, err := s.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt secrets store, check SECRETS_STORE_KEY")
+	}
+
+	if err := yaml.Unmarshal(plain, &secrets); err != nil {
+		return nil, fmt.Errorf("could not parse secrets store: %s", err.Error())
+	}
+	return secrets, nil
+}
+
+// Write the secrets to a temporary file that replaces the store, so that the store is never partially written
+func (s *EncryptedSecretStore) write(secrets map[string]map[string]string) error {
+	plain, err := yaml.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := s.aead.Seal(nonce, nonce, plain, nil)
+
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("could not write secrets store: %s", err.Error())
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not write secrets store: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *EncryptedSecretStore) GetSecret(scope, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secrets, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	value, ok := secrets[scope][name]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+// Set the secret, replacing its value if it exists
+func (s *EncryptedSecretStore) Set(scope, name, value string) error {
+	if !secretNamePattern.MatchString(scope) || !secretNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid secret %s/%s: only letters, digits, '.', '_' and '-' are allowed", scope, name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secrets, err := s.read()
+	if err != nil {
+		return err
+	}
+	if secrets[scope] == nil {
+		secrets[scope] = map[string]string{}
+	}
+	secrets[scope][name] = value
+	return s.write(secrets)
+}
+
+// Delete the secret, returns false if it does not exist
+func (s *EncryptedSecretStore) Delete(scope, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secrets, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := secrets[scope][name]; !ok {
+		return false, nil
+	}
+	delete(secrets[scope], name)
+	if len(secrets[scope]) == 0 {
+		delete(secrets, scope)
+	}
+	return true, s.write(secrets)
+}
+
+// List the secrets as scope/name sorted, values are not returned. All scopes are listed if scope is empty.
+func (s *EncryptedSecretStore) List(scope string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secrets, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for sc, names := range secrets {
+		if scope != "" && sc != scope {
+			continue
+		}
+		for n := range names {
+			res = append(res, sc+"/"+n)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// VaultSecretProvider reads secrets from a KV version 2 secrets engine of HashiCorp Vault or a compatible API.
+// The secret of a scope and name is the "value" key of the secret at <mount>/<scope>/<name>.
+type VaultSecretProvider struct {
+	Addr      string
+	Token     string
+	Namespace string
+	Mount     string
+	Client    *http.Client
+}
+
+// NewVaultSecretProvider creates a provider for the Vault at addr, mount defaults to "secret"
+func NewVaultSecretProvider(addr, token, namespace, mount string) (*VaultSecretProvider, error) {
+	if addr == "" || token == "" {
+		return nil, errors.New("env variables VAULT_ADDR and VAULT_TOKEN are required for the vault secrets provider")
+	}
+	if _, err := url.Parse(addr); err != nil {
+		return nil, fmt.Errorf("invalid VAULT_ADDR: %s", err.Error())
+	}
+	if mount == "" {
+		mount = "secret"
+	}
+	return &VaultSecretProvider{
+		Addr:      strings.TrimSuffix(addr, "/"),
+		Token:     token,
+		Namespace: namespace,
+		Mount:     strings.Trim(mount, "/"),
+		Client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *VaultSecretProvider) GetSecret(scope, name string) (string, error) {
+	if !secretNamePattern.MatchString(scope) || !secretNamePattern.MatchString(name) {
+		return "", ErrSecretNotFound
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s/data/%s/%s", p.Addr, p.Mount, scope, name), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not reach vault: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", ErrSecretNotFound
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("vault responded with status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return "", fmt.Errorf("could not parse vault response: %s", err.Error())
+	}
+
+	// Deleted versions are returned with null data
+	value, ok := res.Data.Data["value"]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", errors.New("value of the vault secret is not a string")
+	}
+	return s, nil
+}
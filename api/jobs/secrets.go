@@ -0,0 +1,217 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Env vars of a process container are either the name of a server env var, copied to the job,
+// or NAME=secret:KEY to set NAME to the secret KEY, resolved from the secret provider when the job starts.
+const secretRefPrefix = "secret:"
+
+// SharedSecretScope holds secrets that all processes can reference.
+// Other secrets are scoped to a process, in the scope named by the process id.
+const SharedSecretScope = "shared"
+
+// ErrSecretNotFound is returned by providers when the scope has no secret with the name
+var ErrSecretNotFound = errors.New("secret not found")
+
+// Values shorter than this are not redacted since they would match unrelated text
+const minRedactedLength = 4
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// Server env vars that hold credentials of the secret provider, auth or metadata signing.
+// Processes can not copy them from the server env, they would get access to the secrets of all processes.
+var deniedHostEnvVars = map[string]bool{
+	"AUTH_CALLBACK_SECRET":      true,
+	"METADATA_SIGNING_KEY_FILE": true,
+	"TLS_KEY_FILE":              true,
+	"POSTGRES_CONN_STRING":      true,
+	"POSTGRES_PASSWORD":         true,
+}
+
+var deniedHostEnvPrefixes = []string{"SECRETS_", "VAULT_"}
+
+func isDeniedHostEnvVar(name string) bool {
+	if deniedHostEnvVars[name] {
+		return true
+	}
+	for _, prefix := range deniedHostEnvPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SecretProvider looks up the value of a secret by scope and name
+type SecretProvider interface {
+	GetSecret(scope, name string) (string, error)
+}
+
+// EnvVar is an entry of the envVars of a process container
+type EnvVar struct {
+	Name string
+	// Key of the secret the value is resolved from, empty if the value is copied from the server env
+	Secret string
+}
+
+// ParseEnvVar parses an entry of the envVars of a process container.
+// Server env vars holding credentials of the server, such as VAULT_TOKEN, are rejected.
+func ParseEnvVar(s string) (EnvVar, error) {
+	name, value, isRef := strings.Cut(s, "=")
+	if name == "" {
+		return EnvVar{}, fmt.Errorf("invalid env var '%s': name is required", s)
+	}
+	if !isRef {
+		if isDeniedHostEnvVar(name) {
+			return EnvVar{}, fmt.Errorf("env var %s holds a server credential and can not be passed to processes, reference a secret instead", name)
+		}
+		return EnvVar{Name: name}, nil
+	}
+
+	if !strings.HasPrefix(value, secretRefPrefix) {
+		return EnvVar{}, fmt.Errorf("invalid env var '%s': values must be secret references, %sKEY", name, secretRefPrefix)
+	}
+	key := strings.TrimPrefix(value, secretRefPrefix)
+	if !secretNamePattern.MatchString(key) {
+		return EnvVar{}, fmt.Errorf("invalid secret key '%s' of env var %s: only letters, digits, '.', '_' and '-' are allowed", key, name)
+	}
+	return EnvVar{Name: name, Secret: key}, nil
+}
+
+// Resolve the envVars of a process container. Secrets are looked up in the scope of the process and then in the shared scope.
+// If hostEnv is false only secret references are resolved. Values of secrets are added to the returned redactor.
+func resolveEnv(provider SecretProvider, processID string, envVars []string, hostEnv bool) (map[string]string, *secretRedactor, error) {
+	env := map[string]string{}
+	redactor := &secretRedactor{}
+
+	for _, s := range envVars {
+		ev, err := ParseEnvVar(s)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if ev.Secret == "" {
+			if hostEnv {
+				env[ev.Name] = os.Getenv(ev.Name)
+			}
+			continue
+		}
+
+		if provider == nil {
+			return nil, nil, fmt.Errorf("env var %s references a secret but no secret provider is configured", ev.Name)
+		}
+		value, err := provider.GetSecret(processID, ev.Secret)
+		if errors.Is(err, ErrSecretNotFound) {
+			value, err = provider.GetSecret(SharedSecretScope, ev.Secret)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not resolve secret %s of env var %s: %s", ev.Secret, ev.Name, err.Error())
+		}
+
+		env[ev.Name] = value
+		redactor.add(value)
+	}
+
+	return env, redactor, nil
+}
+
+// secretRedactor replaces the values of resolved secrets in text.
+// It is a logrus hook so that job logs do not contain them. A nil redactor does not change anything.
+type secretRedactor struct {
+	values []string
+}
+
+const redactedValue = "[REDACTED]"
+
+func (r *secretRedactor) add(value string) {
+	if len(value) < minRedactedLength {
+		return
+	}
+	r.values = append(r.values, value)
+
+	// Values are also replaced as they appear in JSON strings
+	b, err := json.Marshal(value)
+	if err == nil {
+		if escaped := string(b[1 : len(b)-1]); escaped != value {
+			r.values = append(r.values, escaped)
+		}
+	}
+}
+
+func (r *secretRedactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, redactedValue)
+	}
+	return s
+}
+
+// Redact the strings in a value decoded from JSON, such as job inputs. Other types are returned as is.
+func (r *secretRedactor) redactValue(v interface{}) interface{} {
+	if r == nil {
+		return v
+	}
+	switch v := v.(type) {
+	case string:
+		return r.redact(v)
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = r.redactValue(e)
+		}
+		return res
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			res[k] = r.redactValue(e)
+		}
+		return res
+	default:
+		return v
+	}
+}
+
+func (r *secretRedactor) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (r *secretRedactor) Fire(e *log.Entry) error {
+	e.Message = r.redact(e.Message)
+	for k, v := range e.Data {
+		switch v := v.(type) {
+		case string:
+			e.Data[k] = r.redact(v)
+		case error:
+			e.Data[k] = r.redact(v.Error())
+		}
+	}
+	return nil
+}
+
+// NewSecretProvider creates the provider configured by the SECRETS_* env variables, nil if kind is empty.
+// Kind is one of dir, encrypted or vault.
+func NewSecretProvider(kind string) (SecretProvider, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "dir":
+		return NewDirSecretProvider(os.Getenv("SECRETS_DIR"))
+	case "encrypted":
+		return NewEncryptedSecretStore(os.Getenv("SECRETS_STORE_FILE"), os.Getenv("SECRETS_STORE_KEY"))
+	case "vault":
+		return NewVaultSecretProvider(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_NAMESPACE"), os.Getenv("SECRETS_VAULT_MOUNT"))
+	default:
+		return nil, fmt.Errorf("unknown secrets provider '%s', must be one of [dir, encrypted, vault]", kind)
+	}
+}
@@ -0,0 +1,153 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvVar(t *testing.T) {
+	valid := map[string]EnvVar{
+		"AWS_REGION":                   {Name: "AWS_REGION"},
+		"DB_PASSWORD=secret:db-pass.1": {Name: "DB_PASSWORD", Secret: "db-pass.1"},
+		"VAULT_TOKEN=secret:token":     {Name: "VAULT_TOKEN", Secret: "token"},
+	}
+	for s, want := range valid {
+		got, err := ParseEnvVar(s)
+		if err != nil || got != want {
+			t.Errorf("ParseEnvVar(%q) = %+v, %v, want %+v", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{"=x", "A=plain", "A=secret:", "A=secret:../x", "VAULT_TOKEN", "SECRETS_STORE_KEY", "AUTH_CALLBACK_SECRET"} {
+		if _, err := ParseEnvVar(s); err == nil {
+			t.Errorf("ParseEnvVar(%q) did not fail", s)
+		}
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	dir := t.TempDir()
+	for path, value := range map[string]string{"proc1/db": "proc-secret\n", "shared/db": "shared-secret", "proc2/other": "other-secret"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0700)
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := NewDirSecretProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOST_VAR", "host")
+
+	env, _, err := resolveEnv(p, "proc1", []string{"HOST_VAR", "DB=secret:db"}, true)
+	if err != nil || env["DB"] != "proc-secret" || env["HOST_VAR"] != "host" {
+		t.Errorf("process scope: got %v, %v", env, err)
+	}
+
+	env, _, err = resolveEnv(p, "proc3", []string{"HOST_VAR", "DB=secret:db"}, false)
+	if err != nil || env["DB"] != "shared-secret" || len(env) != 1 {
+		t.Errorf("shared scope without host env: got %v, %v", env, err)
+	}
+
+	if _, _, err := resolveEnv(p, "proc1", []string{"X=secret:other"}, true); err == nil {
+		t.Error("secret of another process was resolved")
+	}
+	if _, _, err := resolveEnv(nil, "proc1", []string{"DB=secret:db"}, true); err == nil {
+		t.Error("secret resolved without provider")
+	}
+}
+
+func TestMetaDataRedaction(t *testing.T) {
+	r := &secretRedactor{}
+	r.add("4096")
+	r.add(`pa"ss`)
+
+	md := newMetaData("jid", "", FAILED, nil, process{"p", "1"}, image{}, []string{"run", `{"password":"pa\"ss"}`})
+	md.FailureReason = "could not connect with 4096"
+	md.EnvironmentVariables = map[string]string{"THREADS": "4096"}
+	md.AtLocation.Memory = 4096
+	md.Used = inputEntities("jid", map[string]interface{}{"size": 4096.0, "key": "4096", "list": []interface{}{"a-4096"}})
+	cmd := md.Commands
+
+	md.redact(r)
+	b, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(b) || strings.Contains(string(b), `pa\"ss`) || strings.Contains(string(b), `"4096"`) {
+		t.Errorf("secrets not redacted: %s", b)
+	}
+	if !strings.Contains(string(b), `"memory":4096`) || !strings.Contains(string(b), `"value":4096`) {
+		t.Errorf("numbers changed: %s", b)
+	}
+	if cmd[1] != `{"password":"pa\"ss"}` {
+		t.Error("commands of the job were changed")
+	}
+}
+
+func TestEncryptedSecretStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	s, err := NewEncryptedSecretStore(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("proc1", "db", "enc-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := s.GetSecret("proc1", "db"); err != nil || v != "enc-secret" {
+		t.Errorf("GetSecret = %q, %v", v, err)
+	}
+	if _, err := s.GetSecret("proc2", "db"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("GetSecret of missing secret: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("enc-secret")) {
+		t.Error("store is not encrypted")
+	}
+
+	if _, err := NewEncryptedSecretStore(path, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))); err == nil {
+		t.Error("store opened with another key")
+	}
+	if deleted, err := s.Delete("proc1", "db"); !deleted || err != nil {
+		t.Errorf("Delete = %v, %v", deleted, err)
+	}
+}
+
+func TestVaultSecretProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/v1/kv/data/shared/db" {
+			w.Write([]byte(`{"data":{"data":{"value":"vault-secret"},"metadata":{}}}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	p, err := NewVaultSecretProvider(srv.URL+"/", "token", "", "/kv/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, _, err := resolveEnv(p, "proc1", []string{"DB=secret:db"}, true)
+	if err != nil || env["DB"] != "vault-secret" {
+		t.Errorf("got %v, %v", env, err)
+	}
+
+	p.Token = "wrong"
+	if _, err := p.GetSecret("shared", "db"); err == nil || errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("forbidden request: %v", err)
+	}
+}
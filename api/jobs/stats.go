@@ -0,0 +1,241 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Percentiles of durations in seconds
+type Percentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+}
+
+type SubmitterCount struct {
+	Submitter string `json:"submitter"`
+	Jobs      int    `json:"jobs"`
+}
+
+// JobStats summarizes jobs created in a time window
+type JobStats struct {
+	ProcessID string    `json:"processID,omitempty"`
+	Window    string    `json:"window"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Total     int       `json:"total"`
+	// Number of jobs by current status
+	Counts map[string]int `json:"counts"`
+	// Rates are relative to finished jobs
+	SuccessRate float64 `json:"successRate"`
+	FailureRate float64 `json:"failureRate"`
+	// Time jobs ran, from running to a finished status
+	Duration Percentiles `json:"duration"`
+	// Time jobs waited, from creation to running
+	QueueWait     Percentiles      `json:"queueWait"`
+	TopSubmitters []SubmitterCount `json:"topSubmitters"`
+}
+
+// Windows of stats are limited so that the jobs read stay bounded
+const MaxStatsWindow = 366 * 24 * time.Hour
+
+// jobStatsBuilder accumulates the run times of jobs one at a time, so that statistics are computed
+// without keeping the jobs in memory. Counts and top submitters are set by the database.
+type jobStatsBuilder struct {
+	stats     JobStats
+	durations []float64
+	waits     []float64
+}
+
+func newJobStatsBuilder() *jobStatsBuilder {
+	return &jobStatsBuilder{stats: JobStats{
+		Counts:        map[string]int{ACCEPTED: 0, RUNNING: 0, SUCCESSFUL: 0, FAILED: 0, DISMISSED: 0},
+		TopSubmitters: []SubmitterCount{},
+	}}
+}
+
+// Add the times a job was created, started running and finished, zero if unknown
+func (b *jobStatsBuilder) addTimes(created, started, finished time.Time) {
+	if started.IsZero() {
+		return
+	}
+	b.waits = append(b.waits, started.Sub(created).Seconds())
+	if !finished.IsZero() {
+		b.durations = append(b.durations, finished.Sub(started).Seconds())
+	}
+}
+
+// Set the top submitters from the number of jobs of each submitter
+func (b *jobStatsBuilder) setSubmitters(submitters map[string]int, top int) {
+	for sub, n := range submitters {
+		b.stats.TopSubmitters = append(b.stats.TopSubmitters, SubmitterCount{Submitter: sub, Jobs: n})
+	}
+	sort.Slice(b.stats.TopSubmitters, func(i, j int) bool {
+		if b.stats.TopSubmitters[i].Jobs != b.stats.TopSubmitters[j].Jobs {
+			return b.stats.TopSubmitters[i].Jobs > b.stats.TopSubmitters[j].Jobs
+		}
+		return b.stats.TopSubmitters[i].Submitter < b.stats.TopSubmitters[j].Submitter
+	})
+	if len(b.stats.TopSubmitters) > top {
+		b.stats.TopSubmitters = b.stats.TopSubmitters[:top]
+	}
+}
+
+// Statistics of the jobs added, counts must be set
+func (b *jobStatsBuilder) result() JobStats {
+	s := b.stats
+	s.Total = 0
+	for _, n := range s.Counts {
+		s.Total += n
+	}
+
+	finished := s.Counts[SUCCESSFUL] + s.Counts[FAILED] + s.Counts[DISMISSED]
+	if finished > 0 {
+		s.SuccessRate = roundTo(float64(s.Counts[SUCCESSFUL])/float64(finished), 4)
+		s.FailureRate = roundTo(float64(s.Counts[FAILED])/float64(finished), 4)
+	}
+
+	s.Duration = percentiles(b.durations)
+	s.QueueWait = percentiles(b.waits)
+	return s
+}
+
+// Compute statistics of jobs created in [from, to), top is the number of submitters reported.
+// Counts and top submitters are aggregated by the database, run times are read as a stream of job events.
+// Both databases share the queries, placeholder returns the bind parameter for the nth argument.
+func queryJobStats(h *sql.DB, placeholder func(n int) string, processID string, from, to time.Time, top int) (JobStats, error) {
+	b := newJobStatsBuilder()
+
+	// records are written with server local time
+	args := []interface{}{from.Local(), to.Local()}
+	where := fmt.Sprintf("j.created >= %s AND j.created < %s", placeholder(1), placeholder(2))
+	if processID != "" {
+		args = append(args, processID)
+		where += fmt.Sprintf(" AND j.process_id = %s", placeholder(3))
+	}
+
+	rows, err := h.Query(`SELECT j.status, COUNT(*) FROM jobs j WHERE `+where+` GROUP BY j.status`, args...)
+	if err != nil {
+		return JobStats{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return JobStats{}, err
+		}
+		b.stats.Counts[status] = n
+	}
+	if err := rows.Err(); err != nil {
+		return JobStats{}, err
+	}
+
+	topArgs := append(append([]interface{}{}, args...), top)
+	query := `SELECT j.submitter, COUNT(*) AS n FROM jobs j WHERE ` + where + ` GROUP BY j.submitter ORDER BY n DESC, j.submitter LIMIT ` + placeholder(len(topArgs))
+	subRows, err := h.Query(query, topArgs...)
+	if err != nil {
+		return JobStats{}, err
+	}
+	defer subRows.Close()
+	for subRows.Next() {
+		var sc SubmitterCount
+		if err := subRows.Scan(&sc.Submitter, &sc.Jobs); err != nil {
+			return JobStats{}, err
+		}
+		b.stats.TopSubmitters = append(b.stats.TopSubmitters, sc)
+	}
+	if err := subRows.Err(); err != nil {
+		return JobStats{}, err
+	}
+
+	// events are ordered by job so that the times of a job are complete when the next job starts
+	query = `SELECT e.job_id, j.created, e.status, e.time FROM job_events e JOIN jobs j ON j.id = e.job_id WHERE ` + where + ` ORDER BY e.job_id, e.time, e.id`
+	evRows, err := h.Query(query, args...)
+	if err != nil {
+		return JobStats{}, err
+	}
+	defer evRows.Close()
+
+	var jid string
+	var created, started, finished time.Time
+	for evRows.Next() {
+		var id, status string
+		var c, t time.Time
+		if err := evRows.Scan(&id, &c, &status, &t); err != nil {
+			return JobStats{}, err
+		}
+		if id != jid {
+			if jid != "" {
+				b.addTimes(created, started, finished)
+			}
+			jid, created, started, finished = id, c, time.Time{}, time.Time{}
+		}
+		switch status {
+		case RUNNING:
+			if started.IsZero() {
+				started = t
+			}
+		case SUCCESSFUL, FAILED, DISMISSED:
+			finished = t
+		}
+	}
+	if err := evRows.Err(); err != nil {
+		return JobStats{}, err
+	}
+	if jid != "" {
+		b.addTimes(created, started, finished)
+	}
+	return b.result(), nil
+}
+
+// Nearest rank percentiles
+func percentiles(values []float64) Percentiles {
+	p := Percentiles{Count: len(values)}
+	if len(values) == 0 {
+		return p
+	}
+	sort.Float64s(values)
+	rank := func(q float64) float64 {
+		i := int(math.Ceil(q*float64(len(values)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return roundTo(values[i], 3)
+	}
+	p.P50 = rank(0.50)
+	p.P95 = rank(0.95)
+	return p
+}
+
+func roundTo(v float64, digits int) float64 {
+	f := math.Pow(10, float64(digits))
+	return math.Round(v*f) / f
+}
+
+// Parse a stats window such as 24h, 7d or 90m, days are not supported by time.ParseDuration.
+// Windows longer than MaxStatsWindow are rejected.
+func ParseStatsWindow(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(s, "d") {
+		var n int
+		n, err = strconv.Atoi(strings.TrimSuffix(s, "d"))
+		// checked before converting so that large values do not overflow
+		if n > int(MaxStatsWindow/(24*time.Hour)) {
+			n = -1
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 || d > MaxStatsWindow {
+		return 0, fmt.Errorf("window must be a positive duration of at most 366d, such as 24h or 7d")
+	}
+	return d, nil
+}
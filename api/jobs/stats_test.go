@@ -0,0 +1,27 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStatsWindow(t *testing.T) {
+	valid := map[string]time.Duration{
+		"90m":  90 * time.Minute,
+		"24h":  24 * time.Hour,
+		"7d":   7 * 24 * time.Hour,
+		"366d": MaxStatsWindow,
+	}
+	for s, want := range valid {
+		if d, err := ParseStatsWindow(s); err != nil || d != want {
+			t.Errorf("ParseStatsWindow(%q) = %v, %v, want %v", s, d, err, want)
+		}
+	}
+
+	// 106752d overflows a Duration
+	for _, s := range []string{"", "0d", "-1d", "367d", "106752d", "9999999999999d", "10000h", "d", "1w"} {
+		if d, err := ParseStatsWindow(s); err == nil {
+			t.Errorf("ParseStatsWindow(%q) = %v, want an error", s, d)
+		}
+	}
+}
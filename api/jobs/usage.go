@@ -0,0 +1,195 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Groupings supported for usage reports
+const (
+	UsageBySubmitter = "submitter"
+	UsageByProcess   = "process"
+)
+
+// JobUsage is the compute consumed by a finished job
+type JobUsage struct {
+	JobID     string `json:"jobID"`
+	ProcessID string `json:"processID"`
+	Submitter string `json:"submitter"`
+	Host      string `json:"host"`
+	// Resources the job ran with, memory in MiB
+	CPUs   float32 `json:"cpus"`
+	Memory int     `json:"memory"`
+	// Run duration in seconds, zero if the job never started
+	Duration float64 `json:"durationSeconds"`
+	// vCPUs multiplied by the duration
+	CPUSeconds float64 `json:"cpuSeconds"`
+	// Memory in MiB multiplied by the duration, MiB-seconds
+	MemorySeconds float64   `json:"memoryMiBSeconds"`
+	Ended         time.Time `json:"ended"`
+}
+
+// Create usage of a job from its resources and run times.
+// Jobs that never started or whose times are unknown consume nothing.
+func newJobUsage(jid, pid, submitter, host string, cpus float32, memory int, started, ended *time.Time) JobUsage {
+	u := JobUsage{JobID: jid, ProcessID: pid, Submitter: submitter, Host: host, CPUs: cpus, Memory: memory, Ended: time.Now()}
+	if started == nil || ended == nil {
+		return u
+	}
+
+	u.Ended = *ended
+	if ended.After(*started) {
+		u.Duration = ended.Sub(*started).Seconds()
+	}
+	u.CPUSeconds = float64(cpus) * u.Duration
+	u.MemorySeconds = float64(memory) * u.Duration
+	return u
+}
+
+// Create usage of a job when it reached a terminal status, from its status history.
+// The job ran from its first running transition until the last transition, the terminal status.
+func usageFromHistory(jid, pid, submitter, host string, cpus float32, memory int, history []statusTransition) JobUsage {
+	var started, ended *time.Time
+	for i := range history {
+		if history[i].Status == RUNNING {
+			started = &history[i].Time
+			break
+		}
+	}
+	if len(history) > 0 {
+		ended = &history[len(history)-1].Time
+	}
+	return newJobUsage(jid, pid, submitter, host, cpus, memory, started, ended)
+}
+
+// UsageQuery selects usage of jobs that ended in [From, To), grouped by submitter or process
+type UsageQuery struct {
+	GroupBy    string
+	From       time.Time
+	To         time.Time
+	Submitters []string
+	ProcessIDs []string
+}
+
+// UsageSummary is the compute consumed by the jobs of a submitter or a process
+type UsageSummary struct {
+	Submitter string `json:"submitter,omitempty"`
+	ProcessID string `json:"processID,omitempty"`
+	Jobs      int    `json:"jobs"`
+	// Seconds of run time, vCPU-seconds and MiB-seconds
+	Duration      float64 `json:"durationSeconds"`
+	CPUSeconds    float64 `json:"cpuSeconds"`
+	CPUHours      float64 `json:"cpuHours"`
+	MemorySeconds float64 `json:"memoryMiBSeconds"`
+}
+
+// Both databases share the usage queries, placeholder returns the bind parameter for the nth argument.
+
+// Executes statements on a database handle or in a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertJobUsage(h execer, placeholder func(n int) string, u JobUsage) error {
+	placeholders := make([]string, 10)
+	for i := range placeholders {
+		placeholders[i] = placeholder(i + 1)
+	}
+	query := fmt.Sprintf(`INSERT INTO job_usage (job_id, process_id, submitter, host, cpus, memory, duration, cpu_seconds, memory_seconds, ended)
+	VALUES (%s) ON CONFLICT (job_id) DO NOTHING`, strings.Join(placeholders, ", "))
+
+	// records are written with server local time
+	_, err := h.Exec(query, u.JobID, u.ProcessID, u.Submitter, u.Host, u.CPUs, u.Memory, u.Duration, u.CPUSeconds, u.MemorySeconds, u.Ended.Local())
+	return err
+}
+
+func selectJobUsage(h *sql.DB, placeholder func(n int) string, jid string) (JobUsage, bool, error) {
+	query := fmt.Sprintf(`SELECT job_id, process_id, submitter, host, cpus, memory, duration, cpu_seconds, memory_seconds, ended
+	FROM job_usage WHERE job_id = %s`, placeholder(1))
+
+	var u JobUsage
+	err := h.QueryRow(query, jid).Scan(&u.JobID, &u.ProcessID, &u.Submitter, &u.Host, &u.CPUs, &u.Memory, &u.Duration, &u.CPUSeconds, &u.MemorySeconds, &u.Ended)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return JobUsage{}, false, nil
+		}
+		return JobUsage{}, false, err
+	}
+	return u, true, nil
+}
+
+func queryUsage(h *sql.DB, placeholder func(n int) string, q UsageQuery) ([]UsageSummary, error) {
+	column := "submitter"
+	if q.GroupBy == UsageByProcess {
+		column = "process_id"
+	}
+
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return placeholder(len(args))
+	}
+
+	whereClauses := []string{}
+	if !q.From.IsZero() {
+		whereClauses = append(whereClauses, "ended >= "+arg(q.From.Local()))
+	}
+	if !q.To.IsZero() {
+		whereClauses = append(whereClauses, "ended < "+arg(q.To.Local()))
+	}
+	in := func(column string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		placeholders := make([]string, len(values))
+		for i, v := range values {
+			placeholders[i] = arg(v)
+		}
+		whereClauses = append(whereClauses, fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", ")))
+	}
+	in("submitter", q.Submitters)
+	in("process_id", q.ProcessIDs)
+
+	query := fmt.Sprintf(`SELECT %s, COUNT(*), SUM(duration), SUM(cpu_seconds), SUM(memory_seconds) FROM job_usage`, column)
+	if len(whereClauses) > 0 {
+		query += " WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += fmt.Sprintf(" GROUP BY %s ORDER BY SUM(cpu_seconds) DESC, %s", column, column)
+
+	rows, err := h.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []UsageSummary{}
+	for rows.Next() {
+		var key string
+		var s UsageSummary
+		if err := rows.Scan(&key, &s.Jobs, &s.Duration, &s.CPUSeconds, &s.MemorySeconds); err != nil {
+			return nil, err
+		}
+		if q.GroupBy == UsageByProcess {
+			s.ProcessID = key
+		} else {
+			s.Submitter = key
+		}
+		s.CPUHours = roundTo(s.CPUSeconds/3600, 4)
+		res = append(res, s)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func countJobs(h *sql.DB, placeholder func(n int) string, submitter string, since time.Time) (int, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM jobs WHERE submitter = %s AND created >= %s`, placeholder(1), placeholder(2))
+	var n int
+	err := h.QueryRow(query, submitter, since.Local()).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,75 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUsageFromHistory(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	history := []statusTransition{
+		{ACCEPTED, start},
+		{RUNNING, start.Add(time.Minute)},
+		{SUCCESSFUL, start.Add(11 * time.Minute)},
+	}
+
+	u := usageFromHistory("jid", "pid", "a@example.com", "local", 2, 1024, history)
+	if u.Duration != 600 || u.CPUSeconds != 1200 || u.MemorySeconds != 1024*600 || !u.Ended.Equal(start.Add(11*time.Minute)) {
+		t.Errorf("unexpected usage %+v", u)
+	}
+
+	// jobs that never ran consume nothing
+	u = usageFromHistory("jid", "pid", "a@example.com", "local", 2, 1024, []statusTransition{{ACCEPTED, start}, {DISMISSED, start.Add(time.Minute)}})
+	if u.Duration != 0 || u.CPUSeconds != 0 || u.MemorySeconds != 0 {
+		t.Errorf("unexpected usage of a job that never ran %+v", u)
+	}
+}
+
+func TestQuotasCheck(t *testing.T) {
+	db := NewMemoryDB()
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	q := &Quotas{
+		Default:    QuotaLimits{JobsPerDay: 2, CPUHoursPerMonth: 1},
+		Submitters: map[string]QuotaLimits{"big@example.com": {CPUHoursPerMonth: 100}},
+	}
+
+	var nilQuotas *Quotas
+	if err := nilQuotas.Check(db, "a@example.com", now); err != nil {
+		t.Errorf("quotas not configured: %v", err)
+	}
+
+	// jobs of previous days do not count
+	db.addJob("old", SUCCESSFUL, "", "local", "pid", "1", "a@example.com", "", now.AddDate(0, 0, -1))
+	db.addJob("j1", SUCCESSFUL, "", "local", "pid", "1", "a@example.com", "", now.Add(-time.Hour))
+	if err := q.Check(db, "a@example.com", now); err != nil {
+		t.Errorf("quota exceeded with one job today: %v", err)
+	}
+
+	db.addJob("j2", SUCCESSFUL, "", "local", "pid", "1", "a@example.com", "", now.Add(-time.Minute))
+	var qe *QuotaExceededError
+	if err := q.Check(db, "a@example.com", now); !errors.As(err, &qe) || qe.Quota != "jobs per day" || !qe.Resets.Equal(time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("jobs per day: got %v", err)
+	}
+
+	// an hour on 2 vCPUs used up the default cpu hours, usage of last month does not count
+	started, ended := now.Add(-2*time.Hour), now.Add(-time.Hour)
+	lastMonth, lastMonthEnded := now.AddDate(0, -1, 0), now.AddDate(0, -1, 0).Add(10*time.Hour)
+	db.addJobUsage(newJobUsage("u0", "pid", "b@example.com", "local", 2, 0, &lastMonth, &lastMonthEnded))
+	if err := q.Check(db, "b@example.com", now); err != nil {
+		t.Errorf("usage of last month counted: %v", err)
+	}
+	db.addJobUsage(newJobUsage("u1", "pid", "b@example.com", "local", 2, 0, &started, &ended))
+	if err := q.Check(db, "b@example.com", now); !errors.As(err, &qe) || qe.Quota != "cpu hours per month" || qe.Used != 2 || !qe.Resets.Equal(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("cpu hours per month: got %v", err)
+	}
+
+	// limits of a submitter replace the default
+	db.addJobUsage(newJobUsage("u2", "pid", "big@example.com", "local", 2, 0, &started, &ended))
+	for i := 0; i < 3; i++ {
+		db.addJob(string(rune('a'+i)), SUCCESSFUL, "", "local", "pid", "1", "big@example.com", "", now)
+	}
+	if err := q.Check(db, "big@example.com", now); err != nil {
+		t.Errorf("submitter limits: got %v", err)
+	}
+}
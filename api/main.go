@@ -4,7 +4,10 @@ import (
 	"app/auth"
 	_ "app/docs"
 	"app/handlers"
+	"app/jobs"
+	"app/processes"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -15,8 +18,10 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -120,18 +125,24 @@ const (
 	authLevelAll     = 2
 )
 
-func applyAuthMiddleware(e *echo.Echo, protected *echo.Group, as auth.AuthStrategy, authLevel int) {
+// Callbacks are authenticated with the token issued for the job by the handler
+func isCallback(c echo.Context) bool {
+	return c.Path() == "/jobs/:jobID/status"
+}
+
+// Authorized requests are checked against the policy right after the user roles are set
+func applyAuthMiddleware(e *echo.Echo, protected *echo.Group, as auth.AuthStrategy, authLevel int, policy *auth.Policy, db jobs.Database) {
 	switch authLevel {
 	case authLevelPartial:
 		// Apply the Authorize middleware only to protected group
-		protected.Use(auth.Authorize(as))
+		protected.Use(auth.AuthorizeWithSkipper(as, isCallback), auth.Enforce(policy, db, isCallback))
 	case authLevelAll:
 		// Apply the Authorize middleware to all routes
-		e.Use(auth.Authorize(as))
+		e.Use(auth.AuthorizeWithSkipper(as, isCallback), auth.Enforce(policy, db, isCallback))
 	}
 }
 
-func initAuth(e *echo.Echo, protected *echo.Group) int {
+func initAuth(e *echo.Echo, protected *echo.Group, db jobs.Database, policy *auth.Policy) int {
 	var as auth.AuthStrategy
 	var err error
 
@@ -140,22 +151,58 @@ func initAuth(e *echo.Echo, protected *echo.Group) int {
 		log.Fatalf("Error converting AUTH_LEVEL to number: %s", err.Error())
 	}
 
+	apiKeys, err := strconv.ParseBool(resolveValue("AUTH_API_KEYS", "false"))
+	if err != nil {
+		log.Fatalf("Error converting AUTH_API_KEYS to boolean: %s", err.Error())
+	}
+
+	// Users of client certificates, the certificates are verified by the TLS server against TLS_CLIENT_CA_FILE
+	clientCertsFile := os.Getenv("AUTH_CLIENT_CERTS_FILE")
+	if clientCertsFile != "" && os.Getenv("TLS_CLIENT_CA_FILE") == "" {
+		log.Fatal("AUTH_CLIENT_CERTS_FILE requires TLS_CLIENT_CA_FILE to verify client certificates")
+	}
+
 	if authLvlInt == 0 {
 		log.Warn("No authentication set up.")
 		return 0
 	} else {
+		// Callback tokens of jobs must be verifiable by all instances sharing the database and after restarts
+		if os.Getenv("AUTH_CALLBACK_SECRET") == "" {
+			log.Fatal("AUTH_CALLBACK_SECRET is required when AUTH_LEVEL is set, it must be the same on all instances")
+		}
+
 		switch authSvc {
 		case "keycloak":
 			as, err = auth.NewKeycloakAuthStrategy()
 			if err != nil {
 				log.Fatalf("Error creating KeyCloak auth service: %s", err.Error())
 			}
+		case "oidc":
+			as, err = auth.NewOIDCAuthStrategy()
+			if err != nil {
+				log.Fatalf("Error creating OIDC auth service: %s", err.Error())
+			}
+		case "":
+			// only API keys and client certificates are accepted
+			if !apiKeys && clientCertsFile == "" {
+				log.Fatal("unsupported auth service provider type")
+			}
 		default:
 			log.Fatal("unsupported auth service provider type")
 		}
+
+		if apiKeys {
+			as = auth.NewAPIKeyAuthStrategy(db, as)
+		}
+		if clientCertsFile != "" {
+			as, err = auth.LoadClientCertAuthStrategy(clientCertsFile, as)
+			if err != nil {
+				log.Fatalf("Error creating client certificate auth service: %s", err.Error())
+			}
+		}
 	}
 
-	applyAuthMiddleware(e, protected, as, authLvlInt)
+	applyAuthMiddleware(e, protected, as, authLvlInt, policy, db)
 	return authLvlInt
 }
 
@@ -234,6 +281,419 @@ func copyFile(src, dst string) error {
 	return os.WriteFile(dst, input, 0644)
 }
 
+// Run the migrate subcommand, returns exit code.
+// Usage: main [-e .env] migrate [status | up [version] | down <version>]
+func runMigrate(args []string) int {
+	dbType, exist := os.LookupEnv("DB_SERVICE")
+	if !exist {
+		fmt.Println("env variable DB_SERVICE not set")
+		return 1
+	}
+
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	target := 0
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 {
+			fmt.Println("invalid version:", args[1])
+			return 1
+		}
+		target = v
+	} else if cmd == "down" {
+		fmt.Println("down requires a target version, use 0 to roll back all migrations")
+		return 1
+	}
+
+	m, err := jobs.NewMigrator(dbType)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer m.Close()
+
+	switch cmd {
+	case "status":
+	case "up":
+		_, err = m.Up(target)
+	case "down":
+		_, err = m.Down(target)
+	default:
+		fmt.Println("usage: migrate [status | up [version] | down <version>]")
+		return 1
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	status, err := m.Status()
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, s := range status {
+		applied := "pending"
+		if s.Applied != nil {
+			applied = s.Applied.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	w.Flush()
+	return 0
+}
+
+// Run the processes subcommand, returns exit code.
+// Usage: main [-e .env] processes import [-overwrite] <dir> | processes export <dir>
+func runProcesses(args []string) int {
+	usage := "usage: processes import [-overwrite] <dir> | processes export <dir>"
+	if len(args) < 1 {
+		fmt.Println(usage)
+		return 1
+	}
+
+	fs := flag.NewFlagSet("processes "+args[0], flag.ContinueOnError)
+	overwrite := fs.Bool("overwrite", false, "replace processes changed through the API")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		fmt.Println(usage)
+		return 1
+	}
+	dir := fs.Arg(0)
+
+	dbType, exist := os.LookupEnv("DB_SERVICE")
+	if !exist {
+		fmt.Println("env variable DB_SERVICE not set")
+		return 1
+	}
+
+	db, err := jobs.NewDatabase(dbType)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer db.Close()
+
+	var n int
+	var fileErrors []processes.FileError
+	switch args[0] {
+	case "import":
+		n, fileErrors, err = processes.ImportProcesses(db, dir, *overwrite)
+	case "export":
+		n, err = processes.ExportProcesses(db, dir)
+	default:
+		fmt.Println(usage)
+		return 1
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	fmt.Printf("%sed %d processes\n", args[0], n)
+	if len(fileErrors) > 0 {
+		for _, fe := range fileErrors {
+			fmt.Printf("not imported %s: %s\n", fe.File, fe.Error)
+		}
+		return 1
+	}
+	return 0
+}
+
+// Run the jobs subcommand, returns exit code.
+// Usage: main [-e .env] jobs export [-process <ids>] [-from <time>] [-to <time>] [-include logs,metadata,results] <file> | jobs import <file>
+func runJobs(args []string) int {
+	usage := "usage: jobs export [-process <ids>] [-from <time>] [-to <time>] [-include logs,metadata,results] <file> | jobs import <file>"
+	if len(args) < 1 {
+		fmt.Println(usage)
+		return 1
+	}
+
+	fs := flag.NewFlagSet("jobs "+args[0], flag.ContinueOnError)
+	processIDs := fs.String("process", "", "comma separated list of process ids to export")
+	from := fs.String("from", "", "export jobs created at or after this RFC3339 time")
+	to := fs.String("to", "", "export jobs created before this RFC3339 time")
+	include := fs.String("include", "", "comma separated list of logs, metadata, results to export from storage")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		fmt.Println(usage)
+		return 1
+	}
+	file := fs.Arg(0)
+
+	var opts jobs.ExportOptions
+	if *processIDs != "" {
+		opts.ProcessIDs = strings.Split(*processIDs, ",")
+	}
+	var err error
+	if *from != "" {
+		if opts.CreatedAfter, err = time.Parse(time.RFC3339, *from); err != nil {
+			fmt.Println("invalid -from time:", *from)
+			return 1
+		}
+	}
+	if *to != "" {
+		if opts.CreatedBefore, err = time.Parse(time.RFC3339, *to); err != nil {
+			fmt.Println("invalid -to time:", *to)
+			return 1
+		}
+	}
+	if *include != "" {
+		for _, i := range strings.Split(*include, ",") {
+			switch i {
+			case "logs":
+				opts.Logs = true
+			case "metadata":
+				opts.Metadata = true
+			case "results":
+				opts.Results = true
+			default:
+				fmt.Println("invalid -include value:", i)
+				return 1
+			}
+		}
+	}
+
+	dbType, exist := os.LookupEnv("DB_SERVICE")
+	if !exist {
+		fmt.Println("env variable DB_SERVICE not set")
+		return 1
+	}
+
+	db, err := jobs.NewDatabase(dbType)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer db.Close()
+
+	// storage is optional when only job records are moved
+	var stSvc *s3.S3
+	if stType, exist := os.LookupEnv("STORAGE_SERVICE"); exist {
+		stSvc, err = handlers.NewStorageService(stType)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+	}
+
+	switch args[0] {
+	case "export":
+		f, err := os.Create(file)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		defer f.Close()
+
+		n, err := jobs.ExportJobs(db, stSvc, f, opts)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		fmt.Printf("exported %d jobs\n", n)
+	case "import":
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		defer f.Close()
+
+		res, err := jobs.ImportJobs(db, stSvc, f)
+		if err != nil {
+			fmt.Printf("%s (imported %d jobs before the error)\n", err.Error(), res.Imported)
+			return 1
+		}
+		fmt.Printf("imported %d jobs and %d storage objects, skipped %d existing jobs\n", res.Imported, res.Objects, res.Skipped)
+	default:
+		fmt.Println(usage)
+		return 1
+	}
+	return 0
+}
+
+// Run the apikeys subcommand, returns exit code.
+// Usage: main [-e .env] apikeys create -owner <email> -name <name> [-scopes <scopes>] [-expires <time>] | apikeys list [-owner <email>] | apikeys revoke <id>
+func runAPIKeys(args []string) int {
+	usage := "usage: apikeys create -owner <email> -name <name> [-scopes <scopes>] [-expires <time>] | apikeys list [-owner <email>] | apikeys revoke <id>"
+	if len(args) < 1 {
+		fmt.Println(usage)
+		return 1
+	}
+
+	fs := flag.NewFlagSet("apikeys "+args[0], flag.ContinueOnError)
+	owner := fs.String("owner", "", "email of the key owner")
+	name := fs.String("name", "", "name of the key")
+	scopes := fs.String("scopes", "", "comma separated list of admin, jobs:read, execute:<processID>")
+	expires := fs.String("expires", "", "RFC3339 time the key expires at")
+	if err := fs.Parse(args[1:]); err != nil {
+		fmt.Println(usage)
+		return 1
+	}
+
+	dbType, exist := os.LookupEnv("DB_SERVICE")
+	if !exist {
+		fmt.Println("env variable DB_SERVICE not set")
+		return 1
+	}
+
+	db, err := jobs.NewDatabase(dbType)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "create":
+		if *owner == "" || *name == "" || fs.NArg() != 0 {
+			fmt.Println(usage)
+			return 1
+		}
+		scopeList := []string{}
+		if *scopes != "" {
+			scopeList = strings.Split(*scopes, ",")
+		}
+		var exp *time.Time
+		if *expires != "" {
+			t, err := time.Parse(time.RFC3339, *expires)
+			if err != nil {
+				fmt.Println("invalid -expires time:", *expires)
+				return 1
+			}
+			exp = &t
+		}
+
+		token, k, err := auth.NewAPIKey(*owner, *name, scopeList, exp)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		if err := db.AddAPIKey(k); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		fmt.Printf("created key %s, the token is not shown again:\n%s\n", k.ID, token)
+	case "list":
+		if fs.NArg() != 0 {
+			fmt.Println(usage)
+			return 1
+		}
+		keys, err := db.GetAPIKeys(*owner)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tOWNER\tSCOPES\tEXPIRES\tREVOKED\tLAST USED")
+		format := func(t *time.Time) string {
+			if t == nil {
+				return "-"
+			}
+			return t.Format(time.RFC3339)
+		}
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Owner, strings.Join(k.Scopes, ","), format(k.Expires), format(k.Revoked), format(k.LastUsed))
+		}
+		w.Flush()
+	case "revoke":
+		if fs.NArg() != 1 {
+			fmt.Println(usage)
+			return 1
+		}
+		revoked, err := db.RevokeAPIKey(fs.Arg(0), "", time.Now())
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		if !revoked {
+			fmt.Println("key does not exist or is already revoked")
+			return 1
+		}
+		fmt.Println("revoked key", fs.Arg(0))
+	default:
+		fmt.Println(usage)
+		return 1
+	}
+	return 0
+}
+
+// Run the secrets subcommand to manage the encrypted secrets store, returns exit code.
+// The value of a secret is read from stdin so that it is not kept in the shell history.
+// Usage: main [-e .env] secrets set <scope> <name> | secrets delete <scope> <name> | secrets list [scope]
+func runSecrets(args []string) int {
+	usage := "usage: secrets set <scope> <name> | secrets delete <scope> <name> | secrets list [scope]"
+	if len(args) < 1 {
+		fmt.Println(usage)
+		return 1
+	}
+
+	store, err := jobs.NewEncryptedSecretStore(os.Getenv("SECRETS_STORE_FILE"), os.Getenv("SECRETS_STORE_KEY"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	switch args[0] {
+	case "set":
+		if len(args) != 3 {
+			fmt.Println(usage)
+			return 1
+		}
+		value, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		if err := store.Set(args[1], args[2], strings.TrimRight(string(value), "\r\n")); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		fmt.Printf("set secret %s/%s\n", args[1], args[2])
+	case "delete":
+		if len(args) != 3 {
+			fmt.Println(usage)
+			return 1
+		}
+		deleted, err := store.Delete(args[1], args[2])
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		if !deleted {
+			fmt.Println("secret does not exist")
+			return 1
+		}
+		fmt.Printf("deleted secret %s/%s\n", args[1], args[2])
+	case "list":
+		if len(args) > 2 {
+			fmt.Println(usage)
+			return 1
+		}
+		scope := ""
+		if len(args) == 2 {
+			scope = args[1]
+		}
+		names, err := store.List(scope)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		for _, n := range names {
+			fmt.Println(n)
+		}
+	default:
+		fmt.Println(usage)
+		return 1
+	}
+	return 0
+}
+
 // @title Process-API Server
 // @version dev-8.16.23
 // @description An OGC compliant process server.
@@ -251,6 +711,19 @@ func copyFile(src, dst string) error {
 // @externalDocs.description   Schemas
 // @externalDocs.url    http://schemas.opengis.net/ogcapi/processes/part1/1.0/openapi/schemas/
 func main() {
+	switch flag.Arg(0) {
+	case "migrate":
+		os.Exit(runMigrate(flag.Args()[1:]))
+	case "processes":
+		os.Exit(runProcesses(flag.Args()[1:]))
+	case "jobs":
+		os.Exit(runJobs(flag.Args()[1:]))
+	case "apikeys":
+		os.Exit(runAPIKeys(flag.Args()[1:]))
+	case "secrets":
+		os.Exit(runSecrets(flag.Args()[1:]))
+	}
+
 	initPlugins()
 
 	// Initialize resources
@@ -262,6 +735,8 @@ func main() {
 	// Goroutines
 	go rh.StatusUpdateRoutine()
 	go rh.JobCompletionRoutine()
+	go rh.ProcessSyncRoutine()
+	go rh.Coordinator.Run()
 
 	// Set server configuration
 	e := echo.New()
@@ -270,15 +745,19 @@ func main() {
 	// e.HideBanner = true
 	e.HidePort = true
 	e.Use(middleware.Recover())
+	e.Use(middleware.RequestID())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowCredentials: true,
 		AllowOrigins:     []string{"*"},
 	}))
 	e.Renderer = &rh.T
 
+	// Rejected requests are audited, this must wrap the auth middleware
+	e.Use(rh.AuditAuthFailures)
+
 	// Create a group for all routes that need to be protected when AUTH_LEVEL = protected
 	pg := e.Group("")
-	authLvl := initAuth(e, pg)
+	authLvl := initAuth(e, pg, rh.DB, rh.Policy)
 	rh.Config.AuthLevel = authLvl
 
 	// Server
@@ -287,8 +766,11 @@ func main() {
 	e.GET("/conformance", rh.Conformance)
 
 	// Processes
-	e.GET("/processes", rh.ProcessListHandler)
-	e.GET("/processes/:processID", rh.ProcessDescribeHandler)
+	pg.GET("/processes", rh.ProcessListHandler)
+	pg.GET("/processes/:processID", rh.ProcessDescribeHandler)
+	pg.GET("/processes/:processID/versions", rh.ProcessVersionsHandler)
+	pg.GET("/processes/:processID/versions/:version", rh.ProcessVersionDescribeHandler)
+	pg.GET("/processes/:processID/stats", rh.ProcessStatsHandler)
 	pg.POST("/processes/:processID", rh.AddProcessHandler)
 	pg.PUT("/processes/:processID", rh.UpdateProcessHandler)
 	pg.DELETE("/processes/:processID", rh.DeleteProcessHandler)
@@ -299,15 +781,33 @@ func main() {
 	// pg.Post("processes/:processID/new, rh.RegisterNewProcess)
 	// pg.Delete("processes/:processID", rh.RegisterNewProcess)
 
+	// Statistics
+	pg.GET("/stats", rh.StatsHandler)
+	pg.GET("/usage", rh.UsageHandler)
+
 	// Jobs
-	e.GET("/jobs", rh.ListJobsHandler) // changed for hotfix, should be pg.GET when clients are updated
-	e.GET("/jobs/:jobID", rh.JobStatusHandler)
-	e.GET("/jobs/:jobID/results", rh.JobResultsHandler)
-	e.GET("/jobs/:jobID/logs", rh.JobLogsHandler)
-	e.GET("/jobs/:jobID/metadata", rh.JobMetaDataHandler)
+	pg.GET("/jobs", rh.ListJobsHandler)
+	pg.GET("/jobs/:jobID", rh.JobStatusHandler)
+	pg.GET("/jobs/:jobID/results", rh.JobResultsHandler)
+	pg.GET("/jobs/:jobID/logs", rh.JobLogsHandler)
+	pg.GET("/jobs/:jobID/history", rh.JobHistoryHandler)
+	pg.GET("/jobs/:jobID/metadata", rh.JobMetaDataHandler)
+	pg.GET("/jobs/:jobID/metadata/verify", rh.JobMetaDataVerifyHandler)
 	pg.DELETE("/jobs/:jobID", rh.JobDismissHandler)
 
-	// Callbacks
+	// Auth
+	pg.GET("/auth/whoami", rh.WhoAmIHandler)
+	pg.POST("/auth/keys", rh.CreateAPIKeyHandler)
+	pg.GET("/auth/keys", rh.ListAPIKeysHandler)
+	pg.DELETE("/auth/keys/:keyID", rh.RevokeAPIKeyHandler)
+
+	// Admin
+	pg.GET("/admin/jobs/export", rh.ExportJobsHandler)
+	pg.POST("/admin/jobs/import", rh.ImportJobsHandler)
+	pg.GET("/admin/audit", rh.AuditLogHandler)
+	pg.GET("/admin/processes/errors", rh.PluginErrorsHandler)
+
+	// Callbacks, authenticated with job callback tokens
 	pg.PUT("/jobs/:jobID/status", rh.JobStatusUpdateHandler)
 	// e.POST("/jobs/:jobID/results", rh.JobResultsUpdateHandler)
 
@@ -317,10 +817,35 @@ func main() {
 		Output: lw,
 	}))
 
+	// Serve TLS if a certificate is set, certificates are reloaded when their files change
+	certFile := os.Getenv("TLS_CERT_FILE")
+	stopReload := make(chan struct{})
+	if certFile != "" {
+		cr, err := auth.NewCertReloader(certFile, os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloadInterval, err := time.ParseDuration(resolveValue("TLS_RELOAD_INTERVAL", "30s"))
+		if err != nil || reloadInterval <= 0 {
+			log.Fatalf("TLS_RELOAD_INTERVAL must be a positive duration such as 30s, got %s", os.Getenv("TLS_RELOAD_INTERVAL"))
+		}
+		go cr.Watch(reloadInterval, stopReload)
+
+		e.TLSServer.Addr = ":" + port
+		e.TLSServer.TLSConfig = cr.TLSConfig()
+	}
+
+	// Process files changed after startup are imported until shutdown
+	go rh.PluginsWatchRoutine(stopReload)
+
 	// Start server
 	go func() {
 		log.Info("server starting on port: ", port)
-		if err := e.Start(":" + port); err != nil && err != http.ErrServerClosed {
+		start := func() error { return e.Start(":" + port) }
+		if certFile != "" {
+			start = func() error { return e.StartServer(e.TLSServer) }
+		}
+		if err := start(); err != nil && err != http.ErrServerClosed {
 			log.Error("server error : ", err.Error())
 			log.Fatal("shutting down the server")
 		}
@@ -332,6 +857,7 @@ func main() {
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	<-quit
 	log.Info("gracefully shutting down the server")
+	close(stopReload)
 
 	go func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
@@ -344,9 +870,9 @@ func main() {
 	// Shutdown the server
 	// By default, Docker provides a grace period of 10 seconds with the docker stop command.
 
-	// Kill any running docker containers (clean up resources)
-	rh.ActiveJobs.KillAll()
-	log.Info("kill command sent to all active jobs")
+	// Kill any running docker containers (clean up resources), other jobs are taken over by remaining instances
+	rh.Coordinator.HandOver()
+	log.Info("kill command sent to local jobs, remaining active jobs handed over")
 
 	// sleep so that Close() routines spawned by KillAll() can finish writing logs, and updating statuses
 	// aws batch jobs close() methods take minimum of 5 seconds
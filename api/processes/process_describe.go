@@ -4,14 +4,16 @@ type processDescription struct {
 	Info      `json:"info"`
 	Image     string `json:"image"`
 	Resources `json:"maxResources,omitempty"`
-	Inputs    []Inputs  `json:"inputs"`
-	Outputs   []Outputs `json:"outputs"`
-	Links     []Link    `json:"links"`
+	// Env vars that can be set in environmentVariables of execution requests
+	EnvOverrides []EnvOverride `json:"environmentVariables,omitempty"`
+	Inputs       []Inputs      `json:"inputs"`
+	Outputs      []Outputs     `json:"outputs"`
+	Links        []Link        `json:"links"`
 }
 
 func (p Process) Describe() (processDescription, error) {
 	pd := processDescription{
-		Info: p.Info, Image: p.Container.Image, Resources: p.Container.Resources, Inputs: p.Inputs, Outputs: p.Outputs} // Links: p.createLinks()
+		Info: p.Info, Image: p.Container.Image, Resources: p.Container.Resources, EnvOverrides: p.Container.EnvOverrides, Inputs: p.Inputs, Outputs: p.Outputs} // Links: p.createLinks()
 
 	return pd, nil
 }
@@ -4,10 +4,15 @@ package processes
 
 import (
 	"app/controllers"
+	"app/jobs"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/labstack/gommon/log"
 	"gopkg.in/yaml.v3"
@@ -84,10 +89,35 @@ type Host struct {
 }
 
 type Container struct {
-	Image     string    `yaml:"image" json:"image"`
-	EnvVars   []string  `yaml:"envVars" json:"envVars,omitempty"`
-	Command   []string  `yaml:"command" json:"command,omitempty"`
-	Resources Resources `yaml:"maxResources" json:"maxResources,omitempty"`
+	Image   string   `yaml:"image" json:"image"`
+	EnvVars []string `yaml:"envVars" json:"envVars,omitempty"`
+	// Env vars callers can set in the execution request
+	EnvOverrides []EnvOverride `yaml:"envOverrides" json:"envOverrides,omitempty"`
+	Command      []string      `yaml:"command" json:"command,omitempty"`
+	Resources    Resources     `yaml:"maxResources" json:"maxResources,omitempty"`
+}
+
+// EnvOverride is an env var that callers can set per execution, such as a debug flag or a thread count.
+// The value must fully match Pattern if it is set. Default is used if the caller does not set the var,
+// the var is not set if both are empty.
+type EnvOverride struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	Default     string `yaml:"default" json:"default,omitempty"`
+	Pattern     string `yaml:"pattern" json:"pattern,omitempty"`
+}
+
+// Env vars set by the server for jobs, and names AWS Batch does not accept in overrides
+var reservedEnvPrefixes = []string{"PROCESSAPI_", "AWS_BATCH"}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Compile the pattern so that it matches whole values
+func (o EnvOverride) regexp() (*regexp.Regexp, error) {
+	if o.Pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + o.Pattern + ")$")
 }
 
 func (p Process) Type() string {
@@ -131,11 +161,52 @@ func (p Process) VerifyInputs(inp map[string]interface{}) error {
 	return nil
 }
 
+// VerifyEnvOverrides checks the env vars of an execution request against the envOverrides of the process.
+// Returns the values to set in the job, including defaults of vars the request does not set.
+func (p Process) VerifyEnvOverrides(env map[string]string) (map[string]string, error) {
+	res := map[string]string{}
+	allowed := map[string]bool{}
+
+	for _, o := range p.Container.EnvOverrides {
+		allowed[o.Name] = true
+
+		value, ok := env[o.Name]
+		if !ok {
+			if o.Default != "" {
+				res[o.Name] = o.Default
+			}
+			continue
+		}
+
+		re, err := o.regexp()
+		if err != nil {
+			return nil, err
+		}
+		if re != nil && !re.MatchString(value) {
+			return nil, fmt.Errorf("value of environment variable %s does not match pattern '%s'", o.Name, o.Pattern)
+		}
+		res[o.Name] = value
+	}
+
+	for k := range env {
+		if !allowed[k] {
+			return nil, fmt.Errorf("%s is not an environment variable this process allows to set, use /processes/%s endpoint to get list of environment variables", k, p.Info.ID)
+		}
+	}
+
+	return res, nil
+}
+
+// Secret references are resolved when jobs start, they are not verified here
 func (p Process) VerifyLocalEnvars(container Container) error {
 	var missingEnvVars []string
 	for _, envVar := range container.EnvVars {
-		if os.Getenv(envVar) == "" {
-			missingEnvVars = append(missingEnvVars, envVar)
+		ev, err := jobs.ParseEnvVar(envVar)
+		if err != nil {
+			return err
+		}
+		if ev.Secret == "" && os.Getenv(ev.Name) == "" {
+			missingEnvVars = append(missingEnvVars, ev.Name)
 		}
 	}
 	if len(missingEnvVars) > 0 {
@@ -146,12 +217,17 @@ func (p Process) VerifyLocalEnvars(container Container) error {
 
 // ProcessList describes processes
 // This is not a map since ProcessList Handler function wants order
+// It is a cache of the processes stored in the database, see Load
 type ProcessList struct {
 	List     []Process
 	InfoList []Info
+	mu       sync.RWMutex
 }
 
 func (ps *ProcessList) Get(processID string) (Process, int, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
 	for i, p := range (*ps).List {
 		if p.Info.ID == processID {
 			return p, i, nil
@@ -160,6 +236,29 @@ func (ps *ProcessList) Get(processID string) (Process, int, error) {
 	return Process{}, 0, errors.New("process not found")
 }
 
+// Infos returns a copy of the info of all processes
+func (ps *ProcessList) Infos() []Info {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	infos := make([]Info, len(ps.InfoList))
+	copy(infos, ps.InfoList)
+	return infos
+}
+
+// Set replaces all processes in the list
+func (ps *ProcessList) Set(processes []Process) {
+	infos := make([]Info, len(processes))
+	for i, p := range processes {
+		infos[i] = p.Info
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.List = processes
+	ps.InfoList = infos
+}
+
 func MarshallProcess(f string) (Process, error) {
 	var p Process
 	data, err := os.ReadFile(f)
@@ -191,42 +290,54 @@ func MarshallProcess(f string) (Process, error) {
 	return p, nil
 }
 
-// Load all processes from yml files in the given directory and subdirectories
-func LoadProcesses(dir string) (ProcessList, error) {
-	var pl ProcessList
+// ProcessFile is a valid process loaded from the yml file at Path
+type ProcessFile struct {
+	Path    string
+	Process Process
+}
+
+// FileError is the reason a process file was not imported
+type FileError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
 
+// Load all processes from yml files in the given directory and subdirectories
+// Files that can not be read, are not valid processes, or define a process id already defined by another file
+// are logged, skipped and returned with the error
+func LoadProcesses(dir string) ([]ProcessFile, []FileError, error) {
 	ymls, err := filepath.Glob(fmt.Sprintf("%s/*/*.yml", dir))
 	if err != nil {
-		return pl, err
+		return nil, nil, err
 	}
 	yamls, err := filepath.Glob(fmt.Sprintf("%s/*/*.yaml", dir))
 	if err != nil {
-		return pl, err
+		return nil, nil, err
 	}
 	allYamls := append(ymls, yamls...)
-	processes := make([]Process, len(allYamls))
+	sort.Strings(allYamls)
+	processes := make([]ProcessFile, 0, len(allYamls))
+	fileErrors := []FileError{}
+	files := map[string]string{}
 
-	for i, y := range allYamls {
+	for _, y := range allYamls {
 		p, err := MarshallProcess(y)
-		if err != nil {
-			log.Errorf("could not register process %s Error: %v", filepath.Base(y), err)
+		if err == nil {
+			err = p.Validate()
+		}
+		if err == nil && files[p.Info.ID] != "" {
+			err = fmt.Errorf("process %s is already defined in %s", p.Info.ID, files[p.Info.ID])
 		}
-		err = p.Validate()
 		if err != nil {
 			log.Errorf("could not register process %s Error: %v", filepath.Base(y), err.Error())
+			fileErrors = append(fileErrors, FileError{File: y, Error: err.Error()})
+			continue
 		}
-		processes[i] = p
-	}
-
-	infos := make([]Info, len(processes))
-	for i, p := range processes {
-		infos[i] = p.Info
+		files[p.Info.ID] = y
+		processes = append(processes, ProcessFile{Path: y, Process: p})
 	}
 
-	pl.List = processes
-	pl.InfoList = infos
-
-	return pl, err
+	return processes, fileErrors, nil
 }
 
 // Validate checks if the Process has all required fields properly set.
@@ -278,6 +389,47 @@ func (p *Process) Validate() error {
 		return errors.New("job information is required for aws-batch host type")
 	}
 
+	// Validate EnvVars
+	for _, envVar := range p.Container.EnvVars {
+		ev, err := jobs.ParseEnvVar(envVar)
+		if err != nil {
+			return err
+		}
+		// Values in Batch container overrides can be read by anyone allowed to describe the job
+		if ev.Secret != "" && p.Host.Type == "aws-batch" {
+			return fmt.Errorf("env var %s: aws-batch processes can not reference secrets, use secrets of the job definition", ev.Name)
+		}
+	}
+
+	// Validate EnvOverrides
+	names := map[string]bool{}
+	for _, envVar := range p.Container.EnvVars {
+		ev, _ := jobs.ParseEnvVar(envVar)
+		names[ev.Name] = true
+	}
+	for i, o := range p.Container.EnvOverrides {
+		if !envNamePattern.MatchString(o.Name) {
+			return fmt.Errorf("env override %d: invalid name '%s'", i, o.Name)
+		}
+		for _, prefix := range reservedEnvPrefixes {
+			if strings.HasPrefix(o.Name, prefix) {
+				return fmt.Errorf("env override %s: names starting with %s are reserved", o.Name, prefix)
+			}
+		}
+		if names[o.Name] {
+			return fmt.Errorf("env override %s: name is already used by envVars or another env override", o.Name)
+		}
+		names[o.Name] = true
+
+		re, err := o.regexp()
+		if err != nil {
+			return fmt.Errorf("env override %s: invalid pattern: %s", o.Name, err.Error())
+		}
+		if re != nil && o.Default != "" && !re.MatchString(o.Default) {
+			return fmt.Errorf("env override %s: default does not match pattern", o.Name)
+		}
+	}
+
 	// Validate Inputs
 	for i, input := range p.Inputs {
 		if input.ID == "" {
@@ -0,0 +1,125 @@
+package processes
+
+// Process definitions are stored in the database so that all API instances serve the same catalog.
+// ProcessList is a cache of the database that is reloaded whenever any instance changes a process.
+// YAML files are imported into the database at startup and can be exported for version control.
+
+import (
+	"app/jobs"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/labstack/gommon/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Create database record of a process
+func NewProcessRecord(p Process, source string) (jobs.ProcessRecord, error) {
+	def, err := json.Marshal(p)
+	if err != nil {
+		return jobs.ProcessRecord{}, err
+	}
+	return jobs.ProcessRecord{ID: p.Info.ID, Version: p.Info.Version, Definition: def, Source: source}, nil
+}
+
+// Load replaces the processes in the list with the processes stored in the database.
+// Definitions that are not valid are logged and skipped.
+func (ps *ProcessList) Load(db jobs.Database) error {
+	records, err := db.GetProcesses()
+	if err != nil {
+		return err
+	}
+
+	processes := make([]Process, 0, len(records))
+	for _, r := range records {
+		p, err := processFromRecord(r)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		processes = append(processes, p)
+	}
+
+	ps.Set(processes)
+	return nil
+}
+
+// Import processes from yml files in the given directory into the database. Returns number of processes imported
+// and the files that were not imported because they are not valid or conflict with a registered version.
+// Without overwrite, processes that have been changed or deleted through the API are not replaced and their files are
+// returned with the errors, and processes previously imported from files are replaced only if their definition changed.
+func ImportProcesses(db jobs.Database, dir string, overwrite bool) (int, []FileError, error) {
+	files, fileErrors, err := LoadProcesses(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n := 0
+	for _, f := range files {
+		p := f.Process
+		pr, err := NewProcessRecord(p, jobs.ProcessSourceYAML)
+		if err != nil {
+			return n, fileErrors, err
+		}
+
+		if !overwrite {
+			existing, exist, err := db.GetProcess(p.Info.ID)
+			if err != nil {
+				return n, fileErrors, err
+			}
+			if exist {
+				if bytes.Equal(existing.Definition, pr.Definition) {
+					continue
+				}
+				if existing.Source != jobs.ProcessSourceYAML {
+					log.Errorf("process %s was changed through the API, skipping import of %s", p.Info.ID, f.Path)
+					fileErrors = append(fileErrors, FileError{File: f.Path, Error: "process was changed through the API, use `processes import -overwrite` to replace it with the file"})
+					continue
+				}
+			}
+		}
+
+		err = db.PutProcess(pr)
+		if errors.Is(err, jobs.ErrProcessVersionExists) {
+			log.Errorf("process %s version %s is already registered with a different definition, bump the version to import it", p.Info.ID, p.Info.Version)
+			fileErrors = append(fileErrors, FileError{File: f.Path, Error: fmt.Sprintf("version %s is already registered with a different definition, bump the version to import it", p.Info.Version)})
+			continue
+		}
+		if err != nil {
+			return n, fileErrors, fmt.Errorf("could not import process %s: %s", p.Info.ID, err.Error())
+		}
+		log.Infof("imported process %s version %s", p.Info.ID, p.Info.Version)
+		n++
+	}
+	return n, fileErrors, nil
+}
+
+// Export processes stored in the database to <dir>/<processID>/<processID>.yml files,
+// the layout expected by ImportProcesses. Returns number of processes exported.
+func ExportProcesses(db jobs.Database, dir string) (int, error) {
+	var pl ProcessList
+	if err := pl.Load(db); err != nil {
+		return 0, err
+	}
+
+	for i, p := range pl.List {
+		data, err := yaml.Marshal(p)
+		if err != nil {
+			return i, err
+		}
+
+		destDir := filepath.Join(dir, p.Info.ID)
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return i, err
+		}
+
+		if err := os.WriteFile(filepath.Join(destDir, p.Info.ID+".yml"), data, 0644); err != nil {
+			return i, err
+		}
+	}
+	return len(pl.List), nil
+}
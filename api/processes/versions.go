@@ -0,0 +1,108 @@
+package processes
+
+import (
+	"app/jobs"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// ErrVersionNotFound is returned when no registered version satisfies a version request
+var ErrVersionNotFound = errors.New("no registered version satisfies the version requested")
+
+// VersionInfo describes a registered version of a process
+type VersionInfo struct {
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+	Source  string    `json:"source"`
+	Current bool      `json:"current"`
+}
+
+func processFromRecord(r jobs.ProcessRecord) (Process, error) {
+	var p Process
+	if err := json.Unmarshal(r.Definition, &p); err != nil {
+		return Process{}, fmt.Errorf("could not load process %s version %s: %s", r.ID, r.Version, err.Error())
+	}
+	return p, nil
+}
+
+// Versions lists all registered versions of a process ordered by registration time
+func Versions(db jobs.Database, processID string) ([]VersionInfo, error) {
+	records, err := db.GetProcessVersions(processID)
+	if err != nil {
+		return nil, err
+	}
+
+	current, exist, err := db.GetProcess(processID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]VersionInfo, len(records))
+	for i, r := range records {
+		res[i] = VersionInfo{
+			Version: r.Version,
+			Created: r.Updated,
+			Source:  r.Source,
+			Current: exist && !current.Deleted && current.Version == r.Version,
+		}
+	}
+	return res, nil
+}
+
+// GetVersion returns a registered version of a process
+func GetVersion(db jobs.Database, processID, version string) (Process, error) {
+	r, exist, err := db.GetProcessVersion(processID, version)
+	if err != nil {
+		return Process{}, err
+	}
+	if !exist {
+		return Process{}, ErrVersionNotFound
+	}
+	return processFromRecord(r)
+}
+
+// ResolveVersion returns the version of a process that satisfies the version request.
+// The request is either an exact version or a semantic version constraint such as
+// "^1.2", "~1.2.3", or ">= 1.0, < 2.0", in which case the highest satisfying version is returned.
+func ResolveVersion(db jobs.Database, processID, request string) (Process, error) {
+	r, exist, err := db.GetProcessVersion(processID, request)
+	if err != nil {
+		return Process{}, err
+	}
+	if exist {
+		return processFromRecord(r)
+	}
+
+	constraint, err := semver.NewConstraint(request)
+	if err != nil {
+		return Process{}, fmt.Errorf("version must be a registered version or a semantic version constraint: %s", err.Error())
+	}
+
+	records, err := db.GetProcessVersions(processID)
+	if err != nil {
+		return Process{}, err
+	}
+
+	var best *semver.Version
+	var bestRecord jobs.ProcessRecord
+	for _, r := range records {
+		v, err := semver.NewVersion(r.Version)
+		if err != nil {
+			// versions that are not semantic versions can only be requested exactly
+			continue
+		}
+		if constraint.Check(v) && (best == nil || v.GreaterThan(best)) {
+			best = v
+			bestRecord = r
+		}
+	}
+
+	if best == nil {
+		return Process{}, ErrVersionNotFound
+	}
+	return processFromRecord(bestRecord)
+}
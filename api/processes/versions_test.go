@@ -0,0 +1,58 @@
+package processes
+
+import (
+	"app/jobs"
+	"errors"
+	"testing"
+)
+
+func TestResolveVersion(t *testing.T) {
+	db := jobs.NewMemoryDB()
+	for _, v := range []string{"1.0.0", "1.2.0", "1.2.5", "1.10.0", "2.0.0-beta", "2.1.0", "nightly"} {
+		var p Process
+		p.Info.ID = "pyecho"
+		p.Info.Version = v
+		pr, err := NewProcessRecord(p, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutProcess(pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		request string
+		want    string
+	}{
+		{"1.2.0", "1.2.0"},
+		{"nightly", "nightly"},
+		{"^1.2", "1.10.0"},
+		{"~1.2.0", "1.2.5"},
+		{">= 1.0, < 1.2", "1.0.0"},
+		{"1.x", "1.10.0"},
+		{"*", "2.1.0"},
+		// prereleases are only matched by constraints with a prerelease
+		{"~2.0.0-0", "2.0.0-beta"},
+	}
+	for _, c := range cases {
+		p, err := ResolveVersion(db, "pyecho", c.request)
+		if err != nil {
+			t.Errorf("ResolveVersion(%q): %s", c.request, err.Error())
+			continue
+		}
+		if p.Info.Version != c.want {
+			t.Errorf("ResolveVersion(%q) = %s, want %s", c.request, p.Info.Version, c.want)
+		}
+	}
+
+	if _, err := ResolveVersion(db, "pyecho", "^3"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("unsatisfied constraint: got %v", err)
+	}
+	if _, err := ResolveVersion(db, "other", "^1"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("unknown process: got %v", err)
+	}
+	if _, err := ResolveVersion(db, "pyecho", "not a version"); err == nil || errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("invalid constraint: got %v", err)
+	}
+}
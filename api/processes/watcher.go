@@ -0,0 +1,129 @@
+package processes
+
+import (
+	"app/jobs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/gommon/log"
+)
+
+// Editors and deploy tools write files in several steps, changes are imported once no more events arrive for this long
+const pluginsImportDelay = time.Second
+
+// PluginsWatcher imports the process files of the plugins directory into the database when they change,
+// and keeps the errors of the files that were not imported by the last import.
+type PluginsWatcher struct {
+	DB  jobs.Database
+	Dir string
+	// Called after processes were imported, to serve them before the change notification of the database arrives
+	OnImport func()
+
+	mu         sync.RWMutex
+	lastImport time.Time
+	fileErrors []FileError
+}
+
+// PluginsStatus is the result of the last import of the plugins directory
+type PluginsStatus struct {
+	Dir        string      `json:"dir"`
+	LastImport time.Time   `json:"lastImport"`
+	Errors     []FileError `json:"errors"`
+}
+
+func NewPluginsWatcher(db jobs.Database, dir string, onImport func()) *PluginsWatcher {
+	return &PluginsWatcher{DB: db, Dir: dir, OnImport: onImport, fileErrors: []FileError{}}
+}
+
+// Import the process files into the database and record the files that were not imported.
+// Processes changed through the API are not replaced, see ImportProcesses.
+func (w *PluginsWatcher) Import() (int, error) {
+	n, fileErrors, err := ImportProcesses(w.DB, w.Dir, false)
+	if err != nil {
+		return n, err
+	}
+
+	w.mu.Lock()
+	w.lastImport = time.Now()
+	w.fileErrors = fileErrors
+	w.mu.Unlock()
+
+	if n > 0 && w.OnImport != nil {
+		w.OnImport()
+	}
+	return n, nil
+}
+
+// Status of the last import
+func (w *PluginsWatcher) Status() PluginsStatus {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return PluginsStatus{Dir: w.Dir, LastImport: w.lastImport, Errors: w.fileErrors}
+}
+
+// Watch the directory and the process directories in it, and import the files when they change, until stop is closed.
+// Removing a file does not remove its process, processes are deleted through the API.
+func (w *PluginsWatcher) Watch(stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(w.Dir); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := watcher.Add(filepath.Join(w.Dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	var importAfter <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// Process directories added later are watched too, their files are imported with the next import
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watcher.Add(event.Name); err != nil {
+						log.Errorf("could not watch process directory %s: %s", event.Name, err.Error())
+					}
+				}
+			}
+			switch filepath.Ext(event.Name) {
+			case ".yml", ".yaml", "":
+				importAfter = time.After(pluginsImportDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Errorf("error watching plugins directory: %s", err.Error())
+		case <-importAfter:
+			importAfter = nil
+			n, err := w.Import()
+			if err != nil {
+				log.Errorf("could not import processes from %s: %s", w.Dir, err.Error())
+				continue
+			}
+			if n > 0 {
+				log.Infof("imported %d changed processes from %s", n, w.Dir)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package processes
+
+import (
+	"app/jobs"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testProcessYAML(id, version string) string {
+	return fmt.Sprintf("info:\n  id: %s\n  title: %s\n  version: %s\n  jobControlOptions: [async-execute]\nhost:\n  type: local\ncontainer:\n  image: alpine:3\n", id, id, version)
+}
+
+func writeProcessFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Process ids in the catalog loaded from the database
+func catalogIDs(t *testing.T, db jobs.Database) []string {
+	t.Helper()
+	var pl ProcessList
+	if err := pl.Load(db); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, p := range pl.List {
+		ids = append(ids, p.Info.ID)
+	}
+	return ids
+}
+
+func TestPluginsWatcherImport(t *testing.T) {
+	dir := t.TempDir()
+	db := jobs.NewMemoryDB()
+	imports := 0
+	w := NewPluginsWatcher(db, dir, func() { imports++ })
+
+	writeProcessFile(t, filepath.Join(dir, "pyecho"), "pyecho.yml", testProcessYAML("pyecho", "1.0.0"))
+	broken := writeProcessFile(t, filepath.Join(dir, "broken"), "broken.yaml", "info:\n  id: broken\n  title: [")
+	invalid := writeProcessFile(t, filepath.Join(dir, "invalid"), "invalid.yml", "info:\n  title: no id\n")
+
+	if n, err := w.Import(); err != nil || n != 1 || imports != 1 {
+		t.Fatalf("Import = %d, %v with %d import callbacks", n, err, imports)
+	}
+	status := w.Status()
+	if status.Dir != dir || status.LastImport.IsZero() || len(status.Errors) != 2 || status.Errors[0].File != broken || status.Errors[1].File != invalid {
+		t.Errorf("status after import is %+v", status)
+	}
+	// invalid files do not add processes
+	if ids := catalogIDs(t, db); strings.Join(ids, ",") != "pyecho" {
+		t.Errorf("catalog has processes %q", ids)
+	}
+
+	// unchanged files are not imported again, fixed files are imported and their errors cleared
+	writeProcessFile(t, filepath.Join(dir, "invalid"), "invalid.yml", testProcessYAML("fixed", "1.0.0"))
+	if n, err := w.Import(); err != nil || n != 1 || imports != 2 {
+		t.Errorf("Import after fix = %d, %v with %d import callbacks", n, err, imports)
+	}
+	if errs := w.Status().Errors; len(errs) != 1 || errs[0].File != broken {
+		t.Errorf("errors after fix are %+v", errs)
+	}
+	if ids := catalogIDs(t, db); strings.Join(ids, ",") != "fixed,pyecho" {
+		t.Errorf("catalog has processes %q", ids)
+	}
+
+	if n, err := w.Import(); err != nil || n != 0 || imports != 2 {
+		t.Errorf("Import without changes = %d, %v with %d import callbacks", n, err, imports)
+	}
+}
+
+func TestPluginsWatcherWatch(t *testing.T) {
+	dir := t.TempDir()
+	db := jobs.NewMemoryDB()
+	imported := make(chan struct{}, 10)
+	w := NewPluginsWatcher(db, dir, func() { imported <- struct{}{} })
+
+	stop, done := make(chan struct{}), make(chan error)
+	go func() { done <- w.Watch(stop) }()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// directory created after the watch started, its file is imported once writes settle
+	time.Sleep(100 * time.Millisecond)
+	writeProcessFile(t, filepath.Join(dir, "pyecho"), "pyecho.yml", testProcessYAML("pyecho", "1.0.0"))
+
+	select {
+	case <-imported:
+	case <-time.After(10 * time.Second):
+		t.Fatal("process in new directory not imported")
+	}
+	if ids := catalogIDs(t, db); strings.Join(ids, ",") != "pyecho" {
+		t.Errorf("catalog has processes %q", ids)
+	}
+
+	// changes to files of the new directory are watched
+	writeProcessFile(t, filepath.Join(dir, "pyecho"), "pyecho.yml", testProcessYAML("pyecho", "1.1.0"))
+	select {
+	case <-imported:
+	case <-time.After(10 * time.Second):
+		t.Fatal("changed process not imported")
+	}
+	if p, _, err := db.GetProcess("pyecho"); err != nil || p.Version != "1.1.0" {
+		t.Errorf("process after change has version %s, %v", p.Version, err)
+	}
+}
@@ -3,6 +3,8 @@ package utils
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"os"
@@ -74,6 +76,20 @@ func StringInSlice(a string, list []string) bool {
 	return false
 }
 
+// Assumes file exist
+func GetS3Data(key string, svc *s3.S3) ([]byte, error) {
+	resp, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(os.Getenv("STORAGE_BUCKET")),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
 // Assumes file exist
 func GetS3JsonData(key string, svc *s3.S3) (interface{}, error) {
 	// Create a new S3GetObjectInput object to specify the file you want to read
@@ -134,3 +150,23 @@ func GetS3LinesData(key string, svc *s3.S3) ([]string, error) {
 
 	return lines, nil
 }
+
+// Compute the SHA-256 checksum of an S3 object by streaming its content
+// Returned checksum is of the form sha256:<hex digest>
+func GetS3Checksum(key string, svc *s3.S3) (string, error) {
+	resp, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(os.Getenv("STORAGE_BUCKET")),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}